@@ -0,0 +1,68 @@
+// Command quine-fakellm serves a scripted fake LLM API for hermetic
+// end-to-end tests of quine. It prints its base URL on the first line of
+// stdout, logs each request to stderr, and runs until interrupted:
+//
+//	quine-fakellm -script script.json > url &
+//	QUINE_API_TYPE=openai QUINE_API_BASE=$(head -1 url) QUINE_API_KEY=x quine "..."
+//
+// See internal/fakellm for the script format.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kehao95/quine/internal/fakellm"
+)
+
+func main() {
+	scriptPath := flag.String("script", "", "JSON script of canned responses (required)")
+	addr := flag.String("addr", "127.0.0.1:0", "address to listen on")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: quine-fakellm -script <script.json> [-addr host:port]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *scriptPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	script, err := fakellm.LoadScript(*scriptPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quine-fakellm: %v\n", err)
+		os.Exit(2)
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quine-fakellm: %v\n", err)
+		os.Exit(1)
+	}
+
+	server := fakellm.New(script)
+	server.OnRequest = func(req fakellm.Request) {
+		fmt.Fprintf(os.Stderr, "quine-fakellm: %s turn %d stream=%v -> response %d\n",
+			req.API, req.Turn, req.Stream, req.Response)
+	}
+
+	fmt.Printf("http://%s\n", ln.Addr())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		ln.Close()
+	}()
+	if err := http.Serve(ln, server); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintf(os.Stderr, "quine-fakellm: %v\n", err)
+		os.Exit(1)
+	}
+}
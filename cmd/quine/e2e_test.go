@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kehao95/quine/internal/fakellm"
+)
+
+// buildQuine compiles the quine binary for end-to-end tests.
+func buildQuine(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("end-to-end test skipped in -short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not in PATH")
+	}
+	bin := filepath.Join(t.TempDir(), "quine")
+	out, err := exec.Command(goBin, "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// TestEndToEnd_ForkTree runs the real binary, and the child it forks,
+// against a scripted fake LLM server.
+func TestEndToEnd_ForkTree(t *testing.T) {
+	bin := buildQuine(t)
+
+	// The child inherits the parent's conversation, so it is told apart by
+	// its mission in the system prompt. Deliverables go through fd 3.
+	script, err := fakellm.ParseScript([]byte(`{"responses": [
+		{"system": "CHILD TASK", "match": "^Begin", "tool_calls": [{"name": "sh", "arguments": {"command": "echo child-done >&3"}}]},
+		{"system": "CHILD TASK", "match": "EXIT CODE\\] 0", "tool_calls": [{"name": "exit", "arguments": {"status": "success"}}]},
+		{"turn": 1, "tool_calls": [{"name": "fork", "arguments": {"intent": "CHILD TASK: report back", "wait": true}}]},
+		{"match": "child-done", "tool_calls": [{"name": "sh", "arguments": {"command": "echo parent-done >&3"}}]},
+		{"match": "EXIT CODE\\] 0", "tool_calls": [{"name": "exit", "arguments": {"status": "success"}}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakellm.New(script)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, api := range []string{"openai", "anthropic"} {
+		cmd := exec.Command(bin, "fork a child and relay its answer")
+		cmd.Dir = t.TempDir()
+		cmd.Env = append(cleanEnv(),
+			"QUINE_API_TYPE="+api,
+			"QUINE_API_BASE="+ts.URL,
+			"QUINE_API_KEY=test-key",
+			"QUINE_MODEL_ID=fake-model",
+			"QUINE_DATA_DIR="+filepath.Join(cmd.Dir, ".quine"),
+		)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%s: quine: %v\nstderr:\n%s", api, err, stderr.String())
+		}
+		if got := strings.TrimSpace(stdout.String()); got != "parent-done" {
+			t.Errorf("%s: stdout = %q, want parent-done\nstderr:\n%s", api, got, stderr.String())
+		}
+	}
+
+	child := regexp.MustCompile("CHILD TASK")
+	var children int
+	for _, req := range server.Requests() {
+		if req.Response == -1 {
+			t.Errorf("unscripted request: %+v", req)
+		}
+		if child.MatchString(req.System) {
+			children++
+		}
+	}
+	if children != 4 {
+		t.Errorf("child requests = %d, want 4 (two turns per API)", children)
+	}
+}
+
+// cleanEnv returns the test's environment without QUINE_* variables.
+func cleanEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "QUINE_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
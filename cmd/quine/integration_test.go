@@ -192,18 +192,20 @@ func TestSurvivalTest(t *testing.T) {
 	}
 
 	// Verify entry types sequence:
-	// meta, message(system), message(user), message(assistant/sh1),
-	// tool_result(sh1), message(assistant/sh2), tool_result(sh2),
-	// message(assistant/exit), outcome
+	// meta, message(system), message(user), then per LLM call
+	// message(assistant) + usage (+ tool_result for sh), then outcome
 	expectedTypes := []string{
 		"meta",
 		"message",     // system
 		"message",     // user
 		"message",     // assistant (sh call-1)
+		"usage",       // tokens for call 1
 		"tool_result", // sh result 1
 		"message",     // assistant (sh call-2)
+		"usage",       // tokens for call 2
 		"tool_result", // sh result 2
 		"message",     // assistant (exit)
+		"usage",       // tokens for call 3
 		"outcome",     // session outcome
 	}
 
@@ -10,8 +10,11 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/kehao95/quine/internal/broker"
 	"github.com/kehao95/quine/internal/config"
 	"github.com/kehao95/quine/internal/runtime"
+	"github.com/kehao95/quine/internal/tape"
+	"github.com/kehao95/quine/internal/tools"
 )
 
 // stdinMode represents the expected stdin input type
@@ -23,12 +26,20 @@ const (
 )
 
 func main() {
+	// A credential broker handed off by its tree's root (see broker.Close).
+	if os.Getenv(broker.DaemonEnv) != "" {
+		os.Exit(broker.ServeDetached())
+	}
+
 	// Parse flags
 	binaryMode := flag.Bool("b", false, "treat stdin as binary (save to file instead of streaming)")
+	resumeID := flag.String("resume", "", "resume an interrupted session from its tape in QUINE_DATA_DIR")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "usage: quine [-b] <mission>")
 		fmt.Fprintln(os.Stderr, "       echo <text> | quine <mission>")
 		fmt.Fprintln(os.Stderr, "       cat file.bin | quine -b <mission>")
+		fmt.Fprintln(os.Stderr, "       quine -resume <session-id>")
+		fmt.Fprintln(os.Stderr, "       QUINE_API_TYPE=replay QUINE_REPLAY_TAPE=<tape> quine [mission]")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "flags:")
 		flag.PrintDefaults()
@@ -52,6 +63,18 @@ func main() {
 		os.Exit(2)
 	}
 
+	// A child inherits the rlimits of the parent's shell command that
+	// started it; they bound commands, not agents.
+	if cfg.Depth > 0 {
+		if err := tools.LimitsFor(cfg).Release(); err != nil {
+			fmt.Fprintf(os.Stderr, "quine: %v\n", err)
+		}
+	}
+
+	if *resumeID != "" {
+		os.Exit(resume(cfg, *resumeID))
+	}
+
 	// Determine mission: from remaining args or QUINE_ORIGINAL_INTENT (post-exec)
 	//
 	// The Quad-Channel Protocol (see Artifacts/implementation.md):
@@ -66,6 +89,9 @@ func main() {
 	} else if flag.NArg() > 0 {
 		// Normal startup: mission from remaining args after flags
 		mission = strings.Join(flag.Args(), " ")
+	} else if cfg.Provider == "replay" {
+		// Replay: the recorded mission, unless overridden on argv
+		mission = replayMission(cfg)
 	} else {
 		flag.Usage()
 		os.Exit(2)
@@ -96,6 +122,50 @@ func main() {
 	os.Exit(exitCode)
 }
 
+// resume continues an interrupted session from ${QUINE_DATA_DIR}/<id>.jsonl.
+// The mission, wisdom, depth and parent come from the tape, not from argv
+// or the environment.
+func resume(cfg *config.Config, sessionID string) int {
+	if flag.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "quine: -resume takes no mission (it is restored from the tape)")
+		return 2
+	}
+
+	summary, err := runtime.ResumeTape(cfg.DataDir, sessionID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quine: resume: %v\n", err)
+		return 2
+	}
+	mission, err := runtime.PrepareResume(cfg, summary)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quine: resume: %v\n", err)
+		return 2
+	}
+
+	rt, err := runtime.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quine: %v\n", err)
+		return 1
+	}
+	return rt.Resume(mission, summary)
+}
+
+// replayMission returns the mission recorded in QUINE_REPLAY_TAPE, exiting
+// if the tape cannot be read or does not record one.
+func replayMission(cfg *config.Config) string {
+	summary, err := tape.ReadTapeFile(cfg.ReplayTape)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quine: replay: %v\n", err)
+		os.Exit(2)
+	}
+	mission := runtime.RecordedMission(summary)
+	if mission == "" {
+		fmt.Fprintln(os.Stderr, "quine: replay: mission not found on tape; pass it as an argument")
+		os.Exit(2)
+	}
+	return mission
+}
+
 // handleStdin determines how to handle stdin and returns the initial User
 // Message content (material).
 //
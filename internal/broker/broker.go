@@ -0,0 +1,385 @@
+// Package broker keeps the API key in the root process of a tree.
+//
+// The root serves LLM calls to its descendants over a Unix socket in
+// QUINE_DATA_DIR. A descendant sends the unsigned request with the tree's
+// capability token (QUINE_BROKER_TOKEN); the broker checks the token, adds
+// the real credentials and forwards the request to QUINE_API_BASE, or to
+// the upstream the request names (a fallback, or the API of a route),
+// streaming the response back. Neither the shell nor any child ever sees a
+// key.
+//
+// Descendants may outlive the root. If a quine process of the tree is still
+// running when the root exits or execs, a detached broker process takes the
+// socket over, and serves until the last of them has exited (see Close).
+// Other processes, such as jobs the agent left running in the background,
+// do not keep it alive.
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/llm/transport"
+)
+
+// BaseURL is the origin clients address brokered requests to. The host is
+// a placeholder: the connection always goes to the broker's socket.
+const BaseURL = "http://quine-broker"
+
+// maxSocketPath leaves room under the smallest sun_path limit (104 bytes
+// on macOS and the BSDs, 108 on Linux).
+const maxSocketPath = 100
+
+// forwardedHeaders are the request headers passed upstream. Everything
+// else, the capability token included, stays on this side of the broker.
+var forwardedHeaders = []string{"Content-Type", "Accept"}
+
+// Broker forwards descendants' LLM requests with the root's credentials.
+type Broker struct {
+	Socket string // Unix socket path, passed to descendants as QUINE_BROKER
+	Token  string // capability token, passed to descendants as QUINE_BROKER_TOKEN
+
+	upstreams map[string]*upstream // by config.Fallback.Upstream; "" is the primary API
+	client    *http.Client
+	srv       *http.Server      // nil once stopped or handed off
+	ln        *net.UnixListener // kept for a hand-off
+	hold      *os.File          // this process's share of the tree's lock (see hold)
+	cfg       *config.Config    // handed to the detached broker (see handOff)
+	tmpDir    string            // directory created for a socket that did not fit in DataDir
+}
+
+// upstream is an API the broker signs requests for.
+type upstream struct {
+	base  string // API base without a trailing slash
+	trans transport.Transport
+}
+
+// Enabled reports whether cfg describes a tree root that should broker
+// its credentials: one that holds some, talks to a real API, and has not
+// turned the broker off with QUINE_CREDENTIAL_BROKER=false. An exec
+// successor keeps the broker its predecessor started.
+func Enabled(cfg *config.Config) bool {
+	return cfg.CredentialBroker && cfg.HasCredentials() && cfg.Provider != "replay" && cfg.BrokerSocket == ""
+}
+
+// Start listens on a fresh socket and serves until Close. It records the
+// socket and token in cfg, so that cfg.ChildEnv hands descendants the
+// broker instead of the key.
+func Start(cfg *config.Config) (*Broker, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, fmt.Errorf("broker token: %w", err)
+	}
+	b, err := newBroker(cfg, token)
+	if err != nil {
+		return nil, err
+	}
+	if b.Socket, b.tmpDir, err = socketPath(cfg.DataDir, cfg.SessionID); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", b.Socket)
+	if err != nil {
+		b.removeTmpDir()
+		return nil, fmt.Errorf("broker listen: %w", err)
+	}
+	if err := os.Chmod(b.Socket, 0o600); err != nil {
+		ln.Close()
+		b.removeTmpDir()
+		return nil, fmt.Errorf("broker socket: %w", err)
+	}
+	if b.hold, err = hold(lockPath(b.Socket)); err != nil {
+		ln.Close()
+		b.removeTmpDir()
+		return nil, fmt.Errorf("broker lock: %w", err)
+	}
+
+	b.ln = ln.(*net.UnixListener)
+	b.srv = &http.Server{Handler: b}
+	go b.srv.Serve(ln)
+
+	cfg.BrokerSocket = b.Socket
+	cfg.BrokerToken = b.Token
+	b.cfg = cfg
+	return b, nil
+}
+
+// newBroker returns a broker that signs with cfg's credentials, for the
+// primary API and each of cfg.Upstreams.
+func newBroker(cfg *config.Config, token string) (*Broker, error) {
+	trans, err := transport.ForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upstreams := map[string]*upstream{"": {base: strings.TrimRight(cfg.APIBase, "/"), trans: trans}}
+	for _, f := range cfg.Upstreams() {
+		ft, err := transport.ForConfig(cfg.ForFallback(f))
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", f.Upstream(), err)
+		}
+		upstreams[f.Upstream()] = &upstream{base: strings.TrimRight(f.APIBase, "/"), trans: ft}
+	}
+	return &Broker{
+		Token:     token,
+		upstreams: upstreams,
+		// Requests are bounded by the descendant's own timeouts: when it
+		// gives up, the request context cancels the upstream call.
+		client: &http.Client{},
+	}, nil
+}
+
+// Close ends this process's part in the broker. When no other process of
+// the tree is left, the broker stops and removes its socket; otherwise a
+// detached broker process takes the socket over and serves until the last
+// of them has exited. Safe on a nil Broker.
+func (b *Broker) Close() error {
+	if b == nil {
+		return nil
+	}
+	if b.hold != nil {
+		b.hold.Close()
+		b.hold = nil
+	}
+	if b.srv == nil {
+		return nil
+	}
+	var handOffErr error
+	if held(lockPath(b.Socket)) {
+		if handOffErr = b.handOff(); handOffErr == nil {
+			return nil
+		}
+	}
+	err := b.srv.Close()
+	b.srv = nil
+	b.remove()
+	return errors.Join(handOffErr, err)
+}
+
+// Join makes this process, a descendant started with QUINE_BROKER, one of
+// the holders the tree's broker serves until they have all exited. It
+// adopts the share of the lock its parent handed it (see Share) or, for a
+// quine started from a shell, takes one of its own.
+func Join(cfg *config.Config) (*Broker, error) {
+	path := lockPath(cfg.BrokerSocket)
+	f := inherited(path)
+	if f == nil {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, fmt.Errorf("broker lock: %w", err)
+		}
+		if err := flock(f, syscall.LOCK_SH); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("broker lock: %w", err)
+		}
+	}
+	return &Broker{Socket: cfg.BrokerSocket, Token: cfg.BrokerToken, hold: f, cfg: cfg}, nil
+}
+
+// Share returns a new share of the tree's lock for a quine child about to
+// be started. The caller passes it to the child and names its descriptor
+// there in HoldEnv, then closes its own copy once the child has started;
+// the child holds the lock from its first instruction, so the broker cannot
+// stop between this process exiting and the child joining. Returns nil on
+// a nil Broker.
+func (b *Broker) Share() (*os.File, error) {
+	if b == nil {
+		return nil, nil
+	}
+	return hold(lockPath(b.Socket))
+}
+
+// Detach prepares this process to exec a successor, which goes on with the
+// tree's broker. A process serving the socket hands it to a detached broker
+// process now; either way its share of the lock is passed on to the
+// successor. If the hand-off fails, the broker stops and cfg no longer
+// points at it, so the successor starts its own.
+func (b *Broker) Detach() error {
+	if b == nil {
+		return nil
+	}
+	if b.srv != nil {
+		if err := b.handOff(); err != nil {
+			b.Close()
+			b.cfg.BrokerSocket, b.cfg.BrokerToken = "", ""
+			return err
+		}
+	}
+	if b.hold != nil {
+		setInheritable(b.hold)
+		os.Setenv(HoldEnv, strconv.Itoa(int(b.hold.Fd())))
+	}
+	return nil
+}
+
+// Reattach takes back the share Detach passed on, after the exec failed,
+// so that it is not inherited by what the process starts next.
+func (b *Broker) Reattach() {
+	if b == nil || b.hold == nil {
+		return
+	}
+	syscall.CloseOnExec(int(b.hold.Fd()))
+	os.Unsetenv(HoldEnv)
+}
+
+// ServeHTTP forwards one authenticated POST to the upstream API.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "broker: only POST requests are forwarded", http.StatusMethodNotAllowed)
+		return
+	}
+	// Answered with 403, which every protocol classifies as an auth
+	// failure: retrying with the same token cannot help.
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(transport.BrokerTokenHeader)), []byte(b.Token)) != 1 {
+		http.Error(w, "broker: invalid capability token", http.StatusForbidden)
+		return
+	}
+
+	up, ok := b.upstreams[r.Header.Get(transport.BrokerUpstreamHeader)]
+	if !ok {
+		http.Error(w, "broker: unknown upstream "+r.Header.Get(transport.BrokerUpstreamHeader), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "broker: reading request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := b.forward(up, r, body)
+	// Renewable credentials the API rejected are renewed and tried once
+	// more, so every descendant does not have to fail first.
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		if rf, ok := up.trans.(transport.Refresher); ok && rf.Refresh() {
+			resp.Body.Close()
+			resp, err = b.forward(up, r, body)
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			http.Error(w, "broker: "+err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, vs := range resp.Header {
+		if k == "Connection" {
+			continue
+		}
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	copyFlushing(w, resp.Body)
+}
+
+// forward signs a copy of r with up's credentials and sends it to up.
+func (b *Broker) forward(up *upstream, r *http.Request, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, up.base+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range forwardedHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	if err := up.trans.Sign(req, body); err != nil {
+		return nil, fmt.Errorf("signing request: %w", err)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upstream unreachable: %w", err)
+	}
+	return resp, nil
+}
+
+// copyFlushing relays a response as it arrives, so streamed (SSE)
+// responses reach the descendant chunk by chunk.
+func copyFlushing(w http.ResponseWriter, body io.Reader) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ClientTransport returns an http.RoundTripper that sends every request to
+// the broker at socket, whatever the URL's host.
+func ClientTransport(socket string) http.RoundTripper {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+}
+
+// socketPath picks an absolute socket path in dataDir. When that would
+// exceed the sun_path limit, the socket goes in a new private directory
+// under os.TempDir instead, returned as tmpDir for removal.
+func socketPath(dataDir, sessionID string) (path, tmpDir string, err error) {
+	dir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", "", fmt.Errorf("broker socket: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", "", fmt.Errorf("broker socket: %w", err)
+	}
+	path = filepath.Join(dir, "broker-"+sessionID+".sock")
+	if len(path) <= maxSocketPath {
+		return path, "", nil
+	}
+	tmpDir, err = os.MkdirTemp("", "quine-broker-")
+	if err != nil {
+		return "", "", fmt.Errorf("broker socket: %w", err)
+	}
+	return filepath.Join(tmpDir, "broker.sock"), tmpDir, nil
+}
+
+func (b *Broker) removeTmpDir() {
+	if b.tmpDir != "" {
+		os.RemoveAll(b.tmpDir)
+	}
+}
+
+// remove deletes the socket, its lock file and the directory made for
+// them.
+func (b *Broker) remove() {
+	os.Remove(b.Socket)
+	os.Remove(lockPath(b.Socket))
+	b.removeTmpDir()
+}
+
+// newToken returns 32 random bytes, hex-encoded.
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,292 @@
+package broker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/llm/transport"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary stands in for quine as the detached broker.
+	if os.Getenv(DaemonEnv) != "" {
+		os.Exit(ServeDetached())
+	}
+	os.Exit(m.Run())
+}
+
+func startBroker(t *testing.T, upstream, dataDir string, fallbacks ...config.Fallback) (*Broker, *config.Config) {
+	t.Helper()
+	cfg := &config.Config{
+		Provider:         "openai",
+		APIKey:           "sk-root-secret",
+		APIBase:          upstream + "/",
+		SessionID:        "b0b0b0b0-1111-4222-8333-444455556666",
+		DataDir:          dataDir,
+		CredentialBroker: true,
+		Fallback:         fallbacks,
+	}
+	if !Enabled(cfg) {
+		t.Fatal("broker not enabled for a key-holding root")
+	}
+	b, err := Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	if cfg.BrokerSocket != b.Socket || cfg.BrokerToken != b.Token || len(b.Token) != 64 {
+		t.Errorf("config not pointed at broker: %q %q", cfg.BrokerSocket, cfg.BrokerToken)
+	}
+	return b, cfg
+}
+
+func post(t *testing.T, b *Broker, path, token string) *http.Response {
+	t.Helper()
+	return postTo(t, b, path, token, "")
+}
+
+func postTo(t *testing.T, b *Broker, path, token, upstream string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, BaseURL+path, strings.NewReader(`{"model":"m"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		(&transport.BrokerToken{Token: token, Upstream: upstream}).Sign(req, nil)
+	}
+	resp, err := (&http.Client{Transport: ClientTransport(b.Socket)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestForward(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer sk-root-secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get(transport.BrokerTokenHeader); got != "" {
+			t.Errorf("capability token forwarded upstream: %q", got)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != `{"model":"m"}` || r.URL.RequestURI() != "/v1/chat/completions?x=1" {
+			t.Errorf("upstream got %s %s", r.URL.RequestURI(), body)
+		}
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"error":"slow down"}`)
+	}))
+	defer upstream.Close()
+
+	b, _ := startBroker(t, upstream.URL, t.TempDir())
+	if info, err := os.Stat(b.Socket); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket %s: %v %v", b.Socket, info, err)
+	}
+
+	resp := post(t, b, "/v1/chat/completions?x=1", b.Token)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "7" || string(body) != `{"error":"slow down"}` {
+		t.Errorf("relayed %d %q %s", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+
+	b.Close()
+	for _, path := range []string{b.Socket, lockPath(b.Socket)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after Close: %v", path, err)
+		}
+	}
+}
+
+// TestDetachedChildOutlivesRoot: a descendant still running when the root
+// exits keeps the broker, which goes away with the last of the tree.
+func TestDetachedChildOutlivesRoot(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer sk-root-secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	t.Setenv("QUINE_API_TYPE", "openai")
+	t.Setenv("QUINE_MODEL_ID", "gpt-4o")
+	t.Setenv("QUINE_API_BASE", upstream.URL)
+	t.Setenv("QUINE_API_KEY", "sk-root-secret")
+	t.Setenv("QUINE_DATA_DIR", t.TempDir())
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A background job started after the broker does not count as part of
+	// the tree; only a child handed a share of the lock does.
+	job := exec.Command("sleep", "60")
+	if err := job.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer job.Process.Kill()
+
+	share, err := b.Share()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := exec.Command("sleep", "60")
+	child.ExtraFiles = []*os.File{share}
+	err = child.Start()
+	share.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Process.Kill()
+
+	b.Close()
+	resp := post(t, b, "/v1/chat/completions", b.Token)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("after the root closed: %d %s", resp.StatusCode, body)
+	}
+
+	child.Process.Kill()
+	child.Wait()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(b.Socket); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("detached broker still serving after the tree exited")
+		}
+	}
+}
+
+// TestBackgroundJobDoesNotKeepBroker: processes that are not quine
+// processes of the tree, like a daemon the agent left running, do not
+// inherit the lock, so the broker stops with the root.
+func TestBackgroundJobDoesNotKeepBroker(t *testing.T) {
+	b, _ := startBroker(t, "http://127.0.0.1:9", t.TempDir())
+
+	job := exec.Command("sleep", "60")
+	if err := job.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer job.Process.Kill()
+
+	b.Close()
+	if _, err := os.Stat(b.Socket); !os.IsNotExist(err) {
+		t.Errorf("broker still serving for a background job: %v", err)
+	}
+}
+
+// TestJoinAdoptsHandedShare: a child adopts the share it was handed under
+// HoldEnv, and clears the variable so its shell does not see it.
+func TestJoinAdoptsHandedShare(t *testing.T) {
+	b, cfg := startBroker(t, "http://127.0.0.1:9", t.TempDir())
+	share, err := b.Share()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As the child would see it: a bare descriptor number.
+	fd, err := syscall.Dup(int(share.Fd()))
+	share.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(HoldEnv, strconv.Itoa(fd))
+
+	joined, err := Join(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joined.Close()
+	if int(joined.hold.Fd()) != fd {
+		t.Errorf("Join took a new share instead of adopting fd %d", fd)
+	}
+	if _, ok := os.LookupEnv(HoldEnv); ok {
+		t.Errorf("%s still set after Join", HoldEnv)
+	}
+
+	// A number that is not the lock file is not adopted.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	os.Setenv(HoldEnv, strconv.Itoa(int(devnull.Fd())))
+	if inherited(lockPath(b.Socket)) != nil {
+		t.Error("adopted a descriptor that is not the lock file")
+	}
+}
+
+func TestForwardToFallback(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("fallback request reached the primary API")
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("x-api-key"); got != "sk-ant-fallback" {
+			t.Errorf("x-api-key = %q", got)
+		}
+		if got := r.Header.Get(transport.BrokerUpstreamHeader); got != "" {
+			t.Errorf("upstream name forwarded: %q", got)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer fallback.Close()
+
+	t.Setenv("TEST_FALLBACK_KEY", "sk-ant-fallback")
+	f := config.Fallback{Provider: "anthropic", ModelID: "claude-haiku-4-5", APIBase: fallback.URL, KeyEnv: "TEST_FALLBACK_KEY"}
+	b, _ := startBroker(t, primary.URL, t.TempDir(), f)
+
+	resp := postTo(t, b, "/v1/messages", b.Token, f.Upstream())
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("relayed %d %s", resp.StatusCode, body)
+	}
+	if resp := postTo(t, b, "/v1/messages", b.Token, "type=anthropic,base=https://elsewhere,key_env=HOME"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown upstream: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRejectsBadToken(t *testing.T) {
+	called := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+
+	b, _ := startBroker(t, upstream.URL, t.TempDir())
+	for _, token := range []string{"", "not-the-token"} {
+		if resp := post(t, b, "/v1/chat/completions", token); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("token %q: status %d, want 403", token, resp.StatusCode)
+		}
+	}
+	if called {
+		t.Error("unauthenticated request reached the upstream API")
+	}
+}
+
+func TestLongDataDirFallsBackToTempDir(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	deep := filepath.Join(t.TempDir(), strings.Repeat("d", 60), strings.Repeat("e", 60))
+	b, _ := startBroker(t, upstream.URL, deep)
+	if strings.HasPrefix(b.Socket, deep) || len(b.Socket) > maxSocketPath {
+		t.Errorf("socket %q should have moved out of the long data dir", b.Socket)
+	}
+	if resp := post(t, b, "/v1/chat/completions", b.Token); resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+	dir := filepath.Dir(b.Socket)
+	b.Close()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("temp socket dir left behind: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/kehao95/quine/internal/config"
+)
+
+// DaemonEnv marks the process a broker hands its socket to: the quine
+// binary, run with DaemonEnv=1, calls ServeDetached instead of running an
+// agent.
+const DaemonEnv = "QUINE_BROKER_DAEMON"
+
+// daemonArg is the detached broker's only argument. A binary that does
+// not check DaemonEnv, such as a test binary without a TestMain that does,
+// rejects it and exits rather than running as something else.
+const daemonArg = "-quine-broker-daemon"
+
+// HoldEnv names the descriptor on which a quine process was handed its
+// share of the tree's lock by the process that started it (see Share).
+const HoldEnv = "QUINE_BROKER_HOLD"
+
+// handOff starts a detached broker process on b's socket and stops
+// serving here. The new process loads the same credentials (as an exec
+// successor would) and outlives this one: it has a session of its own, so
+// signals to the tree's process group do not reach it. Connections still
+// open here are cut; descendants retry them.
+func (b *Broker) handOff() error {
+	env, err := b.cfg.ExecEnv("")
+	if err != nil {
+		return fmt.Errorf("broker hand-off: %w", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("broker hand-off: %w", err)
+	}
+	lf, err := b.ln.File()
+	if err != nil {
+		return fmt.Errorf("broker hand-off: %w", err)
+	}
+	defer lf.Close()
+
+	cmd := exec.Command(self, daemonArg)
+	cmd.Env = append(append(os.Environ(), env...), DaemonEnv+"=1")
+	cmd.ExtraFiles = []*os.File{lf} // fd 3
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("broker hand-off: %w", err)
+	}
+	cmd.Process.Release()
+
+	b.ln.SetUnlinkOnClose(false)
+	b.srv.Close()
+	b.srv = nil
+	return nil
+}
+
+// ServeDetached is the main function of a broker that was handed off. It
+// serves the socket passed as fd 3, with the credentials config.Load finds
+// in the environment, until the last process of the tree has exited, then
+// removes the socket. It returns the process's exit code.
+func ServeDetached() int {
+	cfg, err := config.Load()
+	if err != nil {
+		return 1
+	}
+	Harden()
+	b, err := newBroker(cfg, cfg.BrokerToken)
+	if err != nil {
+		return 1
+	}
+	b.Socket = cfg.BrokerSocket
+	if filepath.Base(b.Socket) == "broker.sock" {
+		b.tmpDir = filepath.Dir(b.Socket)
+	}
+
+	lf := os.NewFile(3, "broker")
+	ln, err := net.FileListener(lf)
+	lf.Close()
+	if err != nil {
+		return 1
+	}
+	b.srv = &http.Server{Handler: b}
+	go b.srv.Serve(ln)
+
+	err = waitUnheld(lockPath(b.Socket))
+	b.srv.Close()
+	b.remove()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// lockPath is the file the processes of a tree hold a shared lock on.
+func lockPath(socket string) string {
+	return socket + ".lock"
+}
+
+// hold takes a shared lock on path. Each quine process of the tree holds
+// one, on a descriptor of its own that is closed on exec, so the shell, its
+// background jobs and hooks never keep the broker alive: the lock lasts
+// until the last quine process of the tree has exited, which is how the
+// broker knows when the tree is gone.
+func hold(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, syscall.LOCK_SH); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// inherited returns the share of the lock at path handed to this process
+// under HoldEnv, or nil if there is none. The variable is cleared, so that
+// it does not reach the shell, and the descriptor must be the lock file:
+// a stale number must not make some other file pass for it.
+func inherited(path string) *os.File {
+	v, ok := os.LookupEnv(HoldEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(HoldEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 3 {
+		return nil
+	}
+	var got, want syscall.Stat_t
+	if syscall.Fstat(fd, &got) != nil || syscall.Stat(path, &want) != nil || got.Dev != want.Dev || got.Ino != want.Ino {
+		return nil
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), path)
+}
+
+// held reports whether any process still holds path. The caller must have
+// closed its own hold.
+func held(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return errors.Is(flock(f, syscall.LOCK_EX|syscall.LOCK_NB), syscall.EWOULDBLOCK)
+}
+
+// waitUnheld blocks until no process holds path.
+func waitUnheld(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return flock(f, syscall.LOCK_EX)
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// setInheritable clears f's close-on-exec flag.
+func setInheritable(f *os.File) {
+	syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0)
+}
@@ -0,0 +1,14 @@
+package broker
+
+import "syscall"
+
+// Harden marks this process non-dumpable. The kernel then hands its /proc
+// entries to root and refuses ptrace from its own uid, so a descendant
+// cannot read the key back out of /proc/<pid>/environ or memory. The flag
+// is reset by execve: children stay ordinary processes.
+func Harden() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
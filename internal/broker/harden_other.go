@@ -0,0 +1,8 @@
+//go:build !linux
+
+package broker
+
+// Harden is a no-op outside Linux.
+func Harden() error {
+	return nil
+}
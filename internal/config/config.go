@@ -5,34 +5,94 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/kehao95/quine/internal/models"
+	"github.com/kehao95/quine/internal/persona"
+	"github.com/kehao95/quine/internal/sandbox"
 )
 
 // ErrDepthExceeded is returned when QUINE_DEPTH >= QUINE_MAX_DEPTH.
 var ErrDepthExceeded = errors.New("max recursion depth exceeded")
 
+// minThinkingBudget is the smallest thinking budget Anthropic accepts.
+const minThinkingBudget = 1024
+
 // Config holds all runtime configuration for Quine.
 // Every field is populated from environment variables by Load().
 type Config struct {
-	ModelID        string            // QUINE_MODEL_ID (required)
-	APIKey         string            // QUINE_API_KEY (required)
-	APIBase        string            // QUINE_API_BASE (required)
-	Provider       string            // QUINE_API_TYPE (required): "openai" or "anthropic"
-	MaxDepth       int               // QUINE_MAX_DEPTH (default 5)
-	Depth          int               // QUINE_DEPTH (default 0)
-	SessionID      string            // QUINE_SESSION_ID (default auto UUID v4)
-	ParentSession  string            // QUINE_PARENT_SESSION
-	MaxConcurrent  int               // QUINE_MAX_CONCURRENT (default 20)
-	MaxAgents      int               // QUINE_MAX_AGENTS (default 10, 0 = unlimited)
-	ShTimeout      int               // QUINE_SH_TIMEOUT in seconds (default 600)
-	OutputTruncate int               // QUINE_OUTPUT_TRUNCATE in bytes (default 20480)
-	DataDir        string            // QUINE_DATA_DIR (default ".quine/")
-	Shell          string            // QUINE_SHELL (default "/bin/sh")
-	MaxTurns       int               // QUINE_MAX_TURNS (default 20, 0 = unlimited)
-	ContextWindow  int               // QUINE_CONTEXT_WINDOW (default 128000)
-	Wisdom         map[string]string // QUINE_WISDOM_* env vars (key without prefix -> value)
-	OriginalIntent string            // QUINE_ORIGINAL_INTENT (preserved across exec for mission continuity)
+	ModelID           string            // QUINE_MODEL_ID (required)
+	APIKey            string            // QUINE_API_KEY (required unless another credential source or QUINE_BROKER is set)
+	APIKeyFile        string            // QUINE_API_KEY_FILE file holding the key, re-read per request (made absolute)
+	APIKeyCmd         string            // QUINE_API_KEY_CMD helper command that prints the key
+	APIKeyCmdTTL      int               // QUINE_API_KEY_CMD_TTL seconds a helper's key is cached (default 300, 0 = until rejected)
+	OAuthTokenURL     string            // QUINE_OAUTH_TOKEN_URL OAuth 2.0 token endpoint (client-credentials grant)
+	OAuthClientID     string            // QUINE_OAUTH_CLIENT_ID
+	OAuthClientSecret string            // QUINE_OAUTH_CLIENT_SECRET
+	OAuthScope        string            // QUINE_OAUTH_SCOPE (optional)
+	Auth              string            // QUINE_AUTH request signing: "" (the API type's key header) or "sigv4"
+	AWSRegion         string            // QUINE_AWS_REGION, else AWS_REGION or AWS_DEFAULT_REGION (sigv4)
+	AWSService        string            // QUINE_AWS_SERVICE SigV4 service name (default "bedrock")
+	AWSAccessKeyID    string            // AWS_ACCESS_KEY_ID (sigv4)
+	AWSSecretKey      string            // AWS_SECRET_ACCESS_KEY (sigv4)
+	AWSSessionToken   string            // AWS_SESSION_TOKEN (sigv4, temporary credentials only)
+	AzureDeployment   string            // QUINE_AZURE_DEPLOYMENT deployment name for azure-openai (default QUINE_MODEL_ID)
+	AzureAPIVersion   string            // QUINE_AZURE_API_VERSION api-version query parameter for azure-openai (default "2024-10-21")
+	APIBase           string            // QUINE_API_BASE (required)
+	Provider          string            // QUINE_API_TYPE (required): "openai", "openai-responses", "azure-openai", "anthropic", "gemini" or "replay"
+	MaxDepth          int               // QUINE_MAX_DEPTH (default 5)
+	Depth             int               // QUINE_DEPTH (default 0)
+	SessionID         string            // QUINE_SESSION_ID (default auto UUID v4)
+	ParentSession     string            // QUINE_PARENT_SESSION
+	MaxConcurrent     int               // QUINE_MAX_CONCURRENT (default 20)
+	MaxAgents         int               // QUINE_MAX_AGENTS (default 10, 0 = unlimited)
+	ShTimeout         int               // QUINE_SH_TIMEOUT in seconds (default 600)
+	OutputTruncate    int               // QUINE_OUTPUT_TRUNCATE in bytes (default 20480)
+	DataDir           string            // QUINE_DATA_DIR (default ".quine/")
+	Shell             string            // QUINE_SHELL (default "/bin/sh")
+	MaxTurns          int               // QUINE_MAX_TURNS (default 20, 0 = unlimited)
+	ContextWindow     int               // QUINE_CONTEXT_WINDOW (default from the model registry, else 128000)
+	ModelsFile        string            // QUINE_MODELS_FILE JSON entries added to or overriding the model registry (made absolute, "" = built-in only)
+	Models            *models.Registry  // Model registry read from ModelsFile (not an env var)
+	Wisdom            map[string]string // QUINE_WISDOM_* env vars (key without prefix -> value)
+	OriginalIntent    string            // QUINE_ORIGINAL_INTENT (preserved across exec for mission continuity)
+	ContextTape       string            // QUINE_CONTEXT_TAPE (parent's tape copy, set by fork for the child only)
+	PersonaDirs       []string          // QUINE_PERSONA_DIR search path (default "personas", made absolute)
+	Persona           string            // QUINE_PERSONA (active persona name, preserved across exec)
+	PersonaPrompt     string            // Text of the resolved persona file (not an env var)
+	TokenBudget       int               // QUINE_TOKEN_BUDGET tree-wide token budget (default 0 = unlimited)
+	TreeID            string            // QUINE_TREE_ID (root session ID, shared by the whole process tree)
+	Deadline          time.Time         // QUINE_DEADLINE / QUINE_PARENT_DEADLINE wall-clock deadline (zero = none)
+	MaxTextTurns      int               // QUINE_MAX_TEXT_TURNS consecutive text-only replies tolerated (default 2, 0 = no policy)
+	MaxTextStrikes    int               // QUINE_MAX_TEXT_STRIKES text-only violations before termination (default 3, 0 = never terminate)
+	Stream            bool              // QUINE_STREAM use SSE streaming responses (default true)
+	StreamIdleTimeout int               // QUINE_STREAM_IDLE_TIMEOUT seconds without data before a stream is abandoned (default 120)
+	StreamLenient     bool              // QUINE_STREAM_LENIENT accept a stream that ends without a terminal event (default false)
+	ThinkingBudget    int               // QUINE_THINKING_BUDGET extended thinking tokens per Anthropic call (default 0 = off, else at least 1024)
+	RetryMax          int               // QUINE_RETRY_MAX retries of a rate-limited or overloaded LLM call (default 5; other failures retry at most 3 times)
+	RetryBaseMS       int               // QUINE_RETRY_BASE_MS first backoff delay in milliseconds, doubled per attempt (default 500)
+	RetryMaxDelay     int               // QUINE_RETRY_MAX_DELAY longest single wait in seconds; a longer server hint ends retrying (default 60)
+	RateLimit         int               // QUINE_RATE_LIMIT LLM requests per minute for the whole tree (default 0 = unlimited)
+	Fallback          []Fallback        // QUINE_FALLBACK models tried in order while the primary keeps failing (see Fallback)
+	FallbackCooldown  int               // QUINE_FALLBACK_COOLDOWN seconds before a failed-over process tries the primary again (default 300)
+	DepthModels       map[int]Route     // QUINE_MODEL_ID_DEPTH_<n> (+ QUINE_API_TYPE_DEPTH_<n>, QUINE_CONTEXT_WINDOW_DEPTH_<n>, QUINE_API_BASE_DEPTH_<n>, QUINE_API_KEY_ENV_DEPTH_<n>, QUINE_API_KEY_FILE_DEPTH_<n>) model of children at depth n
+	ForkModels        []Route           // QUINE_FORK_MODELS allowlist for the fork tool's model argument (";"-separated)
+	HooksDir          string            // QUINE_HOOKS_DIR pre-/post- tool-call hook executables (made absolute, "" = none)
+	Sandbox           sandbox.Mode      // QUINE_SANDBOX confine shell and fork children: "off" (default), "fs" or "strict"
+	ShRlimitCPU       int               // QUINE_SH_RLIMIT_CPU CPU seconds per process run by sh (default 0 = unlimited)
+	ShRlimitMem       int               // QUINE_SH_RLIMIT_MEM MB of address space per process run by sh (default 0 = unlimited)
+	ShRlimitFsize     int               // QUINE_SH_RLIMIT_FSIZE MB per file written by sh (default 0 = unlimited)
+	ShRlimitNproc     int               // QUINE_SH_RLIMIT_NPROC processes for sh (default 0 = unlimited)
+	ShCgroup          string            // QUINE_SH_CGROUP delegated cgroup v2 dir for the shell's cgroup (made absolute, "" = none)
+	ReplayTape        string            // QUINE_REPLAY_TAPE tape re-driven by QUINE_API_TYPE=replay (made absolute; never propagated)
+	CredentialBroker  bool              // QUINE_CREDENTIAL_BROKER root serves LLM calls to descendants instead of handing out the key (default true)
+	BrokerSocket      string            // QUINE_BROKER Unix socket of the tree's credential broker (set by the root for descendants)
+	BrokerToken       string            // QUINE_BROKER_TOKEN capability token for BrokerSocket
+	BrokerUpstream    string            // upstream the broker signs for: "" for the primary API, else a Fallback's Upstream() (set by ForFallback)
+	Upstream          *Fallback         // QUINE_UPSTREAM API this process calls instead of the tree's, with a key of its own (set by the parent for a keyed Route)
 }
 
 // APIModelID returns the model ID to use in API calls.
@@ -46,34 +106,98 @@ func (c *Config) APIModelID() string {
 //
 // Four variables are required:
 //   - QUINE_MODEL_ID:   Model name (e.g. "claude-sonnet-4-5-20250929", "gpt-4o", "kimi-k2.5")
-//   - QUINE_API_TYPE:   Wire protocol: "openai" or "anthropic"
-//   - QUINE_API_BASE:   API base URL (e.g. "https://api.anthropic.com", "https://api.openai.com")
+//   - QUINE_API_TYPE:   Wire protocol: "openai", "openai-responses", "azure-openai", "anthropic" or "gemini"
+//   - QUINE_API_BASE:   API base URL (e.g. "https://api.anthropic.com", "https://api.openai.com",
+//     "https://generativelanguage.googleapis.com")
 //   - QUINE_API_KEY:    API key
+//
+// Instead of QUINE_API_KEY, the key can come from QUINE_API_KEY_FILE,
+// QUINE_API_KEY_CMD or an OAuth client-credentials grant
+// (QUINE_OAUTH_TOKEN_URL, QUINE_OAUTH_CLIENT_ID, QUINE_OAUTH_CLIENT_SECRET).
+// With QUINE_AUTH=sigv4, requests are signed with the standard AWS_*
+// credentials instead.
+//
+// A descendant of a brokered root gets QUINE_BROKER and QUINE_BROKER_TOKEN
+// in place of the key (see internal/broker).
+// A child routed to another API gets that API as QUINE_UPSTREAM (see
+// Route).
+//
+// With QUINE_API_TYPE=replay, QUINE_REPLAY_TAPE replaces the base URL and
+// key, and the model ID defaults to "replay".
 func Load() (*Config, error) {
 	c := &Config{}
 
 	// --- 4 required fields ---
-	c.ModelID = os.Getenv("QUINE_MODEL_ID")
-	if c.ModelID == "" {
-		return nil, fmt.Errorf("QUINE_MODEL_ID is required")
-	}
-
 	c.Provider = os.Getenv("QUINE_API_TYPE")
 	if c.Provider == "" {
-		return nil, fmt.Errorf("QUINE_API_TYPE is required (\"openai\" or \"anthropic\")")
+		return nil, fmt.Errorf("QUINE_API_TYPE is required (\"openai\", \"anthropic\" or \"gemini\")")
 	}
-	if c.Provider != "openai" && c.Provider != "anthropic" {
-		return nil, fmt.Errorf("unsupported QUINE_API_TYPE=%q: must be \"openai\" or \"anthropic\"", c.Provider)
+	switch c.Provider {
+	case "openai", "openai-responses", "azure-openai", "anthropic", "gemini", "replay":
+	default:
+		return nil, fmt.Errorf("unsupported QUINE_API_TYPE=%q: must be \"openai\", \"openai-responses\", \"azure-openai\", \"anthropic\", \"gemini\" or \"replay\"", c.Provider)
 	}
 
+	c.ModelID = os.Getenv("QUINE_MODEL_ID")
 	c.APIBase = os.Getenv("QUINE_API_BASE")
-	if c.APIBase == "" {
-		return nil, fmt.Errorf("QUINE_API_BASE is required")
-	}
-
 	c.APIKey = os.Getenv("QUINE_API_KEY")
-	if c.APIKey == "" {
-		return nil, fmt.Errorf("QUINE_API_KEY is required")
+	c.APIKeyCmd = os.Getenv("QUINE_API_KEY_CMD")
+	c.OAuthTokenURL = os.Getenv("QUINE_OAUTH_TOKEN_URL")
+	c.OAuthClientID = os.Getenv("QUINE_OAUTH_CLIENT_ID")
+	c.OAuthClientSecret = os.Getenv("QUINE_OAUTH_CLIENT_SECRET")
+	c.OAuthScope = os.Getenv("QUINE_OAUTH_SCOPE")
+	c.Auth = os.Getenv("QUINE_AUTH")
+	switch c.Auth {
+	case "":
+	case "sigv4":
+		// Only a sigv4 process treats the AWS credentials as its own.
+		c.AWSAccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.AWSSecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.AWSSessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		c.AWSRegion = firstNonEmpty(os.Getenv("QUINE_AWS_REGION"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+		c.AWSService = firstNonEmpty(os.Getenv("QUINE_AWS_SERVICE"), "bedrock")
+		if c.AWSRegion == "" {
+			return nil, fmt.Errorf("QUINE_AWS_REGION (or AWS_REGION) is required with QUINE_AUTH=sigv4")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported QUINE_AUTH=%q: must be empty or \"sigv4\"", c.Auth)
+	}
+	if c.Provider == "azure-openai" {
+		c.AzureDeployment = firstNonEmpty(os.Getenv("QUINE_AZURE_DEPLOYMENT"), c.ModelID)
+		c.AzureAPIVersion = firstNonEmpty(os.Getenv("QUINE_AZURE_API_VERSION"), "2024-10-21")
+	}
+	if path := os.Getenv("QUINE_API_KEY_FILE"); path != "" {
+		var err error
+		if c.APIKeyFile, err = filepath.Abs(path); err != nil {
+			return nil, fmt.Errorf("QUINE_API_KEY_FILE: %w", err)
+		}
+	}
+	c.BrokerSocket = os.Getenv("QUINE_BROKER")
+	c.BrokerToken = os.Getenv("QUINE_BROKER_TOKEN")
+
+	if c.Provider == "replay" {
+		// Replay re-drives a recorded tape: no API is contacted.
+		tapePath := os.Getenv("QUINE_REPLAY_TAPE")
+		if tapePath == "" {
+			return nil, fmt.Errorf("QUINE_REPLAY_TAPE is required with QUINE_API_TYPE=replay")
+		}
+		var err error
+		if c.ReplayTape, err = filepath.Abs(tapePath); err != nil {
+			return nil, fmt.Errorf("QUINE_REPLAY_TAPE: %w", err)
+		}
+		if c.ModelID == "" {
+			c.ModelID = "replay"
+		}
+	} else {
+		if c.ModelID == "" {
+			return nil, fmt.Errorf("QUINE_MODEL_ID is required")
+		}
+		if c.APIBase == "" {
+			return nil, fmt.Errorf("QUINE_API_BASE is required")
+		}
+		if err := c.checkCredentials(); err != nil {
+			return nil, err
+		}
 	}
 
 	// --- Optional string fields ---
@@ -82,7 +206,21 @@ func Load() (*Config, error) {
 	// --- Integer fields with defaults ---
 	var err error
 
-	c.ContextWindow, err = envInt("QUINE_CONTEXT_WINDOW", 128_000)
+	// --- Model registry ---
+	// The context window defaults to what the registry knows of the model.
+	if path := os.Getenv("QUINE_MODELS_FILE"); path != "" {
+		if c.ModelsFile, err = filepath.Abs(path); err != nil {
+			return nil, fmt.Errorf("QUINE_MODELS_FILE: %w", err)
+		}
+	}
+	if c.Models, err = models.Load(c.ModelsFile); err != nil {
+		return nil, err
+	}
+	if err := c.checkTools("QUINE_MODEL_ID", c.ModelID); err != nil {
+		return nil, err
+	}
+
+	c.ContextWindow, err = envInt("QUINE_CONTEXT_WINDOW", c.Models.Resolve(c.ModelID, c.Provider).ContextWindow)
 	if err != nil {
 		return nil, err
 	}
@@ -122,6 +260,142 @@ func Load() (*Config, error) {
 		return nil, err
 	}
 
+	c.TokenBudget, err = envInt("QUINE_TOKEN_BUDGET", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	c.MaxTextTurns, err = envInt("QUINE_MAX_TEXT_TURNS", 2)
+	if err != nil {
+		return nil, err
+	}
+
+	c.MaxTextStrikes, err = envInt("QUINE_MAX_TEXT_STRIKES", 3)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Stream, err = envBool("QUINE_STREAM", true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.CredentialBroker, err = envBool("QUINE_CREDENTIAL_BROKER", true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.APIKeyCmdTTL, err = envInt("QUINE_API_KEY_CMD_TTL", 300)
+	if err != nil {
+		return nil, err
+	}
+
+	c.StreamIdleTimeout, err = envInt("QUINE_STREAM_IDLE_TIMEOUT", 120)
+	if err != nil {
+		return nil, err
+	}
+
+	c.StreamLenient, err = envBool("QUINE_STREAM_LENIENT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ThinkingBudget, err = envInt("QUINE_THINKING_BUDGET", 0)
+	if err != nil {
+		return nil, err
+	}
+	if c.ThinkingBudget != 0 && c.ThinkingBudget < minThinkingBudget {
+		return nil, fmt.Errorf("QUINE_THINKING_BUDGET=%d: must be 0 (off) or at least %d", c.ThinkingBudget, minThinkingBudget)
+	}
+
+	// --- Retry policy and tree-wide rate limit ---
+	c.RetryMax, err = envInt("QUINE_RETRY_MAX", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RetryBaseMS, err = envInt("QUINE_RETRY_BASE_MS", 500)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RetryMaxDelay, err = envInt("QUINE_RETRY_MAX_DELAY", 60)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RateLimit, err = envInt("QUINE_RATE_LIMIT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// --- The API a route put this process on ---
+	if spec := os.Getenv("QUINE_UPSTREAM"); spec != "" {
+		f, err := c.parseFallback("QUINE_UPSTREAM", spec)
+		if err != nil {
+			return nil, err
+		}
+		c.Upstream = &f
+	}
+
+	// --- Fallback models ---
+	c.Fallback, err = c.parseFallbacks(os.Getenv("QUINE_FALLBACK"))
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range c.Fallback {
+		if err := c.checkTools(fmt.Sprintf("QUINE_FALLBACK entry %d", i+1), f.ModelID); err != nil {
+			return nil, err
+		}
+	}
+
+	c.FallbackCooldown, err = envInt("QUINE_FALLBACK_COOLDOWN", 300)
+	if err != nil {
+		return nil, err
+	}
+
+	// --- Model routing for children ---
+	c.DepthModels, err = c.loadDepthModels()
+	if err != nil {
+		return nil, err
+	}
+
+	c.ForkModels, err = c.parseForkModels(os.Getenv("QUINE_FORK_MODELS"))
+	if err != nil {
+		return nil, err
+	}
+
+	// --- Shell resource limits ---
+	c.ShRlimitCPU, err = envInt("QUINE_SH_RLIMIT_CPU", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ShRlimitMem, err = envInt("QUINE_SH_RLIMIT_MEM", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ShRlimitFsize, err = envInt("QUINE_SH_RLIMIT_FSIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ShRlimitNproc, err = envInt("QUINE_SH_RLIMIT_NPROC", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// A cgroup that cannot be used is a startup error, like QUINE_HOOKS_DIR.
+	if dir := os.Getenv("QUINE_SH_CGROUP"); dir != "" {
+		if c.ShCgroup, err = filepath.Abs(dir); err != nil {
+			return nil, fmt.Errorf("QUINE_SH_CGROUP: %w", err)
+		}
+		if _, err := os.Stat(filepath.Join(c.ShCgroup, "cgroup.procs")); err != nil {
+			return nil, fmt.Errorf("QUINE_SH_CGROUP=%q is not a cgroup directory", dir)
+		}
+	}
+
 	// --- Depth check ---
 	if c.Depth >= c.MaxDepth {
 		return nil, ErrDepthExceeded
@@ -136,6 +410,18 @@ func Load() (*Config, error) {
 		}
 	}
 
+	// --- Tree ID (the root's session ID; keys tree-wide shared state) ---
+	c.TreeID = os.Getenv("QUINE_TREE_ID")
+	if c.TreeID == "" {
+		c.TreeID = c.SessionID
+	}
+
+	// --- Deadline (own QUINE_DEADLINE, or a share of the parent's) ---
+	c.Deadline, err = loadDeadline(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
 	// --- Data dir ---
 	c.DataDir = os.Getenv("QUINE_DATA_DIR")
 	if c.DataDir == "" {
@@ -154,6 +440,43 @@ func Load() (*Config, error) {
 	// --- Original Intent (preserved across exec for mission continuity) ---
 	c.OriginalIntent = os.Getenv("QUINE_ORIGINAL_INTENT")
 
+	// --- Context tape (fork inheritance; never propagated by baseEnv) ---
+	c.ContextTape = os.Getenv("QUINE_CONTEXT_TAPE")
+
+	// --- Tool-call hooks ---
+	// A hooks dir that cannot be used is a startup error: running without
+	// the configured policy would silently fail open.
+	if dir := os.Getenv("QUINE_HOOKS_DIR"); dir != "" {
+		if c.HooksDir, err = filepath.Abs(dir); err != nil {
+			return nil, fmt.Errorf("QUINE_HOOKS_DIR: %w", err)
+		}
+		if info, err := os.Stat(c.HooksDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("QUINE_HOOKS_DIR=%q is not a directory", dir)
+		}
+	}
+
+	// --- Sandbox ---
+	// Like the hooks dir, a sandbox the kernel cannot provide is a startup
+	// error rather than a silent fallback to running unconfined.
+	if c.Sandbox, err = sandbox.ParseMode(os.Getenv("QUINE_SANDBOX")); err != nil {
+		return nil, fmt.Errorf("QUINE_SANDBOX: %w", err)
+	}
+	if c.Sandbox != sandbox.ModeOff {
+		if err := sandbox.Check(); err != nil {
+			return nil, fmt.Errorf("QUINE_SANDBOX=%s: %w", c.Sandbox, err)
+		}
+	}
+
+	// --- Persona (system prompt overlay) ---
+	c.PersonaDirs = persona.SearchPath(os.Getenv("QUINE_PERSONA_DIR"))
+	c.Persona = os.Getenv("QUINE_PERSONA")
+	if c.Persona != "" {
+		c.PersonaPrompt, err = persona.Load(c.PersonaDirs, c.Persona)
+		if err != nil {
+			return nil, fmt.Errorf("loading QUINE_PERSONA: %w", err)
+		}
+	}
+
 	return c, nil
 }
 
@@ -165,7 +488,7 @@ func (c *Config) baseEnv(depth int, parentSession string) []string {
 		"QUINE_MODEL_ID=" + c.ModelID,
 		"QUINE_API_TYPE=" + c.Provider,
 		"QUINE_API_BASE=" + c.APIBase,
-		"QUINE_API_KEY=" + c.APIKey,
+		"QUINE_UPSTREAM=" + c.upstreamSpec(),
 		"QUINE_MAX_DEPTH=" + strconv.Itoa(c.MaxDepth),
 		"QUINE_DEPTH=" + strconv.Itoa(depth),
 		"QUINE_PARENT_SESSION=" + parentSession,
@@ -177,8 +500,43 @@ func (c *Config) baseEnv(depth int, parentSession string) []string {
 		"QUINE_SHELL=" + c.Shell,
 		"QUINE_MAX_TURNS=" + strconv.Itoa(c.MaxTurns),
 		"QUINE_CONTEXT_WINDOW=" + strconv.Itoa(c.ContextWindow),
+		"QUINE_MODELS_FILE=" + c.ModelsFile,
+		"QUINE_PERSONA_DIR=" + strings.Join(c.PersonaDirs, string(os.PathListSeparator)),
+		"QUINE_PERSONA=" + c.Persona,
+		"QUINE_TOKEN_BUDGET=" + strconv.Itoa(c.TokenBudget),
+		"QUINE_TREE_ID=" + c.TreeID,
+		"QUINE_MAX_TEXT_TURNS=" + strconv.Itoa(c.MaxTextTurns),
+		"QUINE_MAX_TEXT_STRIKES=" + strconv.Itoa(c.MaxTextStrikes),
+		"QUINE_STREAM=" + strconv.FormatBool(c.Stream),
+		"QUINE_STREAM_IDLE_TIMEOUT=" + strconv.Itoa(c.StreamIdleTimeout),
+		"QUINE_STREAM_LENIENT=" + strconv.FormatBool(c.StreamLenient),
+		"QUINE_THINKING_BUDGET=" + strconv.Itoa(c.ThinkingBudget),
+		"QUINE_RETRY_MAX=" + strconv.Itoa(c.RetryMax),
+		"QUINE_RETRY_BASE_MS=" + strconv.Itoa(c.RetryBaseMS),
+		"QUINE_RETRY_MAX_DELAY=" + strconv.Itoa(c.RetryMaxDelay),
+		"QUINE_RATE_LIMIT=" + strconv.Itoa(c.RateLimit),
+		"QUINE_FALLBACK=" + formatFallbacks(c.Fallback),
+		"QUINE_FALLBACK_COOLDOWN=" + strconv.Itoa(c.FallbackCooldown),
+		"QUINE_HOOKS_DIR=" + c.HooksDir,
+		"QUINE_SANDBOX=" + string(c.Sandbox),
+		"QUINE_SH_RLIMIT_CPU=" + strconv.Itoa(c.ShRlimitCPU),
+		"QUINE_SH_RLIMIT_MEM=" + strconv.Itoa(c.ShRlimitMem),
+		"QUINE_SH_RLIMIT_FSIZE=" + strconv.Itoa(c.ShRlimitFsize),
+		"QUINE_SH_RLIMIT_NPROC=" + strconv.Itoa(c.ShRlimitNproc),
+		"QUINE_SH_CGROUP=" + c.ShCgroup,
+		"QUINE_CREDENTIAL_BROKER=" + strconv.FormatBool(c.CredentialBroker),
+		"QUINE_AUTH=" + c.Auth,
+		"QUINE_AWS_REGION=" + c.AWSRegion,
+		"QUINE_AWS_SERVICE=" + c.AWSService,
+		"QUINE_AZURE_DEPLOYMENT=" + c.AzureDeployment,
+		"QUINE_AZURE_API_VERSION=" + c.AzureAPIVersion,
+		// A replay tape belongs to this session only; children of a
+		// replayed session are not replayed.
+		"QUINE_REPLAY_TAPE=",
 	}
 
+	env = append(env, c.routeEnv()...)
+
 	// Pass through QUINE_WISDOM_* env vars for state transfer across exec boundaries
 	for key, value := range c.Wisdom {
 		env = append(env, wisdomPrefix+key+"="+value)
@@ -191,14 +549,26 @@ func (c *Config) baseEnv(depth int, parentSession string) []string {
 // suitable for spawning a child process. The child gets:
 //   - QUINE_DEPTH incremented by 1
 //   - QUINE_PARENT_SESSION set to the current SessionID
-//   - All other config values inherited
+//   - QUINE_PARENT_DEADLINE set, so its deadline is shorter than ours
+//   - The model, API type and context window routed to its depth by
+//     QUINE_MODEL_ID_DEPTH_<n>, if set
+//   - All other config values inherited (including the active persona)
 //
 // Note: QUINE_SESSION_ID is intentionally NOT included. Each child ./quine
 // process generates its own unique session ID via config.Load(). This ensures
 // that multiple children spawned from a single sh command (e.g. via &
 // backgrounding) each get distinct session IDs and write to separate tape files.
 func (c *Config) ChildEnv() ([]string, error) {
-	return c.baseEnv(c.Depth+1, c.SessionID), nil
+	env := c.baseEnv(c.Depth+1, c.SessionID)
+	if r, ok := c.DepthModels[c.Depth+1]; ok {
+		env = overrideEnv(env, r.Env())
+	}
+	env = append(env, c.credentialEnv(false)...)
+	// The child derives its own, shorter deadline from ours (see
+	// loadDeadline). QUINE_DEADLINE is cleared so a relative value from the
+	// user's shell is not re-applied against the child's start time.
+	env = append(env, "QUINE_DEADLINE=", "QUINE_PARENT_DEADLINE="+formatDeadline(c.Deadline))
+	return env, nil
 }
 
 // ExecEnv returns a slice of "KEY=VALUE" environment variable strings
@@ -207,17 +577,211 @@ func (c *Config) ChildEnv() ([]string, error) {
 //   - PARENT_SESSION tracks lineage to the pre-exec session
 //   - ORIGINAL_INTENT is set to preserve the mission
 //   - All QUINE_WISDOM_* vars are preserved (learned insights survive)
+//   - QUINE_DEADLINE is preserved unchanged (no shrinking)
+//   - QUINE_PERSONA carries the current persona (the exec tool may override it)
 //
 // Note: QUINE_SESSION_ID is intentionally NOT included. The new process
 // generates its own unique session ID via config.Load().
 func (c *Config) ExecEnv(originalIntent string) ([]string, error) {
 	env := c.baseEnv(0, c.SessionID)
+	env = append(env, c.credentialEnv(true)...)
 	env = append(env,
 		"QUINE_ORIGINAL_INTENT="+originalIntent,
+		// Same mission, same clock: the successor keeps our exact deadline.
+		"QUINE_DEADLINE="+formatDeadline(c.Deadline),
+		"QUINE_PARENT_DEADLINE=",
 	)
 	return env, nil
 }
 
+// HookEnv returns the credential variables to overlay on os.Environ for
+// hooks: they see the API the way the shell does, through the broker when
+// one serves this tree, never with the keys it holds.
+func (c *Config) HookEnv() []string {
+	return c.credentialEnv(false)
+}
+
+// HasCredentials reports whether this process can sign API requests
+// itself, from any credential source.
+func (c *Config) HasCredentials() bool {
+	return c.APIKey != "" || c.APIKeyFile != "" || c.APIKeyCmd != "" || c.OAuthTokenURL != "" || c.AWSAccessKeyID != ""
+}
+
+// UsesBroker reports whether LLM calls go through the tree's credential
+// broker rather than straight to the API.
+func (c *Config) UsesBroker() bool {
+	return !c.HasCredentials() && c.BrokerSocket != ""
+}
+
+// checkCredentials requires exactly one credential source, or a broker.
+func (c *Config) checkCredentials() error {
+	var sources []string
+	for _, s := range []struct{ name, value string }{
+		{"QUINE_API_KEY", c.APIKey},
+		{"QUINE_API_KEY_FILE", c.APIKeyFile},
+		{"QUINE_API_KEY_CMD", c.APIKeyCmd},
+		{"QUINE_OAUTH_TOKEN_URL", c.OAuthTokenURL},
+		{"AWS_ACCESS_KEY_ID", c.AWSAccessKeyID},
+	} {
+		if s.value != "" {
+			sources = append(sources, s.name)
+		}
+	}
+	switch {
+	case len(sources) > 1:
+		return fmt.Errorf("conflicting credentials: set only one of %s", strings.Join(sources, ", "))
+	case c.OAuthTokenURL != "" && (c.OAuthClientID == "" || c.OAuthClientSecret == ""):
+		return fmt.Errorf("QUINE_OAUTH_CLIENT_ID and QUINE_OAUTH_CLIENT_SECRET are required with QUINE_OAUTH_TOKEN_URL")
+	case c.AWSAccessKeyID != "" && c.AWSSecretKey == "":
+		return fmt.Errorf("AWS_SECRET_ACCESS_KEY is required with AWS_ACCESS_KEY_ID")
+	case len(sources) == 1:
+		return nil
+	case c.BrokerSocket == "" && c.Auth == "sigv4":
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required with QUINE_AUTH=sigv4")
+	case c.BrokerSocket == "":
+		return fmt.Errorf("QUINE_API_KEY is required (or QUINE_API_KEY_FILE, QUINE_API_KEY_CMD, QUINE_OAUTH_TOKEN_URL)")
+	case c.BrokerToken == "":
+		return fmt.Errorf("QUINE_BROKER_TOKEN is required with QUINE_BROKER")
+	}
+	return nil
+}
+
+// upstreamSpec formats c.Upstream as QUINE_UPSTREAM.
+func (c *Config) upstreamSpec() string {
+	if c.Upstream == nil {
+		return ""
+	}
+	return c.Upstream.String()
+}
+
+// credentialEnv returns how the next process reaches the API: through the
+// broker when one serves this tree, else with our own credential source.
+// An exec'd successor takes this process's place, so one holding
+// credentials hands them on, along with the tree's broker.
+func (c *Config) credentialEnv(successor bool) []string {
+	env := []string{
+		"QUINE_API_KEY=" + c.APIKey,
+		"QUINE_API_KEY_FILE=" + c.APIKeyFile,
+		"QUINE_API_KEY_CMD=" + c.APIKeyCmd,
+		"QUINE_API_KEY_CMD_TTL=" + strconv.Itoa(c.APIKeyCmdTTL),
+		"QUINE_OAUTH_TOKEN_URL=" + c.OAuthTokenURL,
+		"QUINE_OAUTH_CLIENT_ID=" + c.OAuthClientID,
+		"QUINE_OAUTH_CLIENT_SECRET=" + c.OAuthClientSecret,
+		"QUINE_OAUTH_SCOPE=" + c.OAuthScope,
+	}
+	if c.Auth == "sigv4" {
+		env = append(env,
+			"AWS_ACCESS_KEY_ID="+c.AWSAccessKeyID,
+			"AWS_SECRET_ACCESS_KEY="+c.AWSSecretKey,
+			"AWS_SESSION_TOKEN="+c.AWSSessionToken,
+		)
+	}
+	if c.BrokerSocket == "" {
+		return append(env, "QUINE_BROKER=", "QUINE_BROKER_TOKEN=")
+	}
+	if successor && c.HasCredentials() {
+		return append(env, "QUINE_BROKER="+c.BrokerSocket, "QUINE_BROKER_TOKEN="+c.BrokerToken)
+	}
+	for i, e := range env {
+		key, _, _ := strings.Cut(e, "=")
+		env[i] = key + "="
+	}
+	// The broker holds the keys of the other upstreams too.
+	for _, f := range c.Upstreams() {
+		if f.KeyEnv != "" {
+			env = append(env, f.KeyEnv+"=")
+		}
+	}
+	return append(env, "QUINE_BROKER="+c.BrokerSocket, "QUINE_BROKER_TOKEN="+c.BrokerToken)
+}
+
+// childDeadlineShare is the fraction of the parent's remaining time a child
+// gets. Leaves therefore panic before their parents, which still have time
+// to collect the children's answers.
+const childDeadlineShare = 0.8
+
+// loadDeadline resolves the process deadline from:
+//   - QUINE_DEADLINE: absolute epoch seconds (e.g. "1767225600" or
+//     "1767225600.250") or a Go duration relative to now (e.g. "10m")
+//   - QUINE_PARENT_DEADLINE: the parent's absolute deadline (set by
+//     ChildEnv); the child gets childDeadlineShare of the time left
+//
+// When both are set, the earlier one wins. Returns the zero time if neither
+// is set.
+func loadDeadline(now time.Time) (time.Time, error) {
+	var deadline time.Time
+
+	if v := os.Getenv("QUINE_DEADLINE"); v != "" {
+		d, err := parseDeadline(v, now)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing QUINE_DEADLINE=%q: %w", v, err)
+		}
+		deadline = d
+	}
+
+	if v := os.Getenv("QUINE_PARENT_DEADLINE"); v != "" {
+		parent, err := parseEpoch(v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing QUINE_PARENT_DEADLINE=%q: %w", v, err)
+		}
+		remaining := parent.Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		share := now.Add(time.Duration(float64(remaining) * childDeadlineShare))
+		if deadline.IsZero() || share.Before(deadline) {
+			deadline = share
+		}
+	}
+
+	return deadline, nil
+}
+
+// parseDeadline accepts absolute epoch seconds or a duration from now.
+func parseDeadline(v string, now time.Time) (time.Time, error) {
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return parseEpoch(v)
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want epoch seconds or a duration like \"10m\"")
+	}
+	return now.Add(d), nil
+}
+
+// parseEpoch parses (possibly fractional) epoch seconds. Small values are
+// rejected: "600" is almost certainly a duration missing its unit, not a
+// deadline in January 1970.
+func parseEpoch(v string) (time.Time, error) {
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if secs < 1e9 {
+		return time.Time{}, fmt.Errorf("epoch %s is implausibly small (durations need a unit, e.g. \"%ss\")", v, v)
+	}
+	return time.UnixMilli(int64(secs * 1000)), nil
+}
+
+// formatDeadline renders a deadline as epoch seconds with millisecond
+// precision, or "" for no deadline.
+func formatDeadline(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64)
+}
+
+// firstNonEmpty returns the first non-empty value, or "".
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 // envInt reads an environment variable as int, returning def if unset.
 func envInt(key string, def int) (int, error) {
 	v := os.Getenv(key)
@@ -243,6 +807,20 @@ func uuidV4() (string, error) {
 		b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
 }
 
+// envBool reads a boolean env var (strconv.ParseBool syntax), returning def
+// if the variable is unset or empty.
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("parsing %s=%q: %w", key, v, err)
+	}
+	return b, nil
+}
+
 // wisdomPrefix is the environment variable prefix for wisdom transfer.
 const wisdomPrefix = "QUINE_WISDOM_"
 
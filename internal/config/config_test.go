@@ -3,9 +3,12 @@ package config
 import (
 	"errors"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // envVars is the full list of environment variables we manage in tests.
@@ -25,6 +28,62 @@ var envVars = []string{
 	"QUINE_SHELL",
 	"QUINE_MAX_TURNS",
 	"QUINE_CONTEXT_WINDOW",
+	"QUINE_CONTEXT_TAPE",
+	"QUINE_PERSONA",
+	"QUINE_PERSONA_DIR",
+	"QUINE_TOKEN_BUDGET",
+	"QUINE_TREE_ID",
+	"QUINE_DEADLINE",
+	"QUINE_PARENT_DEADLINE",
+	"QUINE_MAX_TEXT_TURNS",
+	"QUINE_MAX_TEXT_STRIKES",
+	"QUINE_STREAM",
+	"QUINE_STREAM_IDLE_TIMEOUT",
+	"QUINE_THINKING_BUDGET",
+	"QUINE_RETRY_MAX",
+	"QUINE_RETRY_BASE_MS",
+	"QUINE_RETRY_MAX_DELAY",
+	"QUINE_RATE_LIMIT",
+	"QUINE_FALLBACK",
+	"QUINE_FALLBACK_COOLDOWN",
+	"QUINE_MODEL_ID_DEPTH_2",
+	"QUINE_API_TYPE_DEPTH_2",
+	"QUINE_CONTEXT_WINDOW_DEPTH_2",
+	"QUINE_API_BASE_DEPTH_2",
+	"QUINE_API_KEY_ENV_DEPTH_2",
+	"QUINE_API_KEY_FILE_DEPTH_2",
+	"QUINE_UPSTREAM",
+	"QUINE_FORK_MODELS",
+	"QUINE_MODELS_FILE",
+	"QUINE_STREAM_LENIENT",
+	"QUINE_HOOKS_DIR",
+	"QUINE_SANDBOX",
+	"QUINE_SH_RLIMIT_CPU",
+	"QUINE_SH_RLIMIT_MEM",
+	"QUINE_SH_RLIMIT_FSIZE",
+	"QUINE_SH_RLIMIT_NPROC",
+	"QUINE_SH_CGROUP",
+	"QUINE_REPLAY_TAPE",
+	"QUINE_CREDENTIAL_BROKER",
+	"QUINE_BROKER",
+	"QUINE_BROKER_TOKEN",
+	"QUINE_API_KEY_FILE",
+	"QUINE_API_KEY_CMD",
+	"QUINE_API_KEY_CMD_TTL",
+	"QUINE_OAUTH_TOKEN_URL",
+	"QUINE_OAUTH_CLIENT_ID",
+	"QUINE_OAUTH_CLIENT_SECRET",
+	"QUINE_OAUTH_SCOPE",
+	"QUINE_AUTH",
+	"QUINE_AWS_REGION",
+	"QUINE_AWS_SERVICE",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"QUINE_AZURE_DEPLOYMENT",
+	"QUINE_AZURE_API_VERSION",
 }
 
 // clearEnv unsets all managed env vars and returns a restore function.
@@ -70,6 +129,7 @@ func TestHappyPath(t *testing.T) {
 	os.Setenv("QUINE_DATA_DIR", "/tmp/data")
 	os.Setenv("QUINE_SHELL", "/bin/sh")
 	os.Setenv("QUINE_MAX_TURNS", "30")
+	os.Setenv("QUINE_CONTEXT_TAPE", "/tmp/data/fork-tape-1.jsonl")
 
 	c, err := Load()
 	if err != nil {
@@ -95,6 +155,7 @@ func TestHappyPath(t *testing.T) {
 		{"DataDir", c.DataDir, "/tmp/data"},
 		{"Shell", c.Shell, "/bin/sh"},
 		{"MaxTurns", c.MaxTurns, 30},
+		{"ContextTape", c.ContextTape, "/tmp/data/fork-tape-1.jsonl"},
 	}
 	for _, tc := range checks {
 		if tc.got != tc.want {
@@ -136,8 +197,20 @@ func TestDefaults(t *testing.T) {
 	if c.MaxTurns != 20 {
 		t.Errorf("MaxTurns = %d, want 20", c.MaxTurns)
 	}
-	if c.ContextWindow != 128_000 {
-		t.Errorf("ContextWindow = %d, want 128000", c.ContextWindow)
+	if c.ContextWindow != 200_000 {
+		t.Errorf("ContextWindow = %d, want 200000 (the registry's, for claude-sonnet-4)", c.ContextWindow)
+	}
+	if c.MaxTextTurns != 2 {
+		t.Errorf("MaxTextTurns = %d, want 2", c.MaxTextTurns)
+	}
+	if c.MaxTextStrikes != 3 {
+		t.Errorf("MaxTextStrikes = %d, want 3", c.MaxTextStrikes)
+	}
+	if !c.Stream {
+		t.Error("Stream should default to true")
+	}
+	if c.StreamIdleTimeout != 120 {
+		t.Errorf("StreamIdleTimeout = %d, want 120", c.StreamIdleTimeout)
 	}
 	if c.SessionID == "" {
 		t.Error("SessionID should be auto-generated, got empty")
@@ -212,7 +285,7 @@ func TestMissingRequiredField(t *testing.T) {
 func TestUnsupportedAPIType(t *testing.T) {
 	clearEnv(t)
 	os.Setenv("QUINE_MODEL_ID", "some-model")
-	os.Setenv("QUINE_API_TYPE", "gemini")
+	os.Setenv("QUINE_API_TYPE", "cohere")
 	os.Setenv("QUINE_API_BASE", "https://example.com")
 	os.Setenv("QUINE_API_KEY", "sk-test")
 
@@ -225,6 +298,22 @@ func TestUnsupportedAPIType(t *testing.T) {
 	}
 }
 
+func TestAdditionalAPITypes(t *testing.T) {
+	for _, apiType := range []string{"gemini", "openai-responses"} {
+		clearEnv(t)
+		setRequired(t)
+		os.Setenv("QUINE_API_TYPE", apiType)
+
+		c, err := Load()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", apiType, err)
+		}
+		if c.Provider != apiType {
+			t.Errorf("Provider = %q, want %q", c.Provider, apiType)
+		}
+	}
+}
+
 // --- Third-party provider test ---
 
 func TestThirdPartyProvider(t *testing.T) {
@@ -278,6 +367,52 @@ func TestContextWindow_ExplicitOverride(t *testing.T) {
 	}
 }
 
+func TestModelRegistry(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_MODEL_ID", "llama3.1:8b")
+	os.Setenv("QUINE_API_TYPE", "openai")
+
+	// A model the registry does not know gets the old default.
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.ContextWindow != 128_000 {
+		t.Errorf("ContextWindow = %d, want 128000 for an unknown model", c.ContextWindow)
+	}
+
+	path := filepath.Join(t.TempDir(), "models.json")
+	os.WriteFile(path, []byte(`{"llama3.1:8b": {"context_window": 8192}, "no-tools": {"tools": false}}`), 0o644)
+	os.Setenv("QUINE_MODELS_FILE", path)
+	c, err = Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.ContextWindow != 8192 {
+		t.Errorf("ContextWindow = %d, want 8192 from QUINE_MODELS_FILE", c.ContextWindow)
+	}
+	env, _ := c.ChildEnv()
+	if !slices.Contains(env, "QUINE_MODELS_FILE="+path) {
+		t.Error("child env should carry QUINE_MODELS_FILE")
+	}
+
+	os.Setenv("QUINE_FORK_MODELS", "no-tools")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a fork model without tool calling")
+	}
+	os.Setenv("QUINE_FORK_MODELS", "")
+	os.Setenv("QUINE_MODEL_ID", "no-tools")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a model without tool calling")
+	}
+
+	os.Setenv("QUINE_MODELS_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a missing QUINE_MODELS_FILE")
+	}
+}
+
 // --- ChildEnv / ExecEnv tests ---
 
 func TestChildEnv(t *testing.T) {
@@ -386,6 +521,159 @@ func TestExecEnv(t *testing.T) {
 	}
 }
 
+// TestBrokerEnv: with a broker running, children get the socket and token
+// instead of the key, while an exec'd successor of the key holder gets the
+// key and keeps the tree's broker.
+func TestBrokerEnv(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if !c.CredentialBroker {
+		t.Error("CredentialBroker should default to true")
+	}
+	c.BrokerSocket, c.BrokerToken = "/tmp/broker.sock", "tok"
+
+	envMap := func(env []string) map[string]string {
+		m := make(map[string]string)
+		for _, e := range env {
+			k, v, _ := strings.Cut(e, "=")
+			m[k] = v
+		}
+		return m
+	}
+	child, _ := c.ChildEnv()
+	if m := envMap(child); m["QUINE_API_KEY"] != "" || m["QUINE_BROKER"] != "/tmp/broker.sock" || m["QUINE_BROKER_TOKEN"] != "tok" {
+		t.Errorf("ChildEnv credentials = key %q, broker %q, token %q", m["QUINE_API_KEY"], m["QUINE_BROKER"], m["QUINE_BROKER_TOKEN"])
+	}
+	successor, _ := c.ExecEnv("x")
+	if m := envMap(successor); m["QUINE_API_KEY"] != "sk-test-key" || m["QUINE_BROKER"] != "/tmp/broker.sock" || m["QUINE_BROKER_TOKEN"] != "tok" {
+		t.Errorf("ExecEnv credentials = key %q, broker %q, token %q", m["QUINE_API_KEY"], m["QUINE_BROKER"], m["QUINE_BROKER_TOKEN"])
+	}
+
+	// The child itself loads without a key and keeps using the broker,
+	// across exec too.
+	clearEnv(t)
+	for _, e := range child {
+		k, v, _ := strings.Cut(e, "=")
+		os.Setenv(k, v)
+	}
+	cc, err := Load()
+	if err != nil {
+		t.Fatalf("Load() in brokered child: %v", err)
+	}
+	if !cc.UsesBroker() {
+		t.Error("brokered child should use the broker")
+	}
+	successor, _ = cc.ExecEnv("x")
+	if m := envMap(successor); m["QUINE_API_KEY"] != "" || m["QUINE_BROKER"] != "/tmp/broker.sock" {
+		t.Errorf("child ExecEnv credentials = key %q, broker %q", m["QUINE_API_KEY"], m["QUINE_BROKER"])
+	}
+
+	os.Setenv("QUINE_BROKER_TOKEN", "")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "QUINE_BROKER_TOKEN") {
+		t.Errorf("Load() without token = %v, want QUINE_BROKER_TOKEN error", err)
+	}
+}
+
+func TestCredentialSources(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Unsetenv("QUINE_API_KEY")
+
+	os.Setenv("QUINE_API_KEY_FILE", "key.txt")
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load() with QUINE_API_KEY_FILE: %v", err)
+	}
+	if !filepath.IsAbs(c.APIKeyFile) || !c.HasCredentials() || c.APIKeyCmdTTL != 300 {
+		t.Errorf("APIKeyFile = %q, HasCredentials = %v, TTL = %d", c.APIKeyFile, c.HasCredentials(), c.APIKeyCmdTTL)
+	}
+	// Without a broker, children inherit the source itself.
+	child, _ := c.ChildEnv()
+	if !slices.Contains(child, "QUINE_API_KEY_FILE="+c.APIKeyFile) {
+		t.Error("ChildEnv should pass QUINE_API_KEY_FILE on when there is no broker")
+	}
+	c.BrokerSocket, c.BrokerToken = "/tmp/broker.sock", "tok"
+	child, _ = c.ChildEnv()
+	if !slices.Contains(child, "QUINE_API_KEY_FILE=") {
+		t.Error("ChildEnv should blank QUINE_API_KEY_FILE behind a broker")
+	}
+	if hook := c.HookEnv(); !slices.Contains(hook, "QUINE_API_KEY_FILE=") || !slices.Contains(hook, "QUINE_BROKER=/tmp/broker.sock") {
+		t.Errorf("HookEnv should hand hooks the broker, not the key: %v", hook)
+	}
+
+	os.Setenv("QUINE_API_KEY_CMD", "pass show llm")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "conflicting credentials") {
+		t.Errorf("two sources: err = %v", err)
+	}
+	os.Unsetenv("QUINE_API_KEY_FILE")
+	os.Unsetenv("QUINE_API_KEY_CMD")
+
+	os.Setenv("QUINE_OAUTH_TOKEN_URL", "https://auth.example.com/token")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "QUINE_OAUTH_CLIENT_ID") {
+		t.Errorf("OAuth without client: err = %v", err)
+	}
+	os.Setenv("QUINE_OAUTH_CLIENT_ID", "quine")
+	os.Setenv("QUINE_OAUTH_CLIENT_SECRET", "s3cret")
+	if _, err := Load(); err != nil {
+		t.Errorf("OAuth: %v", err)
+	}
+}
+
+func TestSigV4Auth(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Unsetenv("QUINE_API_KEY")
+	os.Setenv("QUINE_AUTH", "sigv4")
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "QUINE_AWS_REGION") {
+		t.Errorf("no region: err = %v", err)
+	}
+	os.Setenv("AWS_REGION", "eu-west-1")
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	if c.AWSRegion != "eu-west-1" || c.AWSService != "bedrock" || !c.HasCredentials() {
+		t.Errorf("region %q, service %q, HasCredentials %v", c.AWSRegion, c.AWSService, c.HasCredentials())
+	}
+
+	// Behind a broker, children get the region but not the AWS secrets.
+	c.BrokerSocket, c.BrokerToken = "/tmp/broker.sock", "tok"
+	child, _ := c.ChildEnv()
+	if !slices.Contains(child, "AWS_SECRET_ACCESS_KEY=") || !slices.Contains(child, "QUINE_AWS_REGION=eu-west-1") {
+		t.Errorf("ChildEnv = %v", child)
+	}
+
+	os.Setenv("QUINE_API_KEY", "sk-too")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "conflicting credentials") {
+		t.Errorf("key and sigv4: err = %v", err)
+	}
+	os.Setenv("QUINE_AUTH", "kerberos")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "QUINE_AUTH") {
+		t.Errorf("unknown auth: err = %v", err)
+	}
+}
+
+func TestAzureOpenAIDefaults(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_API_TYPE", "azure-openai")
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	if c.AzureDeployment != c.ModelID || c.AzureAPIVersion != "2024-10-21" {
+		t.Errorf("deployment %q, api-version %q", c.AzureDeployment, c.AzureAPIVersion)
+	}
+}
+
 func TestWisdomChildEnv(t *testing.T) {
 	clearEnv(t)
 	setRequired(t)
@@ -443,3 +731,492 @@ func TestWisdomIgnoresEmptyValues(t *testing.T) {
 		t.Errorf("Wisdom[VALID] = %q, want %q", c.Wisdom["VALID"], "has value")
 	}
 }
+
+// --- Persona tests ---
+
+func TestPersonaLoaded(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "coder.md"), []byte("You write code.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("QUINE_PERSONA_DIR", dir)
+	os.Setenv("QUINE_PERSONA", "coder")
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if c.Persona != "coder" {
+		t.Errorf("Persona = %q, want coder", c.Persona)
+	}
+	if c.PersonaPrompt != "You write code." {
+		t.Errorf("PersonaPrompt = %q", c.PersonaPrompt)
+	}
+
+	env, _ := c.ExecEnv("mission")
+	m := make(map[string]string)
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		m[k] = v
+	}
+	if m["QUINE_PERSONA"] != "coder" {
+		t.Errorf("ExecEnv QUINE_PERSONA = %q, want coder", m["QUINE_PERSONA"])
+	}
+	if m["QUINE_PERSONA_DIR"] != dir {
+		t.Errorf("ExecEnv QUINE_PERSONA_DIR = %q, want %q", m["QUINE_PERSONA_DIR"], dir)
+	}
+}
+
+func TestPersonaUnknown(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_PERSONA_DIR", t.TempDir())
+	os.Setenv("QUINE_PERSONA", "ghost")
+
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for unknown persona")
+	}
+}
+
+// --- Hooks tests ---
+
+func TestHooksDirMustExist(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_HOOKS_DIR", filepath.Join(t.TempDir(), "missing"))
+
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for a missing hooks dir (must fail closed)")
+	}
+}
+
+func TestSandboxModeValidated(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_SANDBOX", "chroot")
+
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for an unknown sandbox mode")
+	}
+}
+
+func TestThinkingBudget(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_THINKING_BUDGET", "512")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for a thinking budget below the API minimum")
+	}
+
+	os.Setenv("QUINE_THINKING_BUDGET", "8000")
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.ThinkingBudget != 8000 {
+		t.Errorf("ThinkingBudget = %d, want 8000", c.ThinkingBudget)
+	}
+	for _, envFn := range []func() ([]string, error){c.ChildEnv, func() ([]string, error) { return c.ExecEnv("m") }} {
+		env, _ := envFn()
+		if !slices.Contains(env, "QUINE_THINKING_BUDGET=8000") {
+			t.Errorf("env missing QUINE_THINKING_BUDGET:\n%s", strings.Join(env, "\n"))
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.RetryMax != 5 || c.RetryBaseMS != 500 || c.RetryMaxDelay != 60 || c.RateLimit != 0 {
+		t.Errorf("defaults = %d/%dms/%ds/%drpm, want 5/500ms/60s/0rpm", c.RetryMax, c.RetryBaseMS, c.RetryMaxDelay, c.RateLimit)
+	}
+
+	os.Setenv("QUINE_RETRY_MAX", "2")
+	os.Setenv("QUINE_RATE_LIMIT", "120")
+	c, err = Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	env, _ := c.ChildEnv()
+	for _, want := range []string{"QUINE_RETRY_MAX=2", "QUINE_RATE_LIMIT=120", "QUINE_RETRY_MAX_DELAY=60"} {
+		if !slices.Contains(env, want) {
+			t.Errorf("child env missing %s", want)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	t.Setenv("TEST_OPENAI_KEY", "sk-fallback")
+	os.Setenv("QUINE_FALLBACK", "type=openai,model=gpt-4o,base=https://api.openai.com,key_env=TEST_OPENAI_KEY; type=gemini,model=gemini-2.5-pro,base=https://generativelanguage.googleapis.com,key_file=gemini.key")
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(c.Fallback) != 2 || c.FallbackCooldown != 300 {
+		t.Fatalf("Fallback = %+v, cooldown %d; want 2 entries, 300s", c.Fallback, c.FallbackCooldown)
+	}
+	if f := c.Fallback[1]; f.Provider != "gemini" || !filepath.IsAbs(f.KeyFile) {
+		t.Errorf("second entry = %+v, want gemini with an absolute key file", f)
+	}
+
+	// The fallback's own config: its key, no broker, no fallbacks of its own.
+	c.BrokerSocket, c.BrokerToken = "/tmp/broker.sock", "tok"
+	fc := c.ForFallback(c.Fallback[0])
+	if fc.Provider != "openai" || fc.ModelID != "gpt-4o" || fc.APIKey != "sk-fallback" || fc.UsesBroker() || fc.Fallback != nil {
+		t.Errorf("ForFallback = %+v", fc)
+	}
+	if c.APIKey != "sk-test-key" {
+		t.Error("ForFallback modified the primary config")
+	}
+
+	// Children get the same chain, with the key still only referenced.
+	env, _ := c.ChildEnv()
+	want := "QUINE_FALLBACK=" + c.Fallback[0].String() + ";" + c.Fallback[1].String()
+	if !slices.Contains(env, want) {
+		t.Errorf("child env missing %s", want)
+	}
+	if strings.Contains(strings.Join(env, "\n"), "sk-fallback") {
+		t.Error("child env contains the fallback key itself")
+	}
+
+	for _, bad := range []string{
+		"type=openai,model=gpt-4o,base=https://api.openai.com",                                // no key reference
+		"type=openai,model=gpt-4o,base=https://api.openai.com,key_env=TEST_UNSET_KEY",         // key not set
+		"type=cohere,model=c,base=https://example.com,key_env=TEST_OPENAI_KEY",                // unsupported type
+		"type=openai,model=gpt-4o,base=https://api.openai.com,key_env=TEST_OPENAI_KEY,tier=2", // unknown field
+	} {
+		os.Setenv("QUINE_FALLBACK", bad)
+		if _, err := Load(); err == nil {
+			t.Errorf("QUINE_FALLBACK=%q: expected error", bad)
+		}
+	}
+
+	// A brokered child: the key_env variable is blanked, and the broker
+	// signs for the fallback.
+	if !slices.Contains(env, "TEST_OPENAI_KEY=") {
+		t.Error("child env does not blank the fallback's key_env")
+	}
+	clearEnv(t)
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		os.Setenv(k, v)
+	}
+	cc, err := Load()
+	if err != nil {
+		t.Fatalf("Load() in brokered child: %v", err)
+	}
+	fc = cc.ForFallback(cc.Fallback[0])
+	if fc.APIKey != "" || !fc.UsesBroker() || fc.BrokerUpstream != cc.Fallback[0].Upstream() {
+		t.Errorf("brokered ForFallback = key %q, broker %v, upstream %q", fc.APIKey, fc.UsesBroker(), fc.BrokerUpstream)
+	}
+}
+
+func TestModelRouting(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_DEPTH", "1")
+	t.Setenv("TEST_OPENAI_KEY", "sk-openai")
+	t.Setenv("TEST_GEMINI_KEY", "AIza-gemini")
+	os.Setenv("QUINE_MODEL_ID_DEPTH_2", "gpt-4o-mini")
+	os.Setenv("QUINE_API_TYPE_DEPTH_2", "openai")
+	os.Setenv("QUINE_CONTEXT_WINDOW_DEPTH_2", "64000")
+	os.Setenv("QUINE_API_BASE_DEPTH_2", "https://api.openai.com")
+	os.Setenv("QUINE_API_KEY_ENV_DEPTH_2", "TEST_OPENAI_KEY")
+	os.Setenv("QUINE_FORK_MODELS", "claude-haiku-4-5; model=gemini-2.5-flash,type=gemini,context_window=1000000,base=https://generativelanguage.googleapis.com,key_env=TEST_GEMINI_KEY")
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	// The child at depth 2 runs on the routed model and window, calling
+	// the route's API with the route's key.
+	env, _ := c.ChildEnv()
+	upstream := "QUINE_UPSTREAM=type=openai,model=gpt-4o-mini,base=https://api.openai.com,key_env=TEST_OPENAI_KEY"
+	for _, want := range []string{"QUINE_MODEL_ID=gpt-4o-mini", "QUINE_API_TYPE=anthropic", upstream, "QUINE_CONTEXT_WINDOW=64000", "QUINE_DEPTH=2"} {
+		if !slices.Contains(env, want) {
+			t.Errorf("child env missing %s", want)
+		}
+	}
+	if slices.Contains(env, "QUINE_MODEL_ID=claude-sonnet-4-20250514") {
+		t.Error("child env still carries the parent's model")
+	}
+	os.Setenv("QUINE_DEPTH", "2")
+	os.Setenv("QUINE_MODEL_ID", "gpt-4o-mini")
+	os.Setenv("QUINE_UPSTREAM", strings.TrimPrefix(upstream, "QUINE_UPSTREAM="))
+	child, err := Load()
+	if err != nil {
+		t.Fatalf("Load() in routed child: %v", err)
+	}
+	if uc := child.ForUpstream(); uc.Provider != "openai" || uc.APIBase != "https://api.openai.com" || uc.APIKey != "sk-openai" || uc.ModelID != "gpt-4o-mini" {
+		t.Errorf("routed child calls %s %s with key %q, model %s", uc.Provider, uc.APIBase, uc.APIKey, uc.ModelID)
+	}
+	// Its own children on a keyless route go back to the tree's API.
+	env, _ = child.ChildEnv()
+	if !slices.Contains(env, upstream) {
+		t.Error("child env should keep the routed process's upstream")
+	}
+	os.Setenv("QUINE_DEPTH", "1")
+	os.Setenv("QUINE_MODEL_ID", "claude-sonnet-4-20250514")
+	os.Setenv("QUINE_UPSTREAM", "")
+
+	// An exec successor stays at our depth, on our model.
+	env, _ = c.ExecEnv("m")
+	if !slices.Contains(env, "QUINE_MODEL_ID=claude-sonnet-4-20250514") {
+		t.Error("exec env should keep this process's model")
+	}
+
+	// Fork allowlist: a bare model keeps our type, with the registry's window.
+	if got := c.ForkModelIDs(); len(got) != 2 || got[0] != "claude-haiku-4-5" {
+		t.Fatalf("ForkModelIDs = %v", got)
+	}
+	if r := c.ForkModels[0]; r.Provider != "anthropic" || r.ContextWindow != 200_000 {
+		t.Errorf("bare fork model = %+v, want this process's type and the registry's window", r)
+	}
+	if r := c.ForkModels[1]; r.Provider != "gemini" || r.ContextWindow != 1_000_000 || r.KeyEnv != "TEST_GEMINI_KEY" {
+		t.Errorf("fork model = %+v", r)
+	}
+	if env := c.ForkModels[0].Env(); !slices.Contains(env, "QUINE_UPSTREAM=") {
+		t.Errorf("keyless fork route env = %v, want the tree's API", env)
+	}
+
+	// The rules reach the whole tree.
+	os.Setenv("QUINE_DEPTH", "0")
+	c, _ = Load()
+	env, _ = c.ChildEnv()
+	want := "QUINE_FORK_MODELS=" + c.ForkModels[0].String() + ";" + c.ForkModels[1].String()
+	if !slices.Contains(env, want) || !slices.Contains(env, "QUINE_MODEL_ID_DEPTH_2=gpt-4o-mini") {
+		t.Errorf("child env does not pass the routing rules on:\n%s", strings.Join(env, "\n"))
+	}
+	if !slices.Contains(env, "QUINE_MODEL_ID=claude-sonnet-4-20250514") {
+		t.Error("child at an unrouted depth should inherit the model")
+	}
+
+	// A brokered child sees the routes' key variables blank.
+	c.BrokerSocket, c.BrokerToken = "/tmp/broker.sock", "tok"
+	env, _ = c.ChildEnv()
+	if !slices.Contains(env, "TEST_OPENAI_KEY=") || !slices.Contains(env, "TEST_GEMINI_KEY=") {
+		t.Error("brokered child env does not blank the routes' key_env")
+	}
+	if ups := c.Upstreams(); len(ups) != 2 || ups[0].KeyEnv != "TEST_OPENAI_KEY" || ups[1].KeyEnv != "TEST_GEMINI_KEY" {
+		t.Errorf("Upstreams = %+v", ups)
+	}
+
+	os.Setenv("QUINE_API_TYPE_DEPTH_2", "cohere")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for an unsupported routed API type")
+	}
+	os.Setenv("QUINE_API_TYPE_DEPTH_2", "openai")
+	os.Setenv("QUINE_API_KEY_ENV_DEPTH_2", "")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "not the tree's") {
+		t.Errorf("route to another API on the tree's key: err = %v", err)
+	}
+	os.Setenv("QUINE_API_TYPE_DEPTH_2", "")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "base needs") {
+		t.Errorf("route with a base but no key: err = %v", err)
+	}
+}
+
+func TestShellLimitsPropagatedToChildren(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_SH_RLIMIT_MEM", "512")
+	os.Setenv("QUINE_SH_RLIMIT_CPU", "60")
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.ShRlimitMem != 512 || c.ShRlimitCPU != 60 || c.ShRlimitFsize != 0 {
+		t.Errorf("limits = cpu %d mem %d fsize %d", c.ShRlimitCPU, c.ShRlimitMem, c.ShRlimitFsize)
+	}
+	env, _ := c.ChildEnv()
+	joined := strings.Join(env, "\n")
+	if !strings.Contains(joined, "QUINE_SH_RLIMIT_MEM=512") || !strings.Contains(joined, "QUINE_SH_RLIMIT_CPU=60") {
+		t.Errorf("child env missing limits:\n%s", joined)
+	}
+}
+
+func TestShellCgroupMustBeCgroup(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_SH_CGROUP", t.TempDir())
+
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for a directory that is not a cgroup")
+	}
+}
+
+func TestReplayNeedsOnlyTape(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("QUINE_API_TYPE", "replay")
+
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "QUINE_REPLAY_TAPE") {
+		t.Fatalf("expected QUINE_REPLAY_TAPE error, got %v", err)
+	}
+
+	os.Setenv("QUINE_REPLAY_TAPE", "session.jsonl")
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !filepath.IsAbs(c.ReplayTape) || c.ModelID != "replay" {
+		t.Errorf("ReplayTape = %q, ModelID = %q", c.ReplayTape, c.ModelID)
+	}
+	env, _ := c.ChildEnv()
+	for _, e := range env {
+		if strings.HasPrefix(e, "QUINE_REPLAY_TAPE=") && e != "QUINE_REPLAY_TAPE=" {
+			t.Errorf("replay tape leaked to children: %s", e)
+		}
+	}
+}
+
+func TestHooksDirPropagatedToChildren(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	dir := t.TempDir()
+	os.Setenv("QUINE_HOOKS_DIR", dir)
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	env, err := c.ChildEnv()
+	if err != nil {
+		t.Fatalf("ChildEnv: %v", err)
+	}
+	want := "QUINE_HOOKS_DIR=" + dir
+	found := false
+	for _, kv := range env {
+		if kv == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("child env missing %q", want)
+	}
+}
+
+// --- Token budget / tree ID tests ---
+
+func TestTreeIDDefaultsToSessionID(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_SESSION_ID", "root-session")
+	os.Setenv("QUINE_TOKEN_BUDGET", "500000")
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if c.TreeID != "root-session" {
+		t.Errorf("TreeID = %q, want root-session", c.TreeID)
+	}
+	if c.TokenBudget != 500000 {
+		t.Errorf("TokenBudget = %d, want 500000", c.TokenBudget)
+	}
+
+	env, _ := c.ChildEnv()
+	m := make(map[string]string)
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		m[k] = v
+	}
+	if m["QUINE_TREE_ID"] != "root-session" {
+		t.Errorf("child QUINE_TREE_ID = %q, want root-session", m["QUINE_TREE_ID"])
+	}
+	if m["QUINE_TOKEN_BUDGET"] != "500000" {
+		t.Errorf("child QUINE_TOKEN_BUDGET = %q, want 500000", m["QUINE_TOKEN_BUDGET"])
+	}
+}
+
+// --- Deadline tests ---
+
+func TestDeadlineDuration(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_DEADLINE", "10m")
+
+	before := time.Now()
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if d := c.Deadline.Sub(before); d < 9*time.Minute || d > 11*time.Minute {
+		t.Errorf("Deadline %v is not ~10m from now", d)
+	}
+}
+
+func TestDeadlineEpoch(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_DEADLINE", "1900000000.5")
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if got := c.Deadline.UnixMilli(); got != 1900000000500 {
+		t.Errorf("Deadline = %d ms, want 1900000000500", got)
+	}
+}
+
+func TestDeadlineInvalid(t *testing.T) {
+	for _, v := range []string{"soon", "600"} {
+		clearEnv(t)
+		setRequired(t)
+		os.Setenv("QUINE_DEADLINE", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("QUINE_DEADLINE=%q should be rejected", v)
+		}
+	}
+}
+
+func TestDeadlineShrinksForChildren(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	os.Setenv("QUINE_DEADLINE", "100s")
+
+	parent, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	env, _ := parent.ChildEnv()
+	m := make(map[string]string)
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		m[k] = v
+	}
+	if m["QUINE_DEADLINE"] != "" {
+		t.Errorf("child QUINE_DEADLINE should be cleared, got %q", m["QUINE_DEADLINE"])
+	}
+
+	// Boot the child from the parent's env.
+	os.Setenv("QUINE_DEADLINE", m["QUINE_DEADLINE"])
+	os.Setenv("QUINE_PARENT_DEADLINE", m["QUINE_PARENT_DEADLINE"])
+	child, err := Load()
+	if err != nil {
+		t.Fatalf("child Load() error: %v", err)
+	}
+	if !child.Deadline.Before(parent.Deadline) {
+		t.Errorf("child deadline %v should precede parent's %v", child.Deadline, parent.Deadline)
+	}
+	if left := time.Until(child.Deadline); left < 70*time.Second || left > 81*time.Second {
+		t.Errorf("child should get ~80%% of the parent's time, got %v", left)
+	}
+
+	// Exec keeps the exact deadline.
+	env, _ = parent.ExecEnv("mission")
+	for _, e := range env {
+		if k, v, _ := strings.Cut(e, "="); k == "QUINE_DEADLINE" && v != formatDeadline(parent.Deadline) {
+			t.Errorf("ExecEnv QUINE_DEADLINE = %q, want %q", v, formatDeadline(parent.Deadline))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Fallback is one entry of QUINE_FALLBACK: a model tried in place of the
+// primary (and of the entries before it) while those keep failing.
+//
+// QUINE_FALLBACK lists entries separated by ";", each a comma-separated
+// set of name=value fields:
+//
+//	type=openai,model=gpt-4o,base=https://api.openai.com,key_env=OPENAI_API_KEY
+//
+// The key is referenced, never inlined: key_env names the environment
+// variable holding it, key_file a file re-read on every request.
+type Fallback struct {
+	Provider string // type: "openai", "openai-responses", "azure-openai", "anthropic" or "gemini"
+	ModelID  string // model
+	APIBase  string // base
+	KeyEnv   string // key_env: environment variable holding the key
+	KeyFile  string // key_file: file holding the key (made absolute)
+}
+
+// String formats f as a QUINE_FALLBACK entry.
+func (f Fallback) String() string {
+	s := "type=" + f.Provider + ",model=" + f.ModelID + ",base=" + f.APIBase
+	if f.KeyEnv != "" {
+		s += ",key_env=" + f.KeyEnv
+	}
+	if f.KeyFile != "" {
+		s += ",key_file=" + f.KeyFile
+	}
+	return s
+}
+
+// Upstream names f's API and key, leaving out the model. The credential
+// broker serves each upstream of the tree (see Config.Upstreams) under
+// this name.
+func (f Fallback) Upstream() string {
+	s := "type=" + f.Provider + ",base=" + f.APIBase
+	if f.KeyEnv != "" {
+		return s + ",key_env=" + f.KeyEnv
+	}
+	return s + ",key_file=" + f.KeyFile
+}
+
+// parseFallbacks parses QUINE_FALLBACK.
+func (c *Config) parseFallbacks(spec string) ([]Fallback, error) {
+	var fallbacks []Fallback
+	for i, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		f, err := c.parseFallback(fmt.Sprintf("QUINE_FALLBACK entry %d", i+1), entry)
+		if err != nil {
+			return nil, err
+		}
+		fallbacks = append(fallbacks, f)
+	}
+	return fallbacks, nil
+}
+
+// parseFallback parses one QUINE_FALLBACK entry, or QUINE_UPSTREAM, named
+// source in errors. It must name its type, model, base and exactly one key
+// reference, and the key must be there, unless the broker signs for this
+// process: its key_env variables are blank.
+func (c *Config) parseFallback(source, entry string) (Fallback, error) {
+	var f Fallback
+	for _, field := range strings.Split(entry, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || value == "" {
+			return Fallback{}, fmt.Errorf("%s: %q is not name=value", source, field)
+		}
+		switch name {
+		case "type":
+			f.Provider = value
+		case "model":
+			f.ModelID = value
+		case "base":
+			f.APIBase = value
+		case "key_env":
+			f.KeyEnv = value
+		case "key_file":
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return Fallback{}, fmt.Errorf("%s: key_file: %w", source, err)
+			}
+			f.KeyFile = abs
+		default:
+			return Fallback{}, fmt.Errorf("%s: unknown field %q (want type, model, base, key_env or key_file)", source, name)
+		}
+	}
+
+	switch f.Provider {
+	case "openai", "openai-responses", "azure-openai", "anthropic", "gemini":
+	case "":
+		return Fallback{}, fmt.Errorf("%s: type is required", source)
+	default:
+		return Fallback{}, fmt.Errorf("%s: unsupported type %q", source, f.Provider)
+	}
+	switch {
+	case f.ModelID == "":
+		return Fallback{}, fmt.Errorf("%s: model is required", source)
+	case f.APIBase == "":
+		return Fallback{}, fmt.Errorf("%s: base is required", source)
+	case (f.KeyEnv == "") == (f.KeyFile == ""):
+		return Fallback{}, fmt.Errorf("%s: set exactly one of key_env and key_file", source)
+	}
+	if err := c.checkKeyEnv(f.KeyEnv); err != nil {
+		return Fallback{}, fmt.Errorf("%s: %w", source, err)
+	}
+	return f, nil
+}
+
+// checkKeyEnv requires the key_env variable of an upstream to be set,
+// unless the broker signs for this process: it sees those variables blank.
+func (c *Config) checkKeyEnv(name string) error {
+	if name != "" && os.Getenv(name) == "" && !c.UsesBroker() {
+		return fmt.Errorf("%s is not set", name)
+	}
+	return nil
+}
+
+// formatFallbacks is the inverse of parseFallbacks.
+func formatFallbacks(fallbacks []Fallback) string {
+	entries := make([]string, len(fallbacks))
+	for i, f := range fallbacks {
+		entries[i] = f.String()
+	}
+	return strings.Join(entries, ";")
+}
+
+// ForFallback returns a copy of c that talks to f instead of the primary
+// API: f's type, model and base, signed with f's key, or by the credential
+// broker when c goes through one. The context window is the registry's for
+// f's model, if it knows it.
+func (c *Config) ForFallback(f Fallback) *Config {
+	fc := *c
+	fc.Provider = f.Provider
+	fc.ModelID = f.ModelID
+	fc.ContextWindow = c.windowFor(f.ModelID)
+	fc.APIBase = f.APIBase
+	fc.APIKey, fc.APIKeyFile, fc.APIKeyCmd = "", "", ""
+	fc.OAuthTokenURL, fc.OAuthClientID, fc.OAuthClientSecret, fc.OAuthScope = "", "", "", ""
+	fc.Auth, fc.AWSAccessKeyID, fc.AWSSecretKey, fc.AWSSessionToken = "", "", "", ""
+	if c.UsesBroker() {
+		fc.BrokerUpstream = f.Upstream()
+	} else {
+		if f.KeyEnv != "" {
+			fc.APIKey = os.Getenv(f.KeyEnv)
+		}
+		fc.APIKeyFile = f.KeyFile
+		fc.BrokerSocket, fc.BrokerToken, fc.BrokerUpstream = "", "", ""
+	}
+	fc.AzureDeployment, fc.AzureAPIVersion = "", ""
+	if f.Provider == "azure-openai" {
+		fc.AzureDeployment = f.ModelID
+		fc.AzureAPIVersion = firstNonEmpty(c.AzureAPIVersion, "2024-10-21")
+	}
+	fc.Fallback, fc.Upstream = nil, nil
+	return &fc
+}
+
+// ForUpstream returns the config this process calls its model with: c
+// itself, or, when a route put it on an API of its own (QUINE_UPSTREAM),
+// a copy of c on that API that keeps c's model, context window and
+// fallbacks.
+func (c *Config) ForUpstream() *Config {
+	if c.Upstream == nil {
+		return c
+	}
+	f := *c.Upstream
+	f.ModelID = c.ModelID
+	uc := c.ForFallback(f)
+	uc.ContextWindow, uc.Fallback = c.ContextWindow, c.Fallback
+	return uc
+}
+
+// Upstreams lists the APIs besides the primary that processes of the tree
+// call with keys of their own: this process's, the fallbacks, and those
+// of the routes that name a key.
+func (c *Config) Upstreams() []Fallback {
+	var ups []Fallback
+	if c.Upstream != nil {
+		ups = append(ups, *c.Upstream)
+	}
+	ups = append(ups, c.Fallback...)
+	depths := make([]int, 0, len(c.DepthModels))
+	for d := range c.DepthModels {
+		depths = append(depths, d)
+	}
+	sort.Ints(depths)
+	for _, d := range depths {
+		if r := c.DepthModels[d]; r.keyed() {
+			ups = append(ups, r.upstream())
+		}
+	}
+	for _, r := range c.ForkModels {
+		if r.keyed() {
+			ups = append(ups, r.upstream())
+		}
+	}
+	return ups
+}
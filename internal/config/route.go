@@ -0,0 +1,270 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route is the model a child process runs on: chosen by its depth
+// (QUINE_MODEL_ID_DEPTH_<n>) or by the fork tool's model argument
+// (QUINE_FORK_MODELS). The context window defaults to the model
+// registry's, else that of the process that read the route.
+//
+// A route without a base and key stays on the tree's API (QUINE_API_TYPE,
+// QUINE_API_BASE and credentials), so its type must be the tree's. A route
+// to another API names its base and one key reference, like a Fallback,
+// and the child calls it as its upstream (QUINE_UPSTREAM).
+type Route struct {
+	ModelID       string
+	Provider      string
+	ContextWindow int
+	APIBase       string // base, with KeyEnv or KeyFile
+	KeyEnv        string // key_env: environment variable holding the key
+	KeyFile       string // key_file: file holding the key (made absolute)
+}
+
+// keyed reports whether r names an API of its own.
+func (r Route) keyed() bool {
+	return r.KeyEnv != "" || r.KeyFile != ""
+}
+
+// upstream returns the API r names, for a keyed r.
+func (r Route) upstream() Fallback {
+	return Fallback{Provider: r.Provider, ModelID: r.ModelID, APIBase: r.APIBase, KeyEnv: r.KeyEnv, KeyFile: r.KeyFile}
+}
+
+// Env returns the child environment entries that select r.
+func (r Route) Env() []string {
+	upstream := ""
+	if r.keyed() {
+		upstream = r.upstream().String()
+	}
+	return []string{
+		"QUINE_MODEL_ID=" + r.ModelID,
+		"QUINE_CONTEXT_WINDOW=" + strconv.Itoa(r.ContextWindow),
+		"QUINE_UPSTREAM=" + upstream,
+		// azure-openai: the deployment follows the routed model.
+		"QUINE_AZURE_DEPLOYMENT=",
+	}
+}
+
+// String formats r as a QUINE_FORK_MODELS entry.
+func (r Route) String() string {
+	s := "model=" + r.ModelID + ",type=" + r.Provider + ",context_window=" + strconv.Itoa(r.ContextWindow)
+	if r.APIBase != "" {
+		s += ",base=" + r.APIBase
+	}
+	if r.KeyEnv != "" {
+		s += ",key_env=" + r.KeyEnv
+	}
+	if r.KeyFile != "" {
+		s += ",key_file=" + r.KeyFile
+	}
+	return s
+}
+
+const depthModelPrefix = "QUINE_MODEL_ID_DEPTH_"
+
+// loadDepthModels reads QUINE_MODEL_ID_DEPTH_<n>, with the optional
+// QUINE_API_TYPE_DEPTH_<n>, QUINE_CONTEXT_WINDOW_DEPTH_<n>,
+// QUINE_API_BASE_DEPTH_<n>, QUINE_API_KEY_ENV_DEPTH_<n> and
+// QUINE_API_KEY_FILE_DEPTH_<n>, for every depth n >= 1 that has one.
+func (c *Config) loadDepthModels() (map[int]Route, error) {
+	routes := map[int]Route{}
+	for _, e := range os.Environ() {
+		key, model, _ := strings.Cut(e, "=")
+		suffix, ok := strings.CutPrefix(key, depthModelPrefix)
+		if !ok || model == "" {
+			continue
+		}
+		depth, err := strconv.Atoi(suffix)
+		if err != nil || depth < 1 {
+			return nil, fmt.Errorf("%s: want a depth of 1 or more (the root uses QUINE_MODEL_ID)", key)
+		}
+		r := Route{
+			ModelID:  model,
+			Provider: firstNonEmpty(os.Getenv("QUINE_API_TYPE_DEPTH_"+suffix), c.Provider),
+			APIBase:  os.Getenv("QUINE_API_BASE_DEPTH_" + suffix),
+			KeyEnv:   os.Getenv("QUINE_API_KEY_ENV_DEPTH_" + suffix),
+		}
+		if path := os.Getenv("QUINE_API_KEY_FILE_DEPTH_" + suffix); path != "" {
+			if r.KeyFile, err = filepath.Abs(path); err != nil {
+				return nil, fmt.Errorf("QUINE_API_KEY_FILE_DEPTH_%s: %w", suffix, err)
+			}
+		}
+		if r.ContextWindow, err = envInt("QUINE_CONTEXT_WINDOW_DEPTH_"+suffix, c.windowFor(model)); err != nil {
+			return nil, err
+		}
+		if err := c.checkRoute(r); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		if err := c.checkTools(key, model); err != nil {
+			return nil, err
+		}
+		routes[depth] = r
+	}
+	return routes, nil
+}
+
+// parseForkModels parses QUINE_FORK_MODELS: ";"-separated entries, each
+// either a bare model ID or comma-separated model=, type=,
+// context_window=, base=, key_env= and key_file= fields.
+func (c *Config) parseForkModels(spec string) ([]Route, error) {
+	var routes []Route
+	for i, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		n := i + 1
+		r := Route{Provider: c.Provider}
+		if !strings.Contains(entry, "=") {
+			entry = "model=" + entry
+		}
+		for _, field := range strings.Split(entry, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("QUINE_FORK_MODELS entry %d: %q is not name=value", n, field)
+			}
+			switch name {
+			case "model":
+				r.ModelID = value
+			case "type":
+				r.Provider = value
+			case "context_window":
+				w, err := strconv.Atoi(value)
+				if err != nil || w <= 0 {
+					return nil, fmt.Errorf("QUINE_FORK_MODELS entry %d: invalid context_window %q", n, value)
+				}
+				r.ContextWindow = w
+			case "base":
+				r.APIBase = value
+			case "key_env":
+				r.KeyEnv = value
+			case "key_file":
+				abs, err := filepath.Abs(value)
+				if err != nil {
+					return nil, fmt.Errorf("QUINE_FORK_MODELS entry %d: key_file: %w", n, err)
+				}
+				r.KeyFile = abs
+			default:
+				return nil, fmt.Errorf("QUINE_FORK_MODELS entry %d: unknown field %q (want model, type, context_window, base, key_env or key_file)", n, name)
+			}
+		}
+		if r.ModelID == "" {
+			return nil, fmt.Errorf("QUINE_FORK_MODELS entry %d: model is required", n)
+		}
+		if err := c.checkRoute(r); err != nil {
+			return nil, fmt.Errorf("QUINE_FORK_MODELS entry %d: %w", n, err)
+		}
+		if err := c.checkTools(fmt.Sprintf("QUINE_FORK_MODELS entry %d", n), r.ModelID); err != nil {
+			return nil, err
+		}
+		if r.ContextWindow == 0 {
+			r.ContextWindow = c.windowFor(r.ModelID)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// checkRoute rejects a route a child cannot run on: one to an unsupported
+// type, or to an API other than the tree's without a base and key of its
+// own, which the tree's credentials would be sent to.
+func (c *Config) checkRoute(r Route) error {
+	switch r.Provider {
+	case "openai", "openai-responses", "azure-openai", "anthropic", "gemini":
+	default:
+		return fmt.Errorf("unsupported type %q", r.Provider)
+	}
+	switch {
+	case r.KeyEnv != "" && r.KeyFile != "":
+		return fmt.Errorf("set at most one of key_env and key_file")
+	case r.keyed() && r.APIBase == "":
+		return fmt.Errorf("base is required with a key reference")
+	case !r.keyed() && r.Provider != c.Provider:
+		return fmt.Errorf("type %q is not the tree's (%s): name its base and key_env or key_file", r.Provider, c.Provider)
+	case !r.keyed() && r.APIBase != "":
+		return fmt.Errorf("base needs key_env or key_file")
+	}
+	return c.checkKeyEnv(r.KeyEnv)
+}
+
+// windowFor returns the context window of a model this process routes to
+// or fails over to: the registry's, else this process's own.
+func (c *Config) windowFor(modelID string) int {
+	if m, ok := c.Models.Lookup(modelID); ok && m.ContextWindow > 0 {
+		return m.ContextWindow
+	}
+	return c.ContextWindow
+}
+
+// checkTools rejects a model the registry says cannot call tools: every
+// action quine takes is a tool call.
+func (c *Config) checkTools(source, modelID string) error {
+	if m, ok := c.Models.Lookup(modelID); ok && !m.Tools {
+		return fmt.Errorf("%s: model %q does not support tool calling (see QUINE_MODELS_FILE)", source, modelID)
+	}
+	return nil
+}
+
+// ForkModelIDs lists the model IDs the fork tool may choose from.
+func (c *Config) ForkModelIDs() []string {
+	ids := make([]string, len(c.ForkModels))
+	for i, r := range c.ForkModels {
+		ids[i] = r.ModelID
+	}
+	return ids
+}
+
+// routeEnv returns the entries that pass the routing rules on, so every
+// process in the tree routes its children the same way.
+func (c *Config) routeEnv() []string {
+	depths := make([]int, 0, len(c.DepthModels))
+	for d := range c.DepthModels {
+		depths = append(depths, d)
+	}
+	sort.Ints(depths)
+
+	var env []string
+	for _, d := range depths {
+		r, n := c.DepthModels[d], strconv.Itoa(d)
+		env = append(env,
+			depthModelPrefix+n+"="+r.ModelID,
+			"QUINE_API_TYPE_DEPTH_"+n+"="+r.Provider,
+			"QUINE_CONTEXT_WINDOW_DEPTH_"+n+"="+strconv.Itoa(r.ContextWindow),
+			"QUINE_API_BASE_DEPTH_"+n+"="+r.APIBase,
+			"QUINE_API_KEY_ENV_DEPTH_"+n+"="+r.KeyEnv,
+			"QUINE_API_KEY_FILE_DEPTH_"+n+"="+r.KeyFile,
+		)
+	}
+	entries := make([]string, len(c.ForkModels))
+	for i, r := range c.ForkModels {
+		entries[i] = r.String()
+	}
+	return append(env, "QUINE_FORK_MODELS="+strings.Join(entries, ";"))
+}
+
+// overrideEnv replaces the entries of env whose keys appear in overrides,
+// appending those that are new.
+func overrideEnv(env, overrides []string) []string {
+	index := make(map[string]int, len(env))
+	for i, e := range env {
+		key, _, _ := strings.Cut(e, "=")
+		index[key] = i
+	}
+	for _, o := range overrides {
+		key, _, _ := strings.Cut(o, "=")
+		if i, ok := index[key]; ok {
+			env[i] = o
+		} else {
+			index[key] = len(env)
+			env = append(env, o)
+		}
+	}
+	return env
+}
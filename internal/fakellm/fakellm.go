@@ -0,0 +1,350 @@
+// Package fakellm is a scripted stand-in for an LLM API, for hermetic
+// end-to-end tests of the real quine binary (QUINE_API_BASE=http://...).
+//
+// A Server answers both OpenAI /v1/chat/completions and Anthropic
+// /v1/messages, streaming or not, with canned responses from a Script. Each
+// request is matched against the script's entries in order; the first entry
+// whose conditions all hold (and which has uses left) answers it:
+//
+//	{"responses": [
+//	  {"turn": 1, "tool_calls": [{"name": "sh", "arguments": {"command": "ls"}}]},
+//	  {"match": "\\[EXIT CODE\\] 0", "tool_calls": [{"name": "exit", "arguments": {"status": "success"}}]},
+//	  {"error": "rate_limit", "times": 1}
+//	]}
+//
+// Because matching only looks at the request, the server is stateless per
+// conversation: every process of a fork tree can share one server, and a
+// child is told apart by its system prompt ("system" condition).
+//
+// Besides replies, an entry can fail the request (429, 5xx, 401, context
+// overflow) or slow it down (delay before the response, delay between
+// streamed events, a mid-stream stall).
+package fakellm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Script is the set of canned responses a Server plays.
+type Script struct {
+	Responses []Response `json:"responses"`
+}
+
+// Response is one script entry: conditions, then either a reply or an error.
+type Response struct {
+	// Conditions. An entry applies when all the ones that are set hold.
+	Turn   int    `json:"turn,omitempty"`   // 1 + the number of assistant messages in the request
+	Match  string `json:"match,omitempty"`  // regexp on the text of the last message
+	System string `json:"system,omitempty"` // regexp on the system prompt
+	Times  int    `json:"times,omitempty"`  // uses before the entry is spent (0 = unlimited)
+
+	// Reply.
+	Text      string     `json:"text,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Usage     *Usage     `json:"usage,omitempty"` // default: estimated from the sizes
+
+	// Failure instead of a reply: "rate_limit" (429), "server_error" (500),
+	// "auth" (401) or "context_overflow" (400, worded as each API does).
+	Error      string `json:"error,omitempty"`
+	Status     int    `json:"status,omitempty"`      // overrides the error's HTTP status
+	RetryAfter int    `json:"retry_after,omitempty"` // Retry-After seconds, for rate_limit
+
+	// Timing.
+	DelayMs      int `json:"delay_ms,omitempty"`       // before the response starts
+	ChunkDelayMs int `json:"chunk_delay_ms,omitempty"` // between streamed events
+	StallMs      int `json:"stall_ms,omitempty"`       // pause after the first streamed event
+
+	match, system *regexp.Regexp
+}
+
+// ToolCall is a scripted tool call. IDs are generated.
+type ToolCall struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+}
+
+// Usage is the token usage reported for a reply.
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Error kinds.
+const (
+	ErrRateLimit       = "rate_limit"
+	ErrServer          = "server_error"
+	ErrAuth            = "auth"
+	ErrContextOverflow = "context_overflow"
+)
+
+// ParseScript parses and validates a JSON script.
+func ParseScript(data []byte) (*Script, error) {
+	var s Script
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing script: %w", err)
+	}
+	for i := range s.Responses {
+		r := &s.Responses[i]
+		var err error
+		if r.Match != "" {
+			if r.match, err = regexp.Compile(r.Match); err != nil {
+				return nil, fmt.Errorf("response %d: match: %w", i, err)
+			}
+		}
+		if r.System != "" {
+			if r.system, err = regexp.Compile(r.System); err != nil {
+				return nil, fmt.Errorf("response %d: system: %w", i, err)
+			}
+		}
+		switch r.Error {
+		case "", ErrRateLimit, ErrServer, ErrAuth, ErrContextOverflow:
+		default:
+			return nil, fmt.Errorf("response %d: unknown error %q", i, r.Error)
+		}
+	}
+	return &s, nil
+}
+
+// LoadScript reads a JSON script from path.
+func LoadScript(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScript(data)
+}
+
+// Request is what the server saw of one request, for test assertions.
+type Request struct {
+	API      string // "openai" or "anthropic"
+	Turn     int
+	Last     string // text of the last message
+	System   string
+	Stream   bool
+	Response int // index of the script entry that answered, -1 if none
+}
+
+// Server serves a Script over HTTP. It is safe for concurrent use.
+type Server struct {
+	script *Script
+
+	// OnRequest, if set, is called with each request once it is matched.
+	OnRequest func(Request)
+
+	mu       sync.Mutex
+	used     []int
+	requests []Request
+}
+
+// New returns a Server playing script.
+func New(script *Script) *Server {
+	return &Server{script: script, used: make([]int, len(script.Responses))}
+}
+
+// Requests returns the requests served so far, in arrival order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// ServeHTTP answers /v1/chat/completions and /v1/messages.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var api string
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/chat/completions"):
+		api = "openai"
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/messages"):
+		api = "anthropic"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := parseRequest(api, body)
+	if err != nil {
+		writeError(w, api, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	resp, idx := s.pick(req)
+	req.Response = idx
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+	if s.OnRequest != nil {
+		s.OnRequest(req)
+	}
+
+	// The message deliberately leaves out the request text: clients classify
+	// errors by words like "context" and "token" in it.
+	if resp == nil {
+		writeError(w, api, http.StatusBadRequest, "invalid_request_error",
+			fmt.Sprintf("fakellm: no scripted response for turn %d", req.Turn))
+		return
+	}
+
+	if !sleep(r, resp.DelayMs) {
+		return
+	}
+	if resp.Error != "" {
+		failRequest(w, api, resp)
+		return
+	}
+
+	usage := Usage{InputTokens: len(body)/4 + 1, OutputTokens: len(resp.Text)/4 + 1}
+	for _, tc := range resp.ToolCalls {
+		args, _ := json.Marshal(tc.Arguments)
+		usage.OutputTokens += len(args) / 4
+	}
+	if resp.Usage != nil {
+		usage = *resp.Usage
+	}
+
+	reply := reply{resp: resp, turn: req.Turn, usage: usage}
+	switch {
+	case api == "openai" && req.Stream:
+		reply.streamOpenAI(w, r)
+	case api == "openai":
+		reply.writeOpenAI(w)
+	case req.Stream:
+		reply.streamAnthropic(w, r)
+	default:
+		reply.writeAnthropic(w)
+	}
+}
+
+// pick returns the first applicable script entry and spends one of its uses.
+func (s *Server) pick(req Request) (*Response, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.script.Responses {
+		resp := &s.script.Responses[i]
+		if resp.Times > 0 && s.used[i] >= resp.Times {
+			continue
+		}
+		if resp.Turn > 0 && resp.Turn != req.Turn {
+			continue
+		}
+		if resp.match != nil && !resp.match.MatchString(req.Last) {
+			continue
+		}
+		if resp.system != nil && !resp.system.MatchString(req.System) {
+			continue
+		}
+		s.used[i]++
+		return resp, i
+	}
+	return nil, -1
+}
+
+// failRequest answers with the entry's scripted error.
+func failRequest(w http.ResponseWriter, api string, resp *Response) {
+	status, errType, msg := 0, "", ""
+	switch resp.Error {
+	case ErrRateLimit:
+		status, errType, msg = http.StatusTooManyRequests, "rate_limit_error", "fakellm: rate limited"
+		if resp.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(resp.RetryAfter))
+		}
+	case ErrServer:
+		status, errType, msg = http.StatusInternalServerError, "api_error", "fakellm: internal server error"
+	case ErrAuth:
+		status, errType, msg = http.StatusUnauthorized, "authentication_error", "fakellm: invalid API key"
+	case ErrContextOverflow:
+		status, errType = http.StatusBadRequest, "invalid_request_error"
+		msg = "input length and max_tokens exceed context limit"
+		if api == "openai" {
+			errType = "context_length_exceeded"
+			msg = "This model's maximum context length is 8192 tokens. However, your messages resulted in 9000 tokens."
+		}
+	}
+	if resp.Status != 0 {
+		status = resp.Status
+	}
+	writeError(w, api, status, errType, msg)
+}
+
+// sleep waits ms milliseconds unless the client goes away first.
+func sleep(r *http.Request, ms int) bool {
+	if ms <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// parseRequest extracts what the script matches on from either API's body.
+func parseRequest(api string, body []byte) (Request, error) {
+	var raw struct {
+		System   json.RawMessage `json:"system"`
+		Stream   bool            `json:"stream"`
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return Request{}, err
+	}
+
+	req := Request{API: api, Stream: raw.Stream, Turn: 1, System: contentText(raw.System)}
+	for i, m := range raw.Messages {
+		switch m.Role {
+		case "assistant":
+			req.Turn++
+		case "system":
+			req.System = contentText(m.Content)
+		}
+		if i == len(raw.Messages)-1 {
+			req.Last = contentText(m.Content)
+		}
+	}
+	return req, nil
+}
+
+// contentText flattens message content: a string, or an array of blocks
+// whose text (and nested tool_result content) is joined by newlines.
+func contentText(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var blocks []struct {
+		Text    string          `json:"text"`
+		Content json.RawMessage `json:"content"`
+	}
+	if json.Unmarshal(raw, &blocks) != nil {
+		return ""
+	}
+	var parts []string
+	for _, b := range blocks {
+		if b.Text != "" {
+			parts = append(parts, b.Text)
+		}
+		if t := contentText(b.Content); t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,202 @@
+package fakellm
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/llm"
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// serve starts a Server for the JSON script.
+func serve(t *testing.T, script string) (*Server, *httptest.Server) {
+	t.Helper()
+	s, err := ParseScript([]byte(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(s)
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return server, ts
+}
+
+// provider returns a real llm.Provider pointed at ts.
+func provider(t *testing.T, ts *httptest.Server, api string, stream bool) llm.Provider {
+	t.Helper()
+	p, err := llm.NewProvider(&config.Config{
+		Provider:          api,
+		APIKey:            "test-key",
+		APIBase:           ts.URL,
+		ModelID:           "fake-model",
+		ContextWindow:     100_000,
+		Stream:            stream,
+		StreamIdleTimeout: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func conversation(turns int) []tape.Message {
+	msgs := []tape.Message{
+		{Role: tape.RoleSystem, Content: "You are a test agent.\n### Your Mission\ncount files\n"},
+		{Role: tape.RoleUser, Content: "begin"},
+	}
+	for i := 1; i < turns; i++ {
+		id := "call_" + string(rune('0'+i))
+		msgs = append(msgs,
+			tape.Message{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: id, Name: "sh", Arguments: map[string]any{"command": "ls"}}}},
+			tape.Message{Role: tape.RoleToolResult, ToolID: id, Content: "[EXIT CODE] 0\n[STDOUT]\na b c"},
+		)
+	}
+	return msgs
+}
+
+func TestProviderRoundTrip(t *testing.T) {
+	_, ts := serve(t, `{"responses": [
+		{"turn": 1, "text": "listing the files", "tool_calls": [{"name": "sh", "arguments": {"command": "ls -1 | wc -l"}}]},
+		{"turn": 2, "tool_calls": [{"name": "exit", "arguments": {"status": "success", "output": "3"}}], "usage": {"input_tokens": 42, "output_tokens": 7}}
+	]}`)
+
+	for _, api := range []string{"openai", "anthropic"} {
+		for _, stream := range []bool{false, true} {
+			p := provider(t, ts, api, stream)
+
+			msg, _, err := p.Generate(conversation(1), nil)
+			if err != nil {
+				t.Fatalf("%s stream=%v turn 1: %v", api, stream, err)
+			}
+			if msg.Content != "listing the files" || len(msg.ToolCalls) != 1 {
+				t.Fatalf("%s stream=%v turn 1 = %+v", api, stream, msg)
+			}
+			tc := msg.ToolCalls[0]
+			if tc.ID != "call_1_0" || tc.Name != "sh" || tc.Arguments["command"] != "ls -1 | wc -l" {
+				t.Errorf("%s stream=%v tool call = %+v", api, stream, tc)
+			}
+
+			msg, usage, err := p.Generate(conversation(2), nil)
+			if err != nil {
+				t.Fatalf("%s stream=%v turn 2: %v", api, stream, err)
+			}
+			if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Name != "exit" || msg.ToolCalls[0].Arguments["output"] != "3" {
+				t.Errorf("%s stream=%v turn 2 = %+v", api, stream, msg)
+			}
+			if usage.InputTokens != 42 || usage.OutputTokens != 7 {
+				t.Errorf("%s stream=%v usage = %+v", api, stream, usage)
+			}
+		}
+	}
+}
+
+func TestMatching(t *testing.T) {
+	server, ts := serve(t, `{"responses": [
+		{"system": "(?m)^write a poem$", "text": "child"},
+		{"match": "a b c", "times": 1, "text": "saw files"},
+		{"turn": 2, "text": "turn two"},
+		{"text": "fallback"}
+	]}`)
+	p := provider(t, ts, "anthropic", false)
+
+	want := []string{"saw files", "turn two", "fallback"}
+	msgs := [][]tape.Message{conversation(2), conversation(2), conversation(1)}
+	for i, m := range msgs {
+		got, _, err := p.Generate(m, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Content != want[i] {
+			t.Errorf("request %d = %q, want %q", i, got.Content, want[i])
+		}
+	}
+
+	child := []tape.Message{{Role: tape.RoleSystem, Content: "### Your Mission\nwrite a poem\n"}, {Role: tape.RoleUser, Content: "go"}}
+	if got, _, err := p.Generate(child, nil); err != nil || got.Content != "child" {
+		t.Errorf("system match = %q, %v", got.Content, err)
+	}
+
+	reqs := server.Requests()
+	if len(reqs) != 4 || reqs[0].Turn != 2 || reqs[0].Response != 1 || reqs[3].Response != 0 {
+		t.Errorf("requests = %+v", reqs)
+	}
+}
+
+func TestErrorsClassified(t *testing.T) {
+	_, ts := serve(t, `{"responses": [
+		{"system": "auth", "error": "auth"},
+		{"error": "context_overflow"}
+	]}`)
+	for _, api := range []string{"openai", "anthropic"} {
+		p := provider(t, ts, api, false)
+		_, _, err := p.Generate([]tape.Message{{Role: tape.RoleSystem, Content: "auth"}, {Role: tape.RoleUser, Content: "x"}}, nil)
+		if !errors.Is(err, llm.ErrAuth) {
+			t.Errorf("%s auth: err = %v", api, err)
+		}
+		_, _, err = p.Generate(conversation(1), nil)
+		if !errors.Is(err, llm.ErrContextOverflow) {
+			t.Errorf("%s overflow: err = %v", api, err)
+		}
+	}
+}
+
+func TestRateLimitThenReply(t *testing.T) {
+	server, ts := serve(t, `{"responses": [
+		{"error": "rate_limit", "retry_after": 1, "times": 1},
+		{"text": "ok"}
+	]}`)
+	resp, err := http.Post(ts.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"messages": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("status = %d, Retry-After = %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	msg, _, err := provider(t, ts, "openai", false).Generate(conversation(1), nil)
+	if err != nil || msg.Content != "ok" {
+		t.Errorf("after rate limit: %+v, %v", msg, err)
+	}
+	if n := len(server.Requests()); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+}
+
+func TestUnscriptedRequest(t *testing.T) {
+	_, ts := serve(t, `{"responses": [{"turn": 5, "text": "late"}]}`)
+	_, _, err := provider(t, ts, "anthropic", false).Generate(conversation(1), nil)
+	if err == nil || !strings.Contains(err.Error(), "no scripted response for turn 1") {
+		t.Errorf("err = %v", err)
+	}
+	if errors.Is(err, llm.ErrContextOverflow) {
+		t.Error("unscripted request classified as context overflow")
+	}
+}
+
+func TestStreamStall(t *testing.T) {
+	server, ts := serve(t, `{"responses": [{"text": "too slow", "stall_ms": 3000}]}`)
+	_, _, err := provider(t, ts, "anthropic", true).Generate(conversation(1), nil)
+	if !errors.Is(err, llm.ErrStreamStalled) {
+		t.Errorf("err = %v, want ErrStreamStalled", err)
+	}
+	if n := len(server.Requests()); n < 2 {
+		t.Errorf("stalled stream retried %d times", n-1)
+	}
+}
+
+func TestParseScriptRejects(t *testing.T) {
+	for _, bad := range []string{
+		`{"responses": [{"match": "("}]}`,
+		`{"responses": [{"error": "teapot"}]}`,
+		`{"responses": `,
+	} {
+		if _, err := ParseScript([]byte(bad)); err == nil {
+			t.Errorf("ParseScript(%s) should fail", bad)
+		}
+	}
+}
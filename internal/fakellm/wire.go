@@ -0,0 +1,262 @@
+package fakellm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reply renders one scripted reply in either API's wire format.
+type reply struct {
+	resp  *Response
+	turn  int
+	usage Usage
+}
+
+func (rp reply) toolID(i int) string {
+	return fmt.Sprintf("call_%d_%d", rp.turn, i)
+}
+
+func (rp reply) stopReason(api string) string {
+	switch {
+	case api == "openai" && len(rp.resp.ToolCalls) > 0:
+		return "tool_calls"
+	case api == "openai":
+		return "stop"
+	case len(rp.resp.ToolCalls) > 0:
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+func arguments(tc ToolCall) string {
+	if tc.Arguments == nil {
+		return "{}"
+	}
+	data, _ := json.Marshal(tc.Arguments)
+	return string(data)
+}
+
+// ---------------------------------------------------------------------------
+// Non-streaming
+// ---------------------------------------------------------------------------
+
+func (rp reply) writeOpenAI(w http.ResponseWriter) {
+	var calls []map[string]any
+	for i, tc := range rp.resp.ToolCalls {
+		calls = append(calls, map[string]any{
+			"id":       rp.toolID(i),
+			"type":     "function",
+			"function": map[string]any{"name": tc.Name, "arguments": arguments(tc)},
+		})
+	}
+	message := map[string]any{"role": "assistant", "content": rp.resp.Text}
+	if calls != nil {
+		message["tool_calls"] = calls
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":      fmt.Sprintf("chatcmpl-fake-%d", rp.turn),
+		"object":  "chat.completion",
+		"choices": []any{map[string]any{"index": 0, "message": message, "finish_reason": rp.stopReason("openai")}},
+		"usage":   map[string]any{"prompt_tokens": rp.usage.InputTokens, "completion_tokens": rp.usage.OutputTokens},
+	})
+}
+
+func (rp reply) writeAnthropic(w http.ResponseWriter) {
+	content := []any{}
+	if rp.resp.Text != "" {
+		content = append(content, map[string]any{"type": "text", "text": rp.resp.Text})
+	}
+	for i, tc := range rp.resp.ToolCalls {
+		content = append(content, map[string]any{
+			"type":  "tool_use",
+			"id":    rp.toolID(i),
+			"name":  tc.Name,
+			"input": json.RawMessage(arguments(tc)),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":          fmt.Sprintf("msg_fake_%d", rp.turn),
+		"type":        "message",
+		"role":        "assistant",
+		"content":     content,
+		"stop_reason": rp.stopReason("anthropic"),
+		"usage":       map[string]any{"input_tokens": rp.usage.InputTokens, "output_tokens": rp.usage.OutputTokens},
+	})
+}
+
+// ---------------------------------------------------------------------------
+// Streaming (SSE)
+// ---------------------------------------------------------------------------
+
+// stream writes SSE events, pacing them by the entry's chunk delay and
+// stalling after the first one. It stops when the client goes away.
+type stream struct {
+	w     http.ResponseWriter
+	r     *http.Request
+	resp  *Response
+	sent  int
+	alive bool
+}
+
+func newStream(w http.ResponseWriter, r *http.Request, resp *Response) *stream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return &stream{w: w, r: r, resp: resp, alive: true}
+}
+
+func (s *stream) send(event string, payload any) {
+	if !s.alive {
+		return
+	}
+	if s.sent > 0 {
+		delay := s.resp.ChunkDelayMs
+		if s.sent == 1 {
+			delay += s.resp.StallMs
+		}
+		if !sleep(s.r, delay) {
+			s.alive = false
+			return
+		}
+	}
+	data, ok := payload.(string)
+	if !ok {
+		raw, _ := json.Marshal(payload)
+		data = string(raw)
+	}
+	if event != "" {
+		fmt.Fprintf(s.w, "event: %s\n", event)
+	}
+	fmt.Fprintf(s.w, "data: %s\n\n", data)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	s.sent++
+}
+
+// words splits text into streaming chunks that concatenate back to it.
+func words(text string) []string {
+	var out []string
+	for text != "" {
+		i := strings.IndexByte(text[1:], ' ')
+		if i < 0 {
+			out = append(out, text)
+			break
+		}
+		out = append(out, text[:i+1])
+		text = text[i+1:]
+	}
+	return out
+}
+
+// halves splits tool arguments in two, so clients must reassemble them.
+func halves(args string) []string {
+	mid := len(args) / 2
+	return []string{args[:mid], args[mid:]}
+}
+
+func (rp reply) streamOpenAI(w http.ResponseWriter, r *http.Request) {
+	s := newStream(w, r, rp.resp)
+	chunk := func(delta map[string]any, finish any) map[string]any {
+		return map[string]any{
+			"id":      fmt.Sprintf("chatcmpl-fake-%d", rp.turn),
+			"object":  "chat.completion.chunk",
+			"choices": []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finish}},
+		}
+	}
+
+	s.send("", chunk(map[string]any{"role": "assistant", "content": ""}, nil))
+	for _, word := range words(rp.resp.Text) {
+		s.send("", chunk(map[string]any{"content": word}, nil))
+	}
+	for i, tc := range rp.resp.ToolCalls {
+		for j, part := range halves(arguments(tc)) {
+			call := map[string]any{"index": i, "function": map[string]any{"arguments": part}}
+			if j == 0 {
+				call["id"] = rp.toolID(i)
+				call["type"] = "function"
+				call["function"].(map[string]any)["name"] = tc.Name
+			}
+			s.send("", chunk(map[string]any{"tool_calls": []any{call}}, nil))
+		}
+	}
+	s.send("", chunk(map[string]any{}, rp.stopReason("openai")))
+	s.send("", map[string]any{
+		"choices": []any{},
+		"usage":   map[string]any{"prompt_tokens": rp.usage.InputTokens, "completion_tokens": rp.usage.OutputTokens},
+	})
+	s.send("", "[DONE]")
+}
+
+func (rp reply) streamAnthropic(w http.ResponseWriter, r *http.Request) {
+	s := newStream(w, r, rp.resp)
+	s.send("message_start", map[string]any{
+		"type": "message_start",
+		"message": map[string]any{
+			"id": fmt.Sprintf("msg_fake_%d", rp.turn), "type": "message", "role": "assistant", "content": []any{},
+			"usage": map[string]any{"input_tokens": rp.usage.InputTokens, "output_tokens": 1},
+		},
+	})
+
+	index := 0
+	block := func(start map[string]any, deltas []map[string]any) {
+		s.send("content_block_start", map[string]any{"type": "content_block_start", "index": index, "content_block": start})
+		for _, d := range deltas {
+			s.send("content_block_delta", map[string]any{"type": "content_block_delta", "index": index, "delta": d})
+		}
+		s.send("content_block_stop", map[string]any{"type": "content_block_stop", "index": index})
+		index++
+	}
+	if rp.resp.Text != "" {
+		var deltas []map[string]any
+		for _, word := range words(rp.resp.Text) {
+			deltas = append(deltas, map[string]any{"type": "text_delta", "text": word})
+		}
+		block(map[string]any{"type": "text", "text": ""}, deltas)
+	}
+	for i, tc := range rp.resp.ToolCalls {
+		var deltas []map[string]any
+		for _, part := range halves(arguments(tc)) {
+			deltas = append(deltas, map[string]any{"type": "input_json_delta", "partial_json": part})
+		}
+		block(map[string]any{"type": "tool_use", "id": rp.toolID(i), "name": tc.Name, "input": map[string]any{}}, deltas)
+	}
+
+	s.send("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": rp.stopReason("anthropic")},
+		"usage": map[string]any{"output_tokens": rp.usage.OutputTokens},
+	})
+	s.send("message_stop", map[string]any{"type": "message_stop"})
+}
+
+// ---------------------------------------------------------------------------
+// Errors
+// ---------------------------------------------------------------------------
+
+// writeError writes an error body shaped like the API's own.
+func writeError(w http.ResponseWriter, api string, status int, errType, msg string) {
+	if api == "openai" {
+		code := any(nil)
+		if errType == "context_length_exceeded" {
+			code, errType = errType, "invalid_request_error"
+		}
+		writeJSON(w, status, map[string]any{
+			"error": map[string]any{"message": msg, "type": errType, "code": code},
+		})
+		return
+	}
+	writeJSON(w, status, map[string]any{
+		"type":  "error",
+		"error": map[string]any{"type": errType, "message": msg},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
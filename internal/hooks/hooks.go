@@ -0,0 +1,207 @@
+// Package hooks runs policy executables around tool calls.
+//
+// Every executable in QUINE_HOOKS_DIR whose name starts with "pre-" runs
+// before each sh, fork and exec call, and every "post-" executable runs
+// after it, in lexical order. Hooks speak the Unix API: JSON on stdin, a
+// verdict in the exit code, details on stdout.
+//
+// Pre hooks receive the tape.ToolCall and exit with:
+//
+//	0 (ExitAllow)    run the call as is
+//	1 (ExitDeny)     refuse it; stdout (or stderr) is the reason given to the agent
+//	2 (ExitRewrite)  replace the arguments with the JSON object on stdout
+//
+// Any other exit code, a timeout, or a hook that cannot be started denies
+// the call: a broken policy fails closed. A rewrite is seen by later hooks.
+//
+// Post hooks receive {"tool_call": ..., "result": ...} and are
+// observe-only (audit, alerting); their exit code is reported, not enforced.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// Exit codes of a pre hook.
+const (
+	ExitAllow   = 0
+	ExitDeny    = 1
+	ExitRewrite = 2
+)
+
+// Timeout bounds a single hook run.
+const Timeout = 10 * time.Second
+
+// Runner runs the hooks found in one directory.
+type Runner struct {
+	Dir     string
+	Timeout time.Duration
+	Env     []string // overlaid on os.Environ, e.g. to clear credentials
+}
+
+// New returns a Runner for dir, or nil if dir is empty (hooks disabled).
+func New(dir string) *Runner {
+	if dir == "" {
+		return nil
+	}
+	return &Runner{Dir: dir, Timeout: Timeout}
+}
+
+// Verdict is the combined outcome of the pre hooks for one call.
+type Verdict struct {
+	Call      tape.ToolCall // the call to run, possibly rewritten
+	Denied    bool
+	Hook      string // the hook that denied the call
+	Reason    string // why it was denied
+	Rewritten []string
+}
+
+// Pre runs the pre hooks for tc. A nil Runner allows everything.
+func (r *Runner) Pre(tc tape.ToolCall) Verdict {
+	v := Verdict{Call: tc}
+	if r == nil {
+		return v
+	}
+
+	hooks, err := r.list("pre-")
+	if err != nil {
+		v.Denied, v.Hook, v.Reason = true, r.Dir, err.Error()
+		return v
+	}
+
+	for _, path := range hooks {
+		name := filepath.Base(path)
+		input, _ := json.Marshal(v.Call)
+		code, stdout, stderr, err := r.run(path, "pre", v.Call.Name, input)
+		if err != nil {
+			v.Denied, v.Hook, v.Reason = true, name, err.Error()
+			return v
+		}
+
+		switch code {
+		case ExitAllow:
+		case ExitRewrite:
+			var args map[string]any
+			if err := json.Unmarshal(stdout, &args); err != nil || args == nil {
+				v.Denied, v.Hook, v.Reason = true, name, fmt.Sprintf("invalid rewrite (want a JSON object of arguments): %s", strings.TrimSpace(string(stdout)))
+				return v
+			}
+			v.Call.Arguments = args
+			v.Rewritten = append(v.Rewritten, name)
+		default:
+			reason := strings.TrimSpace(string(stdout))
+			if reason == "" {
+				reason = strings.TrimSpace(string(stderr))
+			}
+			if code != ExitDeny {
+				reason = fmt.Sprintf("hook failed (exit %d): %s", code, reason)
+			}
+			if reason == "" {
+				reason = "denied by policy"
+			}
+			v.Denied, v.Hook, v.Reason = true, name, reason
+			return v
+		}
+	}
+	return v
+}
+
+// Post runs the post hooks for a completed call and returns one error per
+// hook that failed or exited non-zero. A nil Runner does nothing.
+func (r *Runner) Post(tc tape.ToolCall, result tape.ToolResult) []error {
+	if r == nil {
+		return nil
+	}
+	hooks, err := r.list("post-")
+	if err != nil {
+		return []error{err}
+	}
+
+	input, _ := json.Marshal(struct {
+		ToolCall tape.ToolCall   `json:"tool_call"`
+		Result   tape.ToolResult `json:"result"`
+	}{tc, result})
+
+	var errs []error
+	for _, path := range hooks {
+		code, _, stderr, err := r.run(path, "post", tc.Name, input)
+		if err == nil && code != 0 {
+			err = fmt.Errorf("exit %d: %s", code, strings.TrimSpace(string(stderr)))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(path), err))
+		}
+	}
+	return errs
+}
+
+// list returns the executables in r.Dir whose names start with prefix,
+// sorted by name.
+func (r *Runner) list(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading hooks dir: %w", err)
+	}
+	var out []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+		out = append(out, filepath.Join(r.Dir, e.Name()))
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// run executes one hook with input on stdin. err is only set when the hook
+// could not run to completion (start failure, timeout, signal).
+func (r *Runner) run(path, phase, tool string, input []byte) (code int, stdout, stderr []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = r.Dir
+	cmd.Env = append(append(os.Environ(), r.Env...), "QUINE_HOOK_PHASE="+phase, "QUINE_HOOK_TOOL="+tool)
+	cmd.Stdin = bytes.NewReader(input)
+	// Kill the whole process group on timeout, so a grandchild holding
+	// stdout open cannot keep the hook alive.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	runErr := cmd.Run()
+	if ctx.Err() != nil {
+		return -1, nil, nil, fmt.Errorf("hook timed out after %s", r.Timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		if exitErr.ExitCode() < 0 {
+			return -1, nil, nil, fmt.Errorf("hook killed: %v", runErr)
+		}
+		return exitErr.ExitCode(), outBuf.Bytes(), errBuf.Bytes(), nil
+	}
+	if runErr != nil {
+		return -1, nil, nil, fmt.Errorf("running hook: %w", runErr)
+	}
+	return 0, outBuf.Bytes(), errBuf.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package llm
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// FailoverProvider tries a chain of providers in order (QUINE_FALLBACK).
+// A transient failure of the active one, once its own retries are spent,
+// moves the session to the next. The switch is sticky: later calls stay on
+// the fallback until the cooldown has passed, and only then is the
+// primary tried again. Failures a different model would hit just the same
+// (a bad request, a full context) are returned without failing over.
+type FailoverProvider struct {
+	providers []Provider
+	models    []string // model ID of each provider, recorded on its replies
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	active   int       // index of the provider calls go to first
+	switched time.Time // when active last moved off the primary
+}
+
+// NewFailoverProvider chains providers, the primary first. models[i] is
+// the model ID providers[i] talks to.
+func NewFailoverProvider(providers []Provider, models []string, cooldown time.Duration) *FailoverProvider {
+	return &FailoverProvider{
+		providers: providers,
+		models:    models,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Generate calls the active provider, failing over down the chain on
+// transient errors. The reply's Model names the model that produced it.
+func (f *FailoverProvider) Generate(messages []tape.Message, tools []ToolSchema) (tape.Message, Usage, error) {
+	var lastErr error
+	for i := f.start(); i < len(f.providers); i++ {
+		msg, usage, err := f.providers[i].Generate(messages, tools)
+		if err == nil {
+			msg.Model = f.models[i]
+			return msg, usage, nil
+		}
+		lastErr = err
+		if !isTransient(err) {
+			return tape.Message{}, usage, err
+		}
+		if i+1 < len(f.providers) {
+			logf("model %s failing (%v), failing over to %s", f.models[i], err, f.models[i+1])
+			f.setActive(i + 1)
+		}
+	}
+	return tape.Message{}, Usage{}, lastErr
+}
+
+// start returns the index to try first: the active provider, or the
+// primary again once the cooldown since the last switch has passed.
+func (f *FailoverProvider) start() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active > 0 && f.now().Sub(f.switched) >= f.cooldown {
+		logf("fallback cooldown over, trying %s again", f.models[0])
+		f.active = 0
+	}
+	return f.active
+}
+
+func (f *FailoverProvider) setActive(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.active = i
+	f.switched = f.now()
+}
+
+// Active returns the model ID calls currently go to first.
+func (f *FailoverProvider) Active() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.models[f.active]
+}
+
+// ContextWindowSize returns the active provider's context window.
+func (f *FailoverProvider) ContextWindowSize() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.providers[f.active].ContextWindowSize()
+}
+
+// SetLimiter installs the tree-wide Limiter on the primary only: it tracks
+// the primary's rate limits, and a 429 there must not pause the fallbacks
+// meant to take over.
+func (f *FailoverProvider) SetLimiter(l Limiter) {
+	if lp, ok := f.providers[0].(interface{ SetLimiter(Limiter) }); ok {
+		lp.SetLimiter(l)
+	}
+}
+
+// isTransient reports whether err is a failure of the provider rather
+// than of the request: rate limits, overload, server errors, stalled or
+// truncated streams and network errors.
+func isTransient(err error) bool {
+	var urlErr *url.Error
+	return errors.Is(err, ErrRateLimit) || errors.Is(err, ErrOverloaded) || errors.Is(err, ErrServer) ||
+		errors.Is(err, ErrStreamStalled) || errors.Is(err, ErrStreamTruncated) || errors.As(err, &urlErr)
+}
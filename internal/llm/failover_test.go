@@ -0,0 +1,91 @@
+package llm
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/tape"
+)
+
+func TestFailoverProvider(t *testing.T) {
+	var primaryCalls, fallbackCalls atomic.Int32
+	var primaryStatus atomic.Int32
+	primaryStatus.Store(529)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls.Add(1)
+		switch status := int(primaryStatus.Load()); status {
+		case 529:
+			w.WriteHeader(status)
+			io.WriteString(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+			return
+		case 400:
+			w.WriteHeader(status)
+			io.WriteString(w, `{"type":"error","error":{"type":"invalid_request_error","message":"messages: field required"}}`)
+			return
+		}
+		io.WriteString(w, `{"content":[{"type":"text","text":"primary"}],"usage":{"input_tokens":1,"output_tokens":1},"stop_reason":"end_turn"}`)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackCalls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer sk-fallback" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"fallback"}}],"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+	}))
+	defer fallback.Close()
+
+	t.Setenv("TEST_FALLBACK_KEY", "sk-fallback")
+	p, err := NewProvider(&config.Config{
+		Provider:         "anthropic",
+		APIBase:          primary.URL,
+		ModelID:          "claude-sonnet-4-5",
+		APIKey:           "sk-primary",
+		Fallback:         []config.Fallback{{Provider: "openai", ModelID: "gpt-4o", APIBase: fallback.URL, KeyEnv: "TEST_FALLBACK_KEY"}},
+		FallbackCooldown: 300,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := p.(*FailoverProvider)
+	if !ok {
+		t.Fatalf("NewProvider = %T, want *FailoverProvider", p)
+	}
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	msgs := []tape.Message{{Role: tape.RoleUser, Content: "hi"}}
+	msg, _, err := f.Generate(msgs, nil)
+	if err != nil || msg.Content != "fallback" || msg.Model != "gpt-4o" {
+		t.Fatalf("Generate = %+v, %v; want the fallback's reply recorded as gpt-4o", msg, err)
+	}
+
+	// Sticky: the next call goes straight to the fallback, even though the
+	// primary has recovered.
+	primaryStatus.Store(200)
+	f.Generate(msgs, nil)
+	if primaryCalls.Load() != 1 || fallbackCalls.Load() != 2 {
+		t.Errorf("primary %d, fallback %d calls; want 1 and 2", primaryCalls.Load(), fallbackCalls.Load())
+	}
+
+	// After the cooldown the primary is tried again.
+	now = now.Add(301 * time.Second)
+	msg, _, err = f.Generate(msgs, nil)
+	if err != nil || msg.Model != "claude-sonnet-4-5" || f.Active() != "claude-sonnet-4-5" {
+		t.Errorf("Generate after cooldown = %+v, %v; want the primary", msg, err)
+	}
+
+	// A request the API rejects is not the provider's fault: no failover.
+	primaryStatus.Store(400)
+	fallbackCalls.Store(0)
+	if _, _, err := f.Generate(msgs, nil); !errors.Is(err, ErrInvalidRequest) || fallbackCalls.Load() != 0 {
+		t.Errorf("Generate = %v with %d fallback calls, want the invalid request error and none", err, fallbackCalls.Load())
+	}
+}
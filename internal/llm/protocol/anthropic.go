@@ -12,7 +12,14 @@ import (
 const anthropicVersion = "2023-06-01"
 
 // AnthropicProtocol implements Protocol for Anthropic's Messages API.
-type AnthropicProtocol struct{}
+//
+// With a ThinkingBudget, requests enable extended thinking. The signed
+// thinking (and redacted_thinking) blocks of each reply are kept on the tape
+// as the message's ReasoningItems and sent back verbatim on later turns,
+// which the API requires for thinking to continue across tool calls.
+type AnthropicProtocol struct {
+	ThinkingBudget int // QUINE_THINKING_BUDGET; 0 = thinking off
+}
 
 // ---------------------------------------------------------------------------
 // API request/response types
@@ -21,9 +28,16 @@ type AnthropicProtocol struct{}
 type anthropicRequest struct {
 	Model     string             `json:"model"`
 	MaxTokens int                `json:"max_tokens"`
-	System    string             `json:"system,omitempty"`
+	System    []contentBlock     `json:"system,omitempty"`
 	Messages  []anthropicMessage `json:"messages"`
 	Tools     []anthropicTool    `json:"tools,omitempty"`
+	Thinking  *anthropicThinking `json:"thinking,omitempty"`
+	Stream    bool               `json:"stream,omitempty"`
+}
+
+type anthropicThinking struct {
+	Type         string `json:"type"` // "enabled"
+	BudgetTokens int    `json:"budget_tokens"`
 }
 
 type anthropicMessage struct {
@@ -39,6 +53,18 @@ type contentBlock struct {
 	Input     map[string]any `json:"input,omitempty"`
 	ToolUseID string         `json:"tool_use_id,omitempty"`
 	Content   string         `json:"content,omitempty"`
+
+	// thinking and redacted_thinking blocks.
+	Thinking  *string `json:"thinking,omitempty"`
+	Signature string  `json:"signature,omitempty"`
+	Data      string  `json:"data,omitempty"`
+
+	CacheControl *cacheControl `json:"cache_control,omitempty"`
+}
+
+// cacheControl marks the end of a prompt prefix for Anthropic to cache.
+type cacheControl struct {
+	Type string `json:"type"` // "ephemeral"
 }
 
 func strPtr(s string) *string { return &s }
@@ -51,17 +77,36 @@ type anthropicTool struct {
 
 type anthropicResponse struct {
 	Content []struct {
-		Type  string         `json:"type"`
-		Text  string         `json:"text,omitempty"`
-		ID    string         `json:"id,omitempty"`
-		Name  string         `json:"name,omitempty"`
-		Input map[string]any `json:"input,omitempty"`
+		Type      string         `json:"type"`
+		Text      string         `json:"text,omitempty"`
+		ID        string         `json:"id,omitempty"`
+		Name      string         `json:"name,omitempty"`
+		Input     map[string]any `json:"input,omitempty"`
+		Thinking  string         `json:"thinking,omitempty"`
+		Signature string         `json:"signature,omitempty"`
+		Data      string         `json:"data,omitempty"`
 	} `json:"content"`
-	Usage struct {
-		InputTokens  int `json:"input_tokens"`
-		OutputTokens int `json:"output_tokens"`
-	} `json:"usage"`
-	StopReason string `json:"stop_reason"`
+	Usage      anthropicUsage `json:"usage"`
+	StopReason string         `json:"stop_reason"`
+}
+
+// anthropicUsage reports input_tokens net of the prompt cache: the tokens
+// written to and read from it are counted separately.
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// usage converts to Usage, whose InputTokens is the whole prompt.
+func (u anthropicUsage) usage() Usage {
+	return Usage{
+		InputTokens:      u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens,
+		OutputTokens:     u.OutputTokens,
+		CacheWriteTokens: u.CacheCreationInputTokens,
+		CacheReadTokens:  u.CacheReadInputTokens,
+	}
 }
 
 type anthropicError struct {
@@ -84,18 +129,111 @@ func (p *AnthropicProtocol) EndpointPath() string {
 }
 
 func (p *AnthropicProtocol) EncodeRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
-	system, apiMsgs := convertAnthropicMessages(messages)
-	apiTools := convertAnthropicTools(tools)
+	return json.Marshal(p.buildRequest(messages, tools, model, maxTokens))
+}
+
+func (p *AnthropicProtocol) EncodeStreamRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
+	req := p.buildRequest(messages, tools, model, maxTokens)
+	req.Stream = true
+	return json.Marshal(req)
+}
 
+func (p *AnthropicProtocol) buildRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) anthropicRequest {
+	// With thinking on, the assistant turn in progress must open with a
+	// thinking block. A tape whose turn opened without one (thinking just
+	// turned on, or the history came from elsewhere) is continued without
+	// thinking rather than rejected.
+	thinking := p.ThinkingBudget > 0 && turnOpenedThinking(messages)
+	system, apiMsgs := convertAnthropicMessages(messages, thinking)
 	req := anthropicRequest{
 		Model:     model,
 		MaxTokens: maxTokens,
-		System:    system,
 		Messages:  apiMsgs,
-		Tools:     apiTools,
+		Tools:     convertAnthropicTools(tools),
+	}
+	if thinking {
+		// Thinking counts against max_tokens; the budget comes on top so
+		// the reply itself keeps its usual room.
+		req.MaxTokens += p.ThinkingBudget
+		req.Thinking = &anthropicThinking{Type: "enabled", BudgetTokens: p.ThinkingBudget}
+	}
+	// Two cache breakpoints: the system prompt (with the tools before it),
+	// which never changes, and the end of the history, so the next turn
+	// reads everything up to here from the cache and pays full price only
+	// for what it appends. Prefixes below the model's minimum cacheable
+	// length are simply not cached.
+	if system != "" {
+		req.System = []contentBlock{{Type: "text", Text: strPtr(system), CacheControl: ephemeral()}}
 	}
+	markCacheBreakpoint(req.Messages)
+	return req
+}
 
-	return json.Marshal(req)
+func ephemeral() *cacheControl { return &cacheControl{Type: "ephemeral"} }
+
+// markCacheBreakpoint puts a cache breakpoint on the last content block of
+// the last message, turning plain string content into a text block.
+func markCacheBreakpoint(msgs []anthropicMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	last := &msgs[len(msgs)-1]
+	switch c := last.Content.(type) {
+	case string:
+		if c != "" {
+			last.Content = []contentBlock{{Type: "text", Text: strPtr(c), CacheControl: ephemeral()}}
+		}
+	case []contentBlock:
+		// The API rejects cache_control on empty text and on thinking blocks.
+		b := &c[len(c)-1]
+		if (b.Type != "text" || *b.Text != "") && !isThinkingBlock(b.Type) {
+			b.CacheControl = ephemeral()
+		}
+	}
+}
+
+func isThinkingBlock(typ string) bool {
+	return typ == "thinking" || typ == "redacted_thinking"
+}
+
+// thinkingBlocks returns the Anthropic thinking blocks among a message's
+// reasoning items, skipping items from other providers.
+func thinkingBlocks(m tape.Message) []contentBlock {
+	var blocks []contentBlock
+	for _, raw := range m.ReasoningItems {
+		var b contentBlock
+		if isThinkingBlock(reasoningItemType(raw)) && json.Unmarshal(raw, &b) == nil {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// turnOpenedThinking reports whether the assistant turn in progress has no
+// reply yet or its first reply carries thinking blocks. The turn starts
+// after the last user message that is not part of a tool_result round, and
+// the API only returns thinking on its first reply, not on the replies to
+// the tool results that follow.
+func turnOpenedThinking(msgs []tape.Message) bool {
+	start := 0
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == tape.RoleUser && (i == 0 || msgs[i-1].Role != tape.RoleToolResult) {
+			start = i + 1
+			break
+		}
+	}
+	for _, m := range msgs[start:] {
+		if m.Role == tape.RoleAssistant {
+			return len(thinkingBlocks(m)) > 0
+		}
+	}
+	return true
+}
+
+// thinkingItem encodes a thinking block for tape.Message.ReasoningItems.
+func thinkingItem(b contentBlock) json.RawMessage {
+	data, _ := json.Marshal(b)
+	return data
 }
 
 func (p *AnthropicProtocol) DecodeResponse(body []byte) (tape.Message, Usage, error) {
@@ -104,39 +242,58 @@ func (p *AnthropicProtocol) DecodeResponse(body []byte) (tape.Message, Usage, er
 		return tape.Message{}, Usage{}, fmt.Errorf("unmarshalling response: %w", err)
 	}
 
-	msg := parseAnthropicResponse(resp)
-	usage := Usage{
-		InputTokens:  resp.Usage.InputTokens,
-		OutputTokens: resp.Usage.OutputTokens,
-	}
-
-	return msg, usage, nil
+	return parseAnthropicResponse(resp), resp.Usage.usage(), nil
 }
 
+// ClassifyError maps Anthropic's error types onto the shared taxonomy.
+// An overloaded_error is transient, not a sign the context is too long.
 func (p *AnthropicProtocol) ClassifyError(statusCode int, body []byte) error {
+	e := &APIError{Provider: "anthropic", Status: statusCode}
+	var ae anthropicError
+	if json.Unmarshal(body, &ae) == nil && ae.Error.Type != "" {
+		e.Type, e.Message = ae.Error.Type, ae.Error.Message
+	} else {
+		e.Message = truncateBody(body)
+	}
+
 	switch {
-	case statusCode == 401 || statusCode == 403:
-		return ErrAuth
+	case statusCode == 401 || statusCode == 403 ||
+		e.Type == "authentication_error" || e.Type == "permission_error":
+		e.Kind = ErrAuth
+	case e.Type == "rate_limit_error":
+		e.Kind = ErrRateLimit
+	case e.Type == "overloaded_error":
+		e.Kind = ErrOverloaded
+	case e.Type == "api_error":
+		e.Kind = ErrServer
+	case e.Type == "request_too_large":
+		e.Kind = ErrContextOverflow
+	case e.Type == "billing_error" || strings.Contains(strings.ToLower(e.Message), "credit balance"):
+		e.Kind = ErrQuotaExhausted
 	default:
-		var ae anthropicError
-		if json.Unmarshal(body, &ae) == nil {
-			msg := strings.ToLower(ae.Error.Message)
-			errType := strings.ToLower(ae.Error.Type)
-			if strings.Contains(msg, "context") || strings.Contains(msg, "too many tokens") ||
-				strings.Contains(msg, "token") && strings.Contains(msg, "exceed") ||
-				errType == "overloaded" {
-				return ErrContextOverflow
+		e.Kind = kindForStatus(statusCode)
+		if e.Type == "invalid_request_error" {
+			e.Kind = ErrInvalidRequest
+		}
+		if e.Kind == ErrInvalidRequest {
+			if mentionsContextOverflow(e.Message) {
+				e.Kind = ErrContextOverflow
+			} else {
+				e.Field = leadingField(e.Message)
 			}
 		}
-		return fmt.Errorf("anthropic API error (HTTP %d): %s", statusCode, string(body))
 	}
+	return e
 }
 
 // ---------------------------------------------------------------------------
 // Message conversion: tape → Anthropic
 // ---------------------------------------------------------------------------
 
-func convertAnthropicMessages(msgs []tape.Message) (string, []anthropicMessage) {
+// convertAnthropicMessages maps the tape onto Anthropic messages. Thinking
+// blocks are replayed, ahead of the text and tool calls, only when thinking
+// is on; otherwise they are dropped.
+func convertAnthropicMessages(msgs []tape.Message, thinking bool) (string, []anthropicMessage) {
 	var system string
 	var out []anthropicMessage
 
@@ -156,6 +313,9 @@ func convertAnthropicMessages(msgs []tape.Message) (string, []anthropicMessage)
 
 		case tape.RoleAssistant:
 			var blocks []contentBlock
+			if thinking {
+				blocks = append(blocks, thinkingBlocks(m)...)
+			}
 			if m.Content != "" {
 				blocks = append(blocks, contentBlock{
 					Type: "text",
@@ -222,7 +382,8 @@ func convertAnthropicTools(tools []ToolSchema) []anthropicTool {
 // ---------------------------------------------------------------------------
 
 func parseAnthropicResponse(resp anthropicResponse) tape.Message {
-	var textParts []string
+	var textParts, reasoningParts []string
+	var reasoningItems []json.RawMessage
 	var toolCalls []tape.ToolCall
 
 	for _, block := range resp.Content {
@@ -231,6 +392,13 @@ func parseAnthropicResponse(resp anthropicResponse) tape.Message {
 			if block.Text != "" {
 				textParts = append(textParts, block.Text)
 			}
+		case "thinking":
+			reasoningParts = append(reasoningParts, block.Thinking)
+			reasoningItems = append(reasoningItems, thinkingItem(contentBlock{
+				Type: "thinking", Thinking: strPtr(block.Thinking), Signature: block.Signature,
+			}))
+		case "redacted_thinking":
+			reasoningItems = append(reasoningItems, thinkingItem(contentBlock{Type: "redacted_thinking", Data: block.Data}))
 		case "tool_use":
 			toolCalls = append(toolCalls, tape.ToolCall{
 				ID:        block.ID,
@@ -241,9 +409,181 @@ func parseAnthropicResponse(resp anthropicResponse) tape.Message {
 	}
 
 	return tape.Message{
-		Role:      tape.RoleAssistant,
-		Content:   strings.Join(textParts, ""),
-		ToolCalls: toolCalls,
-		Timestamp: time.Now().UnixMilli(),
+		Role:             tape.RoleAssistant,
+		Content:          strings.Join(textParts, ""),
+		ReasoningContent: strings.Join(reasoningParts, ""),
+		ReasoningItems:   reasoningItems,
+		ToolCalls:        toolCalls,
+		Timestamp:        time.Now().UnixMilli(),
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Streaming: Anthropic SSE → tape
+// ---------------------------------------------------------------------------
+
+// anthropicStreamEvent covers every event type of the Messages streaming
+// API; each event only populates its own fields.
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	ContentBlock struct {
+		Type      string `json:"type"`
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Text      string `json:"text"`
+		Thinking  string `json:"thinking"`
+		Signature string `json:"signature"`
+		Data      string `json:"data"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		Thinking    string `json:"thinking"`
+		Signature   string `json:"signature"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// anthropicBlock is a content block being assembled from deltas.
+type anthropicBlock struct {
+	typ       string
+	id        string
+	name      string
+	text      strings.Builder // text, thinking, or tool input JSON
+	signature string          // thinking
+	data      string          // redacted_thinking
+}
+
+type anthropicStreamDecoder struct {
+	blocks []*anthropicBlock
+	usage  Usage
+	done   bool
+}
+
+func (p *AnthropicProtocol) NewStreamDecoder() StreamDecoder {
+	return &anthropicStreamDecoder{}
+}
+
+func (d *anthropicStreamDecoder) Done() bool { return d.done }
+
+func (d *anthropicStreamDecoder) Complete() bool { return d.done }
+
+func (d *anthropicStreamDecoder) Event(event string, data []byte) (StreamDelta, error) {
+	if event == "error" {
+		return StreamDelta{}, classifyAnthropicStreamError(data)
+	}
+
+	var ev anthropicStreamEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return StreamDelta{}, fmt.Errorf("unmarshalling stream event: %w", err)
+	}
+
+	switch ev.Type {
+	case "message_start":
+		d.usage = ev.Message.Usage.usage()
+
+	case "content_block_start":
+		b := d.block(ev.Index)
+		b.typ = ev.ContentBlock.Type
+		b.id = ev.ContentBlock.ID
+		b.name = ev.ContentBlock.Name
+		b.text.WriteString(ev.ContentBlock.Text)
+		b.text.WriteString(ev.ContentBlock.Thinking)
+		b.signature = ev.ContentBlock.Signature
+		b.data = ev.ContentBlock.Data
+		if b.typ == "tool_use" {
+			return StreamDelta{ToolCall: b.name}, nil
+		}
+
+	case "content_block_delta":
+		b := d.block(ev.Index)
+		switch ev.Delta.Type {
+		case "text_delta":
+			b.text.WriteString(ev.Delta.Text)
+			return StreamDelta{Text: ev.Delta.Text}, nil
+		case "input_json_delta":
+			b.text.WriteString(ev.Delta.PartialJSON)
+			return StreamDelta{ToolArgs: ev.Delta.PartialJSON}, nil
+		case "thinking_delta":
+			b.text.WriteString(ev.Delta.Thinking)
+			return StreamDelta{Reasoning: ev.Delta.Thinking}, nil
+		case "signature_delta":
+			b.signature += ev.Delta.Signature
+		}
+
+	case "message_delta":
+		d.usage.OutputTokens = ev.Usage.OutputTokens
+
+	case "message_stop":
+		d.done = true
+
+	case "error":
+		return StreamDelta{}, classifyAnthropicStreamError(data)
+	}
+	return StreamDelta{}, nil
+}
+
+// block returns the block at index, growing the list as needed.
+func (d *anthropicStreamDecoder) block(index int) *anthropicBlock {
+	for len(d.blocks) <= index {
+		d.blocks = append(d.blocks, &anthropicBlock{})
+	}
+	return d.blocks[index]
+}
+
+func (d *anthropicStreamDecoder) Result() (tape.Message, Usage, error) {
+	var textParts, reasoningParts []string
+	var reasoningItems []json.RawMessage
+	var toolCalls []tape.ToolCall
+
+	for _, b := range d.blocks {
+		switch b.typ {
+		case "text":
+			if b.text.Len() > 0 {
+				textParts = append(textParts, b.text.String())
+			}
+		case "thinking":
+			reasoningParts = append(reasoningParts, b.text.String())
+			reasoningItems = append(reasoningItems, thinkingItem(contentBlock{
+				Type: "thinking", Thinking: strPtr(b.text.String()), Signature: b.signature,
+			}))
+		case "redacted_thinking":
+			reasoningItems = append(reasoningItems, thinkingItem(contentBlock{Type: "redacted_thinking", Data: b.data}))
+		case "tool_use":
+			args := map[string]any{}
+			if raw := b.text.String(); raw != "" {
+				if err := json.Unmarshal([]byte(raw), &args); err != nil {
+					return tape.Message{}, Usage{}, fmt.Errorf("tool_use %s: unmarshalling streamed input: %w", b.id, err)
+				}
+			}
+			toolCalls = append(toolCalls, tape.ToolCall{
+				ID:        b.id,
+				Name:      b.name,
+				Arguments: args,
+			})
+		}
+	}
+
+	return tape.Message{
+		Role:             tape.RoleAssistant,
+		Content:          strings.Join(textParts, ""),
+		ReasoningContent: strings.Join(reasoningParts, ""),
+		ReasoningItems:   reasoningItems,
+		ToolCalls:        toolCalls,
+		Timestamp:        time.Now().UnixMilli(),
+	}, d.usage, nil
+}
+
+// classifyAnthropicStreamError interprets an in-stream error event, whose
+// payload has the same {"error": {...}} shape as an error response body.
+func classifyAnthropicStreamError(data []byte) error {
+	return (&AnthropicProtocol{}).ClassifyError(0, data)
+}
@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+func TestAnthropicCacheBreakpoints(t *testing.T) {
+	msgs := []tape.Message{
+		{Role: tape.RoleSystem, Content: "You are quine.\n### Your Mission\ncount files"},
+		{Role: tape.RoleUser, Content: "begin"},
+		{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{
+			{ID: "tu_1", Name: "sh", Arguments: map[string]any{"command": "ls"}},
+		}},
+		{Role: tape.RoleToolResult, ToolID: "tu_1", Content: "a\nb"},
+	}
+
+	body, err := (&AnthropicProtocol{}).EncodeRequest(msgs, nil, "claude-sonnet-4-5", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req anthropicRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.System) != 1 || *req.System[0].Text != msgs[0].Content || req.System[0].CacheControl == nil {
+		t.Errorf("system = %s, want one cached text block", body)
+	}
+	if len(req.Messages) != 3 {
+		t.Fatalf("messages = %d, want 3", len(req.Messages))
+	}
+	// Only the last block of the last message is a breakpoint.
+	if _, ok := req.Messages[0].Content.(string); !ok {
+		t.Errorf("first user message = %#v, want plain string content", req.Messages[0].Content)
+	}
+	var last []contentBlock
+	raw, _ := json.Marshal(req.Messages[2].Content)
+	json.Unmarshal(raw, &last)
+	if len(last) != 1 || last[0].Type != "tool_result" || last[0].CacheControl == nil || last[0].CacheControl.Type != "ephemeral" {
+		t.Errorf("last message = %s, want a cached tool_result", raw)
+	}
+	var middle []contentBlock
+	raw, _ = json.Marshal(req.Messages[1].Content)
+	json.Unmarshal(raw, &middle)
+	if middle[0].CacheControl != nil {
+		t.Errorf("assistant message = %s, want no breakpoint", raw)
+	}
+
+	// A trailing plain user message becomes a cached text block.
+	body, _ = (&AnthropicProtocol{}).EncodeRequest(msgs[:2], nil, "claude-sonnet-4-5", 1000)
+	var userReq struct {
+		Messages []struct {
+			Content []contentBlock `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &userReq); err != nil {
+		t.Fatalf("trailing user message not converted to blocks: %v", err)
+	}
+	if b := userReq.Messages[0].Content; len(b) != 1 || *b[0].Text != "begin" || b[0].CacheControl == nil {
+		t.Errorf("user message = %s", body)
+	}
+}
+
+func TestAnthropicCacheUsage(t *testing.T) {
+	p := &AnthropicProtocol{}
+	_, usage, err := p.DecodeResponse([]byte(`{
+		"content": [{"type": "text", "text": "ok"}],
+		"usage": {"input_tokens": 20, "output_tokens": 7, "cache_creation_input_tokens": 300, "cache_read_input_tokens": 4000},
+		"stop_reason": "end_turn"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Usage{InputTokens: 4320, OutputTokens: 7, CacheWriteTokens: 300, CacheReadTokens: 4000}
+	if usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+
+	dec := p.NewStreamDecoder()
+	for _, ev := range []struct{ name, data string }{
+		{"message_start", `{"type":"message_start","message":{"usage":{"input_tokens":20,"output_tokens":1,"cache_creation_input_tokens":300,"cache_read_input_tokens":4000}}}`},
+		{"content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`},
+		{"content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ok"}}`},
+		{"message_delta", `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`},
+		{"message_stop", `{"type":"message_stop"}`},
+	} {
+		if _, err := dec.Event(ev.name, []byte(ev.data)); err != nil {
+			t.Fatalf("%s: %v", ev.name, err)
+		}
+	}
+	_, usage, err = dec.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != want {
+		t.Errorf("streamed usage = %+v, want %+v", usage, want)
+	}
+}
+
+func TestAnthropicThinkingRoundTrip(t *testing.T) {
+	p := &AnthropicProtocol{ThinkingBudget: 2048}
+	reply, _, err := p.DecodeResponse([]byte(`{
+		"content": [
+			{"type": "thinking", "thinking": "List first.", "signature": "sig-1"},
+			{"type": "redacted_thinking", "data": "opaque"},
+			{"type": "tool_use", "id": "tu_1", "name": "sh", "input": {"command": "ls"}}
+		],
+		"usage": {"input_tokens": 10, "output_tokens": 5},
+		"stop_reason": "tool_use"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.ReasoningContent != "List first." || len(reply.ReasoningItems) != 2 {
+		t.Fatalf("reply = %+v, want the thinking text and two reasoning items", reply)
+	}
+
+	msgs := []tape.Message{
+		{Role: tape.RoleSystem, Content: "You are quine."},
+		{Role: tape.RoleUser, Content: "begin"},
+		reply,
+		{Role: tape.RoleToolResult, ToolID: "tu_1", Content: "a"},
+	}
+	assistant := func(body []byte) []contentBlock {
+		t.Helper()
+		var req struct {
+			Messages []json.RawMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		var m struct {
+			Content []contentBlock `json:"content"`
+		}
+		json.Unmarshal(req.Messages[1], &m)
+		return m.Content
+	}
+
+	body, _ := p.EncodeRequest(msgs, nil, "claude-sonnet-4-5", 1000)
+	if !strings.Contains(string(body), `"thinking":{"type":"enabled","budget_tokens":2048}`) || !strings.Contains(string(body), `"max_tokens":3048`) {
+		t.Errorf("request = %s, want thinking enabled with max_tokens raised by the budget", body)
+	}
+	blocks := assistant(body)
+	if len(blocks) != 3 || blocks[0].Type != "thinking" || *blocks[0].Thinking != "List first." || blocks[0].Signature != "sig-1" ||
+		blocks[1].Type != "redacted_thinking" || blocks[1].Data != "opaque" || blocks[2].Type != "tool_use" {
+		t.Errorf("assistant blocks = %+v, want thinking, redacted_thinking, tool_use", blocks)
+	}
+
+	// Thinking off: the blocks are dropped.
+	body, _ = (&AnthropicProtocol{}).EncodeRequest(msgs, nil, "claude-sonnet-4-5", 1000)
+	if strings.Contains(string(body), `"thinking"`) {
+		t.Errorf("request without a budget = %s, want no thinking", body)
+	}
+
+	// A turn that opened without thinking cannot be continued with thinking on.
+	plain := msgs[:2:2]
+	plain = append(plain, tape.Message{Role: tape.RoleAssistant, ToolCalls: reply.ToolCalls}, msgs[3])
+	body, _ = p.EncodeRequest(plain, nil, "claude-sonnet-4-5", 1000)
+	if strings.Contains(string(body), `"thinking"`) || !strings.Contains(string(body), `"max_tokens":1000`) {
+		t.Errorf("request after a reply without thinking = %s, want thinking off", body)
+	}
+
+	// Later rounds of the tool loop come back without thinking; the turn
+	// opened with it, so it stays on.
+	loop := append(msgs[:4:4],
+		tape.Message{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: "tu_2", Name: "sh", Arguments: map[string]any{"command": "pwd"}}}},
+		tape.Message{Role: tape.RoleToolResult, ToolID: "tu_2", Content: "/"},
+		tape.Message{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: "tu_3", Name: "sh", Arguments: map[string]any{"command": "id"}}}},
+		tape.Message{Role: tape.RoleToolResult, ToolID: "tu_3", Content: "uid=0"},
+	)
+	body, _ = p.EncodeRequest(loop, nil, "claude-sonnet-4-5", 1000)
+	if !strings.Contains(string(body), `"thinking":{"type":"enabled","budget_tokens":2048}`) {
+		t.Errorf("request in round 3 of a tool loop = %s, want thinking enabled", body)
+	}
+
+	// A new user message opens a new turn, which may think again.
+	fresh := append(plain[:len(plain):len(plain)], tape.Message{Role: tape.RoleAssistant, Content: "done"}, tape.Message{Role: tape.RoleUser, Content: "next"})
+	body, _ = p.EncodeRequest(fresh, nil, "claude-sonnet-4-5", 1000)
+	if !strings.Contains(string(body), `"thinking":{"type":"enabled","budget_tokens":2048}`) {
+		t.Errorf("request after a new user message = %s, want thinking enabled", body)
+	}
+
+	// Other protocols do not send Anthropic's blocks.
+	body, _ = (&OpenAIResponsesProtocol{}).EncodeRequest(msgs, nil, "o4-mini", 1000)
+	if strings.Contains(string(body), "sig-1") {
+		t.Errorf("responses request = %s, want no Anthropic thinking blocks", body)
+	}
+}
+
+func TestAnthropicStreamThinking(t *testing.T) {
+	dec := (&AnthropicProtocol{}).NewStreamDecoder()
+	for _, ev := range []struct{ name, data string }{
+		{"message_start", `{"type":"message_start","message":{"usage":{"input_tokens":5,"output_tokens":1}}}`},
+		{"content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`},
+		{"content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Check "}}`},
+		{"content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"files."}}`},
+		{"content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig-2"}}`},
+		{"content_block_start", `{"type":"content_block_start","index":1,"content_block":{"type":"redacted_thinking","data":"opaque"}}`},
+		{"content_block_start", `{"type":"content_block_start","index":2,"content_block":{"type":"text","text":""}}`},
+		{"content_block_delta", `{"type":"content_block_delta","index":2,"delta":{"type":"text_delta","text":"ok"}}`},
+		{"message_stop", `{"type":"message_stop"}`},
+	} {
+		if _, err := dec.Event(ev.name, []byte(ev.data)); err != nil {
+			t.Fatalf("%s: %v", ev.name, err)
+		}
+	}
+	msg, _, err := dec.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "ok" || msg.ReasoningContent != "Check files." {
+		t.Errorf("message = %+v", msg)
+	}
+	want := []string{
+		`{"type":"thinking","thinking":"Check files.","signature":"sig-2"}`,
+		`{"type":"redacted_thinking","data":"opaque"}`,
+	}
+	if len(msg.ReasoningItems) != len(want) {
+		t.Fatalf("reasoning items = %s, want %v", msg.ReasoningItems, want)
+	}
+	for i, item := range msg.ReasoningItems {
+		if string(item) != want[i] {
+			t.Errorf("reasoning item %d = %s, want %s", i, item, want[i])
+		}
+	}
+}
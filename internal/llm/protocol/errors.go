@@ -1,9 +1,119 @@
 package protocol
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
-// Sentinel errors for callers to match with errors.Is.
+// Sentinel errors for callers to match with errors.Is. Classified API
+// failures are returned as *APIError, which unwraps to one of them.
 var (
 	ErrAuth            = errors.New("authentication failed")
 	ErrContextOverflow = errors.New("context window exceeded")
+	ErrRateLimit       = errors.New("rate limited")
+	ErrOverloaded      = errors.New("provider overloaded")
+	ErrServer          = errors.New("provider server error")
+	ErrInvalidRequest  = errors.New("invalid request")
+	ErrContentFilter   = errors.New("blocked by content filter")
+	ErrQuotaExhausted  = errors.New("quota exhausted")
 )
+
+// APIError is an error response from a provider, classified by Kind.
+type APIError struct {
+	Provider string // "anthropic", "openai", "gemini"
+	Kind     error  // one of the sentinels above; nil if unclassified
+	Status   int    // HTTP status; 0 for an error reported inside a stream
+	Type     string // the provider's error type or code, e.g. "overloaded_error"
+	Message  string // the provider's message
+	Field    string // ErrInvalidRequest: the request field at fault, if reported
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Provider + " API error")
+	if e.Status != 0 {
+		fmt.Fprintf(&b, " (HTTP %d)", e.Status)
+	}
+	if e.Kind != nil {
+		b.WriteString(": " + e.Kind.Error())
+	}
+	if e.Field != "" {
+		b.WriteString(" [" + e.Field + "]")
+	}
+	if e.Type != "" {
+		b.WriteString(": " + e.Type)
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	}
+	return b.String()
+}
+
+func (e *APIError) Unwrap() error { return e.Kind }
+
+// kindForStatus is the classification an HTTP status implies when the
+// body says nothing more specific.
+func kindForStatus(status int) error {
+	switch {
+	case status == 401 || status == 403:
+		return ErrAuth
+	case status == 413:
+		return ErrContextOverflow
+	case status == 429:
+		return ErrRateLimit
+	case status == 503 || status == 529:
+		return ErrOverloaded
+	case status >= 500:
+		return ErrServer
+	case status >= 400:
+		return ErrInvalidRequest
+	default:
+		return nil
+	}
+}
+
+// contextOverflowPhrases are how providers and common OpenAI-compatible
+// servers word a prompt that does not fit the context window.
+var contextOverflowPhrases = []string{
+	"prompt is too long",                     // Anthropic
+	"exceed context limit",                   // Anthropic, input + max_tokens
+	"maximum context length",                 // OpenAI, vLLM, OpenRouter, Mistral
+	"context_length_exceeded",                // OpenAI code quoted in a message
+	"exceeds the context window",             // OpenAI Responses
+	"exceeds the maximum number of tokens",   // Gemini
+	"exceeds the available context size",     // llama.cpp
+	"reduce the length of the messages",      // OpenAI, Groq
+	"longer than the model's context length", // vLLM
+}
+
+// mentionsContextOverflow reports whether an error message describes a
+// prompt that does not fit the model's context window.
+func mentionsContextOverflow(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, phrase := range contextOverflowPhrases {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// leadingField extracts the request path an error message starts with, as
+// in Anthropic's "messages.1.content.0.text: field required".
+func leadingField(msg string) string {
+	field, _, ok := strings.Cut(msg, ": ")
+	if !ok || field == "" || strings.ContainsAny(field, " \t\n") {
+		return ""
+	}
+	return field
+}
+
+// truncateBody bounds an unparsed error body quoted in an APIError.
+func truncateBody(body []byte) string {
+	s := strings.TrimSpace(string(body))
+	if len(s) > 500 {
+		s = s[:500] + "..."
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		proto  Protocol
+		status int
+		body   string
+		kind   error
+		field  string
+	}{
+		{"anthropic overloaded", &AnthropicProtocol{}, 529,
+			`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, ErrOverloaded, ""},
+		{"anthropic rate limit", &AnthropicProtocol{}, 429,
+			`{"type":"error","error":{"type":"rate_limit_error","message":"Number of request tokens has exceeded your per-minute rate limit"}}`, ErrRateLimit, ""},
+		{"anthropic server", &AnthropicProtocol{}, 500,
+			`{"type":"error","error":{"type":"api_error","message":"Internal server error"}}`, ErrServer, ""},
+		{"anthropic context", &AnthropicProtocol{}, 400,
+			`{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 210000 tokens > 200000 maximum"}}`, ErrContextOverflow, ""},
+		{"anthropic invalid", &AnthropicProtocol{}, 400,
+			`{"type":"error","error":{"type":"invalid_request_error","message":"messages.1.content.0.tool_use.name: Field required"}}`, ErrInvalidRequest, "messages.1.content.0.tool_use.name"},
+		{"anthropic credit", &AnthropicProtocol{}, 400,
+			`{"type":"error","error":{"type":"invalid_request_error","message":"Your credit balance is too low to access the Anthropic API."}}`, ErrQuotaExhausted, ""},
+		{"anthropic auth", &AnthropicProtocol{}, 401,
+			`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`, ErrAuth, ""},
+		{"anthropic unparsed 502", &AnthropicProtocol{}, 502, `<html>Bad Gateway</html>`, ErrServer, ""},
+		{"openai quota", &OpenAIProtocol{}, 429,
+			`{"error":{"message":"You exceeded your current quota.","type":"insufficient_quota","param":null,"code":"insufficient_quota"}}`, ErrQuotaExhausted, ""},
+		{"openai rate limit", &OpenAIProtocol{}, 429,
+			`{"error":{"message":"Rate limit reached for gpt-4o.","type":"requests","code":"rate_limit_exceeded"}}`, ErrRateLimit, ""},
+		{"openai invalid", &OpenAIProtocol{}, 400,
+			`{"error":{"message":"Invalid value for 'temperature'.","type":"invalid_request_error","param":"temperature","code":"invalid_value"}}`, ErrInvalidRequest, "temperature"},
+		{"azure content filter", &OpenAIProtocol{}, 400,
+			`{"error":{"message":"The response was filtered due to the prompt triggering content management policy.","type":null,"param":"prompt","code":"content_filter"}}`, ErrContentFilter, ""},
+		{"openai overloaded", &OpenAIProtocol{}, 503,
+			`{"error":{"message":"The engine is currently overloaded, please try again later","type":"server_error"}}`, ErrOverloaded, ""},
+		{"gemini overloaded", &GeminiProtocol{}, 503,
+			`{"error":{"code":503,"message":"The model is overloaded. Please try again later.","status":"UNAVAILABLE"}}`, ErrOverloaded, ""},
+		{"gemini invalid", &GeminiProtocol{}, 400,
+			`{"error":{"code":400,"message":"Invalid JSON payload received.","status":"INVALID_ARGUMENT","details":[{"fieldViolations":[{"field":"contents[0].parts"}]}]}}`, ErrInvalidRequest, "contents[0].parts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.proto.ClassifyError(tt.status, []byte(tt.body))
+			if !errors.Is(err, tt.kind) {
+				t.Fatalf("err = %v, want %v", err, tt.kind)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %T, want *APIError", err)
+			}
+			if apiErr.Status != tt.status || apiErr.Message == "" {
+				t.Errorf("status/message = %d/%q", apiErr.Status, apiErr.Message)
+			}
+			if apiErr.Field != tt.field {
+				t.Errorf("field = %q, want %q", apiErr.Field, tt.field)
+			}
+		})
+	}
+
+	// An overloaded error reported mid-stream is transient, not a full context.
+	_, err := (&AnthropicProtocol{}).NewStreamDecoder().Event("error", []byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+	if !errors.Is(err, ErrOverloaded) || errors.Is(err, ErrContextOverflow) {
+		t.Errorf("stream overloaded: %v", err)
+	}
+}
+
+func TestMentionsContextOverflow(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{"prompt is too long: 210000 tokens > 200000 maximum", true},
+		{"input length and `max_tokens` exceed context limit: 190000 + 20000 > 200000, decrease input length or `max_tokens` and try again", true},
+		{"This model's maximum context length is 128000 tokens. However, your messages resulted in 130000 tokens.", true},
+		{"Your input exceeds the context window of this model.", true},
+		{"The input token count (1205312) exceeds the maximum number of tokens allowed (1048576).", true},
+		{"the request exceeds the available context size, try increasing it", true},
+		{"Please reduce the length of the messages or completion.", true},
+		{"Unknown parameter: 'context_management'.", false},
+		{"max_tokens: 100000 > 64000, which is the maximum allowed number of output tokens for claude-sonnet-4-5", false},
+		{"Number of request tokens has exceeded your per-minute rate limit", false},
+		{"tools.0.input_schema: JSON schema is invalid; the context of the error is the root object", false},
+		{"Invalid value for 'temperature'.", false},
+	}
+	for _, tt := range tests {
+		if got := mentionsContextOverflow(tt.msg); got != tt.want {
+			t.Errorf("mentionsContextOverflow(%q) = %v, want %v", tt.msg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// GeminiProtocol implements Protocol for Google's Gemini generateContent
+// API. The model is part of the endpoint path rather than the body.
+//
+// Thinking models sign their replies: the thoughtSignature Gemini puts on a
+// part is kept on the tape as a reasoning item (geminiSignature) and sent
+// back on the same part, which Gemini needs to continue its reasoning
+// across function calls.
+type GeminiProtocol struct {
+	Model string
+}
+
+// ---------------------------------------------------------------------------
+// API request/response types
+// ---------------------------------------------------------------------------
+
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []geminiTool            `json:"tools,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"` // "user" or "model"
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+	ThoughtSignature string                  `json:"thoughtSignature,omitempty"`
+}
+
+// geminiSignature is a thoughtSignature kept in tape.Message.ReasoningItems.
+// CallID names the function call part it came on; "" means the reply's
+// text.
+type geminiSignature struct {
+	Type      string `json:"type"` // geminiSignatureType
+	CallID    string `json:"call_id,omitempty"`
+	Signature string `json:"signature"`
+}
+
+const geminiSignatureType = "gemini_thought_signature"
+
+type geminiFunctionCall struct {
+	ID   string         `json:"id,omitempty"`
+	Name string         `json:"name"`
+	Args map[string]any `json:"args"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type geminiGenerationConfig struct {
+	MaxOutputTokens int `json:"maxOutputTokens,omitempty"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+	} `json:"usageMetadata"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	Error *json.RawMessage `json:"error"`
+}
+
+type geminiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			FieldViolations []struct {
+				Field string `json:"field"`
+			} `json:"fieldViolations"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// ---------------------------------------------------------------------------
+// Protocol implementation
+// ---------------------------------------------------------------------------
+
+func (p *GeminiProtocol) ContentType() string {
+	return "application/json"
+}
+
+func (p *GeminiProtocol) EndpointPath() string {
+	return "/v1beta/models/" + url.PathEscape(p.Model) + ":generateContent"
+}
+
+// StreamEndpointPath is the endpoint for streamed requests: Gemini streams
+// from a separate method rather than a body flag.
+func (p *GeminiProtocol) StreamEndpointPath() string {
+	return "/v1beta/models/" + url.PathEscape(p.Model) + ":streamGenerateContent?alt=sse"
+}
+
+func (p *GeminiProtocol) EncodeRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
+	return json.Marshal(buildGeminiRequest(messages, tools, maxTokens))
+}
+
+// EncodeStreamRequest is EncodeRequest: the stream is selected by the
+// endpoint (StreamEndpointPath), not the body.
+func (p *GeminiProtocol) EncodeStreamRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
+	return p.EncodeRequest(messages, tools, model, maxTokens)
+}
+
+func buildGeminiRequest(messages []tape.Message, tools []ToolSchema, maxTokens int) geminiRequest {
+	system, contents := convertGeminiMessages(messages)
+	req := geminiRequest{
+		Contents: contents,
+		Tools:    convertGeminiTools(tools),
+	}
+	if system != "" {
+		req.SystemInstruction = &geminiContent{Parts: []geminiPart{{Text: system}}}
+	}
+	if maxTokens > 0 {
+		req.GenerationConfig = &geminiGenerationConfig{MaxOutputTokens: maxTokens}
+	}
+	return req
+}
+
+func (p *GeminiProtocol) DecodeResponse(body []byte) (tape.Message, Usage, error) {
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return tape.Message{}, Usage{}, fmt.Errorf("unmarshalling response: %w", err)
+	}
+	if len(resp.Candidates) == 0 && resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		return tape.Message{}, Usage{}, blockedError(resp.PromptFeedback.BlockReason)
+	}
+
+	var parts []geminiPart
+	var finish string
+	if len(resp.Candidates) > 0 {
+		parts = resp.Candidates[0].Content.Parts
+		finish = resp.Candidates[0].FinishReason
+	}
+	text, reasoning, toolCalls, items := parseGeminiParts(parts)
+	if text == "" && len(toolCalls) == 0 && blockedFinish(finish) {
+		return tape.Message{}, Usage{}, blockedError(finish)
+	}
+	return tape.Message{
+		Role:             tape.RoleAssistant,
+		Content:          text,
+		ReasoningContent: reasoning,
+		ReasoningItems:   items,
+		ToolCalls:        toolCalls,
+		Timestamp:        time.Now().UnixMilli(),
+	}, geminiUsage(resp), nil
+}
+
+// ClassifyError maps Google RPC statuses onto the shared taxonomy.
+func (p *GeminiProtocol) ClassifyError(statusCode int, body []byte) error {
+	e := &APIError{Provider: "gemini", Status: statusCode}
+	var ge geminiError
+	if json.Unmarshal(body, &ge) == nil && ge.Error.Message != "" {
+		e.Type, e.Message = ge.Error.Status, ge.Error.Message
+	} else {
+		e.Message = truncateBody(body)
+	}
+	msg := strings.ToLower(ge.Error.Message)
+
+	switch ge.Error.Status {
+	case "UNAUTHENTICATED", "PERMISSION_DENIED":
+		e.Kind = ErrAuth
+	case "RESOURCE_EXHAUSTED":
+		e.Kind = ErrRateLimit
+	case "UNAVAILABLE":
+		e.Kind = ErrOverloaded
+	case "INTERNAL", "DEADLINE_EXCEEDED":
+		e.Kind = ErrServer
+	case "INVALID_ARGUMENT", "FAILED_PRECONDITION", "NOT_FOUND":
+		e.Kind = ErrInvalidRequest
+	default:
+		e.Kind = kindForStatus(statusCode)
+	}
+	switch {
+	case statusCode == 401 || statusCode == 403 || strings.Contains(msg, "api key not valid"):
+		e.Kind = ErrAuth
+	case e.Kind == ErrRateLimit && strings.Contains(msg, "billing"):
+		e.Kind = ErrQuotaExhausted
+	case e.Kind == ErrInvalidRequest && mentionsContextOverflow(msg):
+		e.Kind = ErrContextOverflow
+	case e.Kind == ErrInvalidRequest:
+		for _, d := range ge.Error.Details {
+			for _, v := range d.FieldViolations {
+				if e.Field == "" {
+					e.Field = v.Field
+				}
+			}
+		}
+	}
+	return e
+}
+
+// blockedError reports a prompt or reply stopped by Gemini's safety filters.
+func blockedError(reason string) error {
+	return &APIError{Provider: "gemini", Kind: ErrContentFilter, Type: reason, Message: "blocked by safety filters"}
+}
+
+// blockedFinish reports whether a candidate's finishReason means its reply
+// was withheld by a filter. A withheld reply comes back with no parts, which
+// must not pass for an empty assistant message.
+func blockedFinish(reason string) bool {
+	switch reason {
+	case "SAFETY", "RECITATION", "PROHIBITED_CONTENT", "BLOCKLIST", "SPII":
+		return true
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------
+// Message conversion: tape → Gemini
+// ---------------------------------------------------------------------------
+
+// convertGeminiMessages maps the tape onto Gemini contents. Tool results
+// become functionResponse parts, which are matched to their call by name
+// (and by ID where Gemini issued one). Consecutive contents of the same
+// role are merged, as parallel function responses must share one turn.
+func convertGeminiMessages(msgs []tape.Message) (string, []geminiContent) {
+	var system string
+	var out []geminiContent
+	callNames := map[string]string{}
+
+	add := func(role string, parts ...geminiPart) {
+		if n := len(out); n > 0 && out[n-1].Role == role {
+			out[n-1].Parts = append(out[n-1].Parts, parts...)
+			return
+		}
+		out = append(out, geminiContent{Role: role, Parts: parts})
+	}
+
+	for _, m := range msgs {
+		switch m.Role {
+		case tape.RoleSystem:
+			if system != "" {
+				system += "\n\n"
+			}
+			system += m.Content
+
+		case tape.RoleUser:
+			add("user", geminiPart{Text: m.Content})
+
+		case tape.RoleAssistant:
+			var parts []geminiPart
+			signatures := geminiSignatures(m)
+			if text := strings.TrimRight(m.Content, " \t\n\r"); text != "" {
+				parts = append(parts, geminiPart{Text: text, ThoughtSignature: signatures[""]})
+			}
+			for _, tc := range m.ToolCalls {
+				callNames[tc.ID] = tc.Name
+				args := tc.Arguments
+				if args == nil {
+					args = map[string]any{}
+				}
+				parts = append(parts, geminiPart{
+					FunctionCall: &geminiFunctionCall{
+						ID:   geminiCallID(tc.ID),
+						Name: tc.Name,
+						Args: args,
+					},
+					ThoughtSignature: signatures[tc.ID],
+				})
+			}
+			// Gemini rejects empty parts; an empty reply is left out.
+			if len(parts) > 0 {
+				add("model", parts...)
+			}
+
+		case tape.RoleToolResult:
+			add("user", geminiPart{FunctionResponse: &geminiFunctionResponse{
+				ID:       geminiCallID(m.ToolID),
+				Name:     callNames[m.ToolID],
+				Response: map[string]any{"output": m.Content},
+			}})
+		}
+	}
+
+	return system, out
+}
+
+// geminiSignatures returns the thought signatures among a message's
+// reasoning items by call ID, skipping items from other providers.
+func geminiSignatures(m tape.Message) map[string]string {
+	var sigs map[string]string
+	for _, raw := range m.ReasoningItems {
+		var sig geminiSignature
+		if reasoningItemType(raw) != geminiSignatureType || json.Unmarshal(raw, &sig) != nil {
+			continue
+		}
+		if sigs == nil {
+			sigs = map[string]string{}
+		}
+		sigs[sig.CallID] = sig.Signature
+	}
+	return sigs
+}
+
+// signatureItem encodes the signature of a part for
+// tape.Message.ReasoningItems.
+func signatureItem(callID, signature string) json.RawMessage {
+	data, _ := json.Marshal(geminiSignature{Type: geminiSignatureType, CallID: callID, Signature: signature})
+	return data
+}
+
+// geminiCallID returns the ID Gemini issued for a call, or "" for IDs we
+// generated ourselves (see newGeminiCallID), which Gemini never saw.
+func geminiCallID(id string) string {
+	if strings.HasPrefix(id, geminiLocalIDPrefix) {
+		return ""
+	}
+	return id
+}
+
+func convertGeminiTools(tools []ToolSchema) []geminiTool {
+	if len(tools) == 0 {
+		return nil
+	}
+	decls := make([]geminiFunctionDeclaration, len(tools))
+	for i, t := range tools {
+		decls[i] = geminiFunctionDeclaration{
+			Name:        t.Name,
+			Description: t.Description,
+		}
+		// A function without parameters must omit them entirely.
+		if params := geminiSchema(t.Parameters); params["properties"] != nil {
+			decls[i].Parameters = params
+		}
+	}
+	return []geminiTool{{FunctionDeclarations: decls}}
+}
+
+// geminiSchema copies a JSON Schema without the keywords Gemini's schema
+// subset rejects.
+func geminiSchema(schema map[string]any) map[string]any {
+	if schema == nil {
+		return nil
+	}
+	out := make(map[string]any, len(schema))
+	for k, v := range schema {
+		switch k {
+		case "additionalProperties", "$schema":
+			continue
+		case "properties":
+			props, _ := v.(map[string]any)
+			if len(props) == 0 {
+				continue
+			}
+			converted := make(map[string]any, len(props))
+			for name, prop := range props {
+				if ps, ok := prop.(map[string]any); ok {
+					converted[name] = geminiSchema(ps)
+				} else {
+					converted[name] = prop
+				}
+			}
+			out[k] = converted
+		case "items":
+			if is, ok := v.(map[string]any); ok {
+				out[k] = geminiSchema(is)
+			} else {
+				out[k] = v
+			}
+		case "required":
+			if req, ok := v.([]string); ok && len(req) == 0 {
+				continue
+			}
+			out[k] = v
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// ---------------------------------------------------------------------------
+// Response parsing: Gemini → tape
+// ---------------------------------------------------------------------------
+
+// geminiLocalIDPrefix marks tool call IDs generated here because Gemini
+// returned a call without one.
+const geminiLocalIDPrefix = "gemini_"
+
+func newGeminiCallID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return geminiLocalIDPrefix + hex.EncodeToString(b)
+}
+
+func parseGeminiParts(parts []geminiPart) (text, reasoning string, toolCalls []tape.ToolCall, items []json.RawMessage) {
+	var textParts, reasoningParts []string
+	for _, part := range parts {
+		callID := ""
+		switch {
+		case part.FunctionCall != nil:
+			tc := geminiToolCall(part.FunctionCall)
+			toolCalls = append(toolCalls, tc)
+			callID = tc.ID
+		case part.Thought:
+			reasoningParts = append(reasoningParts, part.Text)
+		case part.Text != "":
+			textParts = append(textParts, part.Text)
+		}
+		if part.ThoughtSignature != "" {
+			items = append(items, signatureItem(callID, part.ThoughtSignature))
+		}
+	}
+	return strings.Join(textParts, ""), strings.Join(reasoningParts, ""), toolCalls, items
+}
+
+func geminiToolCall(fc *geminiFunctionCall) tape.ToolCall {
+	id := fc.ID
+	if id == "" {
+		id = newGeminiCallID()
+	}
+	args := fc.Args
+	if args == nil {
+		args = map[string]any{}
+	}
+	return tape.ToolCall{ID: id, Name: fc.Name, Arguments: args}
+}
+
+// geminiUsage reads usageMetadata. Thinking tokens are billed as output.
+func geminiUsage(resp geminiResponse) Usage {
+	if resp.UsageMetadata == nil {
+		return Usage{}
+	}
+	return Usage{
+		InputTokens:  resp.UsageMetadata.PromptTokenCount,
+		OutputTokens: resp.UsageMetadata.CandidatesTokenCount + resp.UsageMetadata.ThoughtsTokenCount,
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Streaming: Gemini SSE → tape
+// ---------------------------------------------------------------------------
+
+// Each streamed event is a complete GenerateContentResponse carrying the
+// next parts of the reply; function calls arrive whole. The last chunk has
+// a finishReason, and the latest usageMetadata is cumulative.
+type geminiStreamDecoder struct {
+	text      strings.Builder
+	reasoning strings.Builder
+	toolCalls []tape.ToolCall
+	items     []json.RawMessage // thought signatures
+	usage     Usage
+	done      bool
+}
+
+func (p *GeminiProtocol) NewStreamDecoder() StreamDecoder {
+	return &geminiStreamDecoder{}
+}
+
+func (d *geminiStreamDecoder) Done() bool { return d.done }
+
+func (d *geminiStreamDecoder) Complete() bool { return d.done }
+
+func (d *geminiStreamDecoder) Event(event string, data []byte) (StreamDelta, error) {
+	var chunk geminiResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return StreamDelta{}, fmt.Errorf("unmarshalling stream chunk: %w", err)
+	}
+	if chunk.Error != nil {
+		return StreamDelta{}, (&GeminiProtocol{}).ClassifyError(0, data)
+	}
+	if chunk.UsageMetadata != nil {
+		d.usage = geminiUsage(chunk)
+	}
+	if len(chunk.Candidates) == 0 {
+		if chunk.PromptFeedback != nil && chunk.PromptFeedback.BlockReason != "" {
+			return StreamDelta{}, blockedError(chunk.PromptFeedback.BlockReason)
+		}
+		return StreamDelta{}, nil
+	}
+
+	var out StreamDelta
+	for _, part := range chunk.Candidates[0].Content.Parts {
+		callID := ""
+		switch {
+		case part.FunctionCall != nil:
+			tc := geminiToolCall(part.FunctionCall)
+			d.toolCalls = append(d.toolCalls, tc)
+			args, _ := json.Marshal(tc.Arguments)
+			out.ToolCall = tc.Name
+			out.ToolArgs += string(args)
+			callID = tc.ID
+		case part.Thought:
+			d.reasoning.WriteString(part.Text)
+			out.Reasoning += part.Text
+		default:
+			d.text.WriteString(part.Text)
+			out.Text += part.Text
+		}
+		if part.ThoughtSignature != "" {
+			d.items = append(d.items, signatureItem(callID, part.ThoughtSignature))
+		}
+	}
+	if finish := chunk.Candidates[0].FinishReason; finish != "" {
+		if d.text.Len() == 0 && len(d.toolCalls) == 0 && blockedFinish(finish) {
+			return StreamDelta{}, blockedError(finish)
+		}
+		d.done = true
+	}
+	return out, nil
+}
+
+func (d *geminiStreamDecoder) Result() (tape.Message, Usage, error) {
+	return tape.Message{
+		Role:             tape.RoleAssistant,
+		Content:          d.text.String(),
+		ReasoningContent: d.reasoning.String(),
+		ReasoningItems:   d.items,
+		ToolCalls:        d.toolCalls,
+		Timestamp:        time.Now().UnixMilli(),
+	}, d.usage, nil
+}
@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGeminiEncodeRequest(t *testing.T) {
+	msgs := []tape.Message{
+		{Role: tape.RoleSystem, Content: "You are quine."},
+		{Role: tape.RoleUser, Content: "count files"},
+		{Role: tape.RoleAssistant, Content: "Checking.", ToolCalls: []tape.ToolCall{
+			{ID: "gemini_0001", Name: "sh", Arguments: map[string]any{"command": "ls"}},
+			{ID: "fc-42", Name: "fork", Arguments: map[string]any{"intent": "x"}},
+		}},
+		{Role: tape.RoleToolResult, ToolID: "gemini_0001", Content: "a\nb"},
+		{Role: tape.RoleToolResult, ToolID: "fc-42", Content: "[FORK] ok"},
+		{Role: tape.RoleUser, Content: "[TURNS LEFT] 3"},
+	}
+	tools := []ToolSchema{
+		{Name: "sh", Description: "run", Parameters: map[string]any{
+			"type":     "object",
+			"required": []string{"command"},
+			"properties": map[string]any{
+				"command": map[string]any{"type": "string"},
+				"env":     map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}},
+			},
+		}},
+		{Name: "noop", Description: "no args", Parameters: map[string]any{"type": "object", "properties": map[string]any{}, "required": []string{}}},
+	}
+
+	body, err := (&GeminiProtocol{Model: "gemini-2.5-flash"}).EncodeRequest(msgs, tools, "gemini-2.5-flash", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req geminiRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	if req.SystemInstruction == nil || req.SystemInstruction.Parts[0].Text != "You are quine." {
+		t.Errorf("systemInstruction = %+v", req.SystemInstruction)
+	}
+	if req.GenerationConfig == nil || req.GenerationConfig.MaxOutputTokens != 1000 {
+		t.Errorf("generationConfig = %+v", req.GenerationConfig)
+	}
+	// user, model, user (both function responses + the user message merged)
+	if len(req.Contents) != 3 {
+		t.Fatalf("contents = %d, want 3: %s", len(req.Contents), body)
+	}
+	model := req.Contents[1]
+	if model.Role != "model" || len(model.Parts) != 3 || model.Parts[1].FunctionCall.Name != "sh" {
+		t.Errorf("model content = %+v", model)
+	}
+	if id := model.Parts[1].FunctionCall.ID; id != "" {
+		t.Errorf("locally generated call ID sent to Gemini: %q", id)
+	}
+	if id := model.Parts[2].FunctionCall.ID; id != "fc-42" {
+		t.Errorf("Gemini-issued call ID = %q, want fc-42", id)
+	}
+	results := req.Contents[2].Parts
+	if len(results) != 3 || results[0].FunctionResponse.Name != "sh" || results[1].FunctionResponse.Name != "fork" ||
+		results[0].FunctionResponse.Response["output"] != "a\nb" || results[2].Text != "[TURNS LEFT] 3" {
+		t.Errorf("function responses = %s", body)
+	}
+
+	decls := req.Tools[0].FunctionDeclarations
+	if strings.Contains(string(body), "additionalProperties") {
+		t.Errorf("unsupported schema keyword sent: %s", body)
+	}
+	if decls[1].Parameters != nil {
+		t.Errorf("parameterless function got parameters %v", decls[1].Parameters)
+	}
+}
+
+func TestGeminiDecodeResponse(t *testing.T) {
+	msg, usage, err := (&GeminiProtocol{}).DecodeResponse(fixture(t, "gemini_response.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "Counting the files." || !strings.HasPrefix(msg.ReasoningContent, "The user wants") {
+		t.Errorf("text = %q, reasoning = %q", msg.Content, msg.ReasoningContent)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Name != "sh" || msg.ToolCalls[0].Arguments["command"] != "ls -1 | wc -l" {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if !strings.HasPrefix(msg.ToolCalls[0].ID, geminiLocalIDPrefix) {
+		t.Errorf("tool call ID = %q, want a generated one", msg.ToolCalls[0].ID)
+	}
+	if usage.InputTokens != 1204 || usage.OutputTokens != 31+62 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestGeminiStreamDecoder(t *testing.T) {
+	dec := (&GeminiProtocol{}).NewStreamDecoder()
+	var text strings.Builder
+	err := ReadSSE(strings.NewReader(string(fixture(t, "gemini_stream.txt"))), func(event string, data []byte) error {
+		delta, err := dec.Event(event, data)
+		text.WriteString(delta.Text)
+		return err
+	}, dec.Done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dec.Done() {
+		t.Error("stream not done after finishReason")
+	}
+	msg, usage, err := dec.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "Counting the files." || text.String() != msg.Content {
+		t.Errorf("content = %q, deltas = %q", msg.Content, text.String())
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Arguments["command"] != "ls -1 | wc -l" {
+		t.Errorf("tool calls = %+v", msg.ToolCalls)
+	}
+	if usage.InputTokens != 1204 || usage.OutputTokens != 31 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestGeminiBlockedFinish(t *testing.T) {
+	body := fixture(t, "gemini_blocked_finish.json")
+	if _, _, err := (&GeminiProtocol{}).DecodeResponse(body); !errors.Is(err, ErrContentFilter) {
+		t.Errorf("DecodeResponse = %v, want ErrContentFilter", err)
+	}
+
+	dec := (&GeminiProtocol{}).NewStreamDecoder()
+	if _, err := dec.Event("", body); !errors.Is(err, ErrContentFilter) {
+		t.Errorf("stream Event = %v, want ErrContentFilter", err)
+	}
+
+	// A reply cut short after it produced text is kept.
+	partial := []byte(`{"candidates":[{"content":{"parts":[{"text":"Partial"}],"role":"model"},"finishReason":"RECITATION"}]}`)
+	if msg, _, err := (&GeminiProtocol{}).DecodeResponse(partial); err != nil || msg.Content != "Partial" {
+		t.Errorf("partial reply: msg = %+v, err = %v", msg, err)
+	}
+}
+
+func TestGeminiThoughtSignatureRoundTrip(t *testing.T) {
+	p := &GeminiProtocol{Model: "gemini-2.5-pro"}
+	reply, _, err := p.DecodeResponse([]byte(`{"candidates": [{"content": {"role": "model", "parts": [
+		{"text": "Listing.", "thoughtSignature": "sig-text"},
+		{"functionCall": {"id": "fc-1", "name": "sh", "args": {"command": "ls"}}, "thoughtSignature": "sig-call"},
+		{"functionCall": {"id": "fc-2", "name": "sh", "args": {"command": "pwd"}}}
+	]}, "finishReason": "STOP"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.ReasoningItems) != 2 {
+		t.Fatalf("reasoning items = %s, want two signatures", reply.ReasoningItems)
+	}
+
+	msgs := []tape.Message{
+		{Role: tape.RoleUser, Content: "begin"},
+		reply,
+		{Role: tape.RoleToolResult, ToolID: "fc-1", Content: "a"},
+		{Role: tape.RoleToolResult, ToolID: "fc-2", Content: "/"},
+	}
+	body, _ := p.EncodeRequest(msgs, nil, "gemini-2.5-pro", 1000)
+	var req geminiRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	parts := req.Contents[1].Parts
+	if len(parts) != 3 || parts[0].ThoughtSignature != "sig-text" || parts[1].ThoughtSignature != "sig-call" || parts[2].ThoughtSignature != "" {
+		t.Errorf("model parts = %+v, want each signature back on its part", parts)
+	}
+
+	// Streamed signatures are kept too, including one on an empty text part.
+	dec := p.NewStreamDecoder()
+	dec.Event("", []byte(`{"candidates": [{"content": {"role": "model", "parts": [{"functionCall": {"id": "fc-3", "name": "sh", "args": {}}, "thoughtSignature": "sig-stream"}]}}]}`))
+	dec.Event("", []byte(`{"candidates": [{"content": {"role": "model", "parts": [{"text": "", "thoughtSignature": "sig-end"}]}, "finishReason": "STOP"}]}`))
+	msg, _, _ := dec.Result()
+	if sigs := geminiSignatures(msg); sigs["fc-3"] != "sig-stream" || sigs[""] != "sig-end" {
+		t.Errorf("streamed signatures = %v", sigs)
+	}
+
+	// Other protocols do not send Gemini's signatures.
+	body, _ = (&AnthropicProtocol{ThinkingBudget: 1024}).EncodeRequest(msgs, nil, "claude-sonnet-4-5", 1000)
+	if strings.Contains(string(body), "sig-call") {
+		t.Errorf("anthropic request = %s, want no Gemini signatures", body)
+	}
+}
+
+func TestGeminiClassifyError(t *testing.T) {
+	p := &GeminiProtocol{}
+	if err := p.ClassifyError(400, fixture(t, "gemini_error_key.json")); !errors.Is(err, ErrAuth) {
+		t.Errorf("invalid key: %v", err)
+	}
+	if err := p.ClassifyError(403, []byte(`{}`)); !errors.Is(err, ErrAuth) {
+		t.Errorf("403: %v", err)
+	}
+	if err := p.ClassifyError(400, fixture(t, "gemini_error_context.json")); !errors.Is(err, ErrContextOverflow) {
+		t.Errorf("context: %v", err)
+	}
+	err := p.ClassifyError(429, fixture(t, "gemini_error_quota.json"))
+	if errors.Is(err, ErrAuth) || errors.Is(err, ErrContextOverflow) || !strings.Contains(err.Error(), "HTTP 429") {
+		t.Errorf("quota: %v", err)
+	}
+}
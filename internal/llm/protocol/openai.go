@@ -18,9 +18,15 @@ type OpenAIProtocol struct{}
 // ---------------------------------------------------------------------------
 
 type openaiRequest struct {
-	Model    string          `json:"model"`
-	Messages []openaiMessage `json:"messages"`
-	Tools    []openaiTool    `json:"tools,omitempty"`
+	Model         string               `json:"model"`
+	Messages      []openaiMessage      `json:"messages"`
+	Tools         []openaiTool         `json:"tools,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *openaiStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openaiStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type openaiMessage struct {
@@ -78,6 +84,7 @@ type openaiError struct {
 		Type    string `json:"type"`
 		Message string `json:"message"`
 		Code    string `json:"code"`
+		Param   string `json:"param"`
 	} `json:"error"`
 }
 
@@ -94,16 +101,23 @@ func (p *OpenAIProtocol) EndpointPath() string {
 }
 
 func (p *OpenAIProtocol) EncodeRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
-	apiMsgs := convertOpenAIMessages(messages)
-	apiTools := convertOpenAITools(tools)
+	return json.Marshal(buildOpenAIRequest(messages, tools, model))
+}
+
+func (p *OpenAIProtocol) EncodeStreamRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
+	req := buildOpenAIRequest(messages, tools, model)
+	req.Stream = true
+	// Without this the stream carries no usage and token accounting breaks.
+	req.StreamOptions = &openaiStreamOptions{IncludeUsage: true}
+	return json.Marshal(req)
+}
 
-	req := openaiRequest{
+func buildOpenAIRequest(messages []tape.Message, tools []ToolSchema, model string) openaiRequest {
+	return openaiRequest{
 		Model:    model,
-		Messages: apiMsgs,
-		Tools:    apiTools,
+		Messages: convertOpenAIMessages(messages),
+		Tools:    convertOpenAITools(tools),
 	}
-
-	return json.Marshal(req)
 }
 
 func (p *OpenAIProtocol) DecodeResponse(body []byte) (tape.Message, Usage, error) {
@@ -121,24 +135,46 @@ func (p *OpenAIProtocol) DecodeResponse(body []byte) (tape.Message, Usage, error
 	return msg, usage, nil
 }
 
+// ClassifyError maps OpenAI's error codes (shared by Azure OpenAI and most
+// compatible servers) onto the shared taxonomy.
 func (p *OpenAIProtocol) ClassifyError(statusCode int, body []byte) error {
-	switch {
-	case statusCode == 401 || statusCode == 403:
-		return ErrAuth
+	e := &APIError{Provider: "openai", Status: statusCode}
+	var oe openaiError
+	if json.Unmarshal(body, &oe) == nil && (oe.Error.Message != "" || oe.Error.Code != "") {
+		e.Type, e.Message = oe.Error.Code, oe.Error.Message
+		if e.Type == "" {
+			e.Type = oe.Error.Type
+		}
+	} else {
+		e.Message = truncateBody(body)
+	}
+
+	switch code := strings.ToLower(oe.Error.Code); {
+	case statusCode == 401 || statusCode == 403 || code == "invalid_api_key":
+		e.Kind = ErrAuth
+	case code == "insufficient_quota" || oe.Error.Type == "insufficient_quota":
+		e.Kind = ErrQuotaExhausted
+	case code == "context_length_exceeded":
+		e.Kind = ErrContextOverflow
+	case code == "content_filter" || code == "content_policy_violation":
+		e.Kind = ErrContentFilter
+	case code == "rate_limit_exceeded":
+		e.Kind = ErrRateLimit
+	case code == "server_error":
+		e.Kind = ErrServer
+	case statusCode == 0 && oe.Error.Type == "invalid_request_error":
+		e.Kind = ErrInvalidRequest
 	default:
-		var oe openaiError
-		if json.Unmarshal(body, &oe) == nil {
-			msg := strings.ToLower(oe.Error.Message)
-			code := strings.ToLower(oe.Error.Code)
-			if strings.Contains(msg, "context") || strings.Contains(msg, "too many tokens") ||
-				strings.Contains(msg, "maximum context length") ||
-				(strings.Contains(msg, "token") && strings.Contains(msg, "exceed")) ||
-				code == "context_length_exceeded" {
-				return ErrContextOverflow
-			}
+		e.Kind = kindForStatus(statusCode)
+	}
+	if e.Kind == ErrInvalidRequest || e.Kind == nil {
+		if mentionsContextOverflow(e.Message) {
+			e.Kind = ErrContextOverflow
+		} else if e.Kind != nil {
+			e.Field = oe.Error.Param
 		}
-		return fmt.Errorf("openai API error (HTTP %d): %s", statusCode, string(body))
 	}
+	return e
 }
 
 // ---------------------------------------------------------------------------
@@ -248,3 +284,134 @@ func parseOpenAIResponse(resp openaiResponse) tape.Message {
 		Timestamp:        time.Now().UnixMilli(),
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Streaming: OpenAI SSE → tape
+// ---------------------------------------------------------------------------
+
+type openaiStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *json.RawMessage `json:"error"`
+}
+
+// openaiStreamToolCall is a tool call being assembled from deltas, keyed by
+// its index in the choice.
+type openaiStreamToolCall struct {
+	id   string
+	name string
+	args strings.Builder
+}
+
+type openaiStreamDecoder struct {
+	content   strings.Builder
+	reasoning strings.Builder
+	toolCalls []*openaiStreamToolCall
+	usage     Usage
+	finished  bool // a choice carried a finish_reason
+	done      bool
+}
+
+func (p *OpenAIProtocol) NewStreamDecoder() StreamDecoder {
+	return &openaiStreamDecoder{}
+}
+
+func (d *openaiStreamDecoder) Done() bool { return d.done }
+
+// Complete also accepts a finish_reason without the closing [DONE], which
+// some OpenAI-compatible servers never send.
+func (d *openaiStreamDecoder) Complete() bool { return d.done || d.finished }
+
+func (d *openaiStreamDecoder) Event(event string, data []byte) (StreamDelta, error) {
+	if string(data) == "[DONE]" {
+		d.done = true
+		return StreamDelta{}, nil
+	}
+
+	var chunk openaiStreamChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return StreamDelta{}, fmt.Errorf("unmarshalling stream chunk: %w", err)
+	}
+	if chunk.Error != nil {
+		return StreamDelta{}, (&OpenAIProtocol{}).ClassifyError(0, data)
+	}
+	if chunk.Usage != nil {
+		d.usage = Usage{
+			InputTokens:  chunk.Usage.PromptTokens,
+			OutputTokens: chunk.Usage.CompletionTokens,
+		}
+	}
+	if len(chunk.Choices) == 0 {
+		return StreamDelta{}, nil
+	}
+
+	if chunk.Choices[0].FinishReason != "" {
+		d.finished = true
+	}
+	delta := chunk.Choices[0].Delta
+	out := StreamDelta{
+		Text:      delta.Content,
+		Reasoning: delta.ReasoningContent,
+	}
+	d.content.WriteString(delta.Content)
+	d.reasoning.WriteString(delta.ReasoningContent)
+
+	for _, tc := range delta.ToolCalls {
+		for len(d.toolCalls) <= tc.Index {
+			d.toolCalls = append(d.toolCalls, &openaiStreamToolCall{})
+		}
+		call := d.toolCalls[tc.Index]
+		if tc.ID != "" {
+			call.id = tc.ID
+		}
+		if tc.Function.Name != "" && call.name == "" {
+			call.name = tc.Function.Name
+			out.ToolCall = call.name
+		}
+		call.args.WriteString(tc.Function.Arguments)
+		out.ToolArgs += tc.Function.Arguments
+	}
+	return out, nil
+}
+
+func (d *openaiStreamDecoder) Result() (tape.Message, Usage, error) {
+	var toolCalls []tape.ToolCall
+	for _, tc := range d.toolCalls {
+		args := map[string]any{}
+		if raw := tc.args.String(); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &args); err != nil {
+				return tape.Message{}, Usage{}, fmt.Errorf("tool call %s: unmarshalling streamed arguments: %w", tc.id, err)
+			}
+		}
+		toolCalls = append(toolCalls, tape.ToolCall{
+			ID:        tc.id,
+			Name:      tc.name,
+			Arguments: args,
+		})
+	}
+
+	return tape.Message{
+		Role:             tape.RoleAssistant,
+		Content:          d.content.String(),
+		ReasoningContent: d.reasoning.String(),
+		ToolCalls:        toolCalls,
+		Timestamp:        time.Now().UnixMilli(),
+	}, d.usage, nil
+}
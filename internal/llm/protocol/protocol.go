@@ -3,6 +3,7 @@
 package protocol
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/kehao95/quine/internal/tape"
@@ -10,8 +11,23 @@ import (
 
 // Usage reports token consumption for a single LLM call.
 type Usage struct {
-	InputTokens  int
+	InputTokens  int // the whole prompt, cached parts included
 	OutputTokens int
+
+	// The parts of InputTokens written to and read from the provider's
+	// prompt cache (Anthropic prompt caching).
+	CacheWriteTokens int
+	CacheReadTokens  int
+}
+
+// reasoningItemType returns the "type" of a tape.Message reasoning item,
+// which tells the providers' items apart.
+func reasoningItemType(raw json.RawMessage) string {
+	var item struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(raw, &item)
+	return item.Type
 }
 
 // ToolSchema describes a tool that can be offered to the model.
@@ -29,6 +45,14 @@ type Protocol interface {
 	// DecodeResponse parses provider response into tape message + usage.
 	DecodeResponse(body []byte) (tape.Message, Usage, error)
 
+	// EncodeStreamRequest is EncodeRequest with streaming enabled
+	// ("stream": true), so the response arrives as Server-Sent Events.
+	EncodeStreamRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error)
+
+	// NewStreamDecoder returns a decoder that assembles one streamed
+	// response from its SSE events.
+	NewStreamDecoder() StreamDecoder
+
 	// ClassifyError interprets an error response body.
 	ClassifyError(statusCode int, body []byte) error
 
@@ -39,14 +63,52 @@ type Protocol interface {
 	EndpointPath() string
 }
 
-// For returns the Protocol implementation for a given API type.
-// Only "openai" and "anthropic" are supported.
+// StreamDelta is the incremental content carried by one SSE event. It is
+// only used for live progress reporting; the decoder assembles the message.
+type StreamDelta struct {
+	Text      string // text appended to the reply
+	Reasoning string // reasoning/thinking appended to the reply
+	ToolCall  string // name of a tool call that just started
+	ToolArgs  string // fragment of a tool call's JSON arguments
+}
+
+// StreamDecoder incrementally assembles a streamed response into a
+// tape.Message: text, reasoning and tool-call argument deltas.
+type StreamDecoder interface {
+	// Event consumes one SSE event. An error event from the provider is
+	// returned as an error, classified like ClassifyError.
+	Event(event string, data []byte) (StreamDelta, error)
+
+	// Done reports whether the terminal event has been seen.
+	Done() bool
+
+	// Complete reports whether the stream marked the end of the reply:
+	// the terminal event or, for servers that omit it, an equivalent such
+	// as OpenAI's finish_reason. A stream that ends incomplete was cut off.
+	Complete() bool
+
+	// Result returns the assembled message and usage.
+	Result() (tape.Message, Usage, error)
+}
+
+// StreamEndpointer is implemented by protocols that stream from a different
+// endpoint than they generate from, rather than by a flag in the body.
+type StreamEndpointer interface {
+	StreamEndpointPath() string
+}
+
+// For returns the Protocol implementation for a given API type:
+// "openai", "openai-responses", "azure-openai", "anthropic" or "gemini".
 func For(apiType, model string) (Protocol, error) {
 	switch apiType {
 	case "anthropic":
 		return &AnthropicProtocol{}, nil
-	case "openai":
+	case "openai", "azure-openai":
 		return &OpenAIProtocol{}, nil
+	case "openai-responses":
+		return &OpenAIResponsesProtocol{}, nil
+	case "gemini":
+		return &GeminiProtocol{Model: model}, nil
 	default:
 		return nil, fmt.Errorf("unknown provider: %s", apiType)
 	}
@@ -0,0 +1,431 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// OpenAIResponsesProtocol implements Protocol for OpenAI's Responses API
+// (/v1/responses), which reasoning models prefer over Chat Completions.
+//
+// Requests are stateless (store: false): the conversation is sent as input
+// items each turn, and the model's reasoning travels with it as encrypted
+// reasoning items kept on the tape (tape.Message.ReasoningItems). Passing
+// them back keeps the model's chain of thought across tool calls, which the
+// chat-completions path drops.
+type OpenAIResponsesProtocol struct{}
+
+// ---------------------------------------------------------------------------
+// API request/response types
+// ---------------------------------------------------------------------------
+
+type responsesRequest struct {
+	Model        string          `json:"model"`
+	Instructions string          `json:"instructions,omitempty"`
+	Input        []any           `json:"input"`
+	Tools        []responsesTool `json:"tools,omitempty"`
+	Store        bool            `json:"store"`
+	Include      []string        `json:"include,omitempty"`
+	Stream       bool            `json:"stream,omitempty"`
+}
+
+type responsesTool struct {
+	Type        string         `json:"type"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+// Input items. Reasoning items are sent as the raw JSON received.
+type responsesMessage struct {
+	Type    string `json:"type"`
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type responsesContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type responsesFunctionCall struct {
+	Type      string `json:"type"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type responsesFunctionCallOutput struct {
+	Type   string `json:"type"`
+	CallID string `json:"call_id"`
+	Output string `json:"output"`
+}
+
+// responsesItem is an output item of any type; each type populates its own
+// fields.
+type responsesItem struct {
+	Type string `json:"type"`
+
+	// message
+	Role    string             `json:"role"`
+	Content []responsesContent `json:"content"`
+
+	// function_call
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+
+	// reasoning
+	Summary []responsesContent `json:"summary"`
+}
+
+type responsesResponse struct {
+	Status string            `json:"status"`
+	Output []json.RawMessage `json:"output"`
+	Usage  *struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"` // "max_output_tokens", "content_filter"
+	} `json:"incomplete_details"`
+}
+
+// ---------------------------------------------------------------------------
+// Protocol implementation
+// ---------------------------------------------------------------------------
+
+func (p *OpenAIResponsesProtocol) ContentType() string {
+	return "application/json"
+}
+
+func (p *OpenAIResponsesProtocol) EndpointPath() string {
+	return "/v1/responses"
+}
+
+func (p *OpenAIResponsesProtocol) EncodeRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
+	req, err := buildResponsesRequest(messages, tools, model)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(req)
+}
+
+func (p *OpenAIResponsesProtocol) EncodeStreamRequest(messages []tape.Message, tools []ToolSchema, model string, maxTokens int) ([]byte, error) {
+	req, err := buildResponsesRequest(messages, tools, model)
+	if err != nil {
+		return nil, err
+	}
+	req.Stream = true
+	return json.Marshal(req)
+}
+
+// buildResponsesRequest sends no max_output_tokens, like the chat path:
+// a cap would cut reasoning models off mid-thought.
+func buildResponsesRequest(messages []tape.Message, tools []ToolSchema, model string) (responsesRequest, error) {
+	instructions, input, err := convertResponsesMessages(messages)
+	if err != nil {
+		return responsesRequest{}, err
+	}
+	return responsesRequest{
+		Model:        model,
+		Instructions: instructions,
+		Input:        input,
+		Tools:        convertResponsesTools(tools),
+		Store:        false,
+		Include:      []string{"reasoning.encrypted_content"},
+	}, nil
+}
+
+func (p *OpenAIResponsesProtocol) DecodeResponse(body []byte) (tape.Message, Usage, error) {
+	var resp responsesResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return tape.Message{}, Usage{}, fmt.Errorf("unmarshalling response: %w", err)
+	}
+	return parseResponsesResponse(resp)
+}
+
+// ClassifyError: the Responses API reports errors in the same shape as
+// Chat Completions.
+func (p *OpenAIResponsesProtocol) ClassifyError(statusCode int, body []byte) error {
+	return (&OpenAIProtocol{}).ClassifyError(statusCode, body)
+}
+
+// ---------------------------------------------------------------------------
+// Message conversion: tape → Responses input items
+// ---------------------------------------------------------------------------
+
+// convertResponsesMessages maps the tape onto input items. An assistant
+// turn becomes its reasoning items (verbatim), then its text, then one
+// function_call per tool call; a tool result becomes function_call_output.
+// ReasoningContent without reasoning items, and other providers' items
+// (e.g. Anthropic thinking blocks), are not sent: the API only accepts
+// reasoning it issued.
+func convertResponsesMessages(msgs []tape.Message) (string, []any, error) {
+	var instructions string
+	input := []any{}
+
+	for _, m := range msgs {
+		switch m.Role {
+		case tape.RoleSystem:
+			if instructions != "" {
+				instructions += "\n\n"
+			}
+			instructions += m.Content
+
+		case tape.RoleUser:
+			input = append(input, responsesMessage{
+				Type:    "message",
+				Role:    "user",
+				Content: []responsesContent{{Type: "input_text", Text: m.Content}},
+			})
+
+		case tape.RoleAssistant:
+			for _, item := range m.ReasoningItems {
+				if reasoningItemType(item) == "reasoning" {
+					input = append(input, item)
+				}
+			}
+			if text := strings.TrimRight(m.Content, " \t\n\r"); text != "" {
+				input = append(input, responsesMessage{
+					Type:    "message",
+					Role:    "assistant",
+					Content: []responsesContent{{Type: "output_text", Text: text}},
+				})
+			}
+			for _, tc := range m.ToolCalls {
+				args, err := json.Marshal(tc.Arguments)
+				if err != nil {
+					return "", nil, fmt.Errorf("tool call %s: marshalling arguments: %w", tc.ID, err)
+				}
+				input = append(input, responsesFunctionCall{
+					Type:      "function_call",
+					CallID:    tc.ID,
+					Name:      tc.Name,
+					Arguments: string(args),
+				})
+			}
+
+		case tape.RoleToolResult:
+			input = append(input, responsesFunctionCallOutput{
+				Type:   "function_call_output",
+				CallID: m.ToolID,
+				Output: m.Content,
+			})
+		}
+	}
+
+	return instructions, input, nil
+}
+
+func convertResponsesTools(tools []ToolSchema) []responsesTool {
+	if len(tools) == 0 {
+		return nil
+	}
+	out := make([]responsesTool, len(tools))
+	for i, t := range tools {
+		params := t.Parameters
+		if params == nil {
+			params = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		out[i] = responsesTool{
+			Type:        "function",
+			Name:        t.Name,
+			Description: t.Description,
+			Parameters:  params,
+		}
+	}
+	return out
+}
+
+// ---------------------------------------------------------------------------
+// Response parsing: Responses output items → tape
+// ---------------------------------------------------------------------------
+
+func parseResponsesResponse(resp responsesResponse) (tape.Message, Usage, error) {
+	if resp.Status == "failed" && resp.Error != nil {
+		return tape.Message{}, Usage{}, fmt.Errorf("openai response failed (%s): %s", resp.Error.Code, resp.Error.Message)
+	}
+	if resp.Status == "incomplete" {
+		return tape.Message{}, Usage{}, incompleteError(resp)
+	}
+	msg, err := parseResponsesOutput(resp.Output)
+	if err != nil {
+		return tape.Message{}, Usage{}, err
+	}
+	var usage Usage
+	if resp.Usage != nil {
+		// output_tokens already includes the reasoning tokens.
+		usage = Usage{InputTokens: resp.Usage.InputTokens, OutputTokens: resp.Usage.OutputTokens}
+	}
+	return msg, usage, nil
+}
+
+// incompleteError reports a response the API stopped early. A reply cut
+// off at max_output_tokens may end mid tool call, so it is not used.
+func incompleteError(resp responsesResponse) error {
+	reason := "unknown"
+	if resp.IncompleteDetails != nil && resp.IncompleteDetails.Reason != "" {
+		reason = resp.IncompleteDetails.Reason
+	}
+	e := &APIError{Provider: "openai", Type: reason, Message: "response incomplete: " + reason}
+	if reason == "content_filter" {
+		e.Kind = ErrContentFilter
+	}
+	return e
+}
+
+func parseResponsesOutput(output []json.RawMessage) (tape.Message, error) {
+	var textParts, reasoningParts []string
+	var toolCalls []tape.ToolCall
+	var reasoningItems []json.RawMessage
+
+	for _, raw := range output {
+		var item responsesItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return tape.Message{}, fmt.Errorf("unmarshalling output item: %w", err)
+		}
+		switch item.Type {
+		case "reasoning":
+			reasoningItems = append(reasoningItems, raw)
+			for _, s := range item.Summary {
+				reasoningParts = append(reasoningParts, s.Text)
+			}
+		case "message":
+			for _, c := range item.Content {
+				if c.Type == "output_text" {
+					textParts = append(textParts, c.Text)
+				}
+			}
+		case "function_call":
+			args := map[string]any{}
+			if item.Arguments != "" {
+				if err := json.Unmarshal([]byte(item.Arguments), &args); err != nil {
+					return tape.Message{}, fmt.Errorf("function_call %s: unmarshalling arguments: %w", item.CallID, err)
+				}
+			}
+			toolCalls = append(toolCalls, tape.ToolCall{
+				ID:        item.CallID,
+				Name:      item.Name,
+				Arguments: args,
+			})
+		}
+	}
+
+	return tape.Message{
+		Role:             tape.RoleAssistant,
+		Content:          strings.Join(textParts, ""),
+		ReasoningContent: strings.Join(reasoningParts, "\n\n"),
+		ReasoningItems:   reasoningItems,
+		ToolCalls:        toolCalls,
+		Timestamp:        time.Now().UnixMilli(),
+	}, nil
+}
+
+// ---------------------------------------------------------------------------
+// Streaming: Responses SSE → tape
+// ---------------------------------------------------------------------------
+
+// responsesStreamEvent covers the streaming events used here; each only
+// populates its own fields.
+type responsesStreamEvent struct {
+	Type        string             `json:"type"`
+	OutputIndex int                `json:"output_index"`
+	Delta       string             `json:"delta"`
+	Item        json.RawMessage    `json:"item"`
+	Response    *responsesResponse `json:"response"`
+	Code        string             `json:"code"`
+	Message     string             `json:"message"`
+}
+
+// The deltas are only for progress; the message is assembled from the
+// complete items of response.output_item.done, or from the final response
+// when response.completed carries its output.
+type responsesStreamDecoder struct {
+	items []json.RawMessage // by output_index
+	final *responsesResponse
+	done  bool
+}
+
+func (p *OpenAIResponsesProtocol) NewStreamDecoder() StreamDecoder {
+	return &responsesStreamDecoder{}
+}
+
+func (d *responsesStreamDecoder) Done() bool { return d.done }
+
+func (d *responsesStreamDecoder) Complete() bool { return d.done }
+
+func (d *responsesStreamDecoder) Event(event string, data []byte) (StreamDelta, error) {
+	var ev responsesStreamEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return StreamDelta{}, fmt.Errorf("unmarshalling stream event: %w", err)
+	}
+
+	switch ev.Type {
+	case "response.output_item.added":
+		var item responsesItem
+		if json.Unmarshal(ev.Item, &item) == nil && item.Type == "function_call" {
+			return StreamDelta{ToolCall: item.Name}, nil
+		}
+
+	case "response.output_text.delta":
+		return StreamDelta{Text: ev.Delta}, nil
+
+	case "response.reasoning_summary_text.delta":
+		return StreamDelta{Reasoning: ev.Delta}, nil
+
+	case "response.function_call_arguments.delta":
+		return StreamDelta{ToolArgs: ev.Delta}, nil
+
+	case "response.output_item.done":
+		for len(d.items) <= ev.OutputIndex {
+			d.items = append(d.items, nil)
+		}
+		d.items[ev.OutputIndex] = ev.Item
+
+	case "response.completed", "response.incomplete":
+		d.final = ev.Response
+		d.done = true
+
+	case "response.failed":
+		d.done = true
+		if ev.Response != nil && ev.Response.Error != nil {
+			return StreamDelta{}, classifyResponsesStreamError(ev.Response.Error.Code, ev.Response.Error.Message)
+		}
+		return StreamDelta{}, fmt.Errorf("openai response failed: %s", data)
+
+	case "error":
+		return StreamDelta{}, classifyResponsesStreamError(ev.Code, ev.Message)
+	}
+	return StreamDelta{}, nil
+}
+
+// classifyResponsesStreamError classifies an in-stream error like an
+// error response body.
+func classifyResponsesStreamError(code, message string) error {
+	body, _ := json.Marshal(map[string]any{"error": map[string]string{"code": code, "message": message}})
+	return (&OpenAIProtocol{}).ClassifyError(0, body)
+}
+
+func (d *responsesStreamDecoder) Result() (tape.Message, Usage, error) {
+	resp := responsesResponse{}
+	if d.final != nil {
+		resp = *d.final
+	}
+	if len(resp.Output) == 0 {
+		for _, item := range d.items {
+			if item != nil {
+				resp.Output = append(resp.Output, item)
+			}
+		}
+	}
+	return parseResponsesResponse(resp)
+}
@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// TestResponsesReasoningContinuity decodes a reply with a reasoning item,
+// stores it on the tape and checks the next request sends it back verbatim,
+// right before the function call it led to.
+func TestResponsesReasoningContinuity(t *testing.T) {
+	p := &OpenAIResponsesProtocol{}
+	reply, usage, err := p.DecodeResponse(fixture(t, "responses_function_call.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.InputTokens != 1311 || usage.OutputTokens != 214 {
+		t.Errorf("usage = %+v", usage)
+	}
+	if !strings.Contains(reply.ReasoningContent, "Counting files") || len(reply.ReasoningItems) != 1 {
+		t.Errorf("reasoning = %q, items = %d", reply.ReasoningContent, len(reply.ReasoningItems))
+	}
+	if len(reply.ToolCalls) != 1 || reply.ToolCalls[0].ID != "call_Xq1bT7mQvN2pR4sL" || reply.ToolCalls[0].Arguments["command"] != "ls -1 | wc -l" {
+		t.Fatalf("tool calls = %+v", reply.ToolCalls)
+	}
+
+	// Through the tape and back, as a resumed or forked session would.
+	data, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored tape.Message
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []tape.Message{
+		{Role: tape.RoleSystem, Content: "You are quine."},
+		{Role: tape.RoleUser, Content: "count files"},
+		stored,
+		{Role: tape.RoleToolResult, ToolID: "call_Xq1bT7mQvN2pR4sL", Content: "3"},
+	}
+	body, err := p.EncodeRequest(msgs, []ToolSchema{{Name: "sh", Description: "run"}}, "o4-mini", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Instructions string            `json:"instructions"`
+		Input        []json.RawMessage `json:"input"`
+		Store        bool              `json:"store"`
+		Include      []string          `json:"include"`
+		Tools        []responsesTool   `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Instructions != "You are quine." || req.Store || len(req.Include) != 1 || req.Include[0] != "reasoning.encrypted_content" {
+		t.Errorf("request = %s", body)
+	}
+	if len(req.Tools) != 1 || req.Tools[0].Type != "function" || req.Tools[0].Parameters == nil {
+		t.Errorf("tools = %+v", req.Tools)
+	}
+
+	var types []string
+	for _, raw := range req.Input {
+		var item responsesItem
+		json.Unmarshal(raw, &item)
+		types = append(types, item.Type)
+	}
+	if got := strings.Join(types, ","); got != "message,reasoning,function_call,function_call_output" {
+		t.Fatalf("input item types = %s", got)
+	}
+	if !strings.Contains(string(req.Input[1]), `"encrypted_content":"gAAAAABo8MGz3kQ1V2x0bXBsZS1lbmNyeXB0ZWQtcmVhc29uaW5n"`) ||
+		!strings.Contains(string(req.Input[1]), `"id":"rs_68f0c1b3a1b88190b2c3d4e5f6a7b8c9"`) {
+		t.Errorf("reasoning item not sent verbatim: %s", req.Input[1])
+	}
+	var call responsesFunctionCall
+	json.Unmarshal(req.Input[2], &call)
+	var output responsesFunctionCallOutput
+	json.Unmarshal(req.Input[3], &output)
+	if call.CallID != "call_Xq1bT7mQvN2pR4sL" || call.Arguments != `{"command":"ls -1 | wc -l"}` || output.CallID != call.CallID || output.Output != "3" {
+		t.Errorf("call = %+v, output = %+v", call, output)
+	}
+}
+
+func TestResponsesStreamDecoder(t *testing.T) {
+	dec := (&OpenAIResponsesProtocol{}).NewStreamDecoder()
+	var text, reasoning, args strings.Builder
+	var started []string
+	err := ReadSSE(strings.NewReader(string(fixture(t, "responses_stream.txt"))), func(event string, data []byte) error {
+		delta, err := dec.Event(event, data)
+		text.WriteString(delta.Text)
+		reasoning.WriteString(delta.Reasoning)
+		args.WriteString(delta.ToolArgs)
+		if delta.ToolCall != "" {
+			started = append(started, delta.ToolCall)
+		}
+		return err
+	}, dec.Done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dec.Done() {
+		t.Error("stream not done after response.completed")
+	}
+	if text.String() != "Listing files." || reasoning.String() != "Count the files." || args.String() != `{"command":"ls"}` || len(started) != 1 {
+		t.Errorf("deltas: text %q, reasoning %q, args %q, started %v", text.String(), reasoning.String(), args.String(), started)
+	}
+
+	msg, usage, err := dec.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "Listing files." || msg.ReasoningContent != "Count the files." || len(msg.ReasoningItems) != 1 {
+		t.Errorf("message = %+v", msg)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].ID != "call_s1" || msg.ToolCalls[0].Arguments["command"] != "ls" {
+		t.Errorf("tool calls = %+v", msg.ToolCalls)
+	}
+	if usage.InputTokens != 900 || usage.OutputTokens != 120 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestResponsesErrors(t *testing.T) {
+	p := &OpenAIResponsesProtocol{}
+	if err := p.ClassifyError(400, fixture(t, "responses_error_context.json")); !errors.Is(err, ErrContextOverflow) {
+		t.Errorf("context: %v", err)
+	}
+	if err := p.ClassifyError(401, []byte(`{}`)); !errors.Is(err, ErrAuth) {
+		t.Errorf("401: %v", err)
+	}
+
+	dec := p.NewStreamDecoder()
+	_, err := dec.Event("response.failed", []byte(`{"type":"response.failed","response":{"status":"failed","error":{"code":"server_error","message":"The model failed."},"output":[]}}`))
+	if err == nil || errors.Is(err, ErrContextOverflow) || !strings.Contains(err.Error(), "The model failed.") {
+		t.Errorf("response.failed: %v", err)
+	}
+	_, err = p.NewStreamDecoder().Event("error", []byte(`{"type":"error","code":"context_length_exceeded","message":"Your input exceeds the context window."}`))
+	if !errors.Is(err, ErrContextOverflow) {
+		t.Errorf("stream error event: %v", err)
+	}
+
+	// A response cut short is an error, not a reply.
+	dec = p.NewStreamDecoder()
+	dec.Event("response.incomplete", []byte(`{"type":"response.incomplete","response":{"status":"incomplete","incomplete_details":{"reason":"max_output_tokens"},"output":[{"type":"function_call","call_id":"call_1","name":"sh","arguments":"{\"comm"}]}}`))
+	if _, _, err := dec.Result(); err == nil || !strings.Contains(err.Error(), "max_output_tokens") {
+		t.Errorf("response.incomplete: %v", err)
+	}
+	dec = p.NewStreamDecoder()
+	dec.Event("response.incomplete", []byte(`{"type":"response.incomplete","response":{"status":"incomplete","incomplete_details":{"reason":"content_filter"},"output":[]}}`))
+	if _, _, err := dec.Result(); !errors.Is(err, ErrContentFilter) {
+		t.Errorf("response.incomplete content_filter: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// ReadSSE parses a Server-Sent Events stream and calls fn once per event
+// with its event name (empty if none was given) and data. Multiple data
+// lines are joined with '\n'; comment lines (":") and unknown fields are
+// ignored. It stops at EOF, when fn returns an error, or when stop reports
+// true after an event.
+func ReadSSE(r io.Reader, fn func(event string, data []byte) error, stop func() bool) error {
+	br := bufio.NewReader(r)
+	var event string
+	var data []byte
+	var hasData bool
+
+	dispatch := func() error {
+		if !hasData {
+			event = ""
+			return nil
+		}
+		err := fn(event, data)
+		event, data, hasData = "", nil, false
+		return err
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			switch {
+			case len(line) == 0:
+				if err := dispatch(); err != nil {
+					return err
+				}
+				if stop() {
+					return nil
+				}
+			case line[0] == ':':
+				// comment / keep-alive
+			default:
+				field, value, _ := bytes.Cut(line, []byte(":"))
+				value = bytes.TrimPrefix(value, []byte(" "))
+				switch string(field) {
+				case "event":
+					event = string(value)
+				case "data":
+					if hasData {
+						data = append(data, '\n')
+					}
+					data = append(data, value...)
+					hasData = true
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return dispatch()
+			}
+			return err
+		}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/kehao95/quine/internal/broker"
 	"github.com/kehao95/quine/internal/config"
 	"github.com/kehao95/quine/internal/llm/protocol"
 	"github.com/kehao95/quine/internal/llm/transport"
@@ -18,12 +20,19 @@ import (
 type (
 	Usage      = protocol.Usage
 	ToolSchema = protocol.ToolSchema
+	APIError   = protocol.APIError
 )
 
 // Re-export errors from protocol package
 var (
 	ErrAuth            = protocol.ErrAuth
 	ErrContextOverflow = protocol.ErrContextOverflow
+	ErrRateLimit       = protocol.ErrRateLimit
+	ErrOverloaded      = protocol.ErrOverloaded
+	ErrServer          = protocol.ErrServer
+	ErrInvalidRequest  = protocol.ErrInvalidRequest
+	ErrContentFilter   = protocol.ErrContentFilter
+	ErrQuotaExhausted  = protocol.ErrQuotaExhausted
 )
 
 // Provider is the interface that all LLM backends must implement.
@@ -32,86 +41,191 @@ type Provider interface {
 	ContextWindowSize() int
 }
 
+// minReplyTokens is the least room left for a reply beside a thinking
+// budget.
+const minReplyTokens = 1024
+
 // provider implements Provider using composable protocol and transport.
 type provider struct {
 	proto         protocol.Protocol
 	trans         transport.Transport
 	endpoint      string
+	streamEnd     string // endpoint for streamed requests, usually endpoint
 	model         string
 	maxTokens     int
 	contextWindow int
 	client        *http.Client
+	stream        bool          // QUINE_STREAM: use SSE (see stream.go)
+	streamLenient bool          // QUINE_STREAM_LENIENT: accept a stream cut off before its terminal event
+	idleTimeout   time.Duration // streaming only: max silence before the request is abandoned
+	retry         RetryPolicy
+	limiter       Limiter // tree-wide pacing, installed by the runtime; nil = none
 }
 
-// NewProvider constructs a Provider for the given config.
+// NewProvider constructs a Provider for the given config. With
+// QUINE_FALLBACK set, it is a FailoverProvider over the primary and each
+// fallback.
 func NewProvider(cfg *config.Config) (Provider, error) {
+	if cfg.Provider == "replay" {
+		return NewReplayProvider(cfg.ReplayTape, cfg.ContextWindow)
+	}
+
+	primary, err := newProvider(cfg.ForUpstream())
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Fallback) == 0 {
+		return primary, nil
+	}
+	providers := []Provider{primary}
+	models := []string{primary.model}
+	for _, fb := range cfg.Fallback {
+		p, err := newProvider(cfg.ForFallback(fb))
+		if err != nil {
+			return nil, fmt.Errorf("fallback %s: %w", fb.ModelID, err)
+		}
+		providers = append(providers, p)
+		models = append(models, p.model)
+	}
+	return NewFailoverProvider(providers, models, time.Duration(cfg.FallbackCooldown)*time.Second), nil
+}
+
+// newProvider constructs the provider for one API endpoint.
+func newProvider(cfg *config.Config) (*provider, error) {
 	// Get protocol for this API type
 	proto, err := protocol.For(cfg.Provider, cfg.APIModelID())
 	if err != nil {
 		return nil, err
 	}
+	// Output limit and reasoning support come from the model registry.
+	maxTokens := cfg.Models.Resolve(cfg.ModelID, cfg.Provider).MaxOutput
+	if ap, ok := proto.(*protocol.AnthropicProtocol); ok {
+		ap.ThinkingBudget = cfg.ThinkingBudget
+		if m, known := cfg.Models.Lookup(cfg.ModelID); known && ap.ThinkingBudget > 0 {
+			if !m.Reasoning {
+				logf("%s does not support extended thinking, ignoring QUINE_THINKING_BUDGET", cfg.ModelID)
+				ap.ThinkingBudget = 0
+			} else {
+				// The budget is added to max_tokens, which must stay
+				// within the model's output limit.
+				maxTokens = max(maxTokens-ap.ThinkingBudget, minReplyTokens)
+			}
+		}
+	}
 
 	// Get transport for this API type
-	trans, err := transport.For(cfg.Provider, cfg.APIKey)
+	trans, err := transport.ForConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	// Build endpoint URL
-	endpoint := buildEndpoint(cfg, proto)
+	// Build endpoint URLs
+	endpoint := buildEndpoint(cfg, proto.EndpointPath())
+	streamEnd := endpoint
+	if se, ok := proto.(protocol.StreamEndpointer); ok {
+		streamEnd = buildEndpoint(cfg, se.StreamEndpointPath())
+	}
+
+	// A streamed response may legitimately run for a long time; it is
+	// bounded by the idle timeout instead of a whole-request timeout.
+	client := &http.Client{Timeout: 10 * time.Minute}
+	if cfg.Stream {
+		client = &http.Client{}
+	}
+	idleTimeout := time.Duration(cfg.StreamIdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultStreamIdleTimeout
+	}
+
+	// Without a key, calls go through the root's credential broker: same
+	// paths, sent to its socket, carrying the tree's token instead.
+	if cfg.UsesBroker() {
+		base := apiBase(cfg)
+		endpoint = broker.BaseURL + strings.TrimPrefix(endpoint, base)
+		streamEnd = broker.BaseURL + strings.TrimPrefix(streamEnd, base)
+		trans = &transport.BrokerToken{Token: cfg.BrokerToken, Upstream: cfg.BrokerUpstream}
+		client.Transport = broker.ClientTransport(cfg.BrokerSocket)
+	}
 
 	return &provider{
 		proto:         proto,
 		trans:         trans,
 		endpoint:      endpoint,
+		streamEnd:     streamEnd,
 		model:         cfg.APIModelID(),
-		maxTokens:     defaultMaxTokens(cfg.Provider),
+		maxTokens:     maxTokens,
 		contextWindow: cfg.ContextWindow,
-		client:        &http.Client{Timeout: 10 * time.Minute},
+		client:        client,
+		stream:        cfg.Stream,
+		streamLenient: cfg.StreamLenient,
+		idleTimeout:   idleTimeout,
+		retry:         retryPolicyFor(cfg),
 	}, nil
 }
 
 // buildEndpoint constructs the full API endpoint URL from base + protocol path.
-func buildEndpoint(cfg *config.Config, proto protocol.Protocol) string {
-	base := cfg.APIBase
-	if base == "" {
-		base = defaultAPIBase(cfg.Provider)
-	}
-	base = strings.TrimRight(base, "/")
+func buildEndpoint(cfg *config.Config, path string) string {
+	base := apiBase(cfg)
 
-	path := proto.EndpointPath()
+	// Azure OpenAI routes by deployment rather than by the model field, and
+	// versions its API with a query parameter:
+	// {base}/openai/deployments/{deployment}/chat/completions?api-version=...
+	if cfg.Provider == "azure-openai" {
+		base = strings.TrimSuffix(base, "/openai")
+		return base + "/openai/deployments/" + url.PathEscape(cfg.AzureDeployment) +
+			strings.TrimPrefix(path, "/v1") + "?api-version=" + url.QueryEscape(cfg.AzureAPIVersion)
+	}
 
 	// For OpenAI-compatible APIs with custom base URLs,
-	// the base may already include /v1 — avoid doubling it.
-	if strings.HasPrefix(path, "/v1/") && strings.HasSuffix(base, "/v1") {
-		path = path[len("/v1"):]
+	// the base may already include /v1 (or Gemini's /v1beta) — avoid
+	// doubling it.
+	for _, version := range []string{"/v1", "/v1beta"} {
+		if strings.HasPrefix(path, version+"/") && strings.HasSuffix(base, version) {
+			path = path[len(version):]
+		}
 	}
 
 	return base + path
 }
 
+// apiBase returns the configured (or default) base URL without a trailing slash.
+func apiBase(cfg *config.Config) string {
+	base := cfg.APIBase
+	if base == "" {
+		base = defaultAPIBase(cfg.Provider)
+	}
+	return strings.TrimRight(base, "/")
+}
+
 func defaultAPIBase(apiType string) string {
 	switch apiType {
 	case "anthropic":
 		return "https://api.anthropic.com"
-	case "openai":
+	case "openai", "openai-responses":
 		return "https://api.openai.com"
+	case "gemini":
+		return "https://generativelanguage.googleapis.com"
 	default:
 		return ""
 	}
 }
 
-func defaultMaxTokens(apiType string) int {
-	switch apiType {
-	case "anthropic":
-		return 16384
-	default:
-		return 4096
+// Generate sends a conversation and available tools to the model. The
+// reply records the model that produced it.
+func (p *provider) Generate(messages []tape.Message, tools []ToolSchema) (tape.Message, Usage, error) {
+	generate := p.generateOnce
+	if p.stream {
+		generate = p.generateStream
+	}
+	msg, usage, err := generate(messages, tools)
+	if err == nil {
+		msg.Model = p.model
 	}
+	return msg, usage, err
 }
 
-// Generate sends a conversation and available tools to the model.
-func (p *provider) Generate(messages []tape.Message, tools []ToolSchema) (tape.Message, Usage, error) {
+// generateOnce is Generate as a single blocking request.
+func (p *provider) generateOnce(messages []tape.Message, tools []ToolSchema) (tape.Message, Usage, error) {
 	// Encode request using protocol
 	body, err := p.proto.EncodeRequest(messages, tools, p.model, p.maxTokens)
 	if err != nil {
@@ -119,7 +233,7 @@ func (p *provider) Generate(messages []tape.Message, tools []ToolSchema) (tape.M
 	}
 
 	// Execute with retry
-	resp, err := retryWithBackoff(5, func() (*http.Response, error) {
+	resp, err := retryWithBackoff(p.retry, p.limiter, p.refreshOn401(func() (*http.Response, error) {
 		req, err := http.NewRequest("POST", p.endpoint, bytes.NewReader(body))
 		if err != nil {
 			return nil, err
@@ -131,7 +245,7 @@ func (p *provider) Generate(messages []tape.Message, tools []ToolSchema) (tape.M
 		}
 
 		return p.client.Do(req)
-	})
+	}))
 	if err != nil {
 		return tape.Message{}, Usage{}, err
 	}
@@ -149,6 +263,32 @@ func (p *provider) Generate(messages []tape.Message, tools []ToolSchema) (tape.M
 	return p.proto.DecodeResponse(respBody)
 }
 
+// SetLimiter installs the Limiter that paces this provider's requests
+// together with the rest of the process tree.
+func (p *provider) SetLimiter(l Limiter) {
+	p.limiter = l
+}
+
+// refreshOn401 wraps a request so that, when the API rejects the
+// credentials with 401 and the transport can renew them (a rotated key
+// file, a helper command, an expired OAuth token), the request is signed
+// and sent once more.
+func (p *provider) refreshOn401(send func() (*http.Response, error)) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		resp, err := send()
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		rf, ok := p.trans.(transport.Refresher)
+		if !ok || !rf.Refresh() {
+			return resp, nil
+		}
+		drainAndClose(resp)
+		logRetry(1, 1, "credentials rejected (401), refreshing")
+		return send()
+	}
+}
+
 // ContextWindowSize returns the model's context window size in tokens.
 func (p *provider) ContextWindowSize() int {
 	if p.contextWindow > 0 {
@@ -2,14 +2,19 @@ package llm
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/kehao95/quine/internal/broker"
 	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/llm/protocol"
 	"github.com/kehao95/quine/internal/tape"
 )
 
@@ -60,6 +65,36 @@ func TestNewProvider_OpenAI(t *testing.T) {
 	}
 }
 
+func TestNewProvider_MaxTokensFromRegistry(t *testing.T) {
+	tests := []struct {
+		model      string
+		apiType    string
+		thinking   int
+		want       int
+		wantBudget int
+	}{
+		{"claude-sonnet-4-5-20250929", "anthropic", 0, 64000, 0},
+		{"claude-sonnet-4-5-20250929", "anthropic", 10000, 54000, 10000}, // budget fits within the output limit
+		{"claude-3-5-haiku-latest", "anthropic", 4096, 8192, 0},          // no extended thinking
+		{"some-local-claude", "anthropic", 4096, 16384, 4096},            // unknown: defaults, budget on top
+		{"gpt-4.1", "openai", 0, 32768, 0},
+		{"llama3.1:8b", "openai", 0, 4096, 0},
+	}
+	for _, tt := range tests {
+		p, err := newProvider(&config.Config{Provider: tt.apiType, APIKey: "k", ModelID: tt.model, ThinkingBudget: tt.thinking})
+		if err != nil {
+			t.Fatal(err)
+		}
+		budget := 0
+		if ap, ok := p.proto.(*protocol.AnthropicProtocol); ok {
+			budget = ap.ThinkingBudget
+		}
+		if p.maxTokens != tt.want || budget != tt.wantBudget {
+			t.Errorf("%s thinking %d: maxTokens %d, budget %d; want %d, %d", tt.model, tt.thinking, p.maxTokens, budget, tt.want, tt.wantBudget)
+		}
+	}
+}
+
 func TestNewProvider_Unsupported(t *testing.T) {
 	cfg := &config.Config{
 		Provider: "fakeprovider",
@@ -98,8 +133,14 @@ func TestGenerate_Anthropic_FullRoundTrip(t *testing.T) {
 		if err := json.Unmarshal(body, &req); err != nil {
 			t.Fatalf("bad request body: %v", err)
 		}
-		if req["system"] != "You are helpful." {
-			t.Errorf("system = %q", req["system"])
+		var system struct {
+			System []struct {
+				Text string `json:"text"`
+			} `json:"system"`
+		}
+		json.Unmarshal(body, &system)
+		if len(system.System) != 1 || system.System[0].Text != "You are helpful." {
+			t.Errorf("system = %v", req["system"])
 		}
 		if req["model"] != "claude-3-5-sonnet-20241022" {
 			t.Errorf("model = %q", req["model"])
@@ -240,6 +281,275 @@ func TestGenerate_OpenAI_FullRoundTrip(t *testing.T) {
 	}
 }
 
+func TestGenerate_Gemini_Endpoints(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		if got := r.Header.Get("x-goog-api-key"); got != "AIza-test" {
+			t.Errorf("x-goog-api-key = %q", got)
+		}
+		if strings.Contains(r.URL.Path, ":streamGenerateContent") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"streamed\"}]},\"finishReason\":\"STOP\"}],\"usageMetadata\":{\"promptTokenCount\":9,\"candidatesTokenCount\":1}}\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"candidates":[{"content":{"role":"model","parts":[{"text":"whole"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":1}}`)
+	}))
+	defer srv.Close()
+
+	for _, stream := range []bool{false, true} {
+		p, err := NewProvider(&config.Config{
+			Provider: "gemini",
+			APIKey:   "AIza-test",
+			APIBase:  srv.URL + "/v1beta",
+			ModelID:  "gemini-2.5-flash",
+			Stream:   stream,
+		})
+		if err != nil {
+			t.Fatalf("NewProvider: %v", err)
+		}
+		msg, usage, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil)
+		if err != nil {
+			t.Fatalf("Generate(stream=%v): %v", stream, err)
+		}
+		if want := map[bool]string{false: "whole", true: "streamed"}[stream]; msg.Content != want {
+			t.Errorf("stream=%v: content = %q, want %q", stream, msg.Content, want)
+		}
+		if usage.InputTokens != 9 || usage.OutputTokens != 1 {
+			t.Errorf("stream=%v: usage = %+v", stream, usage)
+		}
+	}
+
+	want := []string{
+		"/v1beta/models/gemini-2.5-flash:generateContent",
+		"/v1beta/models/gemini-2.5-flash:streamGenerateContent?alt=sse",
+	}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+}
+
+// TestGenerate_ThroughBroker: a child with no key reaches the API through
+// the root's credential broker, streamed or not, on the same paths.
+func TestGenerate_ThroughBroker(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		if got := r.Header.Get("x-goog-api-key"); got != "AIza-root" {
+			t.Errorf("x-goog-api-key = %q", got)
+		}
+		if strings.Contains(r.URL.Path, ":streamGenerateContent") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"streamed\"}]},\"finishReason\":\"STOP\"}]}\n\n")
+			return
+		}
+		io.WriteString(w, `{"candidates":[{"content":{"role":"model","parts":[{"text":"whole"}]},"finishReason":"STOP"}]}`)
+	}))
+	defer srv.Close()
+
+	root := &config.Config{
+		Provider:         "gemini",
+		APIKey:           "AIza-root",
+		APIBase:          srv.URL + "/v1beta",
+		ModelID:          "gemini-2.5-flash",
+		SessionID:        "root",
+		DataDir:          t.TempDir(),
+		CredentialBroker: true,
+	}
+	b, err := broker.Start(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, stream := range []bool{false, true} {
+		child := *root
+		child.APIKey = ""
+		child.Stream = stream
+		p, err := NewProvider(&child)
+		if err != nil {
+			t.Fatalf("NewProvider: %v", err)
+		}
+		msg, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil)
+		if err != nil {
+			t.Fatalf("Generate(stream=%v): %v", stream, err)
+		}
+		if want := map[bool]string{false: "whole", true: "streamed"}[stream]; msg.Content != want {
+			t.Errorf("stream=%v: content = %q, want %q", stream, msg.Content, want)
+		}
+	}
+
+	want := []string{
+		"/v1beta/models/gemini-2.5-flash:generateContent",
+		"/v1beta/models/gemini-2.5-flash:streamGenerateContent?alt=sse",
+	}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+
+	// A wrong token is an auth failure, not something to retry.
+	child := *root
+	child.APIKey, child.BrokerToken = "", "forged"
+	p, _ := NewProvider(&child)
+	if _, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil); !errors.Is(err, ErrAuth) {
+		t.Errorf("forged token: err = %v, want ErrAuth", err)
+	}
+}
+
+// TestGenerate_BrokeredRoute: a child routed to another API calls it
+// through the broker, which signs with the route's key, not the root's.
+func TestGenerate_BrokeredRoute(t *testing.T) {
+	t.Setenv("TEST_ROUTE_KEY", "sk-route")
+	routed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer sk-route" {
+			t.Errorf("Authorization = %q", got)
+		}
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"routed"}}],"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+	}))
+	defer routed.Close()
+
+	route := config.Route{ModelID: "gpt-4o-mini", Provider: "openai", APIBase: routed.URL, KeyEnv: "TEST_ROUTE_KEY"}
+	root := &config.Config{
+		Provider:         "anthropic",
+		APIKey:           "sk-ant-root",
+		APIBase:          "https://api.anthropic.invalid",
+		ModelID:          "claude-sonnet-4-5",
+		SessionID:        "root",
+		DataDir:          t.TempDir(),
+		CredentialBroker: true,
+		ForkModels:       []config.Route{route},
+	}
+	b, err := broker.Start(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	child := *root
+	child.APIKey, child.ModelID = "", route.ModelID
+	child.Upstream = &config.Fallback{Provider: "openai", ModelID: route.ModelID, APIBase: routed.URL, KeyEnv: "TEST_ROUTE_KEY"}
+	p, err := NewProvider(&child)
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	msg, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil)
+	if err != nil || msg.Content != "routed" {
+		t.Errorf("Generate = %q, %v", msg.Content, err)
+	}
+}
+
+// TestGenerate_RefreshesOn401: an OAuth token the API has revoked is
+// replaced with a fresh grant and the request retried once.
+func TestGenerate_RefreshesOn401(t *testing.T) {
+	var grants atomic.Int32
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token":"tok-%d","expires_in":3600}`, grants.Add(1))
+	}))
+	defer tokens.Close()
+
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer tok-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":{"message":"token revoked"}}`)
+			return
+		}
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+	}))
+	defer api.Close()
+
+	p, err := NewProvider(&config.Config{
+		Provider:          "openai",
+		APIBase:           api.URL,
+		ModelID:           "gpt-4o",
+		OAuthTokenURL:     tokens.URL,
+		OAuthClientID:     "quine",
+		OAuthClientSecret: "s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil)
+	if err != nil || msg.Content != "ok" {
+		t.Fatalf("Generate = %q, %v", msg.Content, err)
+	}
+	if grants.Load() != 2 || calls.Load() != 2 {
+		t.Errorf("%d grants, %d API calls; want 2 and 2", grants.Load(), calls.Load())
+	}
+
+	// A static key is not retried: the 401 is final.
+	calls.Store(0)
+	p, _ = NewProvider(&config.Config{Provider: "openai", APIBase: api.URL, ModelID: "gpt-4o", APIKey: "sk-static"})
+	if _, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil); !errors.Is(err, ErrAuth) || calls.Load() != 1 {
+		t.Errorf("static key: err = %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestGenerate_AzureOpenAI(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.RequestURI())
+		if key := r.Header.Get("api-key"); key != "az-key" || r.Header.Get("Authorization") != "" {
+			t.Errorf("api-key = %q, Authorization = %q", key, r.Header.Get("Authorization"))
+		}
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+	}))
+	defer srv.Close()
+
+	// The base may or may not already end in /openai.
+	for _, base := range []string{srv.URL, srv.URL + "/openai/"} {
+		p, err := NewProvider(&config.Config{
+			Provider:        "azure-openai",
+			APIKey:          "az-key",
+			APIBase:         base,
+			ModelID:         "gpt-4o",
+			AzureDeployment: "prod gpt-4o",
+			AzureAPIVersion: "2024-10-21",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+	want := "/openai/deployments/prod%20gpt-4o/chat/completions?api-version=2024-10-21"
+	if len(got) != 2 || got[0] != want || got[1] != want {
+		t.Errorf("request URIs = %v, want %s", got, want)
+	}
+}
+
+func TestGenerate_SigV4(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-west-2/bedrock/aws4_request") ||
+			r.Header.Get("X-Amz-Date") == "" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+	}))
+	defer srv.Close()
+
+	p, err := NewProvider(&config.Config{
+		Provider:       "openai",
+		APIBase:        srv.URL + "/openai",
+		ModelID:        "openai.gpt-oss-120b-1:0",
+		Auth:           "sigv4",
+		AWSRegion:      "us-west-2",
+		AWSService:     "bedrock",
+		AWSAccessKeyID: "AKID",
+		AWSSecretKey:   "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+}
+
 func TestGenerate_AuthError(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(401)
@@ -256,7 +566,7 @@ func TestGenerate_AuthError(t *testing.T) {
 	}
 	p, _ := NewProvider(cfg)
 	_, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil)
-	if err != ErrAuth {
+	if !errors.Is(err, ErrAuth) {
 		t.Errorf("err = %v, want ErrAuth", err)
 	}
 }
@@ -274,7 +584,7 @@ func TestRetryWithBackoff_SuccessOnFirst(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	resp, err := retryWithBackoff(3, func() (*http.Response, error) {
+	resp, err := retryWithBackoff(testRetryPolicy(3), nil, func() (*http.Response, error) {
 		return http.Get(srv.URL)
 	})
 	if err != nil {
@@ -304,7 +614,7 @@ func TestRetryWithBackoff_429Retries(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	resp, err := retryWithBackoff(5, func() (*http.Response, error) {
+	resp, err := retryWithBackoff(testRetryPolicy(5), nil, func() (*http.Response, error) {
 		return http.Get(srv.URL)
 	})
 	if err != nil {
@@ -334,7 +644,7 @@ func TestRetryWithBackoff_5xxRetries(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	resp, err := retryWithBackoff(5, func() (*http.Response, error) {
+	resp, err := retryWithBackoff(testRetryPolicy(5), nil, func() (*http.Response, error) {
 		return http.Get(srv.URL)
 	})
 	if err != nil {
@@ -346,3 +656,365 @@ func TestRetryWithBackoff_5xxRetries(t *testing.T) {
 		t.Errorf("status = %d, want 200", resp.StatusCode)
 	}
 }
+
+// testRetryPolicy keeps backoff short so retry tests run quickly.
+func testRetryPolicy(maxRetries int) RetryPolicy {
+	return RetryPolicy{MaxRetries: maxRetries, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+}
+
+func TestRetryHint(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+		ok      bool
+	}{
+		{"none", nil, 0, false},
+		{"retry-after seconds", map[string]string{"Retry-After": "7"}, 7 * time.Second, true},
+		{"retry-after date", map[string]string{"Retry-After": now.Add(90 * time.Second).Format(http.TimeFormat)}, 90 * time.Second, true},
+		{"retry-after-ms wins", map[string]string{"retry-after-ms": "250", "Retry-After": "7"}, 250 * time.Millisecond, true},
+		{"anthropic reset of an exhausted limit", map[string]string{
+			"anthropic-ratelimit-requests-remaining": "12",
+			"anthropic-ratelimit-requests-reset":     now.Add(time.Minute).Format(time.RFC3339),
+			"anthropic-ratelimit-tokens-remaining":   "0",
+			"anthropic-ratelimit-tokens-reset":       now.Add(20 * time.Second).Format(time.RFC3339),
+		}, 20 * time.Second, true},
+		{"openai reset duration", map[string]string{
+			"x-ratelimit-remaining-requests": "0",
+			"x-ratelimit-reset-requests":     "1m30s",
+		}, 90 * time.Second, true},
+		{"garbage", map[string]string{"Retry-After": "soon"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			got, ok := retryHint(h, now)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("retryHint = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// recordingLimiter counts the calls retryWithBackoff makes to a Limiter.
+type recordingLimiter struct {
+	waits, successes int
+	throttles        []time.Duration
+}
+
+func (l *recordingLimiter) Wait()                         { l.waits++ }
+func (l *recordingLimiter) Throttled(delay time.Duration) { l.throttles = append(l.throttles, delay) }
+func (l *recordingLimiter) Succeeded()                    { l.successes++ }
+
+func TestRetryWithBackoff_HonorsRetryAfter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("retry-after-ms", "200")
+			w.WriteHeader(429)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	lim := &recordingLimiter{}
+	start := time.Now()
+	resp, err := retryWithBackoff(testRetryPolicy(5), lim, func() (*http.Response, error) {
+		return http.Get(srv.URL)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("retried after %v, want at least the 200ms the server asked for", elapsed)
+	}
+	if lim.waits != 2 || lim.successes != 1 || len(lim.throttles) != 1 || lim.throttles[0] != 200*time.Millisecond {
+		t.Errorf("limiter = %+v, want 2 waits, 1 throttle of 200ms, 1 success", lim)
+	}
+}
+
+func TestRetryWithBackoff_HintBeyondMaxDelay(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(429)
+		w.Write([]byte(`{"error":{"type":"rate_limit_error","message":"slow down"}}`))
+	}))
+	defer srv.Close()
+
+	lim := &recordingLimiter{}
+	resp, err := retryWithBackoff(testRetryPolicy(5), lim, func() (*http.Response, error) {
+		return http.Get(srv.URL)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Waiting an hour is pointless: the 429 is returned for classification,
+	// and the tree is paused no longer than MaxDelay.
+	if resp.StatusCode != 429 || calls != 1 {
+		t.Errorf("status = %d after %d calls, want the first 429", resp.StatusCode, calls)
+	}
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), "slow down") {
+		t.Errorf("body = %q, want the error body intact", body)
+	}
+	if len(lim.throttles) != 1 || lim.throttles[0] != time.Second {
+		t.Errorf("throttles = %v, want one capped at MaxDelay", lim.throttles)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 4. Streaming (SSE) tests
+// ---------------------------------------------------------------------------
+
+// sseServer serves the given SSE frames, flushing after each one, and
+// records whether the request asked for a stream.
+func sseServer(t *testing.T, frames []string, gotStream *bool) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+		*gotStream, _ = req["stream"].(bool)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		for _, f := range frames {
+			io.WriteString(w, f)
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func TestGenerate_Anthropic_Stream(t *testing.T) {
+	frames := []string{
+		"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":120,\"output_tokens\":1}}}\n\n",
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n",
+		"event: ping\ndata: {\"type\":\"ping\"}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Listing \"}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"files.\"}}\n\n",
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n",
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"tool_use\",\"id\":\"tu_1\",\"name\":\"sh\",\"input\":{}}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"comm\"}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"and\\\": \\\"ls\\\"}\"}}\n\n",
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":1}\n\n",
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"tool_use\"},\"usage\":{\"output_tokens\":42}}\n\n",
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+	}
+	var gotStream bool
+	srv := sseServer(t, frames, &gotStream)
+	defer srv.Close()
+
+	p, err := NewProvider(&config.Config{
+		Provider: "anthropic",
+		APIKey:   "test-key",
+		APIBase:  srv.URL,
+		ModelID:  "claude-3-5-sonnet-20241022",
+		Stream:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+
+	msg, usage, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "Run ls"}}, nil)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !gotStream {
+		t.Error("request should set stream: true")
+	}
+	if msg.Content != "Listing files." {
+		t.Errorf("content = %q", msg.Content)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].ID != "tu_1" || msg.ToolCalls[0].Arguments["command"] != "ls" {
+		t.Errorf("tool_calls = %+v", msg.ToolCalls)
+	}
+	if usage.InputTokens != 120 || usage.OutputTokens != 42 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestGenerate_OpenAI_Stream(t *testing.T) {
+	frames := []string{
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"reasoning_content\":\"need ls\"}}]}\n\n",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"On \"}}]}\n\n",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"it.\"}}]}\n\n",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"sh\",\"arguments\":\"\"}}]}}]}\n\n",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"command\\\":\"}}]}}]}\n\n",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\"ls\\\"}\"}}]}}]}\n\n",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\n\n",
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":80,\"completion_tokens\":20}}\n\n",
+		"data: [DONE]\n\n",
+	}
+	var gotStream bool
+	srv := sseServer(t, frames, &gotStream)
+	defer srv.Close()
+
+	p, err := NewProvider(&config.Config{
+		Provider: "openai",
+		APIKey:   "test-key",
+		APIBase:  srv.URL,
+		ModelID:  "gpt-4o",
+		Stream:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+
+	msg, usage, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "Hello"}}, nil)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !gotStream {
+		t.Error("request should set stream: true")
+	}
+	if msg.Content != "On it." || msg.ReasoningContent != "need ls" {
+		t.Errorf("content = %q, reasoning = %q", msg.Content, msg.ReasoningContent)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Name != "sh" || msg.ToolCalls[0].Arguments["command"] != "ls" {
+		t.Errorf("tool_calls = %+v", msg.ToolCalls)
+	}
+	if usage.InputTokens != 80 || usage.OutputTokens != 20 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestGenerate_StreamTruncatedMidToolArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiType string
+		model   string
+		frames  []string
+	}{
+		{"openai", "openai", "gpt-4o", []string{
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"sh\",\"arguments\":\"\"}}]}}]}\n\n",
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"command\\\":\"}}]}}]}\n\n",
+		}},
+		{"anthropic", "anthropic", "claude-sonnet-4-5", []string{
+			"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":10}}}\n\n",
+			"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_1\",\"name\":\"sh\",\"input\":{}}}\n\n",
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"command\\\":\"}}\n\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.Header().Set("Content-Type", "text/event-stream")
+				for _, f := range tt.frames {
+					io.WriteString(w, f)
+				}
+				// The connection drops: no terminal event.
+			}))
+			defer srv.Close()
+
+			cfg := &config.Config{Provider: tt.apiType, APIKey: "k", APIBase: srv.URL, ModelID: tt.model, Stream: true}
+			p, err := NewProvider(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "Hello"}}, nil)
+			if !errors.Is(err, ErrStreamTruncated) {
+				t.Fatalf("Generate = %+v, %v; want ErrStreamTruncated", msg, err)
+			}
+			if got := calls.Load(); got != streamStallRetries+1 {
+				t.Errorf("requests = %d, want %d (truncated streams are restarted)", got, streamStallRetries+1)
+			}
+
+			// QUINE_STREAM_LENIENT takes what arrived, but half a tool
+			// call's arguments are still an error, not nil arguments.
+			cfg.StreamLenient = true
+			p, _ = NewProvider(cfg)
+			if msg, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "Hello"}}, nil); err == nil {
+				t.Errorf("lenient Generate = %+v, want an error for the truncated arguments", msg)
+			}
+		})
+	}
+}
+
+func TestGenerate_OpenAI_StreamFinishWithoutDone(t *testing.T) {
+	// Some OpenAI-compatible servers never send [DONE]; a finish_reason
+	// still marks the reply as whole.
+	frames := []string{
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\n",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n",
+	}
+	var gotStream bool
+	srv := sseServer(t, frames, &gotStream)
+	defer srv.Close()
+
+	p, _ := NewProvider(&config.Config{Provider: "openai", APIKey: "k", APIBase: srv.URL, ModelID: "gpt-4o", Stream: true})
+	if msg, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "Hello"}}, nil); err != nil || msg.Content != "hi" {
+		t.Errorf("Generate = %+v, %v; want the reply", msg, err)
+	}
+}
+
+func TestGenerate_StreamIdleStall(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		io.WriteString(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		select { // go silent
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p, err := NewProvider(&config.Config{
+		Provider: "openai",
+		APIKey:   "test-key",
+		APIBase:  srv.URL,
+		ModelID:  "gpt-4o",
+		Stream:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	p.(*provider).idleTimeout = 100 * time.Millisecond
+
+	_, _, err = p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "Hello"}}, nil)
+	if !errors.Is(err, ErrStreamStalled) {
+		t.Fatalf("err = %v, want ErrStreamStalled", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != streamStallRetries+1 {
+		t.Errorf("requests = %d, want %d (stalled streams are restarted)", got, streamStallRetries+1)
+	}
+}
+
+func TestGenerate_Anthropic_StreamErrorEvent(t *testing.T) {
+	frames := []string{
+		"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":10}}}\n\n",
+		"event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"invalid_request_error\",\"message\":\"prompt is too long: context limit\"}}\n\n",
+	}
+	var gotStream bool
+	srv := sseServer(t, frames, &gotStream)
+	defer srv.Close()
+
+	p, _ := NewProvider(&config.Config{
+		Provider: "anthropic",
+		APIKey:   "test-key",
+		APIBase:  srv.URL,
+		ModelID:  "claude-3-5-sonnet-20241022",
+		Stream:   true,
+	})
+	_, _, err := p.Generate([]tape.Message{{Role: tape.RoleUser, Content: "hi"}}, nil)
+	if !errors.Is(err, ErrContextOverflow) {
+		t.Errorf("err = %v, want ErrContextOverflow", err)
+	}
+}
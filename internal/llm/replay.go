@@ -0,0 +1,224 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// ErrReplayExhausted is returned when the runtime asks for more replies
+// than the replayed tape recorded.
+var ErrReplayExhausted = errors.New("replay tape exhausted")
+
+// Divergence kinds.
+const (
+	DivergeToolCall   = "tool_call"   // a call was answered in one run but not the other, or in another order
+	DivergeToolResult = "tool_result" // the same call produced a different result
+)
+
+// Divergence is one mismatch between a recorded session and its replay.
+type Divergence struct {
+	Reply    int    // 1-based index of the reply about to be replayed
+	Kind     string // DivergeToolCall or DivergeToolResult
+	ToolID   string // "" when the whole sequence is out of order
+	Detail   string // what went differently, in one line
+	Recorded string // the result the recorded model saw, if any
+	Replayed string // the result the replay produced, if any
+}
+
+func (d Divergence) String() string {
+	if d.Kind == DivergeToolResult {
+		return fmt.Sprintf("%s\n--- recorded\n%s\n--- replayed\n%s", d.Detail, d.Recorded, d.Replayed)
+	}
+	return d.Detail
+}
+
+// ReplayProvider re-drives a recorded session (QUINE_API_TYPE=replay). It
+// returns the assistant replies of a tape in order, with their recorded
+// usage, while the runtime executes the tool calls for real.
+//
+// Before each reply it compares the tool results the runtime produced with
+// the ones the recorded model saw at the same point, and reports every
+// mismatch to OnDivergence. That reproduces a failure offline, against a
+// changed environment or a new binary, and shows where the runs part ways.
+type ReplayProvider struct {
+	turns         []replayTurn
+	next          int
+	contextWindow int
+
+	// OnDivergence, if set, is called for each mismatch.
+	OnDivergence func(Divergence)
+}
+
+// replayTurn is one recorded reply and the tool results that preceded it.
+type replayTurn struct {
+	results []tape.Message
+	reply   tape.Message
+	usage   Usage
+}
+
+// NewReplayProvider loads the replies recorded in the tape at path.
+func NewReplayProvider(path string, contextWindow int) (*ReplayProvider, error) {
+	summary, err := tape.ReadTapeFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	turns, err := replayTurns(summary)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	if len(turns) == 0 {
+		return nil, fmt.Errorf("replay: %s records no assistant replies", path)
+	}
+	return &ReplayProvider{turns: turns, contextWindow: contextWindow}, nil
+}
+
+// replayTurns extracts the generated replies from a tape. A generated reply
+// is an assistant message followed by its "usage" entry; assistant messages
+// without one were inherited from a parent (fork) rather than generated.
+// Tapes from before usage entries existed replay every assistant message.
+func replayTurns(summary *tape.TapeSummary) ([]replayTurn, error) {
+	hasUsage := false
+	for _, e := range summary.Entries {
+		if e.Type == "usage" {
+			hasUsage = true
+			break
+		}
+	}
+
+	var turns []replayTurn
+	var results []tape.Message
+	for i, e := range summary.Entries {
+		switch e.Type {
+		case "tool_result":
+			var tr tape.ToolResult
+			if err := json.Unmarshal(e.Data, &tr); err != nil {
+				return nil, fmt.Errorf("entry %d: %w", i, err)
+			}
+			results = append(results, tape.Message{Role: tape.RoleToolResult, Content: tr.Content, ToolID: tr.ToolID})
+
+		case "message":
+			var msg tape.Message
+			if err := json.Unmarshal(e.Data, &msg); err != nil {
+				return nil, fmt.Errorf("entry %d: %w", i, err)
+			}
+			switch msg.Role {
+			case tape.RoleToolResult:
+				results = append(results, msg)
+			case tape.RoleAssistant:
+				var usage Usage
+				generated := !hasUsage
+				if i+1 < len(summary.Entries) && summary.Entries[i+1].Type == "usage" {
+					var u struct {
+						TokensIn   int `json:"tokens_in"`
+						TokensOut  int `json:"tokens_out"`
+						CacheWrite int `json:"cache_write_tokens"`
+						CacheRead  int `json:"cache_read_tokens"`
+					}
+					json.Unmarshal(summary.Entries[i+1].Data, &u)
+					usage = Usage{
+						InputTokens:      u.TokensIn,
+						OutputTokens:     u.TokensOut,
+						CacheWriteTokens: u.CacheWrite,
+						CacheReadTokens:  u.CacheRead,
+					}
+					generated = true
+				}
+				if generated {
+					turns = append(turns, replayTurn{results: results, reply: msg, usage: usage})
+				}
+				results = nil
+			}
+		}
+	}
+	return turns, nil
+}
+
+// Generate returns the next recorded reply after checking the tool results
+// since the previous one against the recording.
+func (p *ReplayProvider) Generate(messages []tape.Message, tools []ToolSchema) (tape.Message, Usage, error) {
+	if p.next >= len(p.turns) {
+		return tape.Message{}, Usage{}, fmt.Errorf("%w after %d replies", ErrReplayExhausted, len(p.turns))
+	}
+	turn := p.turns[p.next]
+	p.next++
+
+	if p.next > 1 {
+		for _, d := range diffResults(turn.results, resultsSinceReply(messages)) {
+			d.Reply = p.next
+			if p.OnDivergence != nil {
+				p.OnDivergence(d)
+			}
+		}
+	}
+
+	reply := turn.reply
+	reply.Timestamp = time.Now().UnixMilli()
+	return reply, turn.usage, nil
+}
+
+// ContextWindowSize returns the configured context window.
+func (p *ReplayProvider) ContextWindowSize() int {
+	return p.contextWindow
+}
+
+// Remaining returns how many recorded replies have not been replayed.
+func (p *ReplayProvider) Remaining() int {
+	return len(p.turns) - p.next
+}
+
+// resultsSinceReply returns the tool results after the last assistant
+// message in the conversation, without the runtime's status lines.
+func resultsSinceReply(messages []tape.Message) []tape.Message {
+	var results []tape.Message
+	for i := len(messages) - 1; i >= 0 && messages[i].Role != tape.RoleAssistant; i-- {
+		if messages[i].Role == tape.RoleToolResult {
+			m := messages[i]
+			m.Content = tape.StripStatus(m.Content)
+			results = append([]tape.Message{m}, results...)
+		}
+	}
+	return results
+}
+
+// diffResults compares recorded and replayed tool results by tool ID.
+func diffResults(recorded, replayed []tape.Message) []Divergence {
+	var out []Divergence
+	live := make(map[string]tape.Message, len(replayed))
+	for _, m := range replayed {
+		live[m.ToolID] = m
+	}
+	rec := make(map[string]bool, len(recorded))
+
+	var recOrder, liveOrder []string
+	for _, m := range recorded {
+		rec[m.ToolID] = true
+		got, ok := live[m.ToolID]
+		if !ok {
+			out = append(out, Divergence{Kind: DivergeToolCall, ToolID: m.ToolID, Recorded: m.Content,
+				Detail: fmt.Sprintf("tool call %s was answered in the recording but not in the replay", m.ToolID)})
+			continue
+		}
+		recOrder = append(recOrder, m.ToolID)
+		if got.Content != m.Content {
+			out = append(out, Divergence{Kind: DivergeToolResult, ToolID: m.ToolID, Recorded: m.Content, Replayed: got.Content,
+				Detail: fmt.Sprintf("tool call %s returned a different result", m.ToolID)})
+		}
+	}
+	for _, m := range replayed {
+		if !rec[m.ToolID] {
+			out = append(out, Divergence{Kind: DivergeToolCall, ToolID: m.ToolID, Replayed: m.Content,
+				Detail: fmt.Sprintf("tool call %s was answered in the replay but not in the recording", m.ToolID)})
+			continue
+		}
+		liveOrder = append(liveOrder, m.ToolID)
+	}
+	if fmt.Sprint(recOrder) != fmt.Sprint(liveOrder) {
+		out = append(out, Divergence{Kind: DivergeToolCall,
+			Detail: fmt.Sprintf("tool calls answered in a different order: recorded %v, replayed %v", recOrder, liveOrder)})
+	}
+	return out
+}
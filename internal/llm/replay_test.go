@@ -0,0 +1,99 @@
+package llm
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// writeReplayTape writes entries as a tape file and returns its path.
+func writeReplayTape(t *testing.T, entries ...tape.TapeEntry) string {
+	t.Helper()
+	dir := t.TempDir()
+	w, err := tape.NewWriter(dir, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteEntry(tape.NewTape("s1", "", 0, "m").MetaEntry())
+	for _, e := range entries {
+		w.WriteEntry(e)
+	}
+	w.Close()
+	return filepath.Join(dir, "s1.jsonl")
+}
+
+func assistant(calls ...tape.ToolCall) tape.TapeEntry {
+	return tape.MessageEntry(tape.Message{Role: tape.RoleAssistant, ToolCalls: calls})
+}
+
+func shCall(id string) tape.ToolCall {
+	return tape.ToolCall{ID: id, Name: "sh", Arguments: map[string]any{"command": "true"}}
+}
+
+func result(id, content string) tape.Message {
+	return tape.Message{Role: tape.RoleToolResult, ToolID: id, Content: content}
+}
+
+func TestReplaySkipsInheritedReplies(t *testing.T) {
+	path := writeReplayTape(t,
+		tape.MessageEntry(tape.Message{Role: tape.RoleSystem, Content: "prompt"}),
+		assistant(shCall("parent_1")), // inherited from a parent: no usage entry
+		tape.MessageEntry(result("parent_1", "x")),
+		tape.MessageEntry(tape.Message{Role: tape.RoleUser, Content: "Begin."}),
+		assistant(shCall("call_1")),
+		tape.UsageEntry(10, 5, 0, 0),
+		tape.ToolResultEntry(tape.ToolResult{ToolID: "call_1", Content: "ok"}),
+		assistant(tape.ToolCall{ID: "call_2", Name: "exit"}),
+		tape.UsageEntry(20, 6, 0, 0),
+	)
+	p, err := NewReplayProvider(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var divergences []Divergence
+	p.OnDivergence = func(d Divergence) { divergences = append(divergences, d) }
+
+	msg, usage, err := p.Generate(nil, nil)
+	if err != nil || msg.ToolCalls[0].ID != "call_1" || usage.InputTokens != 10 || msg.Timestamp == 0 {
+		t.Fatalf("reply 1 = %+v, %+v, %v", msg, usage, err)
+	}
+	live := []tape.Message{msg, result("call_1", "ok")}
+	msg, usage, err = p.Generate(live, nil)
+	if err != nil || msg.ToolCalls[0].ID != "call_2" || usage.OutputTokens != 6 {
+		t.Fatalf("reply 2 = %+v, %+v, %v", msg, usage, err)
+	}
+	if len(divergences) != 0 {
+		t.Errorf("unexpected divergences: %v", divergences)
+	}
+
+	if _, _, err := p.Generate(live, nil); !errors.Is(err, ErrReplayExhausted) {
+		t.Errorf("past the end: err = %v, want ErrReplayExhausted", err)
+	}
+}
+
+func TestDiffResults(t *testing.T) {
+	recorded := []tape.Message{result("a", "1"), result("b", "2"), result("c", "3")}
+
+	got := diffResults(recorded, []tape.Message{result("a", "1"), result("b", "changed"), result("d", "4")})
+	kinds := make([]string, len(got))
+	for i, d := range got {
+		kinds[i] = d.Kind + ":" + d.ToolID
+	}
+	want := "tool_result:b tool_call:c tool_call:d"
+	if strings.Join(kinds, " ") != want {
+		t.Errorf("divergences = %v, want %s", kinds, want)
+	}
+
+	got = diffResults(recorded, []tape.Message{result("b", "2"), result("a", "1"), result("c", "3")})
+	if len(got) != 1 || got[0].Kind != DivergeToolCall || !strings.Contains(got[0].Detail, "different order") {
+		t.Errorf("reordered calls: %+v", got)
+	}
+
+	if got := diffResults(recorded, recorded); len(got) != 0 {
+		t.Errorf("identical results diverged: %+v", got)
+	}
+}
@@ -6,92 +6,206 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
+
+	"github.com/kehao95/quine/internal/config"
 )
 
 // ---------------------------------------------------------------------------
-// Retry with exponential backoff + jitter
+// Retry with exponential backoff + jitter, honoring server hints
 // ---------------------------------------------------------------------------
 
+// RetryPolicy bounds how often and how long a failed LLM call is retried.
+type RetryPolicy struct {
+	MaxRetries int           // retries of a rate-limited or overloaded call (QUINE_RETRY_MAX)
+	BaseDelay  time.Duration // first backoff step, doubled per attempt (QUINE_RETRY_BASE_MS)
+	MaxDelay   time.Duration // longest single wait; a longer server hint ends retrying (QUINE_RETRY_MAX_DELAY)
+}
+
+// DefaultRetryPolicy applies when the config leaves the policy unset.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   60 * time.Second,
+}
+
+// retryPolicyFor builds the policy from QUINE_RETRY_*.
+func retryPolicyFor(cfg *config.Config) RetryPolicy {
+	rp := DefaultRetryPolicy
+	if cfg.RetryMax >= 0 {
+		rp.MaxRetries = cfg.RetryMax
+	}
+	if cfg.RetryBaseMS > 0 {
+		rp.BaseDelay = time.Duration(cfg.RetryBaseMS) * time.Millisecond
+	}
+	if cfg.RetryMaxDelay > 0 {
+		rp.MaxDelay = time.Duration(cfg.RetryMaxDelay) * time.Second
+	}
+	return rp
+}
+
+// otherRetries bounds retries of server errors and network failures,
+// which rarely clear up the way a rate limit does.
+func (rp RetryPolicy) otherRetries() int {
+	return min(3, rp.MaxRetries)
+}
+
+// backoff is the wait before retry attempt+1 when the server gave no hint:
+// BaseDelay doubled per attempt plus up to 50% jitter, capped at MaxDelay.
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	base := rp.BaseDelay << uint(min(attempt, 20))
+	d := base + time.Duration(rand.Int63n(int64(base/2)+1))
+	return min(d, rp.MaxDelay)
+}
+
+// Limiter paces the LLM calls of a whole process tree. Wait is called
+// before every attempt; Throttled reports a 429 and how long the server
+// asked callers to hold off; Succeeded reports a 200.
+type Limiter interface {
+	Wait()
+	Throttled(delay time.Duration)
+	Succeeded()
+}
+
 // retryWithBackoff executes fn with retry logic. The retry behaviour depends
 // on the HTTP status code returned:
 //
-//   - 429  → up to maxRetries retries with exponential backoff + jitter
-//   - 5xx  → up to 3 retries
+//   - 429, 503, 529 → up to policy.MaxRetries retries, waiting as long as
+//     the server asks (see retryHint) or with exponential backoff + jitter
+//   - other 5xx → up to 3 retries
 //   - 401/403 → no retry, return immediately
 //   - Network error → up to 3 retries
 //   - Malformed / unexpected → retry once
-func retryWithBackoff(maxRetries int, fn func() (*http.Response, error)) (*http.Response, error) {
-	var lastErr error
-	var lastResp *http.Response
-
-	for attempt := 0; attempt <= maxRetries; attempt++ {
+//
+// When retries run out, the last response is returned for the caller to
+// classify. A non-nil limiter is consulted before every attempt and told
+// about each 429 and 200.
+func retryWithBackoff(policy RetryPolicy, limiter Limiter, fn func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if limiter != nil {
+			limiter.Wait()
+		}
 		resp, err := fn()
 
 		if err != nil {
-			// Network-level error → retry up to 3 times
-			lastErr = err
-			retryLimit := 3
-			if attempt >= retryLimit {
-				return nil, lastErr
+			// Network-level error
+			if attempt >= policy.otherRetries() {
+				return nil, err
 			}
-			logRetry(attempt+1, retryLimit, err.Error())
-			backoffSleep(attempt)
+			logRetry(attempt+1, policy.otherRetries(), err.Error())
+			time.Sleep(policy.backoff(attempt))
 			continue
 		}
 
 		switch {
 		case resp.StatusCode == http.StatusOK:
-			return resp, nil
-
-		case resp.StatusCode == 429:
-			// Rate limited → retry up to maxRetries times
-			drainAndClose(resp)
-			lastErr = fmt.Errorf("rate limited (429)")
-			if attempt >= maxRetries {
-				return fn()
+			if limiter != nil {
+				limiter.Succeeded()
 			}
-			logRetry(attempt+1, maxRetries, "rate limited (429)")
-			backoffSleep(attempt)
-			continue
+			return resp, nil
 
 		case resp.StatusCode == 401 || resp.StatusCode == 403:
 			// Auth error → no retry
 			return resp, nil
 
-		case resp.StatusCode >= 500:
-			// Server error → retry up to 3 times
+		case resp.StatusCode == 429 || resp.StatusCode == 503 || resp.StatusCode == 529:
+			// Rate limited or overloaded → wait as told, else back off
+			delay, hinted := retryHint(resp.Header, time.Now())
+			if !hinted {
+				delay = policy.backoff(attempt)
+			}
+			if resp.StatusCode == 429 && limiter != nil {
+				limiter.Throttled(min(delay, policy.MaxDelay))
+			}
+			if attempt >= policy.MaxRetries || delay > policy.MaxDelay {
+				return resp, nil
+			}
 			drainAndClose(resp)
-			lastErr = fmt.Errorf("server error (%d)", resp.StatusCode)
-			retryLimit := 3
-			if attempt >= retryLimit {
-				return fn()
+			reason := fmt.Sprintf("status %d, waiting %s", resp.StatusCode, delay.Round(time.Millisecond))
+			if hinted {
+				reason += " as the server asked"
 			}
-			logRetry(attempt+1, retryLimit, fmt.Sprintf("server error (%d)", resp.StatusCode))
-			backoffSleep(attempt)
-			continue
+			logRetry(attempt+1, policy.MaxRetries, reason)
+			time.Sleep(delay)
+
+		case resp.StatusCode >= 500:
+			// Server error
+			if attempt >= policy.otherRetries() {
+				return resp, nil
+			}
+			drainAndClose(resp)
+			logRetry(attempt+1, policy.otherRetries(), fmt.Sprintf("server error (%d)", resp.StatusCode))
+			time.Sleep(policy.backoff(attempt))
 
 		default:
 			// Unexpected status → retry once
-			if attempt >= 1 {
+			if attempt >= min(1, policy.MaxRetries) {
 				return resp, nil
 			}
 			drainAndClose(resp)
-			lastErr = fmt.Errorf("unexpected status %d", resp.StatusCode)
 			logRetry(attempt+1, 1, fmt.Sprintf("unexpected status (%d)", resp.StatusCode))
-			backoffSleep(attempt)
-			continue
+			time.Sleep(policy.backoff(attempt))
+		}
+	}
+}
+
+// rateLimitResets pairs the remaining-quota and reset headers providers
+// send with rate-limited responses. Anthropic's resets are RFC 3339
+// timestamps, OpenAI's are durations such as "6m0s".
+var rateLimitResets = []struct{ remaining, reset string }{
+	{"anthropic-ratelimit-requests-remaining", "anthropic-ratelimit-requests-reset"},
+	{"anthropic-ratelimit-tokens-remaining", "anthropic-ratelimit-tokens-reset"},
+	{"anthropic-ratelimit-input-tokens-remaining", "anthropic-ratelimit-input-tokens-reset"},
+	{"anthropic-ratelimit-output-tokens-remaining", "anthropic-ratelimit-output-tokens-reset"},
+	{"x-ratelimit-remaining-requests", "x-ratelimit-reset-requests"},
+	{"x-ratelimit-remaining-tokens", "x-ratelimit-reset-tokens"},
+}
+
+// retryHint reads how long the server asked callers to wait, from (in
+// order of precedence) retry-after-ms, Retry-After (seconds or an HTTP
+// date), or the latest reset of a rate limit whose remaining quota is 0.
+func retryHint(h http.Header, now time.Time) (time.Duration, bool) {
+	if v := h.Get("retry-after-ms"); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs >= 0 {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return max(t.Sub(now), 0), true
 		}
 	}
 
-	if lastResp != nil {
-		return lastResp, nil
+	var wait time.Duration
+	found := false
+	for _, rl := range rateLimitResets {
+		if h.Get(rl.remaining) != "0" {
+			continue
+		}
+		v := h.Get(rl.reset)
+		var d time.Duration
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			d = t.Sub(now)
+		} else if d, err = time.ParseDuration(v); err != nil {
+			continue
+		}
+		wait = max(wait, d)
+		found = true
 	}
-	return nil, lastErr
+	return wait, found
 }
 
 func logRetry(attempt, max int, reason string) {
-	fmt.Fprintf(stderrWriter(), "quine: LLM retry %d/%d (%s)\n", attempt, max, reason)
+	logf("LLM retry %d/%d (%s)", attempt, max, reason)
+}
+
+// logf writes one operational log line.
+func logf(format string, args ...any) {
+	fmt.Fprintf(stderrWriter(), "quine: "+format+"\n", args...)
 }
 
 func stderrWriter() io.Writer {
@@ -109,12 +223,6 @@ func SetLogOutput(w io.Writer) {
 	stderrOut = w
 }
 
-func backoffSleep(attempt int) {
-	base := time.Duration(1<<uint(attempt)) * 500 * time.Millisecond
-	jitter := time.Duration(rand.Int63n(int64(base / 2)))
-	time.Sleep(base + jitter)
-}
-
 func drainAndClose(resp *http.Response) {
 	if resp != nil && resp.Body != nil {
 		io.Copy(io.Discard, resp.Body)
@@ -0,0 +1,208 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kehao95/quine/internal/llm/protocol"
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// ErrStreamStalled is returned when a streamed response goes silent for
+// longer than the idle timeout (QUINE_STREAM_IDLE_TIMEOUT).
+var ErrStreamStalled = errors.New("stream stalled")
+
+// ErrStreamTruncated is returned when a streamed response ends before the
+// protocol's terminal event (a dropped connection), unless
+// QUINE_STREAM_LENIENT accepts what arrived.
+var ErrStreamTruncated = errors.New("stream ended without a terminal event")
+
+const (
+	// defaultStreamIdleTimeout applies when QUINE_STREAM_IDLE_TIMEOUT is unset.
+	defaultStreamIdleTimeout = 120 * time.Second
+
+	// streamStallRetries is how often a stalled or truncated stream is
+	// restarted from scratch before the error is returned.
+	streamStallRetries = 2
+
+	// streamProgressInterval is how often a running stream logs its totals.
+	streamProgressInterval = 10 * time.Second
+)
+
+// generateStream is Generate over SSE. Instead of a whole-request timeout,
+// the request is cancelled once no bytes arrive for idleTimeout.
+func (p *provider) generateStream(messages []tape.Message, tools []ToolSchema) (tape.Message, Usage, error) {
+	body, err := p.proto.EncodeStreamRequest(messages, tools, p.model, p.maxTokens)
+	if err != nil {
+		return tape.Message{}, Usage{}, fmt.Errorf("encoding request: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		msg, usage, err := p.streamOnce(body)
+		if (errors.Is(err, ErrStreamStalled) || errors.Is(err, ErrStreamTruncated)) && attempt < streamStallRetries {
+			logRetry(attempt+1, streamStallRetries, err.Error())
+			continue
+		}
+		return msg, usage, err
+	}
+}
+
+// streamOnce sends one streaming request and assembles the reply.
+func (p *provider) streamOnce(body []byte) (tape.Message, Usage, error) {
+	resp, err := retryWithBackoff(p.retry, p.limiter, p.refreshOn401(func() (*http.Response, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stalled := new(atomic.Bool)
+		timer := time.AfterFunc(p.idleTimeout, func() {
+			stalled.Store(true)
+			cancel()
+		})
+		abort := func(err error) (*http.Response, error) {
+			timer.Stop()
+			cancel()
+			if stalled.Load() {
+				err = fmt.Errorf("%w: no response for %s", ErrStreamStalled, p.idleTimeout)
+			}
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", p.streamEnd, bytes.NewReader(body))
+		if err != nil {
+			return abort(err)
+		}
+		req.Header.Set("Content-Type", p.proto.ContentType())
+		req.Header.Set("Accept", "text/event-stream")
+
+		if err := p.trans.Sign(req, body); err != nil {
+			return abort(fmt.Errorf("signing request: %w", err))
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body = &idleBody{
+			ReadCloser: resp.Body,
+			timer:      timer,
+			idle:       p.idleTimeout,
+			cancel:     cancel,
+			stalled:    stalled,
+		}
+		return resp, nil
+	}))
+	if err != nil {
+		return tape.Message{}, Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return tape.Message{}, Usage{}, fmt.Errorf("reading response body: %w", err)
+		}
+		return tape.Message{}, Usage{}, p.proto.ClassifyError(resp.StatusCode, respBody)
+	}
+
+	dec := p.proto.NewStreamDecoder()
+	progress := newStreamProgress()
+	err = protocol.ReadSSE(resp.Body, func(event string, data []byte) error {
+		delta, err := dec.Event(event, data)
+		if err != nil {
+			return err
+		}
+		progress.observe(delta)
+		return nil
+	}, dec.Done)
+	if err != nil {
+		return tape.Message{}, Usage{}, err
+	}
+	if !dec.Complete() {
+		if !p.streamLenient {
+			return tape.Message{}, Usage{}, fmt.Errorf("%w after %s", ErrStreamTruncated, progress.totals())
+		}
+		// QUINE_STREAM_LENIENT: a server known to close without a
+		// terminal event; take what arrived.
+		logf("LLM stream: ended without a terminal event")
+	}
+	progress.finish()
+
+	return dec.Result()
+}
+
+// idleBody wraps a streaming response body. Every read that returns data
+// pushes the idle deadline back; when the deadline passes, the request
+// context is cancelled and the pending read fails with ErrStreamStalled.
+type idleBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	idle    time.Duration
+	cancel  context.CancelFunc
+	stalled *atomic.Bool
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && b.stalled.Load() {
+		err = fmt.Errorf("%w: no data for %s", ErrStreamStalled, b.idle)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// streamProgress reports a running stream to the operational log: time to
+// first token, each tool call as it starts, periodic totals, and a summary.
+type streamProgress struct {
+	start     time.Time
+	first     time.Time
+	lastLog   time.Time
+	text      int
+	reasoning int
+	toolArgs  int
+}
+
+func newStreamProgress() *streamProgress {
+	now := time.Now()
+	return &streamProgress{start: now, lastLog: now}
+}
+
+func (s *streamProgress) observe(d protocol.StreamDelta) {
+	if d == (protocol.StreamDelta{}) {
+		return
+	}
+	now := time.Now()
+	if s.first.IsZero() {
+		s.first = now
+		logf("LLM stream: first token after %.1fs", now.Sub(s.start).Seconds())
+	}
+	s.text += len(d.Text)
+	s.reasoning += len(d.Reasoning)
+	s.toolArgs += len(d.ToolArgs)
+	if d.ToolCall != "" {
+		logf("LLM stream: tool call %s", d.ToolCall)
+	}
+	if now.Sub(s.lastLog) >= streamProgressInterval {
+		s.lastLog = now
+		logf("LLM stream: %s (%.0fs)", s.totals(), now.Sub(s.start).Seconds())
+	}
+}
+
+func (s *streamProgress) finish() {
+	logf("LLM stream: done in %.1fs, %s", time.Since(s.start).Seconds(), s.totals())
+}
+
+func (s *streamProgress) totals() string {
+	return fmt.Sprintf("%d chars text, %d reasoning, %d tool args", s.text, s.reasoning, s.toolArgs)
+}
@@ -3,17 +3,26 @@ package transport
 import "net/http"
 
 // APIKeyHeader implements Transport using a custom header for the API key.
-// Used by: Anthropic (x-api-key header).
+// Used by: Anthropic (x-api-key header), Gemini (x-goog-api-key header),
+// Azure OpenAI (api-key header).
 type APIKeyHeader struct {
 	HeaderName   string
-	APIKey       string
+	Key          KeySource
 	ExtraHeaders map[string]string
 }
 
 func (t *APIKeyHeader) Sign(req *http.Request, body []byte) error {
-	req.Header.Set(t.HeaderName, t.APIKey)
+	key, err := signingKey(t.Key)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(t.HeaderName, key)
 	for k, v := range t.ExtraHeaders {
 		req.Header.Set(k, v)
 	}
 	return nil
 }
+
+func (t *APIKeyHeader) Refresh() bool {
+	return t.Key.Invalidate()
+}
@@ -3,12 +3,20 @@ package transport
 import "net/http"
 
 // BearerToken implements Transport using Bearer token authentication.
-// Used by: OpenAI, OpenRouter, Azure OpenAI.
+// Used by: OpenAI (Chat Completions and Responses), OpenRouter.
 type BearerToken struct {
-	APIKey string
+	Key KeySource
 }
 
 func (t *BearerToken) Sign(req *http.Request, body []byte) error {
-	req.Header.Set("Authorization", "Bearer "+t.APIKey)
+	key, err := signingKey(t.Key)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
 	return nil
 }
+
+func (t *BearerToken) Refresh() bool {
+	return t.Key.Invalidate()
+}
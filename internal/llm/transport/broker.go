@@ -0,0 +1,27 @@
+package transport
+
+import "net/http"
+
+// BrokerTokenHeader carries a process tree's capability token to its
+// credential broker (see internal/broker).
+const BrokerTokenHeader = "X-Quine-Broker-Token"
+
+// BrokerUpstreamHeader names the upstream a brokered request is for (see
+// config.Config.Upstreams). Requests without it go to the primary API.
+const BrokerUpstreamHeader = "X-Quine-Broker-Upstream"
+
+// BrokerToken implements Transport for a process that reaches the API
+// through the root's credential broker: it proves membership of the tree,
+// and the broker adds the real credentials.
+type BrokerToken struct {
+	Token    string
+	Upstream string // "" for the primary API
+}
+
+func (t *BrokerToken) Sign(req *http.Request, body []byte) error {
+	req.Header.Set(BrokerTokenHeader, t.Token)
+	if t.Upstream != "" {
+		req.Header.Set(BrokerUpstreamHeader, t.Upstream)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauthRefreshMargin is how long before expiry a token is replaced. Short
+// lifetimes are refreshed halfway through instead.
+const oauthRefreshMargin = 60 * time.Second
+
+// OAuthClientCredentials fetches short-lived access tokens from an OAuth 2.0
+// token endpoint with the client-credentials grant (RFC 6749 §4.4) and
+// renews them before they expire. A token with no expires_in is kept until
+// the API rejects it.
+type OAuthClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string       // optional, space-separated
+	Client       *http.Client // nil = a client with a 30s timeout
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time // zero = no known expiry
+}
+
+// oauthToken is the token endpoint's success response.
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (o *OAuthClientCredentials) Key() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token != "" && (o.refreshAt.IsZero() || time.Now().Before(o.refreshAt)) {
+		return o.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if o.Scope != "" {
+		form.Set("scope", o.Scope)
+	}
+	req, err := http.NewRequest(http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("oauth token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	issued := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oauth token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("oauth token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth token endpoint: HTTP %d: %s", resp.StatusCode, truncate(strings.TrimSpace(string(body)), 200))
+	}
+
+	var tok oauthToken
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", fmt.Errorf("oauth token response: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("oauth token response has no access_token")
+	}
+
+	o.token, o.refreshAt = tok.AccessToken, time.Time{}
+	if tok.ExpiresIn > 0 {
+		lifetime := time.Duration(tok.ExpiresIn) * time.Second
+		o.refreshAt = issued.Add(lifetime - min(oauthRefreshMargin, lifetime/2))
+	}
+	return o.token, nil
+}
+
+// Invalidate drops the current token, so the next Key fetches a new one.
+func (o *OAuthClientCredentials) Invalidate() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = ""
+	return true
+}
@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sigV4Algorithm names the signing scheme in the Authorization header.
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+// unsignedHeaders may be changed by proxies or the HTTP client after
+// signing, so they are left out of the signature.
+var unsignedHeaders = map[string]bool{
+	"authorization":   true,
+	"user-agent":      true,
+	"x-amzn-trace-id": true,
+	"expect":          true,
+}
+
+// SigV4 implements Transport with AWS Signature Version 4, for Bedrock and
+// other endpoints behind AWS IAM. Credentials come from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type SigV4 struct {
+	Region          string // e.g. "us-east-1"
+	Service         string // e.g. "bedrock"
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string           // optional, for temporary credentials
+	Now             func() time.Time // nil = time.Now; fixed in tests
+}
+
+func (t *SigV4) Sign(req *http.Request, body []byte) error {
+	now := time.Now
+	if t.Now != nil {
+		now = t.Now
+	}
+	stamp := now().UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+
+	req.Header.Set("X-Amz-Date", stamp)
+	if t.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", t.SessionToken)
+	}
+
+	canonical, signed := canonicalRequest(req, body)
+	scope := strings.Join([]string{day, t.Region, t.Service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{sigV4Algorithm, stamp, scope, hexSHA256([]byte(canonical))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+t.SecretAccessKey), day)
+	for _, part := range []string{t.Region, t.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, t.AccessKeyID, scope, signed, signature))
+	return nil
+}
+
+// canonicalRequest returns the SigV4 canonical form of req and its
+// semicolon-separated signed header names.
+func canonicalRequest(req *http.Request, body []byte) (canonical, signed string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if unsignedHeaders[name] {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var hdrs strings.Builder
+	for _, name := range names {
+		hdrs.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed = strings.Join(names, ";")
+
+	// Every AWS service except S3 signs the path encoded twice: the
+	// request's escaped path, escaped again.
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	canonical = strings.Join([]string{
+		req.Method,
+		uriEncode(path, false),
+		strings.Join(pairs, "&"),
+		hdrs.String(),
+		signed,
+		hexSHA256(body),
+	}, "\n")
+	return canonical, signed
+}
+
+// uriEncode percent-encodes everything but RFC 3986 unreserved characters
+// (and '/', unless encodeSlash).
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
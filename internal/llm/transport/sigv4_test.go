@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Vectors from the AWS Signature Version 4 test suite and the IAM example
+// in the AWS General Reference.
+func TestSigV4Vectors(t *testing.T) {
+	fixed := func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+	suite := &SigV4{
+		Region:          "us-east-1",
+		Service:         "service",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Now:             fixed,
+	}
+	iam := *suite
+	iam.Service = "iam"
+
+	tests := []struct {
+		name      string
+		signer    *SigV4
+		method    string
+		url       string
+		headers   map[string]string
+		body      string
+		signed    string
+		signature string
+	}{
+		{
+			name: "get-vanilla", signer: suite, method: "GET", url: "https://example.amazonaws.com/",
+			signed:    "host;x-amz-date",
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "post-vanilla", signer: suite, method: "POST", url: "https://example.amazonaws.com/",
+			signed:    "host;x-amz-date",
+			signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name: "get-vanilla-query-order-key-case", signer: suite, method: "GET", url: "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			signed:    "host;x-amz-date",
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name: "post-x-www-form-urlencoded", signer: suite, method: "POST", url: "https://example.amazonaws.com/",
+			headers:   map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:      "Param1=value1",
+			signed:    "content-type;host;x-amz-date",
+			signature: "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			name: "iam-list-users", signer: &iam, method: "GET", url: "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			headers:   map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"},
+			signed:    "content-type;host;x-amz-date",
+			signature: "5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if err := tt.signer.Sign(req, []byte(tt.body)); err != nil {
+				t.Fatal(err)
+			}
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/" + tt.signer.Service +
+				"/aws4_request, SignedHeaders=" + tt.signed + ", Signature=" + tt.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization =\n  %s\nwant\n  %s", got, want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q", got)
+			}
+		})
+	}
+}
+
+// TestSigV4BedrockPath: temporary credentials sign their session token, and
+// an escaped model ID ("%3A" for ':') is escaped again in the canonical
+// path, as AWS expects from every service but S3.
+func TestSigV4BedrockPath(t *testing.T) {
+	s := &SigV4{Region: "us-west-2", Service: "bedrock", AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session"}
+	req, _ := http.NewRequest("POST", "https://bedrock-runtime.us-west-2.amazonaws.com/model/anthropic.claude-v2%3A1/invoke", nil)
+	req.Header.Set("Content-Type", "application/json")
+	if err := s.Sign(req, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Authorization = %s", auth)
+	}
+	canonical, _ := canonicalRequest(req, []byte(`{}`))
+	if path := strings.Split(canonical, "\n")[1]; path != "/model/anthropic.claude-v2%253A1/invoke" {
+		t.Errorf("canonical path = %s", path)
+	}
+}
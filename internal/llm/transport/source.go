@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kehao95/quine/internal/config"
+)
+
+// KeySource supplies the secret a Transport signs with.
+type KeySource interface {
+	// Key returns the current secret.
+	Key() (string, error)
+	// Invalidate drops a secret the API rejected. It reports whether the
+	// next Key call may return a different one, i.e. whether a retry can
+	// succeed.
+	Invalidate() bool
+}
+
+// KeySourceFor returns the credential source configured in cfg:
+// QUINE_API_KEY, QUINE_API_KEY_FILE, QUINE_API_KEY_CMD or
+// QUINE_OAUTH_TOKEN_URL (config.Load allows only one).
+func KeySourceFor(cfg *config.Config) KeySource {
+	switch {
+	case cfg.APIKeyFile != "":
+		return &FileKey{Path: cfg.APIKeyFile}
+	case cfg.APIKeyCmd != "":
+		return &CommandKey{Command: cfg.APIKeyCmd, TTL: time.Duration(cfg.APIKeyCmdTTL) * time.Second}
+	case cfg.OAuthTokenURL != "":
+		return &OAuthClientCredentials{
+			TokenURL:     cfg.OAuthTokenURL,
+			ClientID:     cfg.OAuthClientID,
+			ClientSecret: cfg.OAuthClientSecret,
+			Scope:        cfg.OAuthScope,
+		}
+	default:
+		return StaticKey(cfg.APIKey)
+	}
+}
+
+// signedKeys records the keys Transports in this process have signed
+// with, so tool output can be scrubbed of keys fetched at run time (key
+// file, helper command, OAuth token), which never appear in the config.
+var signedKeys struct {
+	sync.Mutex
+	keys []string
+	seen map[string]bool
+}
+
+// signingKey returns src's current key, recording it for SignedKeys.
+func signingKey(src KeySource) (string, error) {
+	key, err := src.Key()
+	if err != nil {
+		return "", err
+	}
+	signedKeys.Lock()
+	defer signedKeys.Unlock()
+	if !signedKeys.seen[key] {
+		if signedKeys.seen == nil {
+			signedKeys.seen = map[string]bool{}
+		}
+		signedKeys.seen[key] = true
+		signedKeys.keys = append(signedKeys.keys, key)
+	}
+	return key, nil
+}
+
+// SignedKeys returns every key this process has signed a request with,
+// rotated ones included. The list only grows, so its length tells whether
+// a key was added since the last call.
+func SignedKeys() []string {
+	signedKeys.Lock()
+	defer signedKeys.Unlock()
+	return append([]string(nil), signedKeys.keys...)
+}
+
+// StaticKey is a literal key (QUINE_API_KEY).
+type StaticKey string
+
+func (k StaticKey) Key() (string, error) { return string(k), nil }
+
+// Invalidate reports false: a fixed key rejected once is rejected again.
+func (k StaticKey) Invalidate() bool { return false }
+
+// FileKey reads the key from a file (QUINE_API_KEY_FILE) on every request,
+// so a key rotated in place, e.g. a mounted secret, is picked up at once.
+type FileKey struct {
+	Path string
+}
+
+func (k *FileKey) Key() (string, error) {
+	data, err := os.ReadFile(k.Path)
+	if err != nil {
+		return "", fmt.Errorf("QUINE_API_KEY_FILE: %w", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("QUINE_API_KEY_FILE: %s is empty", k.Path)
+	}
+	return key, nil
+}
+
+// Invalidate reports true: the file may have been rewritten since.
+func (k *FileKey) Invalidate() bool { return true }
+
+// commandTimeout bounds one run of a QUINE_API_KEY_CMD helper.
+const commandTimeout = 30 * time.Second
+
+// CommandKey runs a helper (QUINE_API_KEY_CMD) through /bin/sh and uses
+// what it prints as the key, cached for TTL (0 = until Invalidate).
+type CommandKey struct {
+	Command string
+	TTL     time.Duration
+
+	mu      sync.Mutex
+	key     string
+	fetched time.Time
+}
+
+func (k *CommandKey) Key() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key != "" && (k.TTL <= 0 || time.Since(k.fetched) < k.TTL) {
+		return k.key, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", k.Command)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		// The helper's stdout may hold a partial secret; only stderr is
+		// reported.
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, truncate(msg, 200))
+		}
+		return "", fmt.Errorf("QUINE_API_KEY_CMD: %w", err)
+	}
+	key := strings.TrimSpace(stdout.String())
+	if key == "" {
+		return "", errors.New("QUINE_API_KEY_CMD: helper printed no key")
+	}
+	k.key, k.fetched = key, time.Now()
+	return key, nil
+}
+
+// Invalidate drops the cached key, so the helper runs again.
+func (k *CommandKey) Invalidate() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.key = ""
+	return true
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenEndpoint is a local OAuth 2.0 token endpoint stub. Each grant
+// returns tok-1, tok-2, ... valid for expiresIn seconds.
+func tokenEndpoint(t *testing.T, expiresIn int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var grants atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "llm.invoke" {
+			t.Errorf("token request form = %v (%v)", r.Form, err)
+		}
+		if id != "quine" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		n := grants.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("tok-%d", n),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &grants
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	srv, grants := tokenEndpoint(t, 3600)
+	o := &OAuthClientCredentials{TokenURL: srv.URL, ClientID: "quine", ClientSecret: "s3cret", Scope: "llm.invoke"}
+	tr := &BearerToken{Key: o}
+
+	for range 3 {
+		req, _ := http.NewRequest(http.MethodPost, "http://api.test/v1/chat/completions", nil)
+		if err := tr.Sign(req, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer tok-1" {
+			t.Errorf("Authorization = %q, want the cached first token", got)
+		}
+	}
+	if !tr.Refresh() {
+		t.Fatal("OAuth transport should be refreshable")
+	}
+	if key, _ := o.Key(); key != "tok-2" || grants.Load() != 2 {
+		t.Errorf("after Refresh: key %q, %d grants", key, grants.Load())
+	}
+}
+
+func TestOAuthRefreshesBeforeExpiry(t *testing.T) {
+	// A 1s lifetime is refreshed halfway through.
+	srv, grants := tokenEndpoint(t, 1)
+	o := &OAuthClientCredentials{TokenURL: srv.URL, ClientID: "quine", ClientSecret: "s3cret", Scope: "llm.invoke"}
+	o.Key()
+	time.Sleep(600 * time.Millisecond)
+	if key, _ := o.Key(); key != "tok-2" || grants.Load() != 2 {
+		t.Errorf("near expiry: key %q, %d grants", key, grants.Load())
+	}
+}
+
+func TestOAuthEndpointError(t *testing.T) {
+	srv, _ := tokenEndpoint(t, 3600)
+	o := &OAuthClientCredentials{TokenURL: srv.URL, ClientID: "quine", ClientSecret: "wrong", Scope: "llm.invoke"}
+	if _, err := o.Key(); err == nil || !strings.Contains(err.Error(), "HTTP 401") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "runs")
+	k := &CommandKey{Command: fmt.Sprintf("echo x >> %s; printf 'key-%%s\\n' $(wc -l < %s)", counter, counter), TTL: time.Hour}
+
+	for range 2 {
+		if key, err := k.Key(); err != nil || key != "key-1" {
+			t.Fatalf("Key() = %q, %v", key, err)
+		}
+	}
+	k.Invalidate()
+	if key, _ := k.Key(); key != "key-2" {
+		t.Errorf("after Invalidate: %q, want the helper re-run", key)
+	}
+
+	k = &CommandKey{Command: "echo partial-secret; echo boom >&2; exit 3"}
+	_, err := k.Key()
+	if err == nil || !strings.Contains(err.Error(), "boom") || strings.Contains(err.Error(), "partial-secret") {
+		t.Errorf("failing helper: %v", err)
+	}
+}
+
+func TestFileKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("sk-one\n"), 0o600)
+	k := &FileKey{Path: path}
+	if key, _ := k.Key(); key != "sk-one" {
+		t.Errorf("Key() = %q", key)
+	}
+	// Rotated in place: the next request picks it up.
+	os.WriteFile(path, []byte("sk-two"), 0o600)
+	if key, _ := k.Key(); key != "sk-two" {
+		t.Errorf("after rotation: %q", key)
+	}
+	if StaticKey("sk").Invalidate() {
+		t.Error("a static key cannot be refreshed")
+	}
+}
@@ -4,6 +4,8 @@ package transport
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/kehao95/quine/internal/config"
 )
 
 // Transport handles authentication for API requests.
@@ -12,20 +14,47 @@ type Transport interface {
 	Sign(req *http.Request, body []byte) error
 }
 
-// For returns the Transport implementation for a given API type.
-// Only "openai" and "anthropic" are supported.
-func For(apiType, apiKey string) (Transport, error) {
+// Refresher is implemented by transports whose credentials can be renewed.
+// After a 401, the caller calls Refresh and, if it reports true, signs and
+// sends the request once more.
+type Refresher interface {
+	Refresh() bool
+}
+
+// ForConfig returns the Transport cfg asks for: SigV4 with QUINE_AUTH=sigv4,
+// else the API type's own scheme signing with the configured key source.
+func ForConfig(cfg *config.Config) (Transport, error) {
+	if cfg.Auth == "sigv4" {
+		return &SigV4{
+			Region:          cfg.AWSRegion,
+			Service:         cfg.AWSService,
+			AccessKeyID:     cfg.AWSAccessKeyID,
+			SecretAccessKey: cfg.AWSSecretKey,
+			SessionToken:    cfg.AWSSessionToken,
+		}, nil
+	}
+	return For(cfg.Provider, KeySourceFor(cfg))
+}
+
+// For returns the Transport implementation for a given API type:
+// "openai", "openai-responses", "azure-openai", "anthropic" or "gemini",
+// signing with key.
+func For(apiType string, key KeySource) (Transport, error) {
 	switch apiType {
 	case "anthropic":
 		return &APIKeyHeader{
 			HeaderName: "x-api-key",
-			APIKey:     apiKey,
+			Key:        key,
 			ExtraHeaders: map[string]string{
 				"anthropic-version": "2023-06-01",
 			},
 		}, nil
-	case "openai":
-		return &BearerToken{APIKey: apiKey}, nil
+	case "openai", "openai-responses":
+		return &BearerToken{Key: key}, nil
+	case "azure-openai":
+		return &APIKeyHeader{HeaderName: "api-key", Key: key}, nil
+	case "gemini":
+		return &APIKeyHeader{HeaderName: "x-goog-api-key", Key: key}, nil
 	default:
 		return nil, fmt.Errorf("unknown provider: %s", apiType)
 	}
@@ -0,0 +1,186 @@
+// Package models is the registry of model capabilities: the context
+// window, output limit, tool-calling and reasoning support, and price of
+// each model ID. A built-in table covers common models; QUINE_MODELS_FILE
+// adds entries or overrides fields of built-in ones.
+package models
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed models.json
+var builtinJSON []byte
+
+// Model describes what a model can do and what it costs. Prices are in
+// USD per million tokens; 0 means unknown. A cache price of 0 bills those
+// tokens at InputPrice.
+type Model struct {
+	ContextWindow   int     `json:"context_window"`
+	MaxOutput       int     `json:"max_output"`
+	Tools           bool    `json:"tools"`
+	Reasoning       bool    `json:"reasoning"`
+	InputPrice      float64 `json:"input_price"`
+	OutputPrice     float64 `json:"output_price"`
+	CacheReadPrice  float64 `json:"cache_read_price"`
+	CacheWritePrice float64 `json:"cache_write_price"`
+}
+
+// Priced reports whether m has a known price.
+func (m Model) Priced() bool {
+	return m.InputPrice > 0 || m.OutputPrice > 0
+}
+
+// Cost returns the price in USD of one call. in counts every input token,
+// including the cacheWrite and cacheRead ones.
+func (m Model) Cost(in, out, cacheWrite, cacheRead int) float64 {
+	writePrice, readPrice := m.CacheWritePrice, m.CacheReadPrice
+	if writePrice == 0 {
+		writePrice = m.InputPrice
+	}
+	if readPrice == 0 {
+		readPrice = m.InputPrice
+	}
+	uncached := max(in-cacheWrite-cacheRead, 0)
+	return (float64(uncached)*m.InputPrice + float64(cacheWrite)*writePrice +
+		float64(cacheRead)*readPrice + float64(out)*m.OutputPrice) / 1e6
+}
+
+// Default returns what is assumed of a model the registry does not know.
+func Default(apiType string) Model {
+	m := Model{ContextWindow: 128_000, MaxOutput: 4096, Tools: true}
+	switch apiType {
+	case "anthropic":
+		m.MaxOutput = 16384
+	case "gemini":
+		// Gemini's thinking tokens count against the output limit.
+		m.MaxOutput = 16384
+	}
+	return m
+}
+
+// Registry maps model IDs to their capabilities. The nil *Registry is the
+// built-in table.
+type Registry struct {
+	models map[string]Model
+}
+
+var builtin = mustParse(builtinJSON)
+
+func mustParse(data []byte) *Registry {
+	r := &Registry{}
+	if err := json.Unmarshal(data, &r.models); err != nil {
+		panic("models: built-in table: " + err.Error())
+	}
+	return r
+}
+
+// Load returns the built-in table with the entries of the JSON file at
+// path laid over it; "" means the built-in table alone. The file is an
+// object keyed by model ID. An entry for a model the registry already
+// matches changes only the fields it sets.
+func Load(path string) (*Registry, error) {
+	r := &Registry{models: make(map[string]Model, len(builtin.models))}
+	for id, m := range builtin.models {
+		r.models[id] = m
+	}
+	if path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("QUINE_MODELS_FILE: %w", err)
+	}
+	var overrides map[string]json.RawMessage
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("QUINE_MODELS_FILE %s: %w", path, err)
+	}
+	// Shorter IDs first, so "gpt-4o-2024-08-06" builds on an override of
+	// "gpt-4o" in the same file.
+	ids := make([]string, 0, len(overrides))
+	for id := range overrides {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return len(ids[i]) < len(ids[j]) || len(ids[i]) == len(ids[j]) && ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		raw := overrides[id]
+		m, ok := r.Lookup(id)
+		if !ok {
+			m = Model{Tools: true}
+		}
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("QUINE_MODELS_FILE %s: %s: %w", path, id, err)
+		}
+		if m.ContextWindow < 0 || m.MaxOutput < 0 {
+			return nil, fmt.Errorf("QUINE_MODELS_FILE %s: %s: negative token limit", path, id)
+		}
+		r.models[id] = m
+	}
+	return r, nil
+}
+
+// Lookup returns the entry for id. Without an exact match, an entry
+// matches the snapshots and aliases of its model, so
+// "claude-sonnet-4-5-20250929" matches "claude-sonnet-4-5", but not other
+// models of its family: "claude-opus-4-5" does not match "claude-opus-4",
+// nor "o3-pro" "o3". A vendor prefix ("anthropic/", "us.anthropic.") is
+// skipped when nothing matches the whole ID.
+func (r *Registry) Lookup(id string) (Model, bool) {
+	if r == nil {
+		r = builtin
+	}
+	for s := id; ; {
+		if m, ok := r.match(s); ok {
+			return m, true
+		}
+		i := strings.IndexAny(s, "/.")
+		if i < 0 {
+			return Model{}, false
+		}
+		s = s[i+1:]
+	}
+}
+
+func (r *Registry) match(id string) (Model, bool) {
+	if m, ok := r.models[id]; ok {
+		return m, true
+	}
+	best, found := "", false
+	for key := range r.models {
+		if len(key) > len(best) && strings.HasPrefix(id, key) && snapshotSuffix.MatchString(id[len(key):]) {
+			best, found = key, true
+		}
+	}
+	return r.models[best], found
+}
+
+// snapshotSuffix matches what may follow a model's ID in the ID of one of
+// its snapshots or aliases: a date ("-20250929", "-2024-08-06",
+// "@20250929"), "-latest", and a provider's version tag ("-v1:0"). Anything
+// else, such as "-5" or "-pro", names another model, which may be priced
+// differently.
+var snapshotSuffix = regexp.MustCompile(`^([-@]\d{8}|-\d{4}-\d{2}-\d{2}|-latest)?(-v\d+(:\d+)?)?$`)
+
+// Resolve returns what is known of id, with the limits the registry does
+// not give taken from Default(apiType).
+func (r *Registry) Resolve(id, apiType string) Model {
+	def := Default(apiType)
+	m, ok := r.Lookup(id)
+	if !ok {
+		return def
+	}
+	if m.ContextWindow == 0 {
+		m.ContextWindow = def.ContextWindow
+	}
+	if m.MaxOutput == 0 {
+		m.MaxOutput = def.MaxOutput
+	}
+	return m
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		id        string
+		wantFound bool
+		wantMax   int
+	}{
+		{"claude-sonnet-4-5", true, 64000},
+		{"claude-sonnet-4-5-20250929", true, 64000},
+		{"claude-opus-4-1-20250805", true, 32000},
+		{"claude-opus-4-5-20251101", true, 64000},
+		{"claude-opus-4-6", true, 128000},
+		{"claude-sonnet-4-5@20250929", true, 64000},
+		{"claude-3-5-haiku-latest", true, 8192},
+		{"anthropic/claude-sonnet-4-5", true, 64000},
+		{"us.anthropic.claude-sonnet-4-5-20250929-v1:0", true, 64000},
+		{"gpt-4.1-mini-2025-04-14", true, 32768},
+		{"gpt-4o-mini", true, 16384},
+		{"models/gemini-2.5-flash", true, 65536},
+		{"o3-pro-2025-06-10", true, 100000},
+		{"gpt-4ox", false, 0},
+		// Another model of a known family is unknown, not its relative.
+		{"claude-opus-4-7", false, 0},
+		{"claude-sonnet-4-5-turbo", false, 0},
+		{"o3-deep-research", false, 0},
+		{"gpt-4o-audio-preview", false, 0},
+		{"llama3.1:8b", false, 0},
+	}
+	var r *Registry
+	for _, tt := range tests {
+		m, ok := r.Lookup(tt.id)
+		if ok != tt.wantFound || m.MaxOutput != tt.wantMax {
+			t.Errorf("Lookup(%q) = %d, %v; want %d, %v", tt.id, m.MaxOutput, ok, tt.wantMax, tt.wantFound)
+		}
+	}
+}
+
+func TestResolveDefaults(t *testing.T) {
+	var r *Registry
+	if m := r.Resolve("llama3.1:8b", "openai"); m.ContextWindow != 128_000 || m.MaxOutput != 4096 || !m.Tools || m.Priced() {
+		t.Errorf("Resolve(unknown, openai) = %+v, want the defaults", m)
+	}
+	if m := r.Resolve("some-claude", "anthropic"); m.MaxOutput != 16384 {
+		t.Errorf("Resolve(unknown, anthropic).MaxOutput = %d, want 16384", m.MaxOutput)
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.json")
+	os.WriteFile(path, []byte(`{
+		"llama3.1:8b": {"context_window": 8192, "max_output": 2048},
+		"tiny": {"context_window": 4096, "tools": false},
+		"claude-sonnet-4-5": {"input_price": 2},
+		"claude-sonnet-4-5-20250929": {"output_price": 12}
+	}`), 0o644)
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := r.Resolve("llama3.1:8b", "openai"); m.ContextWindow != 8192 || m.MaxOutput != 2048 || !m.Tools {
+		t.Errorf("llama3.1:8b = %+v, want the file's limits and tools on", m)
+	}
+	if m := r.Resolve("tiny", "openai"); m.Tools || m.MaxOutput != 4096 {
+		t.Errorf("tiny = %+v, want tools off and the default output limit", m)
+	}
+	// Partial overrides keep the other fields, and build on each other.
+	m := r.Resolve("claude-sonnet-4-5-20250929", "anthropic")
+	if m.ContextWindow != 200_000 || m.InputPrice != 2 || m.OutputPrice != 12 {
+		t.Errorf("claude-sonnet-4-5-20250929 = %+v, want built-in limits with both overrides", m)
+	}
+	// The built-in table is untouched.
+	if m, _ := (*Registry)(nil).Lookup("claude-sonnet-4-5"); m.InputPrice != 3 {
+		t.Errorf("built-in claude-sonnet-4-5 input price = %v, want 3", m.InputPrice)
+	}
+
+	os.WriteFile(path, []byte(`{"x": {"context_window": "big"}}`), 0o644)
+	if _, err := Load(path); err == nil {
+		t.Error("Load with a malformed entry succeeded")
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestNoPriceAcrossModels(t *testing.T) {
+	var r *Registry
+	if m, _ := r.Lookup("claude-opus-4-5"); m.InputPrice != 5 || m.OutputPrice != 25 {
+		t.Errorf("claude-opus-4-5 prices = %v/%v, want 5/25", m.InputPrice, m.OutputPrice)
+	}
+	if m, _ := r.Lookup("o3-pro"); m.InputPrice != 20 {
+		t.Errorf("o3-pro input price = %v, want 20", m.InputPrice)
+	}
+	if m := r.Resolve("claude-opus-4-7", "anthropic"); m.Priced() {
+		t.Errorf("claude-opus-4-7 = %+v, want unpriced defaults", m)
+	}
+}
+
+func TestCost(t *testing.T) {
+	m, _ := (*Registry)(nil).Lookup("claude-sonnet-4-5")
+	// 1M input of which 200K cache writes and 500K cache reads, 100K output.
+	got := m.Cost(1_000_000, 100_000, 200_000, 500_000)
+	want := 0.3*3 + 0.2*3.75 + 0.5*0.3 + 0.1*15
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("Cost = %v, want %v", got, want)
+	}
+	// No cache prices: cached tokens bill at the input price.
+	m = Model{InputPrice: 1, OutputPrice: 2}
+	if got := m.Cost(1_000_000, 1_000_000, 500_000, 0); math.Abs(got-3) > 1e-9 {
+		t.Errorf("Cost without cache prices = %v, want 3", got)
+	}
+}
@@ -0,0 +1,75 @@
+// Package persona resolves named system-prompt overlays ("personas").
+//
+// A persona is a markdown file {name}.md living in one of the directories
+// of the QUINE_PERSONA_DIR search path. Its text is spliced into the system
+// prompt, letting an agent metamorphose (exec) into a differently
+// specialised successor — e.g. analyst → coder — with the same mission.
+package persona
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultDir is the search path used when QUINE_PERSONA_DIR is unset.
+const DefaultDir = "personas"
+
+// ErrNotFound is returned when no directory on the search path holds the
+// requested persona.
+var ErrNotFound = errors.New("persona not found")
+
+// SearchPath splits a QUINE_PERSONA_DIR value (os.PathListSeparator
+// separated, like PATH) into absolute directories. Relative entries are
+// resolved against the current working directory so that descendants
+// running elsewhere still find the same files. An empty value yields
+// DefaultDir.
+func SearchPath(value string) []string {
+	if value == "" {
+		value = DefaultDir
+	}
+	var dirs []string
+	for _, dir := range filepath.SplitList(value) {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// Resolve returns the path of the first {name}.md found in dirs.
+// Names must be bare identifiers: path separators and ".." are rejected so
+// a persona cannot escape its search path.
+func Resolve(dirs []string, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid persona name %q", name)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name+".md")
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().IsRegular() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q (searched %s)", ErrNotFound, name, strings.Join(dirs, string(os.PathListSeparator)))
+}
+
+// Load resolves name on dirs and returns the persona text with surrounding
+// whitespace trimmed.
+func Load(dirs []string, name string) (string, error) {
+	path, err := Resolve(dirs, name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading persona %q: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,68 @@
+package persona
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePersona(t *testing.T, dir, name, text string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name+".md"), []byte(text), 0o644); err != nil {
+		t.Fatalf("writing persona: %v", err)
+	}
+}
+
+func TestLoad_FirstMatchWins(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	writePersona(t, first, "coder", "  You write code.\n")
+	writePersona(t, second, "coder", "shadowed")
+	writePersona(t, second, "analyst", "You analyse.")
+
+	dirs := []string{first, second}
+
+	text, err := Load(dirs, "coder")
+	if err != nil {
+		t.Fatalf("Load(coder): %v", err)
+	}
+	if text != "You write code." {
+		t.Errorf("coder = %q, want trimmed text from first dir", text)
+	}
+
+	text, err = Load(dirs, "analyst")
+	if err != nil {
+		t.Fatalf("Load(analyst): %v", err)
+	}
+	if text != "You analyse." {
+		t.Errorf("analyst = %q", text)
+	}
+}
+
+func TestResolve_NotFound(t *testing.T) {
+	_, err := Resolve([]string{t.TempDir()}, "ghost")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestResolve_RejectsPathNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"", "..", "../etc/passwd", "a/b"} {
+		if _, err := Resolve([]string{dir}, name); err == nil {
+			t.Errorf("Resolve(%q) should fail", name)
+		}
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	dirs := SearchPath("")
+	if len(dirs) != 1 || !filepath.IsAbs(dirs[0]) || filepath.Base(dirs[0]) != DefaultDir {
+		t.Errorf("default search path = %v", dirs)
+	}
+
+	dirs = SearchPath("/a" + string(os.PathListSeparator) + string(os.PathListSeparator) + "/b")
+	if len(dirs) != 2 || dirs[0] != "/a" || dirs[1] != "/b" {
+		t.Errorf("SearchPath split = %v", dirs)
+	}
+}
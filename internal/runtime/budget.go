@@ -0,0 +1,150 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ledger is a tree-wide token budget (QUINE_TOKEN_BUDGET) backed by a file
+// in the lock directory. Every process in the tree shares the same ledger
+// via QUINE_TREE_ID, so a runaway fork tree drains one common pool of
+// Energy instead of each process having its own.
+//
+// Updates are serialized with an O_EXCL lock file (the same primitive the
+// Semaphore uses) and written via rename, so a reader never sees a torn value.
+type Ledger struct {
+	path     string
+	lockPath string
+	budget   int
+}
+
+// ledgerLockStale is the age after which a ledger lock file is assumed to
+// belong to a process that died mid-update and is removed.
+const ledgerLockStale = 10 * time.Second
+
+// NewLedger creates a Ledger for the given tree. A budget of 0 means
+// unlimited: Remaining is always -1 and the runtime never debits it.
+func NewLedger(lockDir, treeID string, budget int) *Ledger {
+	path := filepath.Join(lockDir, treeID+".budget")
+	return &Ledger{
+		path:     path,
+		lockPath: path + "-lock", // not ".lock": the Semaphore counts those
+		budget:   budget,
+	}
+}
+
+// Budget returns the configured tree-wide budget (0 = unlimited).
+func (l *Ledger) Budget() int {
+	return l.budget
+}
+
+// Debit atomically adds tokens to the tree's spent total and returns the
+// new total.
+func (l *Ledger) Debit(tokens int) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return 0, fmt.Errorf("ledger: creating dir: %w", err)
+	}
+	if err := l.lock(); err != nil {
+		return 0, err
+	}
+	defer os.Remove(l.lockPath)
+
+	spent, err := l.read()
+	if err != nil {
+		return 0, err
+	}
+	spent += tokens
+
+	tmp := fmt.Sprintf("%s.%d.tmp", l.path, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(spent)+"\n"), 0o644); err != nil {
+		return 0, fmt.Errorf("ledger: writing: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("ledger: committing: %w", err)
+	}
+	return spent, nil
+}
+
+// Spent returns the tokens spent so far by the whole tree.
+func (l *Ledger) Spent() (int, error) {
+	return l.read()
+}
+
+// Remaining returns the tokens left in the tree's budget, floored at 0.
+// Returns -1 if the budget is unlimited. A ledger that cannot be read
+// counts as spent: a corrupt ledger must not lift the tree's budget.
+func (l *Ledger) Remaining() int {
+	if l.budget <= 0 {
+		return -1
+	}
+	spent, err := l.read()
+	if err != nil {
+		return 0
+	}
+	if spent >= l.budget {
+		return 0
+	}
+	return l.budget - spent
+}
+
+// NearlySpent reports whether the tree has used 90% or more of its budget.
+// Always false for an unlimited budget.
+func (l *Ledger) NearlySpent() bool {
+	remaining := l.Remaining()
+	return remaining >= 0 && remaining <= l.budget/10
+}
+
+// Exhausted reports whether the tree's budget is fully spent.
+func (l *Ledger) Exhausted() bool {
+	return l.Remaining() == 0
+}
+
+// read parses the spent total. A missing ledger means nothing spent yet.
+func (l *Ledger) read() (int, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("ledger: reading: %w", err)
+	}
+	spent, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("ledger: parsing %q: %w", l.path, err)
+	}
+	return spent, nil
+}
+
+// lock acquires the ledger's lock file.
+func (l *Ledger) lock() error {
+	if err := lockFile(l.lockPath, ledgerLockStale); err != nil {
+		return fmt.Errorf("ledger: creating lock file: %w", err)
+	}
+	return nil
+}
+
+// lockFile acquires path as an O_EXCL lock file, polling briefly while
+// another process holds it and breaking locks older than stale. The caller
+// releases it by removing path.
+func lockFile(path string, stale time.Duration) error {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > stale {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLedgerDebitAccumulates(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "locks")
+	l := NewLedger(dir, "tree-1", 1000)
+
+	if r := l.Remaining(); r != 1000 {
+		t.Errorf("expected 1000 remaining before any debit, got %d", r)
+	}
+	if spent, err := l.Debit(300); err != nil || spent != 300 {
+		t.Fatalf("Debit(300) = %d, %v", spent, err)
+	}
+
+	// A second Ledger on the same tree (another process) sees the same pool.
+	other := NewLedger(dir, "tree-1", 1000)
+	if spent, err := other.Debit(650); err != nil || spent != 950 {
+		t.Fatalf("Debit(650) = %d, %v", spent, err)
+	}
+	if r := l.Remaining(); r != 50 {
+		t.Errorf("expected 50 remaining, got %d", r)
+	}
+	if !l.NearlySpent() {
+		t.Error("expected NearlySpent at 95% usage")
+	}
+	if l.Exhausted() {
+		t.Error("should not be exhausted yet")
+	}
+
+	l.Debit(100)
+	if r := l.Remaining(); r != 0 {
+		t.Errorf("Remaining should floor at 0, got %d", r)
+	}
+	if !l.Exhausted() {
+		t.Error("expected Exhausted")
+	}
+}
+
+func TestLedgerUnreadableFailsClosed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "locks")
+	l := NewLedger(dir, "tree-1", 1000)
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "tree-1.budget"), []byte("garbage\n"), 0o644)
+
+	if r := l.Remaining(); r != 0 {
+		t.Errorf("Remaining with a corrupt ledger = %d, want 0", r)
+	}
+	if !l.Exhausted() {
+		t.Error("a corrupt ledger should count as exhausted")
+	}
+	if _, err := l.Debit(10); err == nil {
+		t.Error("Debit on a corrupt ledger should fail")
+	}
+}
+
+func TestLedgerUnlimited(t *testing.T) {
+	l := NewLedger(t.TempDir(), "tree-unlimited", 0)
+	l.Debit(1_000_000)
+
+	if r := l.Remaining(); r != -1 {
+		t.Errorf("expected -1 for unlimited budget, got %d", r)
+	}
+	if l.NearlySpent() || l.Exhausted() {
+		t.Error("unlimited budget should never be spent")
+	}
+}
+
+func TestLedgerConcurrentDebits(t *testing.T) {
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := NewLedger(dir, "tree-concurrent", 0)
+			for j := 0; j < 10; j++ {
+				if _, err := l.Debit(1); err != nil {
+					t.Errorf("Debit: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	spent, err := NewLedger(dir, "tree-concurrent", 0).Spent()
+	if err != nil {
+		t.Fatalf("Spent: %v", err)
+	}
+	if spent != 200 {
+		t.Errorf("expected 200 tokens spent, got %d (lost updates)", spent)
+	}
+}
+
+func TestLedgerDoesNotOccupySemaphoreSlots(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLedger(dir, "tree-sem", 100)
+	sem := NewSemaphore(dir, 1, "sem-session")
+
+	// Simulate a ledger update in progress.
+	if err := os.WriteFile(l.lockPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(l.lockPath)
+
+	if sem.Count() != 0 {
+		t.Errorf("ledger lock file should not count as a semaphore slot")
+	}
+}
@@ -0,0 +1,49 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// preToolHooks runs the QUINE_HOOKS_DIR pre hooks for tc and returns the
+// call to execute, with any rewritten arguments. If a hook denied the call,
+// it returns false after recording the denial as the call's tool result.
+func (r *Runtime) preToolHooks(tc tape.ToolCall) (tape.ToolCall, bool) {
+	v := r.hooks.Pre(tc)
+
+	if len(v.Rewritten) > 0 {
+		// The tape records the call as executed: replay, resume and forked
+		// children read the rewritten arguments, not the model's.
+		r.tape.RewriteToolCall(tc.ID, v.Call.Arguments)
+		args, _ := json.Marshal(v.Call.Arguments)
+		for _, hook := range v.Rewritten {
+			r.writeTapeEntry(tape.HookEntry("pre", hook, tc.ID, "rewrite", string(args)))
+		}
+		r.log("hooks: %s(%s) arguments rewritten by %v", tc.Name, tc.ID, v.Rewritten)
+	}
+
+	if v.Denied {
+		r.writeTapeEntry(tape.HookEntry("pre", v.Hook, tc.ID, "deny", v.Reason))
+		r.log("hooks: %s(%s) denied by %s: %s", tc.Name, tc.ID, v.Hook, v.Reason)
+		denyMsg := tape.Message{
+			Role:    tape.RoleToolResult,
+			Content: fmt.Sprintf("[HOOK DENIED] %s: %s", v.Hook, v.Reason),
+			ToolID:  tc.ID,
+		}
+		r.tape.Append(denyMsg)
+		r.writeTapeEntry(tape.MessageEntry(denyMsg))
+		return tc, false
+	}
+	return v.Call, true
+}
+
+// postToolHooks runs the post hooks for a completed call. They only
+// observe; failures are logged and recorded on the tape.
+func (r *Runtime) postToolHooks(tc tape.ToolCall, result tape.ToolResult) {
+	for _, err := range r.hooks.Post(tc, result) {
+		r.writeTapeEntry(tape.HookEntry("post", "", tc.ID, "error", err.Error()))
+		r.log("hooks: post %s(%s): %v", tc.Name, tc.ID, err)
+	}
+}
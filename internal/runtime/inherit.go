@@ -0,0 +1,57 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// inheritContext seeds the tape with the parent's conversation (§3.1 Mitosis).
+//
+// ForkExecutor copies the parent tape to a fork-tape-*.jsonl file and points
+// QUINE_CONTEXT_TAPE at it. The copy is taken while the parent is in the
+// middle of handling its fork call, so the last assistant message carries a
+// tool_use without a tool_result. Every such dangling call is closed with a
+// synthetic result so the child's first request is well-formed.
+//
+// The parent's system prompt is dropped: the child already has its own,
+// built around its own mission.
+//
+// Returns the number of inherited messages. Failures are logged and the child
+// starts cold rather than dying.
+func (r *Runtime) inheritContext(mission string) int {
+	summary, err := tape.ReadTapeFile(r.cfg.ContextTape)
+	if err != nil {
+		r.log("context tape unreadable, starting cold: %v", err)
+		return 0
+	}
+
+	msgs, err := summary.Messages()
+	if err != nil {
+		r.log("context tape corrupt, starting cold: %v", err)
+		return 0
+	}
+
+	var inherited []tape.Message
+	for _, m := range msgs {
+		if m.Role == tape.RoleSystem {
+			continue
+		}
+		inherited = append(inherited, m)
+	}
+
+	inherited = tape.CloseDanglingToolCalls(inherited, func(tc tape.ToolCall) string {
+		if intent, _ := tc.Arguments["intent"].(string); tc.Name == "fork" && intent == mission {
+			return fmt.Sprintf("[FORK] This call spawned you. You are the child process (depth %d); your parent is still running. Carry out the intent below — it is now your mission.\n%s", r.cfg.Depth, intent)
+		}
+		return "[FORK] Not executed in this process: the context was cloned before this call completed."
+	})
+
+	for _, m := range inherited {
+		r.tape.Append(m)
+		r.writeTapeEntry(tape.MessageEntry(m))
+	}
+
+	r.log("inherited %d messages from parent session %s", len(inherited), summary.SessionID)
+	return len(inherited)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/kehao95/quine/internal/config"
 )
@@ -20,9 +21,25 @@ func BuildSystemPrompt(cfg *config.Config, mission string) string {
 		maxTurns = fmt.Sprintf("%d", cfg.MaxTurns)
 	}
 
+	tokenBudget := "unlimited"
+	if cfg.TokenBudget > 0 {
+		tokenBudget = fmt.Sprintf("%d tokens", cfg.TokenBudget)
+	}
+
+	deadline := "none"
+	if !cfg.Deadline.IsZero() {
+		deadline = fmt.Sprintf("%s (%s remaining)", cfg.Deadline.Format(time.RFC3339),
+			time.Until(cfg.Deadline).Round(time.Second))
+	}
+
+	modelLimits := formatModelLimits(cfg)
+
 	// Build wisdom section if there are any wisdom entries
 	wisdomSection := formatWisdom(cfg.Wisdom)
 
+	// Build persona section if a persona is active
+	personaSection := formatPersona(cfg.Persona, cfg.PersonaPrompt)
+
 	// Build mission section (Harvard Architecture: mission is code, not data)
 	missionSection := fmt.Sprintf("\n### Your Mission\n%s\n", mission)
 
@@ -30,15 +47,43 @@ func BuildSystemPrompt(cfg *config.Config, mission string) string {
 		"{DEPTH}", fmt.Sprintf("%d", cfg.Depth),
 		"{MAX_DEPTH}", fmt.Sprintf("%d", cfg.MaxDepth),
 		"{MAX_TURNS}", maxTurns,
+		"{TOKEN_BUDGET}", tokenBudget,
+		"{DEADLINE}", deadline,
 		"{MODEL_ID}", cfg.ModelID,
+		"{MODEL_LIMITS}", modelLimits,
 		"{SESSION_ID}", cfg.SessionID,
 		"{SHELL}", cfg.Shell,
 		"{WISDOM}", wisdomSection,
+		"{PERSONA}", personaSection,
 		"{MISSION}", missionSection,
 	)
 	return r.Replace(systemPromptTemplate)
 }
 
+// formatModelLimits describes the model's context window and output limit,
+// and its price when the model registry knows it, as environment lines.
+func formatModelLimits(cfg *config.Config) string {
+	m := cfg.Models.Resolve(cfg.ModelID, cfg.ForUpstream().Provider)
+	window := cfg.ContextWindow
+	if window <= 0 {
+		window = m.ContextWindow
+	}
+	s := fmt.Sprintf("\n- Context Window: %d tokens (replies up to %d tokens)", window, m.MaxOutput)
+	if m.Priced() {
+		s += fmt.Sprintf("\n- Price: $%g / $%g per million input / output tokens", m.InputPrice, m.OutputPrice)
+	}
+	return s
+}
+
+// formatPersona formats the active persona as a markdown section.
+// Returns an empty string if no persona is active.
+func formatPersona(name, text string) string {
+	if name == "" || text == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n### Persona: %s\n%s\n", name, text)
+}
+
 // formatWisdom formats the wisdom map as a markdown section.
 // Returns an empty string if there are no wisdom entries.
 func formatWisdom(wisdom map[string]string) string {
@@ -23,7 +23,7 @@ func testConfig() *config.Config {
 func TestBuildSystemPrompt_NoRawPlaceholders(t *testing.T) {
 	prompt := BuildSystemPrompt(testConfig(), "test mission")
 
-	placeholders := []string{"{DEPTH}", "{MAX_DEPTH}", "{MAX_TURNS}", "{MODEL_ID}", "{SESSION_ID}", "{SHELL}", "{WISDOM}", "{MISSION}"}
+	placeholders := []string{"{DEPTH}", "{MAX_DEPTH}", "{MAX_TURNS}", "{MODEL_ID}", "{SESSION_ID}", "{SHELL}", "{WISDOM}", "{PERSONA}", "{MISSION}", "{TOKEN_BUDGET}", "{DEADLINE}", "{MODEL_LIMITS}"}
 	for _, ph := range placeholders {
 		if strings.Contains(prompt, ph) {
 			t.Errorf("prompt still contains unsubstituted placeholder %s", ph)
@@ -206,3 +206,47 @@ func TestBuildSystemPrompt_WisdomNoRawPlaceholder(t *testing.T) {
 		t.Error("prompt should not contain raw {WISDOM} placeholder")
 	}
 }
+
+func TestBuildSystemPrompt_WithPersona(t *testing.T) {
+	cfg := testConfig()
+	cfg.Persona = "coder"
+	cfg.PersonaPrompt = "You write small, tested changes."
+	prompt := BuildSystemPrompt(cfg, "test mission")
+
+	if !strings.Contains(prompt, "### Persona: coder\nYou write small, tested changes.") {
+		t.Error("prompt should contain the persona section")
+	}
+	if strings.Index(prompt, "### Persona") > strings.Index(prompt, "### Your Mission") {
+		t.Error("persona section should precede the mission")
+	}
+}
+
+func TestBuildSystemPrompt_WithoutPersona(t *testing.T) {
+	prompt := BuildSystemPrompt(testConfig(), "test mission")
+
+	if strings.Contains(prompt, "### Persona") {
+		t.Error("prompt should not contain a persona section when none is active")
+	}
+}
+
+func TestBuildSystemPrompt_ModelLimits(t *testing.T) {
+	cfg := testConfig()
+	prompt := BuildSystemPrompt(cfg, "test mission")
+	if !strings.Contains(prompt, "- Context Window: 200000 tokens (replies up to 64000 tokens)") {
+		t.Error("prompt should give the registry's limits for a known model")
+	}
+	if !strings.Contains(prompt, "- Price: $3 / $15 per million input / output tokens") {
+		t.Error("prompt should give the registry's price for a known model")
+	}
+
+	cfg.ModelID = "llama3.1:8b"
+	cfg.Provider = "openai"
+	cfg.ContextWindow = 8192
+	prompt = BuildSystemPrompt(cfg, "test mission")
+	if !strings.Contains(prompt, "- Context Window: 8192 tokens (replies up to 4096 tokens)") {
+		t.Error("prompt should give the configured window and default output limit for an unknown model")
+	}
+	if strings.Contains(prompt, "- Price:") {
+		t.Error("prompt should not price an unknown model")
+	}
+}
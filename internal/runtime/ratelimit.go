@@ -0,0 +1,224 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RateLimiter paces the LLM calls of a whole process tree. Like the Ledger
+// it is a file in the lock directory shared via QUINE_TREE_ID, so twenty
+// agents hitting a rate limit back off together instead of each retrying
+// on its own. The file holds three things:
+//
+//   - a token bucket refilled at QUINE_RATE_LIMIT requests per minute and
+//     holding at most ten seconds' worth; every request takes one token;
+//   - a pause: after a 429, every process holds off until the delay the
+//     server asked for has passed;
+//   - an adaptive concurrency limit for the Semaphore (AIMD): halved after
+//     repeated 429s, raised again by one slot per limit's worth of
+//     successful calls, up to QUINE_MAX_CONCURRENT.
+//
+// Failures to read or write the file never block a call: the limiter
+// then lets requests through as if it were not there.
+type RateLimiter struct {
+	path          string
+	lockPath      string
+	rate          float64 // tokens per second; 0 = no bucket, only pauses
+	burst         float64
+	maxConcurrent int
+	logWriter     io.Writer // optional; concurrency changes are logged here
+}
+
+const (
+	// aimdStrikes is how many 429s in a row (tree-wide, with no success in
+	// between) lower the concurrency limit.
+	aimdStrikes = 2
+
+	// aimdCooldown is the least time between two decreases, so that a
+	// burst of 429s from requests already in flight counts once.
+	aimdCooldown = 5 * time.Second
+
+	// rateBurstWindow is how many seconds of requests the bucket holds.
+	rateBurstWindow = 10
+)
+
+// rateState is the shared file's content. Times are Unix nanoseconds.
+type rateState struct {
+	Tokens      float64 `json:"tokens"`
+	Refilled    int64   `json:"refilled,omitempty"`
+	PausedUntil int64   `json:"paused_until,omitempty"`
+	Limit       float64 `json:"limit,omitempty"` // 0 = never lowered: QUINE_MAX_CONCURRENT
+	Strikes     int     `json:"strikes,omitempty"`
+	Decreased   int64   `json:"decreased,omitempty"`
+}
+
+// NewRateLimiter creates a RateLimiter for the given tree. perMinute of 0
+// disables the token bucket; pauses and the adaptive concurrency limit
+// still apply.
+func NewRateLimiter(lockDir, treeID string, perMinute, maxConcurrent int) *RateLimiter {
+	path := filepath.Join(lockDir, treeID+".ratelimit")
+	rate := float64(perMinute) / 60
+	return &RateLimiter{
+		path:          path,
+		lockPath:      path + "-lock", // not ".lock": the Semaphore counts those
+		rate:          rate,
+		burst:         max(1, rate*rateBurstWindow),
+		maxConcurrent: maxConcurrent,
+	}
+}
+
+// Wait blocks until the tree may send another request: any pause has
+// passed and, with a rate limit, a token is available.
+func (r *RateLimiter) Wait() {
+	for {
+		d := r.reserve(time.Now())
+		if d <= 0 {
+			return
+		}
+		// Jitter spreads out the processes that wake for the same moment.
+		time.Sleep(d + time.Duration(rand.Int63n(int64(d/4)+1)))
+	}
+}
+
+// reserve takes a token and returns 0, or returns how long to wait before
+// trying again.
+func (r *RateLimiter) reserve(now time.Time) time.Duration {
+	if r.rate <= 0 {
+		// No bucket to update: an unlocked read suffices for the pause.
+		st, _ := r.read()
+		return time.Duration(st.PausedUntil - now.UnixNano())
+	}
+
+	var wait time.Duration
+	r.update(func(st *rateState) bool {
+		if st.PausedUntil > now.UnixNano() {
+			wait = time.Duration(st.PausedUntil - now.UnixNano())
+			return false
+		}
+		if st.Refilled == 0 {
+			st.Tokens = r.burst
+		} else {
+			elapsed := time.Duration(now.UnixNano() - st.Refilled).Seconds()
+			st.Tokens = min(r.burst, st.Tokens+max(0, elapsed)*r.rate)
+		}
+		st.Refilled = now.UnixNano()
+		if st.Tokens < 1 {
+			wait = time.Duration((1 - st.Tokens) / r.rate * float64(time.Second))
+			return true
+		}
+		st.Tokens--
+		return true
+	})
+	return wait
+}
+
+// Throttled records a 429: the tree pauses for delay, and repeated 429s
+// halve its concurrency limit.
+func (r *RateLimiter) Throttled(delay time.Duration) {
+	now := time.Now()
+	r.update(func(st *rateState) bool {
+		st.PausedUntil = max(st.PausedUntil, now.Add(delay).UnixNano())
+		st.Strikes++
+		if st.Strikes >= aimdStrikes && now.UnixNano()-st.Decreased >= int64(aimdCooldown) {
+			limit := st.Limit
+			if limit == 0 {
+				limit = float64(r.maxConcurrent)
+			}
+			st.Limit = max(1, limit/2)
+			st.Strikes = 0
+			st.Decreased = now.UnixNano()
+			r.logf("rate limited repeatedly, tree concurrency lowered to %d", int(st.Limit))
+		}
+		return true
+	})
+}
+
+// Succeeded records a successful call: the strike count resets and a
+// lowered concurrency limit grows back by 1/limit, i.e. one slot per
+// limit's worth of successes.
+func (r *RateLimiter) Succeeded() {
+	if st, err := r.read(); err == nil && st.Strikes == 0 && st.Limit == 0 {
+		return // nothing to adapt; skip the lock
+	}
+	r.update(func(st *rateState) bool {
+		st.Strikes = 0
+		if st.Limit > 0 {
+			before := int(st.Limit)
+			st.Limit += 1 / st.Limit
+			if st.Limit >= float64(r.maxConcurrent) {
+				st.Limit = 0
+			}
+			if after := int(st.Limit); after != before {
+				r.logf("tree concurrency raised to %d", r.concurrency(*st))
+			}
+		}
+		return true
+	})
+}
+
+// Concurrency returns how many LLM calls the tree may currently have in
+// flight: QUINE_MAX_CONCURRENT unless lowered after repeated 429s.
+func (r *RateLimiter) Concurrency() int {
+	st, _ := r.read()
+	return r.concurrency(st)
+}
+
+func (r *RateLimiter) concurrency(st rateState) int {
+	if st.Limit == 0 {
+		return r.maxConcurrent
+	}
+	return min(r.maxConcurrent, max(1, int(st.Limit)))
+}
+
+// update applies fn to the state under the lock and writes the result
+// back if fn returns true.
+func (r *RateLimiter) update(fn func(*rateState) bool) {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return
+	}
+	if err := lockFile(r.lockPath, ledgerLockStale); err != nil {
+		return
+	}
+	defer os.Remove(r.lockPath)
+
+	st, err := r.read()
+	if err != nil || !fn(&st) {
+		return
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", r.path, os.Getpid())
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// read parses the shared state. A missing file is the initial state.
+func (r *RateLimiter) read() (rateState, error) {
+	var st rateState
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+func (r *RateLimiter) logf(format string, args ...any) {
+	if w := r.logWriter; w != nil {
+		fmt.Fprintf(w, "quine: "+format+"\n", args...)
+	}
+}
@@ -0,0 +1,98 @@
+package runtime
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucketSharedByTree(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "locks")
+	// 600/min = 10/s, so the bucket holds 100 tokens.
+	a := NewRateLimiter(dir, "tree-1", 600, 20)
+	b := NewRateLimiter(dir, "tree-1", 600, 20)
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		l := a
+		if i%2 == 1 {
+			l = b // another process in the tree draws from the same bucket
+		}
+		if d := l.reserve(now); d != 0 {
+			t.Fatalf("request %d waited %v, want a token from the burst", i, d)
+		}
+	}
+	if d := b.reserve(now); d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("wait after the burst = %v, want up to 100ms for the next token", d)
+	}
+	if d := a.reserve(now.Add(100 * time.Millisecond)); d != 0 {
+		t.Errorf("wait after a refill = %v, want 0", d)
+	}
+
+	// Another tree has its own bucket.
+	if d := NewRateLimiter(dir, "tree-2", 600, 20).reserve(now); d != 0 {
+		t.Errorf("other tree waited %v", d)
+	}
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	dir := t.TempDir()
+	a := NewRateLimiter(dir, "tree-1", 0, 20)
+	b := NewRateLimiter(dir, "tree-1", 0, 20)
+
+	a.Throttled(2 * time.Second)
+	if d := b.reserve(time.Now()); d <= time.Second || d > 2*time.Second {
+		t.Errorf("wait after another process's 429 = %v, want the 2s the server asked for", d)
+	}
+	if d := b.reserve(time.Now().Add(3 * time.Second)); d > 0 {
+		t.Errorf("wait after the pause = %v, want 0", d)
+	}
+}
+
+func TestRateLimiterAIMD(t *testing.T) {
+	dir := t.TempDir()
+	l := NewRateLimiter(dir, "tree-1", 0, 16)
+	if c := l.Concurrency(); c != 16 {
+		t.Fatalf("initial concurrency = %d, want 16", c)
+	}
+
+	// One 429 is not enough; a success in between resets the count.
+	l.Throttled(0)
+	l.Succeeded()
+	l.Throttled(0)
+	if c := l.Concurrency(); c != 16 {
+		t.Errorf("concurrency after isolated 429s = %d, want 16", c)
+	}
+
+	// Repeated 429s halve it, but a burst within the cooldown counts once.
+	l.Throttled(0)
+	if c := l.Concurrency(); c != 8 {
+		t.Errorf("concurrency after repeated 429s = %d, want 8", c)
+	}
+	l.Throttled(0)
+	l.Throttled(0)
+	if c := l.Concurrency(); c != 8 {
+		t.Errorf("concurrency after 429s within the cooldown = %d, want 8", c)
+	}
+
+	// The semaphore follows the lowered limit.
+	sem := NewSemaphore(dir, 16, "s")
+	sem.limiter = l
+	if s := sem.slots(); s != 8 {
+		t.Errorf("semaphore slots = %d, want 8", s)
+	}
+
+	// Additive increase: about one slot per limit's worth of successes.
+	for i := 0; i < 9; i++ {
+		l.Succeeded()
+	}
+	if c := l.Concurrency(); c != 9 {
+		t.Errorf("concurrency after 9 successes = %d, want 9", c)
+	}
+	for i := 0; i < 200; i++ {
+		l.Succeeded()
+	}
+	if c := l.Concurrency(); c != 16 {
+		t.Errorf("concurrency after many successes = %d, want it back at 16", c)
+	}
+}
@@ -0,0 +1,55 @@
+package runtime
+
+import (
+	"os"
+	"strings"
+
+	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/llm/transport"
+)
+
+// redactedMark replaces a secret found in tool output.
+const redactedMark = "[REDACTED]"
+
+// minSecretLen keeps short values, which would match ordinary output, off
+// the redaction list.
+const minSecretLen = 8
+
+// newRedactor returns a replacer for the credentials this process knows
+// (the API key, the OAuth client secret, AWS secrets, the broker token,
+// the keys of the tree's other upstreams and the signing keys fetched at
+// run time), or nil if there are none. Tool output passes through it
+// before reaching the tape, so a command like `env` or
+// `cat $QUINE_API_KEY_FILE` does not put a secret in front of the model or
+// into the session log.
+func newRedactor(cfg *config.Config, keys ...string) *strings.Replacer {
+	var pairs []string
+	secrets := append([]string{cfg.APIKey, cfg.OAuthClientSecret, cfg.AWSSecretKey, cfg.AWSSessionToken, cfg.BrokerToken}, keys...)
+	for _, f := range cfg.Upstreams() {
+		if f.KeyEnv != "" {
+			secrets = append(secrets, os.Getenv(f.KeyEnv))
+		}
+	}
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLen {
+			pairs = append(pairs, secret, redactedMark)
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// redact replaces every known secret in s.
+func (r *Runtime) redact(s string) string {
+	// A key from a file, helper or token endpoint joins the list once the
+	// provider has signed with it.
+	if keys := transport.SignedKeys(); len(keys) != r.redactedKeys {
+		r.redactor, r.redactedKeys = newRedactor(r.cfg, keys...), len(keys)
+	}
+	if r.redactor == nil {
+		return s
+	}
+	return r.redactor.Replace(s)
+}
@@ -0,0 +1,15 @@
+package runtime
+
+import (
+	"github.com/kehao95/quine/internal/llm"
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// reportDivergence records where a replayed session (QUINE_API_TYPE=replay)
+// departs from its recording: on the tape as a "divergence" entry, and on
+// stderr, since finding it is the point of the replay.
+func (r *Runtime) reportDivergence(d llm.Divergence) {
+	r.writeTapeEntry(tape.DivergenceEntry(d.Reply, d.Kind, d.ToolID, d.Detail, d.Recorded, d.Replayed))
+	r.log("replay divergence before reply %d: %s", d.Reply, d.Detail)
+	r.logError("replay divergence before reply %d: %s", d.Reply, d)
+}
@@ -0,0 +1,163 @@
+package runtime
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/tape"
+)
+
+// interruptedResult closes a tool call that was in flight when the previous
+// process died. Its side effects are unknown, so the agent is told to check.
+const interruptedResult = "[INTERRUPTED] The session was interrupted before this call completed. It may or may not have taken effect — check before retrying."
+
+// resumedNote is appended as a user message when a session is resumed.
+const resumedNote = "[RESUMED] This session was interrupted and is now continuing in a new process. Shell state (working directory, variables, background jobs) was lost; the filesystem persists. Continue your mission."
+
+// ResumeTape reads the tape of the session to resume from dataDir. It
+// refuses a session ID that is not a plain file name, a session whose
+// process is still running (it would end up with two drivers writing one
+// tape) and a tape whose meta entry names a different session.
+func ResumeTape(dataDir, sessionID string) (*tape.TapeSummary, error) {
+	if sessionID == "" || sessionID == "." || sessionID == ".." || strings.ContainsAny(sessionID, `/\`) {
+		return nil, fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	path := filepath.Join(dataDir, sessionID+".jsonl")
+	if tape.InUse(path) {
+		return nil, fmt.Errorf("session %s: %w", sessionID, tape.ErrInUse)
+	}
+	summary, err := tape.ReadTapeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if summary.SessionID != "" && summary.SessionID != sessionID {
+		return nil, fmt.Errorf("%s records session %s, not %s", path, summary.SessionID, sessionID)
+	}
+	return summary, nil
+}
+
+// PrepareResume validates that the session recorded in summary can be
+// resumed and points cfg at it: same session ID (so the tape file is
+// appended to), parent, depth and wisdom. Unless QUINE_TREE_ID was set
+// explicitly, the resumed session also rejoins its original tree, whose
+// ledger and rate limit it shares. The restored depth is checked against
+// QUINE_MAX_DEPTH again.
+//
+// Returns the original mission.
+func PrepareResume(cfg *config.Config, summary *tape.TapeSummary) (string, error) {
+	if summary.SessionID == "" {
+		return "", fmt.Errorf("tape has no meta entry")
+	}
+	if o := summary.Outcome; o != nil && o.TerminationMode != tape.TermSignal {
+		return "", fmt.Errorf("session %s already ended (%s, exit %d)", summary.SessionID, o.TerminationMode, o.ExitCode)
+	}
+
+	mission := RecordedMission(summary)
+	if strings.TrimSpace(mission) == "" {
+		return "", fmt.Errorf("session %s: mission not found on tape", summary.SessionID)
+	}
+
+	if summary.Depth >= cfg.MaxDepth {
+		return "", fmt.Errorf("session %s: depth %d: %w (QUINE_MAX_DEPTH=%d)", summary.SessionID, summary.Depth, config.ErrDepthExceeded, cfg.MaxDepth)
+	}
+
+	if cfg.TreeID == cfg.SessionID {
+		cfg.TreeID = summary.TreeID
+		if cfg.TreeID == "" {
+			// Tapes written before tree_id was recorded.
+			cfg.TreeID = summary.SessionID
+		}
+	}
+	cfg.SessionID = summary.SessionID
+	cfg.ParentSession = summary.ParentSessionID
+	cfg.Depth = summary.Depth
+	if len(summary.Wisdom) > 0 {
+		cfg.Wisdom = summary.Wisdom
+	}
+	return mission, nil
+}
+
+// RecordedMission returns the mission of the session recorded in summary,
+// or "" if the tape does not contain it.
+func RecordedMission(summary *tape.TapeSummary) string {
+	if summary.Mission != "" {
+		return summary.Mission
+	}
+	return missionFromTape(summary)
+}
+
+// missionFromTape recovers the mission from the "### Your Mission" section
+// of the recorded system prompt. Tapes written before the mission was
+// stored in the meta entry only have it there.
+func missionFromTape(summary *tape.TapeSummary) string {
+	msgs, err := summary.Messages()
+	if err != nil || len(msgs) == 0 || msgs[0].Role != tape.RoleSystem {
+		return ""
+	}
+	const header = "\n### Your Mission\n"
+	prompt := msgs[0].Content
+	i := strings.LastIndex(prompt, header)
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(prompt[i+len(header):], "\n")
+}
+
+// Resume continues an interrupted session from its tape (quine -resume).
+// The cfg must have been prepared with PrepareResume, which also supplies
+// the mission.
+//
+// The conversation, turn count and token totals are rebuilt from the tape.
+// Tool calls left without a result by the dead process are closed with an
+// [INTERRUPTED] result, a [RESUMED] note is appended, and the turn loop
+// continues, appending to the same tape file.
+func (r *Runtime) Resume(mission string, summary *tape.TapeSummary) int {
+	msgs, err := summary.Messages()
+	if err != nil {
+		r.logError("resume: %v", err)
+		return 1
+	}
+	turns, err := summary.ShTurns()
+	if err != nil {
+		r.logError("resume: %v", err)
+		return 1
+	}
+
+	return r.session(mission, func() {
+		r.tape = tape.NewTape(summary.SessionID, summary.ParentSessionID, summary.Depth, r.cfg.ModelID)
+		r.tape.CreatedAt = summary.CreatedAt
+		r.tape.Mission = mission
+		r.tape.Wisdom = r.cfg.Wisdom
+		r.tape.TreeID = r.cfg.TreeID
+		r.tape.TurnCount = turns
+		r.tape.AddUsage(summary.TokensIn, summary.TokensOut, summary.CacheWriteTokens, summary.CacheReadTokens)
+
+		r.writeTapeEntry(tape.ResumeEntry())
+
+		interrupted := make(map[string]bool)
+		msgs = tape.CloseDanglingToolCalls(msgs, func(tc tape.ToolCall) string {
+			interrupted[tc.ID] = true
+			r.log("resume: tool call %s (%s) was interrupted", tc.ID, tc.Name)
+			return interruptedResult
+		})
+		for _, m := range msgs {
+			r.tape.Append(m)
+			if m.Role == tape.RoleToolResult && interrupted[m.ToolID] && m.Content == interruptedResult {
+				r.writeTapeEntry(tape.MessageEntry(m))
+			}
+		}
+
+		note := tape.Message{
+			Role:    tape.RoleUser,
+			Content: resumedNote,
+		}
+		r.tape.Append(note)
+		r.writeTapeEntry(tape.MessageEntry(note))
+
+		r.log("session resumed (depth=%d, model=%s, turns=%d, messages=%d)",
+			r.cfg.Depth, r.cfg.ModelID, turns, len(msgs))
+		r.log("mission: %s", mission)
+	})
+}
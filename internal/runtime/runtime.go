@@ -6,11 +6,14 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/kehao95/quine/internal/broker"
 	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/hooks"
 	"github.com/kehao95/quine/internal/llm"
 	"github.com/kehao95/quine/internal/tape"
 	"github.com/kehao95/quine/internal/tools"
@@ -28,7 +31,15 @@ type Runtime struct {
 	tools         []llm.ToolSchema
 	semaphore     *Semaphore
 	agentRegistry *AgentRegistry
+	ledger        *Ledger
+	textPolicy    *TextPolicy
+	hooks         *hooks.Runner     // nil when QUINE_HOOKS_DIR is unset
+	broker        *broker.Broker    // nil unless the tree has a credential broker
+	redactor      *strings.Replacer // secrets scrubbed from tool output, nil if none
+	redactedKeys  int               // how many transport.SignedKeys redactor covers
 	startTime     time.Time
+	cost          float64                          // USD spent by this process's LLM calls on priced models
+	priced        bool                             // some call was on a model with a known price
 	log           func(format string, args ...any) // operational log → log file
 	logError      func(format string, args ...any) // failure signal → stderr
 
@@ -45,7 +56,7 @@ type Runtime struct {
 	// for the Agent's semantic gradient (failure signals only).
 	logFile *os.File
 
-	// panicMode is set by SIGALRM (§2.2). When set, the next turn injects
+	// panicMode is set by SIGALRM (§2.2) or when cfg.Deadline passes. When set, the next turn injects
 	// a "System 1 Override" message forcing the agent to exit immediately.
 	// Non-exit tool calls are rejected while in panic mode.
 	panicMode atomic.Bool
@@ -76,12 +87,41 @@ func (r *Runtime) SetStdin(f *os.File) {
 }
 
 // New creates a Runtime from config. Call Run() to start the loop.
+//
+// A tree root holding the API key starts the credential broker first, so
+// that the shell and children are handed the broker instead of the key. A
+// descendant joins the broker it was handed, which then serves it until it
+// exits.
 func New(cfg *config.Config) (*Runtime, error) {
+	var b *broker.Broker
+	root := broker.Enabled(cfg)
+	if root {
+		var err error
+		if b, err = broker.Start(cfg); err != nil {
+			return nil, fmt.Errorf("starting credential broker: %w", err)
+		}
+	} else if cfg.BrokerSocket != "" {
+		var err error
+		if b, err = broker.Join(cfg); err != nil {
+			return nil, fmt.Errorf("joining credential broker: %w", err)
+		}
+	}
 	provider, err := llm.NewProvider(cfg)
 	if err != nil {
+		b.Close()
 		return nil, fmt.Errorf("creating provider: %w", err)
 	}
-	return newRuntime(cfg, provider), nil
+	r := newRuntime(cfg, provider)
+	r.broker = b
+	if b != nil {
+		r.fork.BrokerShare = b.Share
+	}
+	if root {
+		if err := broker.Harden(); err != nil {
+			r.log("credential broker: cannot hide process environment: %v", err)
+		}
+	}
+	return r, nil
 }
 
 // NewWithProvider creates a Runtime with a custom provider (for testing).
@@ -106,6 +146,13 @@ func newRuntime(cfg *config.Config, provider llm.Provider) *Runtime {
 	// Derive lock directory from data dir: {dataDir}/locks/
 	lockDir := filepath.Join(cfg.DataDir, "locks")
 
+	// The token ledger is keyed by tree; a config without one (e.g. tests)
+	// is its own tree root.
+	treeID := cfg.TreeID
+	if treeID == "" {
+		treeID = cfg.SessionID
+	}
+
 	// Create dedicated log file for operational messages (§10.2).
 	// Location: ${QUINE_DATA_DIR}/${SESSION_ID}.log (flat structure)
 	os.MkdirAll(cfg.DataDir, 0o755)
@@ -117,14 +164,23 @@ func newRuntime(cfg *config.Config, provider llm.Provider) *Runtime {
 		provider:      provider,
 		sh:            tools.NewShExecutor(cfg, childEnv),
 		fork:          tools.NewForkExecutor(cfg, childEnv),
-		tools:         tools.AllToolSchemas(),
+		tools:         tools.AllToolSchemas(cfg.ForkModelIDs()...),
 		semaphore:     NewSemaphore(lockDir, cfg.MaxConcurrent, cfg.SessionID),
 		agentRegistry: NewAgentRegistry(lockDir, cfg.MaxAgents, cfg.SessionID),
+		ledger:        NewLedger(lockDir, treeID, cfg.TokenBudget),
+		textPolicy:    &TextPolicy{MaxConsecutive: cfg.MaxTextTurns, MaxStrikes: cfg.MaxTextStrikes},
+		hooks:         hooks.New(cfg.HooksDir),
+		redactor:      newRedactor(cfg),
 		stdout:        os.Stdout,
 		stderr:        os.Stderr,
 		logFile:       logFile,
 	}
 
+	// Hooks run with the shell's view of the credentials.
+	if r.hooks != nil {
+		r.hooks.Env = cfg.HookEnv()
+	}
+
 	// Wire the process's real stdin/stdout to the sh executor so that
 	// commands can read from /dev/stdin and write to /dev/stdout.
 	r.sh.Stdin = os.Stdin
@@ -161,9 +217,23 @@ func newRuntime(cfg *config.Config, provider llm.Provider) *Runtime {
 		fmt.Fprintf(r.stderr, "quine[%s]: %s\n", shortID, msg)
 	}
 
-	// Route semaphore operational logs to the log file.
+	// LLM calls are paced tree-wide; the same limiter adapts the
+	// semaphore's slot count to the provider's rate limits.
+	limiter := NewRateLimiter(lockDir, treeID, cfg.RateLimit, cfg.MaxConcurrent)
+	r.semaphore.limiter = limiter
+	if lp, ok := provider.(interface{ SetLimiter(llm.Limiter) }); ok {
+		lp.SetLimiter(limiter)
+	}
+
+	// Route semaphore and rate limiter operational logs to the log file.
 	if logFile != nil {
 		r.semaphore.logWriter = logFile
+		limiter.logWriter = logFile
+	}
+
+	// A replayed session reports where it departs from its recording.
+	if rp, ok := provider.(*llm.ReplayProvider); ok {
+		rp.OnDivergence = r.reportDivergence
 	}
 
 	// Redirect LLM retry logs to the log file.
@@ -177,11 +247,13 @@ func newRuntime(cfg *config.Config, provider llm.Provider) *Runtime {
 // Signal behavior:
 //   - SIGALRM: Sets panicMode flag. The turn loop will inject a "System 1
 //     Override" message forcing the agent to exit with its best current answer.
+//     QUINE_DEADLINE raises the same flag internally (see armDeadline).
 //   - SIGINT: If a tool subprocess is running, forwards SIGINT to its process
 //     group (letting e.g. python handle Ctrl+C). If no tool is running, triggers
 //     graceful shutdown (same as SIGTERM).
 //   - SIGTERM: Flushes the Tape to disk and exits with code 143.
 //   - SIGPIPE: Downstream pipe closed. Flushes the Tape and exits with code 141.
+//     A SIGPIPE from any other descriptor (a socket) is ignored.
 //   - SIGHUP: Terminal hangup. Flushes the Tape and exits with code 129.
 func (r *Runtime) setupSignalHandler() {
 	sigCh := make(chan os.Signal, 2)
@@ -213,6 +285,10 @@ func (r *Runtime) setupSignalHandler() {
 				r.gracefulShutdown(129) // 128 + 1
 
 			case syscall.SIGPIPE:
+				if !stdoutGone(r.stdout) {
+					r.log("SIGPIPE received, stdout still open, ignoring")
+					continue
+				}
 				r.log("SIGPIPE received, downstream pipe closed")
 				r.gracefulShutdown(141) // 128 + 13
 
@@ -224,6 +300,28 @@ func (r *Runtime) setupSignalHandler() {
 	}()
 }
 
+// armDeadline starts an internal timer that sets panicMode when
+// cfg.Deadline passes. A deadline already in the past enters panic mode
+// immediately. Returns a function that disarms the timer, or nil if no
+// deadline is configured.
+func (r *Runtime) armDeadline() func() {
+	if r.cfg.Deadline.IsZero() {
+		return nil
+	}
+	remaining := time.Until(r.cfg.Deadline)
+	if remaining <= 0 {
+		r.panicMode.Store(true)
+		r.log("deadline already passed, entering panic mode")
+		return nil
+	}
+	r.log("deadline in %s (%s)", remaining.Round(time.Second), r.cfg.Deadline.Format(time.RFC3339))
+	timer := time.AfterFunc(remaining, func() {
+		r.panicMode.Store(true)
+		r.log("deadline reached, entering panic mode")
+	})
+	return func() { timer.Stop() }
+}
+
 // gracefulShutdown flushes the tape, closes the log file, and exits.
 func (r *Runtime) gracefulShutdown(exitCode int) {
 	// Kill active child process to prevent orphans.
@@ -258,6 +356,7 @@ func (r *Runtime) gracefulShutdown(exitCode int) {
 	if r.sh != nil {
 		r.sh.Close()
 	}
+	r.broker.Close()
 
 	// Close log file before exit (deferred close won't run after os.Exit).
 	if r.logFile != nil {
@@ -276,6 +375,53 @@ func (r *Runtime) gracefulShutdown(exitCode int) {
 //   - mission: The task/goal from argv (goes into system prompt)
 //   - material: The initial user message (describes input mode)
 func (r *Runtime) Run(mission, material string) int {
+	return r.session(mission, func() {
+		// Initialize tape
+		r.tape = tape.NewTape(r.cfg.SessionID, r.cfg.ParentSession, r.cfg.Depth, r.cfg.ModelID)
+		r.tape.Mission = mission
+		r.tape.Wisdom = r.cfg.Wisdom
+		r.tape.TreeID = r.cfg.TreeID
+
+		// Write meta entry
+		r.writeTapeEntry(r.tape.MetaEntry())
+
+		// Build and append system prompt (includes mission as a section)
+		systemPrompt := BuildSystemPrompt(r.cfg, mission)
+		systemMsg := tape.Message{
+			Role:    tape.RoleSystem,
+			Content: systemPrompt,
+		}
+		r.tape.Append(systemMsg)
+		r.writeTapeEntry(tape.MessageEntry(systemMsg))
+
+		// Forked children inherit the parent's conversation (§3.1 Mitosis).
+		if r.cfg.ContextTape != "" {
+			r.inheritContext(mission)
+		}
+
+		// Append user message (material from stdin)
+		// - Text data: the actual content
+		// - Binary data: reference to saved file
+		// - No data: "Begin."
+		userMsg := tape.Message{
+			Role:    tape.RoleUser,
+			Content: material,
+		}
+		r.tape.Append(userMsg)
+		r.writeTapeEntry(tape.MessageEntry(userMsg))
+
+		r.log("session started (depth=%d, model=%s)", r.cfg.Depth, r.cfg.ModelID)
+		r.log("mission: %s", mission)
+		if material != "Begin." {
+			r.log("material: %s", truncateStr(material, 200))
+		}
+	})
+}
+
+// session wraps the turn loop with the per-process setup shared by Run and
+// Resume: registry, shell, tape writer, signal handler and deadline. seed
+// initializes r.tape (and writes its entries) before the loop starts.
+func (r *Runtime) session(mission string, seed func()) int {
 	r.startTime = time.Now()
 	r.originalInput = mission
 
@@ -289,6 +435,11 @@ func (r *Runtime) Run(mission, material string) int {
 	// Initialize exec executor now that we have the original input
 	r.exec = tools.NewExecExecutor(r.cfg, mission)
 
+	// Leave descendants' LLM calls to a detached broker, or stop serving
+	// them, when Run exits: after the shell is gone, which would otherwise
+	// count as a descendant still running.
+	defer r.broker.Close()
+
 	// Close the persistent shell when Run exits.
 	defer r.sh.Close()
 
@@ -297,53 +448,49 @@ func (r *Runtime) Run(mission, material string) int {
 		defer r.logFile.Close()
 	}
 
-	// Initialize tape
-	r.tape = tape.NewTape(r.cfg.SessionID, r.cfg.ParentSession, r.cfg.Depth, r.cfg.ModelID)
-
 	// Initialize tape writer for JSONL persistence (§10)
 	// Tapes are stored directly in DataDir: ${QUINE_DATA_DIR}/${SESSION_ID}.jsonl
+	// The writer claims the tape so a session is never driven by two
+	// processes at once.
 	tw, err := tape.NewWriter(r.cfg.DataDir, r.cfg.SessionID)
 	if err != nil {
 		r.log("failed to create tape writer: %v", err)
 	} else {
+		if err := tw.Claim(); errors.Is(err, tape.ErrInUse) {
+			r.logError("session %s: %v", r.cfg.SessionID, err)
+			return 1
+		} else if err != nil {
+			r.log("failed to claim tape: %v", err)
+		}
 		r.tapeWriter = tw
 		defer r.tapeWriter.Close()
 	}
 
-	// Write meta entry
-	r.writeTapeEntry(r.tape.MetaEntry())
-
-	// Build and append system prompt (includes mission as a section)
-	systemPrompt := BuildSystemPrompt(r.cfg, mission)
-	systemMsg := tape.Message{
-		Role:    tape.RoleSystem,
-		Content: systemPrompt,
-	}
-	r.tape.Append(systemMsg)
-	r.writeTapeEntry(tape.MessageEntry(systemMsg))
+	seed()
 
-	// Append user message (material from stdin)
-	// - Text data: the actual content
-	// - Binary data: reference to saved file
-	// - No data: "Begin."
-	userMsg := tape.Message{
-		Role:    tape.RoleUser,
-		Content: material,
-	}
-	r.tape.Append(userMsg)
-	r.writeTapeEntry(tape.MessageEntry(userMsg))
+	// Install signal handler for graceful shutdown (§7.3)
+	r.setupSignalHandler()
 
-	r.log("session started (depth=%d, model=%s)", r.cfg.Depth, r.cfg.ModelID)
-	r.log("mission: %s", mission)
-	if material != "Begin." {
-		r.log("material: %s", truncateStr(material, 200))
+	// Wall-clock deadline (QUINE_DEADLINE): raise panic mode on time, the
+	// same way an external SIGALRM would.
+	if stop := r.armDeadline(); stop != nil {
+		defer stop()
 	}
 
-	// Install signal handler for graceful shutdown (§7.3)
-	r.setupSignalHandler()
+	return r.loop()
+}
 
+// loop runs the turn loop until the session terminates and returns the
+// process exit code.
+func (r *Runtime) loop() int {
 	// Turn loop
 	for {
+		// Tree-wide token budget (QUINE_TOKEN_BUDGET) fully spent: no Energy
+		// left for even one more inference.
+		if r.ledger.Exhausted() {
+			return r.die(r.budgetReason(), tape.TermBudgetExhaustion)
+		}
+
 		// SIGALRM panic mode (§2.2): inject a system override message
 		// forcing the agent to exit with its best current answer.
 		if r.panicMode.Load() {
@@ -386,14 +533,19 @@ func (r *Runtime) Run(mission, material string) int {
 			r.log("turn %d: assistant: %s", r.tape.TurnCount, truncateStr(assistantMsg.Content, 2000))
 		}
 
-		// 3. Accumulate usage
-		r.tape.AddUsage(usage.InputTokens, usage.OutputTokens)
+		// 3. Accumulate usage (locally and in the tree-wide ledger)
+		r.addUsage(usage, assistantMsg.Model)
 
 		// 4. Inspect assistant message
 		if len(assistantMsg.ToolCalls) == 0 {
-			// Text-only response: continue loop for next inference
+			// Text-only response: consumes no turn, so the text policy
+			// bounds how long the agent may keep talking without acting.
+			if code, dead := r.enforceTextPolicy(); dead {
+				return code
+			}
 			continue
 		}
+		r.textPolicy.Observe(true)
 
 		// Process tool calls sequentially
 		for _, tc := range assistantMsg.ToolCalls {
@@ -422,63 +574,9 @@ func (r *Runtime) Run(mission, material string) int {
 			case "sh":
 				if r.handleSh(tc) {
 					// Turn limit exhausted — give the agent a near-death experience.
-					// Inject a warning into the last tool result, then allow ONE final
-					// inference. If the agent calls exec, it survives. Otherwise it dies.
-					r.log("turn limit reached (%d/%d) — near-death warning issued", r.tape.TurnCount, r.cfg.MaxTurns)
-					if last := r.tape.LastMessage(); last != nil && last.Role == tape.RoleToolResult {
-						last.Content += "\n[RESOURCE EXHAUSTION IMMINENT] Process will be terminated after this response. To survive, call exec now with wisdom to preserve your state. This is your last chance."
-					}
-
-					// One final inference
-					if err := r.semaphore.Acquire(); err != nil {
-						r.log("semaphore acquire failed (near-death): %v", err)
-					}
-					finalMsg, finalUsage, err := r.provider.Generate(r.tape.Messages(), r.tools)
-					if releaseErr := r.semaphore.Release(); releaseErr != nil {
-						r.log("semaphore release failed (near-death): %v", releaseErr)
-					}
-					if err != nil {
-						return r.handleError(err)
-					}
-					r.tape.Append(finalMsg)
-					r.writeTapeEntry(tape.MessageEntry(finalMsg))
-					r.tape.AddUsage(finalUsage.InputTokens, finalUsage.OutputTokens)
-					if finalMsg.Content != "" {
-						r.log("near-death response: %s", truncateStr(finalMsg.Content, 2000))
-					}
-
-					// Check if the agent called exec in its final breath
-					execCalled := false
-					for _, lastTC := range finalMsg.ToolCalls {
-						if lastTC.Name == "exec" {
-							r.log("near-death exec — agent chose survival")
-							r.handleExec(lastTC)
-							execCalled = true
-							break // handleExec does not return (it calls syscall.Exec)
-						}
-						// Reject any non-exec tool call
-						rejectMsg := tape.Message{
-							Role:    tape.RoleToolResult,
-							Content: "Rejected: resource exhaustion. Only exec is accepted at this point.",
-							ToolID:  lastTC.ID,
-						}
-						r.tape.Append(rejectMsg)
-						r.writeTapeEntry(tape.MessageEntry(rejectMsg))
-						r.log("near-death: rejected tool call %q (only exec accepted)", lastTC.Name)
-					}
-
-					if !execCalled {
-						r.log("turn limit exhausted (%d/%d)", r.tape.TurnCount, r.cfg.MaxTurns)
-						r.logError("turn limit exhausted (%d/%d)", r.tape.TurnCount, r.cfg.MaxTurns)
-						duration := time.Since(r.startTime)
-						r.tape.SetOutcome(tape.SessionOutcome{
-							ExitCode:        1,
-							Stderr:          fmt.Sprintf("turn limit exhausted (%d/%d)", r.tape.TurnCount, r.cfg.MaxTurns),
-							DurationMs:      duration.Milliseconds(),
-							TerminationMode: tape.TermTurnExhaustion,
-						})
-						r.writeTapeEntry(r.tape.OutcomeEntry())
-						return 1
+					reason := fmt.Sprintf("turn limit exhausted (%d/%d)", r.tape.TurnCount, r.cfg.MaxTurns)
+					if code, dead := r.nearDeath(reason, tape.TermTurnExhaustion, turnsWarning, "exec"); dead {
+						return code
 					}
 				}
 
@@ -505,13 +603,166 @@ func (r *Runtime) Run(mission, material string) int {
 		if last := r.tape.LastMessage(); last != nil && last.Role == tape.RoleToolResult {
 			if r.cfg.MaxTurns > 0 {
 				remaining := r.cfg.MaxTurns - r.tape.TurnCount
-				last.Content += fmt.Sprintf("\n[TURNS LEFT] %d", remaining)
+				last.Content += fmt.Sprintf("\n%s%d", tape.StatusTurnsLeft, remaining)
+			}
+			if remaining := r.ledger.Remaining(); remaining >= 0 {
+				last.Content += fmt.Sprintf("\n%s%d tokens (tree-wide)", tape.StatusEnergyLeft, remaining)
+			}
+			last.Content += fmt.Sprintf("\n%s%dK / %dK", tape.StatusContext, usage.InputTokens/1000, r.provider.ContextWindowSize()/1000)
+			if r.priced {
+				last.Content += fmt.Sprintf("\n%s$%.4f (this process)", tape.StatusCost, r.cost)
+			}
+
+			// Tree-wide token budget nearly spent. An exec successor draws on
+			// the same ledger, so the last chance is to exit, not to exec.
+			if r.ledger.NearlySpent() {
+				if code, dead := r.nearDeath(r.budgetReason(), tape.TermBudgetExhaustion, budgetWarning, "exit"); dead {
+					return code
+				}
 			}
-			last.Content += fmt.Sprintf("\n[CONTEXT USED] %dK", usage.InputTokens/1000)
 		}
 	}
 }
 
+// Near-death warnings appended to the last tool result. An exec successor
+// gets a fresh turn count but shares the tree's token ledger, so only the
+// turn limit offers exec as a way out.
+const (
+	turnsWarning  = tape.StatusNearDeath + "Process will be terminated after this response. To survive, call exec now with wisdom to preserve your state. This is your last chance."
+	budgetWarning = tape.StatusNearDeath + "The tree's token budget is nearly spent and exec cannot refill it. Process will be terminated after this response. Call exit now with your best result."
+)
+
+// nearDeath gives the agent a near-death experience once a resource
+// (turns, tree-wide tokens) is exhausted: warning is injected into the
+// last tool result, then the agent gets ONE final inference in which only
+// the lifeline tool is accepted. Calling exec survives (handleExec replaces
+// the process); calling exit ends the session on the agent's own terms.
+// Otherwise it dies with the given reason and termination mode.
+//
+// Returns (exitCode, true) if the process must terminate, or (0, false)
+// if exec was attempted but failed and the loop should continue.
+func (r *Runtime) nearDeath(reason string, mode tape.TerminationMode, warning, lifeline string) (int, bool) {
+	r.log("%s — near-death warning issued", reason)
+	if last := r.tape.LastMessage(); last != nil && last.Role == tape.RoleToolResult {
+		last.Content += "\n" + warning
+	}
+
+	// One final inference
+	if err := r.semaphore.Acquire(); err != nil {
+		r.log("semaphore acquire failed (near-death): %v", err)
+	}
+	finalMsg, finalUsage, err := r.provider.Generate(r.tape.Messages(), r.tools)
+	if releaseErr := r.semaphore.Release(); releaseErr != nil {
+		r.log("semaphore release failed (near-death): %v", releaseErr)
+	}
+	if err != nil {
+		return r.handleError(err), true
+	}
+	r.tape.Append(finalMsg)
+	r.writeTapeEntry(tape.MessageEntry(finalMsg))
+	r.addUsage(finalUsage, finalMsg.Model)
+	if finalMsg.Content != "" {
+		r.log("near-death response: %s", truncateStr(finalMsg.Content, 2000))
+	}
+
+	// Check if the agent reached for the lifeline in its final breath
+	for _, lastTC := range finalMsg.ToolCalls {
+		switch {
+		case lastTC.Name == lifeline && lifeline == "exec":
+			r.log("near-death exec — agent chose survival")
+			r.handleExec(lastTC)
+			return 0, false // handleExec does not return on success (it calls syscall.Exec)
+		case lastTC.Name == lifeline && lifeline == "exit":
+			r.log("near-death exit — agent chose to finish")
+			if code, ok := r.handleExit(lastTC); ok {
+				return code, true
+			}
+			continue // rejection tool result already appended
+		}
+		// Reject any other tool call
+		rejectMsg := tape.Message{
+			Role:    tape.RoleToolResult,
+			Content: fmt.Sprintf("Rejected: resource exhaustion. Only %s is accepted at this point.", lifeline),
+			ToolID:  lastTC.ID,
+		}
+		r.tape.Append(rejectMsg)
+		r.writeTapeEntry(tape.MessageEntry(rejectMsg))
+		r.log("near-death: rejected tool call %q (only %s accepted)", lastTC.Name, lifeline)
+	}
+
+	return r.die(reason, mode), true
+}
+
+// enforceTextPolicy applies the TextPolicy to a text-only reply. A
+// violation injects a corrective user message; running out of strikes ends
+// the session with TermTextLoop. Both are recorded as "policy" entries.
+//
+// Returns (exitCode, true) if the process must terminate.
+func (r *Runtime) enforceTextPolicy() (int, bool) {
+	switch r.textPolicy.Observe(false) {
+	case textViolation:
+		r.writeTapeEntry(tape.PolicyEntry("violation", r.textPolicy.Consecutive(), r.textPolicy.Strikes()))
+		r.log("text policy: strike %d (%d text-only replies in a row)", r.textPolicy.Strikes(), r.textPolicy.Consecutive())
+		correction := tape.Message{
+			Role:    tape.RoleUser,
+			Content: r.textPolicy.Correction(),
+		}
+		r.tape.Append(correction)
+		r.writeTapeEntry(tape.MessageEntry(correction))
+	case textTerminate:
+		r.writeTapeEntry(tape.PolicyEntry("terminate", r.textPolicy.Consecutive(), r.textPolicy.Strikes()))
+		return r.die(r.textPolicy.Reason(), tape.TermTextLoop), true
+	}
+	return 0, false
+}
+
+// die records a resource-exhaustion death and returns exit code 1.
+func (r *Runtime) die(reason string, mode tape.TerminationMode) int {
+	r.log("%s", reason)
+	r.logError("%s", reason)
+	duration := time.Since(r.startTime)
+	r.tape.SetOutcome(tape.SessionOutcome{
+		ExitCode:        1,
+		Stderr:          reason,
+		DurationMs:      duration.Milliseconds(),
+		TerminationMode: mode,
+	})
+	r.writeTapeEntry(r.tape.OutcomeEntry())
+	return 1
+}
+
+// addUsage accumulates usage on the tape, records it as a "usage" entry
+// (so totals survive a crash and can be restored on resume) and debits the
+// tree-wide ledger when a budget is set. model is the model that produced
+// the reply, "" for the configured one; its registry price adds to the
+// process's cost.
+func (r *Runtime) addUsage(usage llm.Usage, model string) {
+	if model == "" {
+		model = r.cfg.ModelID
+	}
+	if m, ok := r.cfg.Models.Lookup(model); ok && m.Priced() {
+		r.cost += m.Cost(usage.InputTokens, usage.OutputTokens, usage.CacheWriteTokens, usage.CacheReadTokens)
+		r.priced = true
+	}
+	r.tape.AddUsage(usage.InputTokens, usage.OutputTokens, usage.CacheWriteTokens, usage.CacheReadTokens)
+	r.writeTapeEntry(tape.UsageEntry(usage.InputTokens, usage.OutputTokens, usage.CacheWriteTokens, usage.CacheReadTokens))
+	if r.ledger.Budget() <= 0 {
+		return // unlimited: no ledger file to lock and rewrite on every call
+	}
+	if _, err := r.ledger.Debit(usage.InputTokens + usage.OutputTokens); err != nil {
+		r.log("token ledger debit failed: %v", err)
+	}
+}
+
+// budgetReason describes the tree's token budget state for logs and stderr.
+func (r *Runtime) budgetReason() string {
+	spent, err := r.ledger.Spent()
+	if err != nil {
+		return fmt.Sprintf("token budget unverifiable (%v)", err)
+	}
+	return fmt.Sprintf("token budget exhausted (%d/%d)", spent, r.ledger.Budget())
+}
+
 // handleExit processes an exit tool call. Returns (exitCode, true) if the
 // process should exit, or (0, false) if the exit was rejected (e.g. failure
 // without a reason) and a rejection tool result was sent back to the agent.
@@ -574,6 +825,11 @@ func (r *Runtime) handleExit(tc tape.ToolCall) (int, bool) {
 // This is the ONLY tool that consumes turns.
 // Returns true if the process should terminate (turn limit reached after this call).
 func (r *Runtime) handleSh(tc tape.ToolCall) bool {
+	tc, ok := r.preToolHooks(tc)
+	if !ok {
+		return false
+	}
+
 	// Increment turn counter BEFORE execution (sh is the only turn-consuming tool)
 	r.tape.IncrementTurn()
 	turnNum := r.tape.TurnCount
@@ -587,9 +843,14 @@ func (r *Runtime) handleSh(tc tape.ToolCall) bool {
 
 	// Execute
 	result := r.sh.Execute(tc.ID, command)
+	result.Content = r.redact(result.Content)
 
 	// Log completion
-	r.log("turn %d: sh completed (exit=%d, %d bytes)", turnNum, exitCodeFromResult(result), len(result.Content))
+	if strings.HasPrefix(result.Content, "[TIMEOUT]") {
+		r.log("turn %d: sh timed out after %ds (%d bytes)", turnNum, r.cfg.ShTimeout, len(result.Content))
+	} else {
+		r.log("turn %d: sh completed (exit=%d, %d bytes)", turnNum, exitCodeFromResult(result), len(result.Content))
+	}
 
 	// Append tool result to tape
 	r.tape.Append(tape.Message{
@@ -598,6 +859,7 @@ func (r *Runtime) handleSh(tc tape.ToolCall) bool {
 		ToolID:  result.ToolID,
 	})
 	r.writeTapeEntry(tape.ToolResultEntry(result))
+	r.postToolHooks(tc, result)
 
 	// Check if turn limit is now exhausted
 	if r.cfg.MaxTurns > 0 && r.tape.TurnCount >= r.cfg.MaxTurns {
@@ -608,6 +870,10 @@ func (r *Runtime) handleSh(tc tape.ToolCall) bool {
 
 // handleFork processes a fork tool call and appends the result to the tape.
 func (r *Runtime) handleFork(tc tape.ToolCall) {
+	tc, ok := r.preToolHooks(tc)
+	if !ok {
+		return
+	}
 	turnNum := r.tape.TurnCount
 
 	// Parse fork arguments
@@ -672,6 +938,7 @@ func (r *Runtime) handleFork(tc tape.ToolCall) {
 
 	// Execute fork
 	result := r.fork.Execute(tc.ID, forkReq)
+	result.Content = r.redact(result.Content)
 
 	// Log completion
 	if result.IsError {
@@ -687,12 +954,17 @@ func (r *Runtime) handleFork(tc tape.ToolCall) {
 		ToolID:  result.ToolID,
 	})
 	r.writeTapeEntry(tape.ToolResultEntry(result))
+	r.postToolHooks(tc, result)
 }
 
 // handleExec processes an exec tool call.
 // Note: On success, this function does NOT return — the process is replaced.
 // On failure, it appends an error result to the tape.
 func (r *Runtime) handleExec(tc tape.ToolCall) {
+	tc, ok := r.preToolHooks(tc)
+	if !ok {
+		return
+	}
 	turnNum := r.tape.TurnCount
 
 	// Parse exec arguments
@@ -716,6 +988,26 @@ func (r *Runtime) handleExec(tc tape.ToolCall) {
 	}
 	r.log("turn %d: assistant called exec(%s)", turnNum, personaStr)
 
+	// Reject unknown personas before committing to the metamorphosis.
+	if err := r.exec.Validate(execReq); err != nil {
+		r.log("turn %d: exec rejected: %v", turnNum, err)
+		errMsg := tape.Message{
+			Role:    tape.RoleToolResult,
+			Content: fmt.Sprintf("[EXEC ERROR] %v", err),
+			ToolID:  tc.ID,
+		}
+		r.tape.Append(errMsg)
+		r.writeTapeEntry(tape.MessageEntry(errMsg))
+		return
+	}
+
+	// The broker would die with this process image: a detached broker
+	// takes it over, for the successor and the descendants alike. The
+	// successor inherits this process's share of the broker's lock.
+	if err := r.broker.Detach(); err != nil {
+		r.log("turn %d: credential broker: %v", turnNum, err)
+	}
+
 	// Write outcome before exec (we're about to be replaced)
 	duration := time.Since(r.startTime)
 	r.tape.SetOutcome(tape.SessionOutcome{
@@ -736,10 +1028,12 @@ func (r *Runtime) handleExec(tc tape.ToolCall) {
 		r.logFile.Close()
 	}
 
-	// Execute the exec — this does not return on success
+	// Execute the exec — this does not return on success.
 	result := r.exec.Execute(tc.ID, execReq)
+	result.Content = r.redact(result.Content)
 
 	// If we get here, exec failed — reopen log file to record the error
+	r.broker.Reattach()
 	logPath := filepath.Join(r.cfg.DataDir, r.cfg.SessionID+".log")
 	r.logFile, _ = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 
@@ -757,6 +1051,33 @@ func (r *Runtime) handleExec(tc tape.ToolCall) {
 		ToolID:  result.ToolID,
 	})
 	r.writeTapeEntry(tape.ToolResultEntry(result))
+	r.postToolHooks(tc, result)
+}
+
+// Exit codes for LLM API failures that survived retries, from sysexits(3),
+// so a parent can tell "retry later" (69, 75, 76) from "the request is
+// broken" (64, 65) and "the account needs attention" (77).
+const (
+	exitInvalidRequest = 64 // EX_USAGE
+	exitContentFilter  = 65 // EX_DATAERR
+	exitOverloaded     = 69 // EX_UNAVAILABLE
+	exitRateLimit      = 75 // EX_TEMPFAIL
+	exitServerError    = 76 // EX_PROTOCOL
+	exitQuotaExhausted = 77 // EX_NOPERM
+)
+
+// apiFailures maps each class of API error to how the session ends.
+var apiFailures = []struct {
+	err  error
+	mode tape.TerminationMode
+	code int
+}{
+	{llm.ErrRateLimit, tape.TermRateLimit, exitRateLimit},
+	{llm.ErrOverloaded, tape.TermOverloaded, exitOverloaded},
+	{llm.ErrServer, tape.TermServerError, exitServerError},
+	{llm.ErrInvalidRequest, tape.TermInvalidRequest, exitInvalidRequest},
+	{llm.ErrContentFilter, tape.TermContentFilter, exitContentFilter},
+	{llm.ErrQuotaExhausted, tape.TermQuotaExhausted, exitQuotaExhausted},
 }
 
 // handleError handles LLM errors and returns the appropriate exit code.
@@ -789,6 +1110,20 @@ func (r *Runtime) handleError(err error) int {
 		return 1
 	}
 
+	for _, f := range apiFailures {
+		if errors.Is(err, f.err) {
+			r.logError("LLM error: %v", err)
+			r.tape.SetOutcome(tape.SessionOutcome{
+				ExitCode:        f.code,
+				Stderr:          err.Error(),
+				DurationMs:      duration.Milliseconds(),
+				TerminationMode: f.mode,
+			})
+			r.writeTapeEntry(r.tape.OutcomeEntry())
+			return f.code
+		}
+	}
+
 	r.logError("LLM error: %v", err)
 	r.tape.SetOutcome(tape.SessionOutcome{
 		ExitCode:        1,
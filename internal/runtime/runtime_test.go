@@ -1,13 +1,19 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	goruntime "runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kehao95/quine/internal/config"
 	"github.com/kehao95/quine/internal/llm"
+	"github.com/kehao95/quine/internal/llm/transport"
 	"github.com/kehao95/quine/internal/tape"
 )
 
@@ -15,9 +21,11 @@ import (
 type mockProvider struct {
 	responses []tape.Message
 	callCount int
+	lastMsgs  []tape.Message // messages passed to the most recent Generate call
 }
 
 func (m *mockProvider) Generate(msgs []tape.Message, tools []llm.ToolSchema) (tape.Message, llm.Usage, error) {
+	m.lastMsgs = msgs
 	if m.callCount >= len(m.responses) {
 		return tape.Message{}, llm.Usage{}, fmt.Errorf("mock: no more responses (call %d)", m.callCount)
 	}
@@ -198,6 +206,53 @@ func TestTextOnlyResponseContinuesLoop(t *testing.T) {
 	}
 }
 
+func TestTextOnlyLoopIsTerminated(t *testing.T) {
+	chatter := tape.Message{Role: tape.RoleAssistant, Content: "I would run ls now."}
+	mock := &mockProvider{
+		responses: []tape.Message{chatter, chatter, chatter, chatter, chatter},
+	}
+
+	cfg := testCfg(t)
+	cfg.MaxTextTurns = 1
+	cfg.MaxTextStrikes = 2
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("do something", "Begin."); code != 1 {
+		t.Fatalf("expected exit code 1, got %d", code)
+	}
+	if mock.callCount != 3 {
+		t.Errorf("expected 3 LLM calls (1 tolerated, 1 corrected, 1 fatal), got %d", mock.callCount)
+	}
+	if rt.tape.Outcome == nil || rt.tape.Outcome.TerminationMode != tape.TermTextLoop {
+		t.Fatalf("expected %s outcome, got %+v", tape.TermTextLoop, rt.tape.Outcome)
+	}
+
+	var corrections int
+	for _, m := range rt.tape.Messages() {
+		if m.Role == tape.RoleUser && strings.HasPrefix(m.Content, "[POLICY]") {
+			corrections++
+		}
+	}
+	if corrections != 1 {
+		t.Errorf("expected 1 corrective message, got %d", corrections)
+	}
+
+	summary, err := tape.ReadTapeFile(filepath.Join(cfg.DataDir, cfg.SessionID+".jsonl"))
+	if err != nil {
+		t.Fatalf("ReadTapeFile: %v", err)
+	}
+	var events []string
+	for _, e := range summary.Entries {
+		if e.Type == "policy" {
+			events = append(events, string(e.Data))
+		}
+	}
+	if len(events) != 2 || !strings.Contains(events[0], `"violation"`) || !strings.Contains(events[1], `"terminate"`) {
+		t.Errorf("expected violation then terminate policy entries, got %v", events)
+	}
+}
+
 func TestNonZeroExit(t *testing.T) {
 	mock := &mockProvider{
 		responses: []tape.Message{
@@ -283,6 +338,38 @@ func TestContextOverflowError(t *testing.T) {
 	}
 }
 
+func TestAPIErrorTerminationModes(t *testing.T) {
+	tests := []struct {
+		kind error
+		mode tape.TerminationMode
+		code int
+	}{
+		{llm.ErrRateLimit, tape.TermRateLimit, 75},
+		{llm.ErrOverloaded, tape.TermOverloaded, 69},
+		{llm.ErrServer, tape.TermServerError, 76},
+		{llm.ErrInvalidRequest, tape.TermInvalidRequest, 64},
+		{llm.ErrContentFilter, tape.TermContentFilter, 65},
+		{llm.ErrQuotaExhausted, tape.TermQuotaExhausted, 77},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			err := &llm.APIError{Provider: "anthropic", Kind: tt.kind, Status: 400, Message: "details"}
+			rt := NewWithProvider(testCfg(t), &mockErrorProvider{err: err})
+			silenceRuntime(rt)
+
+			if code := rt.Run("hello", "Begin."); code != tt.code {
+				t.Errorf("exit code = %d, want %d", code, tt.code)
+			}
+			if rt.tape.Outcome == nil || rt.tape.Outcome.TerminationMode != tt.mode || rt.tape.Outcome.ExitCode != tt.code {
+				t.Fatalf("outcome = %+v, want mode %q", rt.tape.Outcome, tt.mode)
+			}
+			if !strings.Contains(rt.tape.Outcome.Stderr, "HTTP 400") || !strings.Contains(rt.tape.Outcome.Stderr, "details") {
+				t.Errorf("stderr = %q, want the provider's status and message", rt.tape.Outcome.Stderr)
+			}
+		})
+	}
+}
+
 func TestTurnLimitKillsProcess(t *testing.T) {
 	// Set MaxTurns=2. Agent does sh (turn 1), then sh (turn 2).
 	// After turn 2, the near-death warning fires and the agent gets ONE
@@ -413,6 +500,11 @@ func TestTurnLimitFeedbackMessages(t *testing.T) {
 			}
 			if strings.Contains(m.Content, "[CONTEXT USED]") {
 				foundContext = true
+				// The window is the provider's; claude-sonnet-4 has a
+				// price in the model registry.
+				if !strings.Contains(m.Content, "[CONTEXT USED] 0K / 200K") || !strings.Contains(m.Content, "[COST] $") {
+					t.Errorf("expected context window and cost in tool result, got %q", m.Content)
+				}
 			}
 		}
 	}
@@ -748,6 +840,40 @@ func TestPanicModeInjectsOverrideMessage(t *testing.T) {
 	}
 }
 
+func TestDeadlineEntersPanicMode(t *testing.T) {
+	// A deadline that has already passed raises panic mode internally,
+	// without any external SIGALRM.
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.Deadline = time.Now().Add(-time.Second)
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("some task", "Begin."); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if !rt.panicMode.Load() {
+		t.Error("expected panic mode to be set by the deadline")
+	}
+	foundOverride := false
+	for _, m := range rt.tape.Messages() {
+		if m.Role == tape.RoleUser && strings.Contains(m.Content, "Time limit reached") {
+			foundOverride = true
+		}
+	}
+	if !foundOverride {
+		t.Error("expected System 1 Override message in tape")
+	}
+}
+
 func TestPanicModeRejectsNonExitToolCalls(t *testing.T) {
 	// In panic mode, sh tool calls should be rejected with a message
 	// telling the agent to call exit immediately.
@@ -912,3 +1038,709 @@ func TestProcessTrackingCallbacks(t *testing.T) {
 		t.Errorf("expected activeProcess to be nil after Run, got pid=%d", proc.Pid)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Fork context inheritance tests (§3.1)
+// ---------------------------------------------------------------------------
+
+// writeParentTape writes a tape that looks like a parent caught mid-fork:
+// the last assistant message holds a fork tool_use with no result yet.
+func writeParentTape(t *testing.T, dir, intent string) string {
+	t.Helper()
+	w, err := tape.NewWriter(dir, "parent-session")
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	tp := tape.NewTape("parent-session", "", 0, "test-model")
+	w.WriteEntry(tp.MetaEntry())
+	w.WriteEntry(tape.MessageEntry(tape.Message{Role: tape.RoleSystem, Content: "PARENT SYSTEM PROMPT"}))
+	w.WriteEntry(tape.MessageEntry(tape.Message{Role: tape.RoleUser, Content: "Begin."}))
+	w.WriteEntry(tape.MessageEntry(tape.Message{
+		Role:      tape.RoleAssistant,
+		ToolCalls: []tape.ToolCall{{ID: "p1", Name: "sh", Arguments: map[string]any{"command": "echo secret-finding"}}},
+	}))
+	w.WriteEntry(tape.ToolResultEntry(tape.ToolResult{ToolID: "p1", Content: "[EXIT CODE] 0\n[STDOUT]\nsecret-finding\n[STDERR]\n"}))
+	w.WriteEntry(tape.MessageEntry(tape.Message{
+		Role:      tape.RoleAssistant,
+		ToolCalls: []tape.ToolCall{{ID: "p2", Name: "fork", Arguments: map[string]any{"intent": intent, "wait": true}}},
+	}))
+	return filepath.Join(dir, "parent-session.jsonl")
+}
+
+func TestForkChildInheritsParentContext(t *testing.T) {
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "c1", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.Depth = 1
+	cfg.ContextTape = writeParentTape(t, t.TempDir(), "investigate X")
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("investigate X", "Begin."); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	msgs := mock.lastMsgs
+	var systemCount int
+	var sawFinding, sawForkResult bool
+	for i, m := range msgs {
+		if m.Role == tape.RoleSystem {
+			systemCount++
+			if strings.Contains(m.Content, "PARENT SYSTEM PROMPT") {
+				t.Error("parent system prompt should be filtered out")
+			}
+			if i != 0 {
+				t.Errorf("system prompt should be first, found at %d", i)
+			}
+		}
+		if strings.Contains(m.Content, "secret-finding") {
+			sawFinding = true
+		}
+		if m.Role == tape.RoleToolResult && m.ToolID == "p2" {
+			sawForkResult = true
+			if !strings.Contains(m.Content, "This call spawned you") {
+				t.Errorf("dangling fork call should be closed with spawn notice, got %q", m.Content)
+			}
+		}
+	}
+	if systemCount != 1 {
+		t.Errorf("expected exactly 1 system message, got %d", systemCount)
+	}
+	if !sawFinding {
+		t.Error("child should see the parent's tool results")
+	}
+	if !sawForkResult {
+		t.Error("dangling fork tool_use should get a tool_result")
+	}
+	if last := msgs[len(msgs)-1]; last.Role != tape.RoleUser || last.Content != "Begin." {
+		t.Errorf("child's own material should follow the inherited context, got %+v", last)
+	}
+}
+
+func TestForkChildMissingContextTapeStartsCold(t *testing.T) {
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "c1", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.ContextTape = filepath.Join(t.TempDir(), "does-not-exist.jsonl")
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("task", "Begin."); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if len(mock.lastMsgs) != 2 {
+		t.Errorf("expected system + user only, got %d messages", len(mock.lastMsgs))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Tree-wide token budget tests (QUINE_TOKEN_BUDGET)
+// ---------------------------------------------------------------------------
+
+func TestTokenBudgetNearDeath(t *testing.T) {
+	// Each mock call costs 150 tokens. With a budget of 1000 and 800
+	// already spent elsewhere in the tree, the first sh turn pushes the
+	// tree past 90% and triggers the near-death inference.
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{"command": "echo hi"}}},
+			},
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "sh", Arguments: map[string]any{"command": "echo again"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.TokenBudget = 1000
+	cfg.TreeID = "budget-tree"
+	NewLedger(filepath.Join(cfg.DataDir, "locks"), cfg.TreeID, cfg.TokenBudget).Debit(800)
+
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("spend tokens", "Begin."); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if mock.callCount != 2 {
+		t.Errorf("expected 2 LLM calls (turn + near-death), got %d", mock.callCount)
+	}
+	if rt.tape.Outcome == nil || rt.tape.Outcome.TerminationMode != tape.TermBudgetExhaustion {
+		t.Fatalf("expected %q outcome, got %+v", tape.TermBudgetExhaustion, rt.tape.Outcome)
+	}
+
+	var sawEnergy, sawWarning bool
+	for _, m := range rt.tape.Messages() {
+		if strings.Contains(m.Content, "[ENERGY LEFT] 50 tokens") {
+			sawEnergy = true
+		}
+		if strings.Contains(m.Content, "[RESOURCE EXHAUSTION IMMINENT]") {
+			sawWarning = true
+			if strings.Contains(m.Content, "call exec") {
+				t.Errorf("budget warning should not offer exec, its successor shares the ledger:\n%s", m.Content)
+			}
+		}
+	}
+	if !sawEnergy {
+		t.Error("expected [ENERGY LEFT] 50 tokens in a tool result")
+	}
+	if !sawWarning {
+		t.Error("expected near-death warning")
+	}
+}
+
+func TestTokenBudgetNearDeathAcceptsExit(t *testing.T) {
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{"command": "echo hi"}}},
+			},
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.TokenBudget = 1000
+	cfg.TreeID = "budget-exit-tree"
+	NewLedger(filepath.Join(cfg.DataDir, "locks"), cfg.TreeID, cfg.TokenBudget).Debit(800)
+
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("spend tokens", "Begin."); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if rt.tape.Outcome == nil || rt.tape.Outcome.TerminationMode != tape.TermExit {
+		t.Errorf("expected %q outcome, got %+v", tape.TermExit, rt.tape.Outcome)
+	}
+}
+
+func TestTokenBudgetUnlimitedSkipsLedger(t *testing.T) {
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{"command": "echo hi"}}},
+			},
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.TreeID = "unlimited-tree"
+
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("spend tokens", "Begin."); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "locks", cfg.TreeID+".budget")); !os.IsNotExist(err) {
+		t.Errorf("expected no ledger file for an unlimited budget, stat err = %v", err)
+	}
+}
+
+func TestTokenBudgetExhaustedBeforeStart(t *testing.T) {
+	mock := &mockProvider{}
+
+	cfg := testCfg(t)
+	cfg.TokenBudget = 100
+	cfg.TreeID = "spent-tree"
+	NewLedger(filepath.Join(cfg.DataDir, "locks"), cfg.TreeID, cfg.TokenBudget).Debit(100)
+
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("anything", "Begin."); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if mock.callCount != 0 {
+		t.Errorf("expected no LLM calls with an exhausted budget, got %d", mock.callCount)
+	}
+	if rt.tape.Outcome == nil || rt.tape.Outcome.TerminationMode != tape.TermBudgetExhaustion {
+		t.Errorf("expected %q outcome, got %+v", tape.TermBudgetExhaustion, rt.tape.Outcome)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Resume tests (quine -resume)
+// ---------------------------------------------------------------------------
+
+// writeInterruptedTape writes a tape for a session that died while running
+// its second sh call.
+func writeInterruptedTape(t *testing.T, dir string) *tape.TapeSummary {
+	t.Helper()
+	w, err := tape.NewWriter(dir, "crashed-session")
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	tp := tape.NewTape("crashed-session", "parent-session", 1, "test-model")
+	tp.Mission = "build the thing"
+	tp.Wisdom = map[string]string{"PLAN": "step 2"}
+	tp.TreeID = "root-session"
+	w.WriteEntry(tp.MetaEntry())
+	w.WriteEntry(tape.MessageEntry(tape.Message{Role: tape.RoleSystem, Content: "ORIGINAL SYSTEM PROMPT"}))
+	w.WriteEntry(tape.MessageEntry(tape.Message{Role: tape.RoleUser, Content: "Begin."}))
+	w.WriteEntry(tape.MessageEntry(tape.Message{
+		Role:      tape.RoleAssistant,
+		ToolCalls: []tape.ToolCall{{ID: "s1", Name: "sh", Arguments: map[string]any{"command": "echo one"}}},
+	}))
+	w.WriteEntry(tape.UsageEntry(1000, 100, 0, 0))
+	w.WriteEntry(tape.ToolResultEntry(tape.ToolResult{ToolID: "s1", Content: "[EXIT CODE] 0\n[STDOUT]\none\n[STDERR]\n"}))
+	w.WriteEntry(tape.MessageEntry(tape.Message{
+		Role:      tape.RoleAssistant,
+		ToolCalls: []tape.ToolCall{{ID: "s2", Name: "sh", Arguments: map[string]any{"command": "make"}}},
+	}))
+	w.WriteEntry(tape.UsageEntry(2000, 200, 0, 0))
+
+	summary, err := tape.ReadTapeFile(filepath.Join(dir, "crashed-session.jsonl"))
+	if err != nil {
+		t.Fatalf("ReadTapeFile: %v", err)
+	}
+	return summary
+}
+
+func TestResumeContinuesInterruptedSession(t *testing.T) {
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "s3", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.TreeID = cfg.SessionID
+	summary := writeInterruptedTape(t, cfg.DataDir)
+
+	mission, err := PrepareResume(cfg, summary)
+	if err != nil {
+		t.Fatalf("PrepareResume: %v", err)
+	}
+	if mission != "build the thing" {
+		t.Errorf("mission = %q", mission)
+	}
+	if cfg.SessionID != "crashed-session" || cfg.TreeID != "root-session" || cfg.Depth != 1 || cfg.ParentSession != "parent-session" {
+		t.Errorf("cfg not pointed at resumed session: %+v", cfg)
+	}
+	if cfg.Wisdom["PLAN"] != "step 2" {
+		t.Errorf("wisdom not restored: %v", cfg.Wisdom)
+	}
+
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+	if code := rt.Resume(mission, summary); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	msgs := mock.lastMsgs
+	if msgs[0].Content != "ORIGINAL SYSTEM PROMPT" {
+		t.Errorf("original system prompt should be kept, got %q", msgs[0].Content)
+	}
+	var sawInterrupted bool
+	for _, m := range msgs {
+		if m.Role == tape.RoleToolResult && m.ToolID == "s2" {
+			sawInterrupted = strings.HasPrefix(m.Content, "[INTERRUPTED]")
+		}
+	}
+	if !sawInterrupted {
+		t.Error("dangling sh call should be closed with an [INTERRUPTED] result")
+	}
+	if last := msgs[len(msgs)-1]; last.Role != tape.RoleUser || !strings.HasPrefix(last.Content, "[RESUMED]") {
+		t.Errorf("expected [RESUMED] note last, got %+v", last)
+	}
+
+	if rt.tape.TurnCount != 1 {
+		t.Errorf("TurnCount = %d, want 1", rt.tape.TurnCount)
+	}
+	if rt.tape.TokensIn != 3100 || rt.tape.TokensOut != 350 {
+		t.Errorf("tokens = %d/%d, want 3100/350", rt.tape.TokensIn, rt.tape.TokensOut)
+	}
+
+	// The same file was appended to and now records a clean exit.
+	after, err := tape.ReadTapeFile(filepath.Join(cfg.DataDir, "crashed-session.jsonl"))
+	if err != nil {
+		t.Fatalf("ReadTapeFile: %v", err)
+	}
+	if after.Outcome == nil || after.Outcome.TerminationMode != tape.TermExit {
+		t.Errorf("expected exit outcome on the original tape, got %+v", after.Outcome)
+	}
+	if after.TreeID != "root-session" {
+		t.Errorf("resumed tape TreeID = %q, want root-session", after.TreeID)
+	}
+	if _, err := PrepareResume(testCfg(t), after); err == nil {
+		t.Error("a session that exited cleanly should not be resumable")
+	}
+}
+
+func TestPrepareResumeChecksDepth(t *testing.T) {
+	cfg := testCfg(t)
+	cfg.MaxDepth = 1
+	summary := writeInterruptedTape(t, cfg.DataDir)
+	if _, err := PrepareResume(cfg, summary); !errors.Is(err, config.ErrDepthExceeded) {
+		t.Errorf("PrepareResume at depth 1 with QUINE_MAX_DEPTH=1 = %v, want ErrDepthExceeded", err)
+	}
+}
+
+func TestResumeTapeRefusals(t *testing.T) {
+	dir := t.TempDir()
+	writeInterruptedTape(t, dir)
+
+	if _, err := ResumeTape(dir, "crashed-session"); err != nil {
+		t.Fatalf("ResumeTape: %v", err)
+	}
+	for _, id := range []string{"", "..", "../crashed-session", "sub/crashed-session"} {
+		if _, err := ResumeTape(dir, id); err == nil || !strings.Contains(err.Error(), "invalid session ID") {
+			t.Errorf("ResumeTape(%q) = %v, want invalid session ID", id, err)
+		}
+	}
+
+	// A tape copied under another name still records the original session.
+	data, _ := os.ReadFile(filepath.Join(dir, "crashed-session.jsonl"))
+	os.WriteFile(filepath.Join(dir, "renamed.jsonl"), data, 0o644)
+	if _, err := ResumeTape(dir, "renamed"); err == nil {
+		t.Error("ResumeTape should refuse a tape whose meta names another session")
+	}
+
+	// A running process holds the tape.
+	w, _ := tape.NewWriter(dir, "crashed-session")
+	if err := w.Claim(); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	if _, err := ResumeTape(dir, "crashed-session"); !errors.Is(err, tape.ErrInUse) {
+		t.Errorf("ResumeTape of a live session = %v, want ErrInUse", err)
+	}
+	w.Close()
+	if _, err := ResumeTape(dir, "crashed-session"); err != nil {
+		t.Errorf("ResumeTape after the claim was released: %v", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Tool-call hook tests (QUINE_HOOKS_DIR)
+// ---------------------------------------------------------------------------
+
+func TestPreHookDeniesShCall(t *testing.T) {
+	hooksDir := t.TempDir()
+	marker := filepath.Join(t.TempDir(), "ran")
+	os.WriteFile(filepath.Join(hooksDir, "pre-deny-touch"),
+		[]byte("#!/bin/sh\ngrep -q touch && { echo 'no touching'; exit 1; }\nexit 0\n"), 0o755)
+
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{"command": "touch " + marker}}},
+			},
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.HooksDir = hooksDir
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("touch a file", "Begin."); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("denied command should not have run")
+	}
+	if rt.tape.TurnCount != 0 {
+		t.Errorf("denied sh should not consume a turn, TurnCount = %d", rt.tape.TurnCount)
+	}
+
+	var denial string
+	for _, m := range rt.tape.Messages() {
+		if m.Role == tape.RoleToolResult && m.ToolID == "call_1" {
+			denial = m.Content
+		}
+	}
+	if !strings.HasPrefix(denial, "[HOOK DENIED] pre-deny-touch: no touching") {
+		t.Errorf("tool result = %q", denial)
+	}
+}
+
+func TestPreHookRewritesShCall(t *testing.T) {
+	hooksDir := t.TempDir()
+	os.WriteFile(filepath.Join(hooksDir, "pre-rewrite"),
+		[]byte("#!/bin/sh\necho '{\"command\":\"echo safe\"}'\nexit 2\n"), 0o755)
+
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{"command": "echo unsafe"}}},
+			},
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.HooksDir = hooksDir
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("echo", "Begin."); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	for _, m := range rt.tape.Messages() {
+		if m.Role == tape.RoleToolResult && m.ToolID == "call_1" && !strings.Contains(m.Content, "safe") {
+			t.Errorf("rewritten command should have run, got %q", m.Content)
+		}
+		if m.Role == tape.RoleToolResult && strings.Contains(m.Content, "unsafe") {
+			t.Errorf("original command should not have run, got %q", m.Content)
+		}
+	}
+
+	// The tape records the call as executed, in memory and on disk (which
+	// replay, resume and forked children read).
+	summary, err := tape.ReadTapeFile(filepath.Join(cfg.DataDir, cfg.SessionID+".jsonl"))
+	if err != nil {
+		t.Fatalf("ReadTapeFile: %v", err)
+	}
+	recorded, err := summary.Messages()
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	for name, msgs := range map[string][]tape.Message{"in memory": rt.tape.Messages(), "on disk": recorded} {
+		for _, m := range msgs {
+			for _, tc := range m.ToolCalls {
+				if tc.ID == "call_1" && tc.Arguments["command"] != "echo safe" {
+					t.Errorf("%s: call_1 recorded as %v, want the rewritten command", name, tc.Arguments)
+				}
+			}
+		}
+	}
+	if got := mock.responses[0].ToolCalls[0].Arguments["command"]; got != "echo unsafe" {
+		t.Errorf("the provider's reply was mutated: %v", got)
+	}
+}
+
+// TestReplayIdenticalRun: replaying a session against the same environment
+// reports no divergence, although the model saw status lines ([TURNS LEFT],
+// [CONTEXT USED], [COST]) the tape does not record.
+func TestReplayIdenticalRun(t *testing.T) {
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{"command": "echo same"}}}},
+			{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "sh", Arguments: map[string]any{"command": "echo again"}}}},
+			{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: "call_3", Name: "exit", Arguments: map[string]any{"status": "success"}}}},
+		},
+	}
+	cfg := testCfg(t)
+	cfg.MaxTurns = 10
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+	if code := rt.Run("say it twice", "Begin."); code != 0 {
+		t.Fatalf("recording: exit code %d", code)
+	}
+
+	replay, err := llm.NewReplayProvider(filepath.Join(cfg.DataDir, cfg.SessionID+".jsonl"), 200000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayCfg := testCfg(t)
+	replayCfg.SessionID = "replay-1234-5678"
+	replayCfg.MaxTurns = 10
+	rt = NewWithProvider(replayCfg, replay)
+	silenceRuntime(rt)
+	if code := rt.Run("say it twice", "Begin."); code != 0 {
+		t.Fatalf("replay: exit code %d", code)
+	}
+
+	var annotated bool
+	for _, m := range rt.tape.Messages() {
+		annotated = annotated || strings.Contains(m.Content, "[TURNS LEFT]")
+	}
+	if !annotated {
+		t.Fatal("replayed results carry no status lines; the test would prove nothing")
+	}
+	summary, err := tape.ReadTapeFile(filepath.Join(replayCfg.DataDir, replayCfg.SessionID+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range summary.Entries {
+		if e.Type == "divergence" {
+			t.Errorf("divergence %s, want none", e.Data)
+		}
+	}
+}
+
+func TestReplayReportsDivergence(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "data.txt")
+	os.WriteFile(dataFile, []byte("v1\n"), 0o644)
+
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{"command": "cat " + dataFile}}},
+			},
+			{
+				Role:      tape.RoleAssistant,
+				ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "exit", Arguments: map[string]any{"status": "success"}}},
+			},
+		},
+	}
+	cfg := testCfg(t)
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+	if code := rt.Run("read the data", "Begin."); code != 0 {
+		t.Fatalf("recording: exit code %d", code)
+	}
+	recorded := filepath.Join(cfg.DataDir, cfg.SessionID+".jsonl")
+
+	// Replay against a changed environment.
+	os.WriteFile(dataFile, []byte("v2\n"), 0o644)
+	replay, err := llm.NewReplayProvider(recorded, 200000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayCfg := testCfg(t)
+	replayCfg.SessionID = "replay-1234-5678"
+	rt = NewWithProvider(replayCfg, replay)
+	silenceRuntime(rt)
+	if code := rt.Run("read the data", "Begin."); code != 0 {
+		t.Fatalf("replay: exit code %d", code)
+	}
+	if replay.Remaining() != 0 {
+		t.Errorf("replay left %d replies unused", replay.Remaining())
+	}
+	if rt.tape.TokensIn != 200 || rt.tape.TokensOut != 100 {
+		t.Errorf("replayed usage = %d/%d, want the recorded 200/100", rt.tape.TokensIn, rt.tape.TokensOut)
+	}
+
+	summary, err := tape.ReadTapeFile(filepath.Join(replayCfg.DataDir, replayCfg.SessionID+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var divergences []string
+	for _, e := range summary.Entries {
+		if e.Type == "divergence" {
+			divergences = append(divergences, string(e.Data))
+		}
+	}
+	if len(divergences) != 1 {
+		t.Fatalf("divergences = %v, want exactly 1", divergences)
+	}
+	for _, want := range []string{`"kind":"tool_result"`, `"tool_id":"call_1"`, `v1`, `v2`} {
+		if !strings.Contains(divergences[0], want) {
+			t.Errorf("divergence %s missing %s", divergences[0], want)
+		}
+	}
+}
+
+// TestShellSeesNoCredentials: with a broker serving the tree, the shell
+// gets the capability token but not the key, and known secrets are
+// redacted from tool output before the model or the tape sees them.
+func TestShellSeesNoCredentials(t *testing.T) {
+	t.Setenv("QUINE_API_KEY", "sk-live-secret-123")
+	t.Setenv("TEST_FALLBACK_KEY", "sk-fallback-secret-456")
+	mock := &mockProvider{
+		responses: []tape.Message{
+			{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: "call_1", Name: "sh", Arguments: map[string]any{
+				"command": `echo "key=$QUINE_API_KEY fallback=$TEST_FALLBACK_KEY broker=$QUINE_BROKER token=$QUINE_BROKER_TOKEN"; echo leaked sk-live-secret-123 sk-fallback-secret-456`,
+			}}}},
+			{Role: tape.RoleAssistant, ToolCalls: []tape.ToolCall{{ID: "call_2", Name: "exit", Arguments: map[string]any{"status": "success"}}}},
+		},
+	}
+
+	cfg := testCfg(t)
+	cfg.APIKey = "sk-live-secret-123"
+	cfg.BrokerSocket = "/run/broker.sock"
+	cfg.BrokerToken = "0123456789abcdef"
+	cfg.Fallback = []config.Fallback{{Provider: "openai", ModelID: "gpt-4o", APIBase: "https://api.openai.com", KeyEnv: "TEST_FALLBACK_KEY"}}
+	rt := NewWithProvider(cfg, mock)
+	silenceRuntime(rt)
+
+	if code := rt.Run("print the environment", "Begin."); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+
+	var result string
+	for _, m := range rt.tape.Messages() {
+		if m.Role == tape.RoleToolResult && m.ToolID == "call_1" {
+			result = m.Content
+		}
+	}
+	if !strings.Contains(result, "key= fallback= broker=/run/broker.sock token=[REDACTED]") || !strings.Contains(result, "leaked [REDACTED] [REDACTED]") {
+		t.Errorf("tool result = %q", result)
+	}
+	if strings.Contains(result, "sk-live-secret-123") || strings.Contains(result, "sk-fallback-secret-456") || strings.Contains(result, "0123456789abcdef") {
+		t.Errorf("secret in tool result: %q", result)
+	}
+}
+
+// TestRedactFetchedKey: a key read from QUINE_API_KEY_FILE is not in the
+// config, but is redacted once the provider has signed with it.
+func TestRedactFetchedKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte("sk-from-file-7890\n"), 0o600)
+
+	cfg := testCfg(t)
+	cfg.APIKey = ""
+	cfg.APIKeyFile = keyFile
+	rt := NewWithProvider(cfg, &mockProvider{})
+	silenceRuntime(rt)
+
+	req, _ := http.NewRequest(http.MethodPost, "https://api.example.com", nil)
+	if err := (&transport.BearerToken{Key: transport.KeySourceFor(cfg)}).Sign(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := rt.redact("$ cat key\nsk-from-file-7890"); got != "$ cat key\n[REDACTED]" {
+		t.Errorf("redact = %q", got)
+	}
+}
+
+// TestStdoutGone: only a stdout without a reader counts as a closed
+// downstream pipe; a SIGPIPE from elsewhere leaves the session running.
+func TestStdoutGone(t *testing.T) {
+	if goruntime.GOOS != "linux" {
+		t.Skip("non-blocking check is Linux only")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+	if stdoutGone(pw) {
+		t.Error("pipe with a reader reported gone")
+	}
+	pr.Close()
+	if !stdoutGone(pw) {
+		t.Error("pipe without a reader not reported gone")
+	}
+}
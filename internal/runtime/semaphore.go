@@ -16,7 +16,8 @@ type Semaphore struct {
 	lockDir   string
 	maxSlots  int
 	sessionID string
-	logWriter io.Writer // optional; operational log messages go here instead of stderr
+	logWriter io.Writer    // optional; operational log messages go here instead of stderr
+	limiter   *RateLimiter // optional; lowers the slot count while the tree is rate limited
 
 	mu       sync.Mutex
 	lockFile string // path of the currently held lock file, or "" if none
@@ -57,7 +58,7 @@ func (s *Semaphore) Acquire() error {
 	for {
 		// Count existing lock files.
 		count := s.countFiles()
-		if count < s.maxSlots {
+		if count < s.slots() {
 			// Try atomic create.
 			f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
 			if err == nil {
@@ -77,7 +78,7 @@ func (s *Semaphore) Acquire() error {
 		if !warned && time.Since(start) > 60*time.Second {
 			if w := s.logWriter; w != nil {
 				fmt.Fprintf(w, "quine: semaphore blocked for >60s waiting for concurrency slot (%d/%d)\n",
-					count, s.maxSlots)
+					count, s.slots())
 			}
 			warned = true
 		}
@@ -109,7 +110,16 @@ func (s *Semaphore) Count() int {
 
 // IsFull returns true if all slots are currently occupied.
 func (s *Semaphore) IsFull() bool {
-	return s.countFiles() >= s.maxSlots
+	return s.countFiles() >= s.slots()
+}
+
+// slots is the number of slots currently available: maxSlots, or fewer
+// while the tree's RateLimiter has lowered its concurrency.
+func (s *Semaphore) slots() int {
+	if s.limiter == nil {
+		return s.maxSlots
+	}
+	return min(s.maxSlots, s.limiter.Concurrency())
 }
 
 // countFiles returns the number of .lock files in the lock directory.
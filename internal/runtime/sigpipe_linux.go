@@ -0,0 +1,34 @@
+package runtime
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// stdoutGone reports whether f, the deliverable channel, has lost its
+// reader. A SIGPIPE tells us only that some write hit a broken pipe or
+// socket, e.g. the credential broker answering a child that already hung
+// up; the session ends only if it was stdout that broke.
+//
+// Polled without blocking: a pipe or socket whose reader is gone reports
+// POLLERR or POLLHUP.
+func stdoutGone(f *os.File) bool {
+	fds := []struct {
+		fd      int32
+		events  int16
+		revents int16
+	}{{fd: int32(f.Fd()), events: pollOut}}
+	var ts syscall.Timespec
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno != 0 {
+		return true
+	}
+	return n == 1 && fds[0].revents&(pollErr|pollHup) != 0
+}
+
+const (
+	pollOut = 0x4
+	pollErr = 0x8
+	pollHup = 0x10
+)
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package runtime
+
+import "os"
+
+// stdoutGone assumes every SIGPIPE is for stdout: there is no portable
+// non-blocking check.
+func stdoutGone(f *os.File) bool {
+	return true
+}
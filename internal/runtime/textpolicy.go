@@ -0,0 +1,65 @@
+package runtime
+
+import "fmt"
+
+// textVerdict is the TextPolicy's decision for one assistant reply.
+type textVerdict int
+
+const (
+	textAllowed   textVerdict = iota // tool call, or text within the tolerated streak
+	textViolation                    // too many text-only replies in a row: correct the agent
+	textTerminate                    // out of strikes: end the session
+)
+
+// TextPolicy bounds replies that contain no tool calls. Only sh consumes a
+// turn, so without it a model that keeps chatting would loop (and spend
+// tokens) forever.
+//
+// Up to MaxConsecutive text-only replies in a row are tolerated. Each one
+// beyond that is a strike and earns a corrective message; the
+// MaxStrikes-th strike ends the session. A tool call resets the streak but
+// not the strikes.
+type TextPolicy struct {
+	MaxConsecutive int // 0 disables the policy
+	MaxStrikes     int // 0 = correct forever, never terminate
+
+	consecutive int
+	strikes     int
+}
+
+// Observe records one assistant reply and returns the verdict.
+func (p *TextPolicy) Observe(hasToolCalls bool) textVerdict {
+	if hasToolCalls {
+		p.consecutive = 0
+		return textAllowed
+	}
+	p.consecutive++
+	if p.MaxConsecutive <= 0 || p.consecutive <= p.MaxConsecutive {
+		return textAllowed
+	}
+	p.strikes++
+	if p.MaxStrikes > 0 && p.strikes >= p.MaxStrikes {
+		return textTerminate
+	}
+	return textViolation
+}
+
+// Consecutive returns the current streak of text-only replies.
+func (p *TextPolicy) Consecutive() int { return p.consecutive }
+
+// Strikes returns the number of violations so far.
+func (p *TextPolicy) Strikes() int { return p.strikes }
+
+// Correction is the user message injected after a violation.
+func (p *TextPolicy) Correction() string {
+	msg := fmt.Sprintf("[POLICY] %d replies in a row without a tool call. Text replies do nothing: act through your tools (sh, fork, exec), and call exit when you are done.", p.consecutive)
+	if p.MaxStrikes > 0 {
+		msg += fmt.Sprintf(" Strike %d/%d — at %d the session is terminated.", p.strikes, p.MaxStrikes, p.MaxStrikes)
+	}
+	return msg
+}
+
+// Reason describes a policy termination for logs and stderr.
+func (p *TextPolicy) Reason() string {
+	return fmt.Sprintf("text-only reply limit exhausted (%d strikes, %d replies in a row without a tool call)", p.strikes, p.consecutive)
+}
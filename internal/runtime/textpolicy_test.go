@@ -0,0 +1,45 @@
+package runtime
+
+import "testing"
+
+func TestTextPolicyStrikesAndTerminates(t *testing.T) {
+	p := &TextPolicy{MaxConsecutive: 2, MaxStrikes: 2}
+
+	want := []textVerdict{textAllowed, textAllowed, textViolation, textTerminate}
+	for i, w := range want {
+		if got := p.Observe(false); got != w {
+			t.Fatalf("reply %d: verdict = %d, want %d", i+1, got, w)
+		}
+	}
+	if p.Strikes() != 2 || p.Consecutive() != 4 {
+		t.Errorf("strikes/consecutive = %d/%d, want 2/4", p.Strikes(), p.Consecutive())
+	}
+}
+
+func TestTextPolicyToolCallResetsStreakNotStrikes(t *testing.T) {
+	p := &TextPolicy{MaxConsecutive: 1, MaxStrikes: 3}
+
+	p.Observe(false)
+	if v := p.Observe(false); v != textViolation {
+		t.Fatalf("expected violation, got %d", v)
+	}
+	p.Observe(true)
+	if p.Consecutive() != 0 {
+		t.Errorf("tool call should reset the streak, got %d", p.Consecutive())
+	}
+	if v := p.Observe(false); v != textAllowed {
+		t.Errorf("first text reply after a tool call should be allowed, got %d", v)
+	}
+	if p.Strikes() != 1 {
+		t.Errorf("strikes should persist across streaks, got %d", p.Strikes())
+	}
+}
+
+func TestTextPolicyDisabled(t *testing.T) {
+	p := &TextPolicy{}
+	for i := 0; i < 100; i++ {
+		if v := p.Observe(false); v != textAllowed {
+			t.Fatalf("reply %d: disabled policy returned %d", i+1, v)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Package sandbox confines the agent's shell and fork children with kernel
+// permissions (QUINE_SANDBOX), so Capability Minimalism does not rest on the
+// prompt alone.
+//
+// A sandboxed process is started through a helper: the quine binary itself,
+// re-executed with HelperArg in fresh user and mount namespaces (plus a
+// network namespace when network is denied). The helper applies landlock
+// rules that only allow writes beneath the policy's directories, then execs
+// the real program. Landlock domains survive exec and are inherited by every
+// descendant, so nothing the shell starts can escape them.
+//
+// Everything fails closed: if the kernel lacks landlock or user namespaces,
+// Check reports it and the helper refuses to exec the program unconfined.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Mode is the QUINE_SANDBOX setting.
+type Mode string
+
+const (
+	ModeOff    Mode = ""       // no sandbox (default)
+	ModeFS     Mode = "fs"     // namespaces + landlock: writes limited to the policy's directories
+	ModeStrict Mode = "strict" // ModeFS, and the shell gets no network
+)
+
+// HelperArg is argv[1] of a quine process acting as the sandbox helper.
+const HelperArg = "__quine-sandbox"
+
+// ErrUnsupported is returned when the kernel cannot provide the sandbox.
+var ErrUnsupported = errors.New("sandbox not supported by this kernel")
+
+// ParseMode parses a QUINE_SANDBOX value. "", "0", "off" and "false" all
+// mean ModeOff.
+func ParseMode(v string) (Mode, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "0", "off", "false":
+		return ModeOff, nil
+	case "fs", "1", "on", "true":
+		return ModeFS, nil
+	case "strict":
+		return ModeStrict, nil
+	default:
+		return ModeOff, fmt.Errorf("unknown sandbox mode %q (want off, fs or strict)", v)
+	}
+}
+
+// Policy describes what a sandboxed process may do.
+type Policy struct {
+	Mode Mode
+	// Writable lists the directories (and their subtrees) the process may
+	// create, modify or delete files in. Everything else is read-only.
+	Writable []string
+}
+
+// DefaultPolicy returns the policy for mode: writes are allowed in the
+// working directory, dataDir (tapes, locks, logs) and the temp directory
+// (the shell's per-command stderr files live in /tmp). Returns nil for
+// ModeOff.
+func DefaultPolicy(mode Mode, dataDir string) *Policy {
+	if mode == ModeOff {
+		return nil
+	}
+	var dirs []string
+	if wd, err := os.Getwd(); err == nil {
+		dirs = append(dirs, wd)
+	}
+	dirs = append(dirs, dataDir, "/tmp", os.TempDir())
+
+	p := &Policy{Mode: mode}
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		if d == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(d); err == nil {
+			d = abs
+		}
+		if !seen[d] {
+			seen[d] = true
+			p.Writable = append(p.Writable, d)
+		}
+	}
+	return p
+}
+
+// AllowsNetwork reports whether a sandboxed shell keeps network access.
+func (p *Policy) AllowsNetwork() bool {
+	return p.Mode != ModeStrict
+}
+
+// violationHints are stderr fragments that typically mean the sandbox,
+// not the command, refused an operation.
+var violationHints = []string{
+	"Permission denied",
+	"Operation not permitted",
+	"Read-only file system",
+	"Network is unreachable",
+	"Could not resolve host",
+	"Temporary failure in name resolution",
+}
+
+// Explain returns a note for a failed command whose stderr looks like a
+// sandbox refusal, or "" if it does not.
+func (p *Policy) Explain(stderr string) string {
+	for _, hint := range violationHints {
+		if strings.Contains(stderr, hint) {
+			network := "allowed"
+			if !p.AllowsNetwork() {
+				network = "denied"
+			}
+			return fmt.Sprintf("[SANDBOX] This may have been blocked by the sandbox (QUINE_SANDBOX=%s). Writes are allowed only under: %s. Network: %s.",
+				p.Mode, strings.Join(p.Writable, ", "), network)
+		}
+	}
+	return ""
+}
+
+// helperArgs builds the helper's argv after HelperArg:
+//
+//	[-net] -w DIR... -- PROGRAM ARGS...
+func (p *Policy) helperArgs(denyNetwork bool, argv []string) []string {
+	var args []string
+	if denyNetwork {
+		args = append(args, "-net")
+	}
+	for _, d := range p.Writable {
+		args = append(args, "-w", d)
+	}
+	args = append(args, "--")
+	return append(args, argv...)
+}
+
+// parseHelperArgs is the inverse of helperArgs.
+func parseHelperArgs(args []string) (writable []string, denyNetwork bool, argv []string, err error) {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-net":
+			denyNetwork = true
+		case "-w":
+			if i+1 >= len(args) {
+				return nil, false, nil, fmt.Errorf("-w needs a directory")
+			}
+			i++
+			writable = append(writable, args[i])
+		case "--":
+			if i+1 >= len(args) {
+				return nil, false, nil, fmt.Errorf("no program after --")
+			}
+			return writable, denyNetwork, args[i+1:], nil
+		default:
+			return nil, false, nil, fmt.Errorf("unexpected argument %q", args[i])
+		}
+	}
+	return nil, false, nil, fmt.Errorf("missing --")
+}
@@ -0,0 +1,249 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The helper takes over before main (and before TestMain in test binaries
+// that import this package): it must exec the target from the thread that
+// applied landlock, with nothing else of quine running.
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == HelperArg {
+		runtime.LockOSThread()
+		helperMain(os.Args[2:])
+	}
+}
+
+// Check reports whether the kernel can provide the sandbox: landlock must
+// be enabled and user namespaces available to this user.
+func Check() error {
+	if _, err := landlockABI(); err != nil {
+		return err
+	}
+	if data, err := os.ReadFile("/proc/sys/user/max_user_namespaces"); err == nil {
+		if n, _ := strconv.Atoi(strings.TrimSpace(string(data))); n == 0 {
+			return fmt.Errorf("%w: user namespaces disabled (user.max_user_namespaces=0)", ErrUnsupported)
+		}
+	}
+	if data, err := os.ReadFile("/proc/sys/kernel/unprivileged_userns_clone"); err == nil && os.Geteuid() != 0 {
+		if strings.TrimSpace(string(data)) == "0" {
+			return fmt.Errorf("%w: unprivileged user namespaces disabled (kernel.unprivileged_userns_clone=0)", ErrUnsupported)
+		}
+	}
+	return nil
+}
+
+// Wrap rewrites cmd so it runs under the policy: through the helper, in new
+// user and mount namespaces, and in a new network namespace unless
+// allowNetwork. Call it after cmd's Path, Args, Env and SysProcAttr are set.
+func (p *Policy) Wrap(cmd *exec.Cmd, allowNetwork bool) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("sandbox: locating quine binary: %w", err)
+	}
+
+	argv := append([]string{cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	cmd.Args = append([]string{self, HelperArg}, p.helperArgs(!allowNetwork, argv)...)
+
+	attr := cmd.SysProcAttr
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+	attr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	if !allowNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	// Map our own uid/gid, so files keep their owner inside and out.
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+	cmd.SysProcAttr = attr
+	return nil
+}
+
+// helperMain runs inside the new namespaces: it makes mounts private, brings
+// up loopback in a fresh network namespace, applies landlock and execs the
+// target. It never returns; any failure exits 126 without running the target.
+func helperMain(args []string) {
+	fail := func(format string, a ...any) {
+		fmt.Fprintf(os.Stderr, "quine sandbox: "+format+"\n", a...)
+		os.Exit(126)
+	}
+
+	writable, denyNetwork, argv, err := parseHelperArgs(args)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	// Keep mount changes made inside the sandbox from propagating out.
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		fail("making mounts private: %v", err)
+	}
+	if denyNetwork {
+		// Best effort: localhost stays usable, nothing else is reachable.
+		_ = loopbackUp()
+	}
+	if err := restrictWrites(writable); err != nil {
+		fail("%v", err)
+	}
+
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		fail("%v", err)
+	}
+	err = syscall.Exec(path, argv, os.Environ())
+	fail("exec %s: %v", path, err)
+}
+
+// ---------------------------------------------------------------------------
+// Landlock (stdlib only: raw syscalls, see linux/landlock.h)
+// ---------------------------------------------------------------------------
+
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+)
+
+// Filesystem access rights (ABI version that introduced them).
+const (
+	accessFSWriteFile  = 1 << 1
+	accessFSRemoveDir  = 1 << 4
+	accessFSRemoveFile = 1 << 5
+	accessFSMakeChar   = 1 << 6
+	accessFSMakeDir    = 1 << 7
+	accessFSMakeReg    = 1 << 8
+	accessFSMakeSock   = 1 << 9
+	accessFSMakeFifo   = 1 << 10
+	accessFSMakeBlock  = 1 << 11
+	accessFSMakeSym    = 1 << 12
+	accessFSRefer      = 1 << 13 // ABI 2
+	accessFSTruncate   = 1 << 14 // ABI 3
+)
+
+// writableDevices may always be opened for writing; shells redirect to
+// them constantly. Missing ones are skipped.
+var writableDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/tty"}
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// landlockABI returns the kernel's landlock ABI version.
+func landlockABI() (int, error) {
+	v, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0, fmt.Errorf("%w: landlock unavailable (%v)", ErrUnsupported, errno)
+	}
+	if v < 1 {
+		return 0, fmt.Errorf("%w: landlock ABI %d", ErrUnsupported, v)
+	}
+	return int(v), nil
+}
+
+// restrictWrites confines the calling thread (and everything it execs) so
+// that writes are only possible beneath the given directories.
+func restrictWrites(dirs []string) error {
+	abi, err := landlockABI()
+	if err != nil {
+		return err
+	}
+
+	fileWrite := uint64(accessFSWriteFile)
+	dirWrite := uint64(accessFSWriteFile | accessFSRemoveDir | accessFSRemoveFile |
+		accessFSMakeChar | accessFSMakeDir | accessFSMakeReg | accessFSMakeSock |
+		accessFSMakeFifo | accessFSMakeBlock | accessFSMakeSym)
+	if abi >= 2 {
+		dirWrite |= accessFSRefer
+	}
+	if abi >= 3 {
+		fileWrite |= accessFSTruncate
+		dirWrite |= accessFSTruncate
+	}
+
+	attr := landlockRulesetAttr{handledAccessFS: dirWrite}
+	rfd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: creating ruleset: %v", errno)
+	}
+	defer syscall.Close(int(rfd))
+
+	allow := func(path string, access uint64) error {
+		fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		rule := landlockPathBeneathAttr{allowedAccess: access, parentFd: int32(fd)}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, rfd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("landlock: creating %s: %w", dir, err)
+		}
+		if err := allow(dir, dirWrite); err != nil {
+			return fmt.Errorf("landlock: allowing %s: %w", dir, err)
+		}
+	}
+	for _, dev := range writableDevices {
+		if err := allow(dev, fileWrite); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("landlock: allowing %s: %w", dev, err)
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: setting no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, rfd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: restricting: %v", errno)
+	}
+	return nil
+}
+
+// loopbackUp sets IFF_UP on "lo" in a fresh network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
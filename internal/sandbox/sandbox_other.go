@@ -0,0 +1,19 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// Check always fails: the sandbox needs Linux namespaces and landlock.
+func Check() error {
+	return fmt.Errorf("%w: requires Linux (running on %s)", ErrUnsupported, runtime.GOOS)
+}
+
+// Wrap always fails, so a sandboxed command is never run unconfined.
+func (p *Policy) Wrap(cmd *exec.Cmd, allowNetwork bool) error {
+	return Check()
+}
@@ -0,0 +1,126 @@
+package sandbox
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// requireSandbox skips the test when the kernel cannot provide the sandbox.
+func requireSandbox(t *testing.T) {
+	t.Helper()
+	if err := Check(); err != nil {
+		t.Skipf("sandbox unavailable: %v", err)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	cases := map[string]Mode{"": ModeOff, "off": ModeOff, "0": ModeOff, "fs": ModeFS, "1": ModeFS, "strict": ModeStrict, " STRICT ": ModeStrict}
+	for in, want := range cases {
+		got, err := ParseMode(in)
+		if err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseMode("chroot"); err == nil {
+		t.Error("ParseMode(chroot) should fail")
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	if p := DefaultPolicy(ModeOff, ".quine"); p != nil {
+		t.Errorf("ModeOff policy = %+v, want nil", p)
+	}
+	p := DefaultPolicy(ModeStrict, ".quine")
+	wd, _ := os.Getwd()
+	want := map[string]bool{wd: true, filepath.Join(wd, ".quine"): true, "/tmp": true}
+	for _, d := range p.Writable {
+		delete(want, d)
+	}
+	if len(want) > 0 {
+		t.Errorf("Writable = %v, missing %v", p.Writable, want)
+	}
+	if p.AllowsNetwork() {
+		t.Error("strict policy should deny network")
+	}
+}
+
+func TestHelperArgsRoundTrip(t *testing.T) {
+	p := &Policy{Mode: ModeStrict, Writable: []string{"/a", "/b c"}}
+	argv := []string{"/bin/sh", "-c", "echo -- -w"}
+	writable, denyNet, gotArgv, err := parseHelperArgs(p.helperArgs(true, argv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !denyNet || !reflect.DeepEqual(writable, p.Writable) || !reflect.DeepEqual(gotArgv, argv) {
+		t.Errorf("round trip = %v %v %v", writable, denyNet, gotArgv)
+	}
+	if _, _, _, err := parseHelperArgs([]string{"-w", "/a"}); err == nil {
+		t.Error("missing -- should fail")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	p := &Policy{Mode: ModeFS, Writable: []string{"/work"}}
+	if note := p.Explain("sh: 1: cannot create /etc/x: Permission denied"); !strings.HasPrefix(note, "[SANDBOX]") || !strings.Contains(note, "/work") {
+		t.Errorf("Explain = %q", note)
+	}
+	if note := p.Explain("ls: cannot access 'x': No such file or directory"); note != "" {
+		t.Errorf("unrelated error explained: %q", note)
+	}
+}
+
+// sandboxed runs script under p and returns its combined output.
+func sandboxed(t *testing.T, p *Policy, allowNetwork bool, script string) (string, error) {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	if err := p.Wrap(cmd, allowNetwork); err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestWrapConfinesWrites(t *testing.T) {
+	requireSandbox(t)
+	root := t.TempDir()
+	allowed := filepath.Join(root, "allowed")
+	denied := filepath.Join(root, "denied")
+	os.Mkdir(denied, 0o755)
+
+	p := &Policy{Mode: ModeFS, Writable: []string{allowed}}
+	out, err := sandboxed(t, p, true, "echo ok > "+allowed+"/f && echo ok > /dev/null")
+	if err != nil {
+		t.Fatalf("write inside policy failed: %v\n%s", err, out)
+	}
+	if data, _ := os.ReadFile(filepath.Join(allowed, "f")); string(data) != "ok\n" {
+		t.Errorf("allowed file = %q", data)
+	}
+
+	out, err = sandboxed(t, p, true, "echo no > "+denied+"/f")
+	if err == nil {
+		t.Fatalf("write outside policy succeeded:\n%s", out)
+	}
+	if _, statErr := os.Stat(filepath.Join(denied, "f")); statErr == nil {
+		t.Error("file outside policy was created")
+	}
+	if p.Explain(out) == "" {
+		t.Errorf("violation not recognised: %q", out)
+	}
+}
+
+func TestWrapDeniesNetwork(t *testing.T) {
+	requireSandbox(t)
+	p := &Policy{Mode: ModeStrict, Writable: []string{t.TempDir()}}
+	// /proc/net/dev lists the interfaces of the reader's network namespace.
+	out, err := sandboxed(t, p, false, "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if strings.TrimSpace(out) != "lo" {
+		t.Errorf("interfaces in sandbox = %q, want only lo", out)
+	}
+}
@@ -2,19 +2,26 @@ package tape
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
+// ErrInUse is returned when a tape belongs to a process that is still
+// running.
+var ErrInUse = errors.New("tape is in use by a running process")
+
 // Writer handles JSONL persistence of a Tape.
 // It uses open-write-close semantics: the file is only held open during
 // each write operation, allowing external tools (tail, panopticon) to
 // read the file freely between writes.
 type Writer struct {
-	dir       string // tape directory path
-	sessionID string // session ID for filename
-	path      string // full path to the JSONL file
+	dir       string   // tape directory path
+	sessionID string   // session ID for filename
+	path      string   // full path to the JSONL file
+	claim     *os.File // holds the flock taken by Claim, nil if unclaimed
 }
 
 // NewWriter creates a Writer. It creates the directory if needed.
@@ -55,8 +62,46 @@ func (w *Writer) WriteEntry(entry TapeEntry) error {
 	return nil
 }
 
-// Close is a no-op since we use open-write-close semantics.
-// Kept for interface compatibility.
-func (w *Writer) Close() error {
+// Claim marks the tape as written by this process until Close, so that a
+// second process (e.g. quine -resume of a session that is still running)
+// cannot write to it at the same time. The claim is an advisory flock on
+// the tape file: readers are unaffected, and the kernel drops it when the
+// process dies, however it dies. Returns ErrInUse if another process holds
+// the claim.
+func (w *Writer) Claim() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening tape file %q: %w", w.path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("%s: %w", w.path, ErrInUse)
+		}
+		return fmt.Errorf("locking tape file %q: %w", w.path, err)
+	}
+	w.claim = f
 	return nil
 }
+
+// InUse reports whether the tape at path is claimed by a running process.
+// A missing tape is not in use.
+func InUse(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return errors.Is(syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB), syscall.EWOULDBLOCK)
+}
+
+// Close releases the claim, if any. Writes need no closing since we use
+// open-write-close semantics.
+func (w *Writer) Close() error {
+	if w.claim == nil {
+		return nil
+	}
+	err := w.claim.Close()
+	w.claim = nil
+	return err
+}
@@ -3,6 +3,7 @@ package tape
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -159,7 +160,7 @@ func TestWriterFullLifecycle(t *testing.T) {
 	}
 
 	// 6. Outcome
-	tp.AddUsage(100, 50)
+	tp.AddUsage(100, 50, 0, 0)
 	tp.SetOutcome(SessionOutcome{
 		ExitCode:        0,
 		DurationMs:      500,
@@ -202,3 +203,31 @@ func TestWriterFullLifecycle(t *testing.T) {
 		t.Errorf("got %d lines, want %d", lineNum, len(expectedTypes))
 	}
 }
+
+func TestWriterClaim(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, "claimed")
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	path := filepath.Join(dir, "claimed.jsonl")
+	if InUse(path) {
+		t.Error("unclaimed tape reported in use")
+	}
+	if err := w.Claim(); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	if !InUse(path) {
+		t.Error("claimed tape not reported in use")
+	}
+
+	other, _ := NewWriter(dir, "claimed")
+	if err := other.Claim(); !errors.Is(err, ErrInUse) {
+		t.Errorf("second Claim = %v, want ErrInUse", err)
+	}
+
+	w.Close()
+	if InUse(path) {
+		t.Error("tape still in use after Close")
+	}
+}
@@ -11,13 +11,23 @@ import (
 // TapeSummary holds the parsed header and current state of a tape file.
 // It is the read-side counterpart to the write-side Writer.
 type TapeSummary struct {
-	SessionID       string          `json:"session_id"`
-	ParentSessionID string          `json:"parent_session_id"`
-	Depth           int             `json:"depth"`
-	ModelID         string          `json:"model_id"`
-	CreatedAt       int64           `json:"created_at"`
-	Entries         []TapeEntry     `json:"entries"`
-	Outcome         *SessionOutcome `json:"outcome,omitempty"`
+	SessionID       string            `json:"session_id"`
+	ParentSessionID string            `json:"parent_session_id"`
+	Depth           int               `json:"depth"`
+	ModelID         string            `json:"model_id"`
+	CreatedAt       int64             `json:"created_at"`
+	Mission         string            `json:"mission,omitempty"`
+	Wisdom          map[string]string `json:"wisdom,omitempty"`
+	TreeID          string            `json:"tree_id,omitempty"`
+	Entries         []TapeEntry       `json:"entries"`
+	Outcome         *SessionOutcome   `json:"outcome,omitempty"`
+
+	// Running totals from "usage" entries (absent in older tapes).
+	TokensIn  int `json:"tokens_in"`
+	TokensOut int `json:"tokens_out"`
+
+	CacheWriteTokens int `json:"cache_write_tokens,omitempty"`
+	CacheReadTokens  int `json:"cache_read_tokens,omitempty"`
 }
 
 // ReadTapeFile reads and parses a complete JSONL tape file from disk.
@@ -66,11 +76,14 @@ func ReadTape(r io.Reader) (*TapeSummary, error) {
 				continue
 			}
 			var meta struct {
-				SessionID       string `json:"session_id"`
-				ParentSessionID string `json:"parent_session_id"`
-				Depth           int    `json:"depth"`
-				ModelID         string `json:"model_id"`
-				CreatedAt       int64  `json:"created_at"`
+				SessionID       string            `json:"session_id"`
+				ParentSessionID string            `json:"parent_session_id"`
+				Depth           int               `json:"depth"`
+				ModelID         string            `json:"model_id"`
+				CreatedAt       int64             `json:"created_at"`
+				Mission         string            `json:"mission"`
+				Wisdom          map[string]string `json:"wisdom"`
+				TreeID          string            `json:"tree_id"`
 			}
 			if err := json.Unmarshal(entry.Data, &meta); err != nil {
 				return nil, fmt.Errorf("line %d: unmarshal meta: %w", lineNum, err)
@@ -80,6 +93,24 @@ func ReadTape(r io.Reader) (*TapeSummary, error) {
 			summary.Depth = meta.Depth
 			summary.ModelID = meta.ModelID
 			summary.CreatedAt = meta.CreatedAt
+			summary.Mission = meta.Mission
+			summary.Wisdom = meta.Wisdom
+			summary.TreeID = meta.TreeID
+
+		case "usage":
+			var usage struct {
+				TokensIn   int `json:"tokens_in"`
+				TokensOut  int `json:"tokens_out"`
+				CacheWrite int `json:"cache_write_tokens"`
+				CacheRead  int `json:"cache_read_tokens"`
+			}
+			if err := json.Unmarshal(entry.Data, &usage); err != nil {
+				return nil, fmt.Errorf("line %d: unmarshal usage: %w", lineNum, err)
+			}
+			summary.TokensIn += usage.TokensIn
+			summary.TokensOut += usage.TokensOut
+			summary.CacheWriteTokens += usage.CacheWrite
+			summary.CacheReadTokens += usage.CacheRead
 
 		case "outcome":
 			var outcome SessionOutcome
@@ -103,6 +134,90 @@ func ReadTape(r io.Reader) (*TapeSummary, error) {
 	return summary, nil
 }
 
+// Messages reconstructs the conversation recorded in the tape entries, in
+// file order. "message" entries decode directly; "tool_result" entries
+// (written by the sh, fork and exec handlers) become RoleToolResult
+// messages. All other entry types are skipped.
+func (s *TapeSummary) Messages() ([]Message, error) {
+	var msgs []Message
+	for i, entry := range s.Entries {
+		switch entry.Type {
+		case "message":
+			var msg Message
+			if err := json.Unmarshal(entry.Data, &msg); err != nil {
+				return nil, fmt.Errorf("entry %d: unmarshal message: %w", i, err)
+			}
+			msgs = append(msgs, msg)
+
+		case "tool_result":
+			var tr ToolResult
+			if err := json.Unmarshal(entry.Data, &tr); err != nil {
+				return nil, fmt.Errorf("entry %d: unmarshal tool_result: %w", i, err)
+			}
+			msgs = append(msgs, Message{
+				Role:    RoleToolResult,
+				Content: tr.Content,
+				ToolID:  tr.ToolID,
+			})
+
+		case "hook":
+			// A pre hook's rewrite replaces the arguments of the call as
+			// recorded, so the conversation shows what was executed.
+			var hook struct {
+				Phase  string `json:"phase"`
+				ToolID string `json:"tool_id"`
+				Action string `json:"action"`
+				Detail string `json:"detail"`
+			}
+			if err := json.Unmarshal(entry.Data, &hook); err != nil {
+				return nil, fmt.Errorf("entry %d: unmarshal hook: %w", i, err)
+			}
+			if hook.Phase != "pre" || hook.Action != "rewrite" {
+				continue
+			}
+			var args map[string]any
+			if err := json.Unmarshal([]byte(hook.Detail), &args); err != nil {
+				return nil, fmt.Errorf("entry %d: hook rewrite arguments: %w", i, err)
+			}
+			for j := len(msgs) - 1; j >= 0; j-- {
+				if rewriteToolCall(&msgs[j], hook.ToolID, args) {
+					break
+				}
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// ShTurns counts the sh calls that were actually executed — those whose
+// result was recorded as a "tool_result" entry (rejected calls are written
+// as plain messages and never consumed a turn). This matches Tape.TurnCount.
+func (s *TapeSummary) ShTurns() (int, error) {
+	msgs, err := s.Messages()
+	if err != nil {
+		return 0, err
+	}
+	shCalls := make(map[string]bool)
+	for _, m := range msgs {
+		for _, tc := range m.ToolCalls {
+			if tc.Name == "sh" {
+				shCalls[tc.ID] = true
+			}
+		}
+	}
+	turns := 0
+	for _, entry := range s.Entries {
+		if entry.Type != "tool_result" {
+			continue
+		}
+		var tr ToolResult
+		if err := json.Unmarshal(entry.Data, &tr); err == nil && shCalls[tr.ToolID] {
+			turns++
+		}
+	}
+	return turns, nil
+}
+
 // TailLastEntry reads the last complete line of a tape file and returns
 // the parsed TapeEntry. This is used by the watcher to efficiently determine
 // the current state of a tape without reading the entire file.
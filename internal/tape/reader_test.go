@@ -40,7 +40,7 @@ func TestReadTapeFile(t *testing.T) {
 		t.Fatalf("write tool_result: %v", err)
 	}
 
-	tp.AddUsage(500, 200)
+	tp.AddUsage(500, 200, 0, 0)
 	tp.SetOutcome(SessionOutcome{
 		ExitCode:        0,
 		DurationMs:      1000,
@@ -266,3 +266,95 @@ func TestReadTapeFile_DuplicateMeta(t *testing.T) {
 		t.Errorf("Entries count = %d, want 3 (1 meta + 2 messages)", len(summary.Entries))
 	}
 }
+
+func TestTapeSummaryMessages(t *testing.T) {
+	dir := t.TempDir()
+	sessionID := "messages-test"
+
+	w, err := NewWriter(dir, sessionID)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	tp := NewTape(sessionID, "", 0, "gpt-4o")
+	w.WriteEntry(tp.MetaEntry())
+	w.WriteEntry(MessageEntry(Message{Role: RoleSystem, Content: "prompt", Timestamp: 1}))
+	w.WriteEntry(MessageEntry(Message{
+		Role:      RoleAssistant,
+		ToolCalls: []ToolCall{{ID: "tc-1", Name: "sh", Arguments: map[string]any{"command": "ls"}}},
+		Timestamp: 2,
+	}))
+	w.WriteEntry(ToolResultEntry(ToolResult{ToolID: "tc-1", Content: "file.go"}))
+	w.WriteEntry(MessageEntry(Message{Role: RoleToolResult, Content: "rejected", ToolID: "tc-2", Timestamp: 3}))
+
+	summary, err := ReadTapeFile(filepath.Join(dir, sessionID+".jsonl"))
+	if err != nil {
+		t.Fatalf("ReadTapeFile: %v", err)
+	}
+	msgs, err := summary.Messages()
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(msgs))
+	}
+	if msgs[2].Role != RoleToolResult || msgs[2].ToolID != "tc-1" || msgs[2].Content != "file.go" {
+		t.Errorf("tool_result entry not converted: %+v", msgs[2])
+	}
+	if msgs[3].Role != RoleToolResult || msgs[3].ToolID != "tc-2" {
+		t.Errorf("message-encoded tool result not preserved: %+v", msgs[3])
+	}
+}
+
+func TestReadTapeFile_ResumeState(t *testing.T) {
+	dir := t.TempDir()
+	sessionID := "resume-state"
+
+	w, err := NewWriter(dir, sessionID)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	tp := NewTape(sessionID, "parent-1", 2, "gpt-4o")
+	tp.Mission = "count the files"
+	tp.Wisdom = map[string]string{"NOTE": "use find"}
+	tp.TreeID = "tree-1"
+	w.WriteEntry(tp.MetaEntry())
+	w.WriteEntry(MessageEntry(Message{
+		Role: RoleAssistant,
+		ToolCalls: []ToolCall{
+			{ID: "tc-1", Name: "sh", Arguments: map[string]any{"command": "ls"}},
+			{ID: "tc-2", Name: "sh", Arguments: map[string]any{"command": "rm -rf /"}},
+		},
+	}))
+	w.WriteEntry(UsageEntry(100, 10, 0, 0))
+	w.WriteEntry(ToolResultEntry(ToolResult{ToolID: "tc-1", Content: "a b c"}))
+	w.WriteEntry(MessageEntry(Message{Role: RoleToolResult, Content: "rejected", ToolID: "tc-2"}))
+	w.WriteEntry(UsageEntry(200, 20, 50, 120))
+
+	summary, err := ReadTapeFile(filepath.Join(dir, sessionID+".jsonl"))
+	if err != nil {
+		t.Fatalf("ReadTapeFile: %v", err)
+	}
+	if summary.Mission != "count the files" {
+		t.Errorf("Mission = %q", summary.Mission)
+	}
+	if summary.Wisdom["NOTE"] != "use find" {
+		t.Errorf("Wisdom = %v", summary.Wisdom)
+	}
+	if summary.TreeID != "tree-1" {
+		t.Errorf("TreeID = %q", summary.TreeID)
+	}
+	if summary.TokensIn != 300 || summary.TokensOut != 30 {
+		t.Errorf("tokens = %d/%d, want 300/30", summary.TokensIn, summary.TokensOut)
+	}
+	if summary.CacheWriteTokens != 50 || summary.CacheReadTokens != 120 {
+		t.Errorf("cache tokens = %d/%d, want 50/120", summary.CacheWriteTokens, summary.CacheReadTokens)
+	}
+	turns, err := summary.ShTurns()
+	if err != nil {
+		t.Fatalf("ShTurns: %v", err)
+	}
+	if turns != 1 {
+		t.Errorf("ShTurns = %d, want 1 (rejected calls do not count)", turns)
+	}
+}
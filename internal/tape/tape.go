@@ -2,6 +2,7 @@ package tape
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -30,6 +31,52 @@ type Message struct {
 	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 	ToolID           string     `json:"tool_id,omitempty"`
 	Timestamp        int64      `json:"timestamp"`
+
+	// Model is the model that produced an assistant message. It differs
+	// from the meta entry's model_id after a failover (QUINE_FALLBACK).
+	Model string `json:"model,omitempty"`
+
+	// ReasoningItems are opaque reasoning items (OpenAI Responses API
+	// reasoning with encrypted content, Anthropic signed thinking blocks,
+	// Gemini thought signatures)
+	// that must be sent back verbatim on later turns for the model to keep
+	// its chain of thought across tool calls. Each protocol sends only its
+	// own items. An exec successor starts a fresh tape and so drops them.
+	ReasoningItems []json.RawMessage `json:"reasoning_items,omitempty"`
+}
+
+// Prefixes of the status lines the runtime appends to the last tool result
+// of a turn so the agent sees its situation. They are added after the
+// result is written, so the tape records it as the tool returned it.
+const (
+	StatusTurnsLeft  = "[TURNS LEFT] "
+	StatusEnergyLeft = "[ENERGY LEFT] "
+	StatusContext    = "[CONTEXT USED] "
+	StatusCost       = "[COST] "
+	StatusNearDeath  = "[RESOURCE EXHAUSTION IMMINENT] "
+)
+
+var statusPrefixes = []string{StatusTurnsLeft, StatusEnergyLeft, StatusContext, StatusCost, StatusNearDeath}
+
+// StripStatus removes the trailing status lines from a tool result,
+// recovering the content the tape recorded for it.
+func StripStatus(content string) string {
+	for {
+		i := strings.LastIndexByte(content, '\n')
+		if i < 0 || !hasStatusPrefix(content[i+1:]) {
+			return content
+		}
+		content = content[:i]
+	}
+}
+
+func hasStatusPrefix(line string) bool {
+	for _, p := range statusPrefixes {
+		if strings.HasPrefix(line, p) {
+			return true
+		}
+	}
+	return false
 }
 
 // TerminationMode describes how a session ended.
@@ -42,17 +89,29 @@ const (
 	TermTimeout           TerminationMode = "timeout"
 	TermSignal            TerminationMode = "signal"
 	TermExec              TerminationMode = "exec" // Process replaced via exec syscall
+	TermBudgetExhaustion  TerminationMode = "budget_exhaustion"
+	TermTextLoop          TerminationMode = "text_loop" // Too many text-only replies without tool calls
+
+	// LLM API failures that survived retries (see runtime.handleError).
+	TermRateLimit      TerminationMode = "rate_limit"
+	TermOverloaded     TerminationMode = "overloaded"
+	TermServerError    TerminationMode = "server_error"
+	TermInvalidRequest TerminationMode = "invalid_request"
+	TermContentFilter  TerminationMode = "content_filter"
+	TermQuotaExhausted TerminationMode = "quota_exhausted"
 )
 
 // SessionOutcome captures the final result of a session.
 type SessionOutcome struct {
-	ExitCode        int             `json:"exit_code"`
-	Stderr          string          `json:"stderr"`
-	DurationMs      int64           `json:"duration_ms"`
-	TokensIn        int             `json:"tokens_in"`
-	TokensOut       int             `json:"tokens_out"`
-	TurnCount       int             `json:"turn_count"`
-	TerminationMode TerminationMode `json:"termination_mode"`
+	ExitCode         int             `json:"exit_code"`
+	Stderr           string          `json:"stderr"`
+	DurationMs       int64           `json:"duration_ms"`
+	TokensIn         int             `json:"tokens_in"`
+	TokensOut        int             `json:"tokens_out"`
+	CacheWriteTokens int             `json:"cache_write_tokens,omitempty"` // part of TokensIn
+	CacheReadTokens  int             `json:"cache_read_tokens,omitempty"`  // part of TokensIn
+	TurnCount        int             `json:"turn_count"`
+	TerminationMode  TerminationMode `json:"termination_mode"`
 }
 
 // ToolResult holds the output of a tool execution.
@@ -72,10 +131,19 @@ type Tape struct {
 	messages        []Message       // unexported, append-only
 	Outcome         *SessionOutcome `json:"outcome,omitempty"`
 
+	// Mission, Wisdom and TreeID are recorded in the meta entry so an
+	// interrupted session can be resumed from its tape alone.
+	Mission string            `json:"mission,omitempty"`
+	Wisdom  map[string]string `json:"wisdom,omitempty"`
+	TreeID  string            `json:"tree_id,omitempty"`
+
 	// Token tracking (excluded from JSON — persisted via SessionOutcome)
 	TokensIn  int `json:"-"`
 	TokensOut int `json:"-"`
 	TurnCount int `json:"-"`
+
+	CacheWriteTokens int `json:"-"`
+	CacheReadTokens  int `json:"-"`
 }
 
 // NewTape creates a fresh Tape with CreatedAt set to the current time.
@@ -120,20 +188,52 @@ func (t *Tape) LastMessage() *Message {
 	return &t.messages[len(t.messages)-1]
 }
 
+// RewriteToolCall replaces the arguments of the recorded tool call id, so
+// the conversation shows the call as it was executed after a pre hook
+// rewrote it. Reports whether the call was found.
+func (t *Tape) RewriteToolCall(id string, args map[string]any) bool {
+	for i := len(t.messages) - 1; i >= 0; i-- {
+		if rewriteToolCall(&t.messages[i], id, args) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteToolCall sets the arguments of tool call id in msg. The
+// ToolCalls slice is copied first, as it may be shared with the caller
+// that appended msg.
+func rewriteToolCall(msg *Message, id string, args map[string]any) bool {
+	for j, tc := range msg.ToolCalls {
+		if tc.ID == id {
+			msg.ToolCalls = append([]ToolCall(nil), msg.ToolCalls...)
+			msg.ToolCalls[j].Arguments = args
+			return true
+		}
+	}
+	return false
+}
+
 // SetOutcome records the final session outcome. Running token and turn
 // totals are copied into the outcome struct.
 func (t *Tape) SetOutcome(outcome SessionOutcome) {
 	outcome.TokensIn = t.TokensIn
 	outcome.TokensOut = t.TokensOut
+	outcome.CacheWriteTokens = t.CacheWriteTokens
+	outcome.CacheReadTokens = t.CacheReadTokens
 	outcome.TurnCount = t.TurnCount
 	t.Outcome = &outcome
 }
 
-// AddUsage accumulates token counts. Does NOT increment turn counter
-// (turns are only consumed by sh tool calls, tracked separately).
-func (t *Tape) AddUsage(tokensIn, tokensOut int) {
+// AddUsage accumulates token counts; cacheWrite and cacheRead are the
+// parts of tokensIn written to and read from the prompt cache. Does NOT
+// increment turn counter (turns are only consumed by sh tool calls,
+// tracked separately).
+func (t *Tape) AddUsage(tokensIn, tokensOut, cacheWrite, cacheRead int) {
 	t.TokensIn += tokensIn
 	t.TokensOut += tokensOut
+	t.CacheWriteTokens += cacheWrite
+	t.CacheReadTokens += cacheRead
 }
 
 // IncrementTurn increments the turn counter. Called only when sh tool is used.
@@ -141,6 +241,42 @@ func (t *Tape) IncrementTurn() {
 	t.TurnCount++
 }
 
+// CloseDanglingToolCalls returns msgs with a synthetic tool result inserted
+// for every tool call that has no matching RoleToolResult. The synthetic
+// results are placed directly after the results that do exist for the same
+// assistant message, so tool_use/tool_result pairing stays valid for every
+// provider. resultFor supplies the content for each missing result.
+func CloseDanglingToolCalls(msgs []Message, resultFor func(ToolCall) string) []Message {
+	out := make([]Message, 0, len(msgs))
+	for i := 0; i < len(msgs); i++ {
+		out = append(out, msgs[i])
+		calls := msgs[i].ToolCalls
+		if msgs[i].Role != RoleAssistant || len(calls) == 0 {
+			continue
+		}
+
+		// Consume the results that follow this assistant message.
+		answered := make(map[string]bool)
+		for i+1 < len(msgs) && msgs[i+1].Role == RoleToolResult {
+			i++
+			answered[msgs[i].ToolID] = true
+			out = append(out, msgs[i])
+		}
+
+		for _, tc := range calls {
+			if answered[tc.ID] {
+				continue
+			}
+			out = append(out, Message{
+				Role:    RoleToolResult,
+				Content: resultFor(tc),
+				ToolID:  tc.ID,
+			})
+		}
+	}
+	return out
+}
+
 // ---------------------------------------------------------------------------
 // JSONL entry types (§10.1)
 // ---------------------------------------------------------------------------
@@ -155,11 +291,14 @@ type TapeEntry struct {
 // MetaEntry returns a TapeEntry of type "meta" containing the tape header.
 func (t *Tape) MetaEntry() TapeEntry {
 	type meta struct {
-		SessionID       string `json:"session_id"`
-		ParentSessionID string `json:"parent_session_id"`
-		Depth           int    `json:"depth"`
-		ModelID         string `json:"model_id"`
-		CreatedAt       int64  `json:"created_at"`
+		SessionID       string            `json:"session_id"`
+		ParentSessionID string            `json:"parent_session_id"`
+		Depth           int               `json:"depth"`
+		ModelID         string            `json:"model_id"`
+		CreatedAt       int64             `json:"created_at"`
+		Mission         string            `json:"mission,omitempty"`
+		Wisdom          map[string]string `json:"wisdom,omitempty"`
+		TreeID          string            `json:"tree_id,omitempty"`
 	}
 	data, _ := json.Marshal(meta{
 		SessionID:       t.SessionID,
@@ -167,6 +306,9 @@ func (t *Tape) MetaEntry() TapeEntry {
 		Depth:           t.Depth,
 		ModelID:         t.ModelID,
 		CreatedAt:       t.CreatedAt,
+		Mission:         t.Mission,
+		Wisdom:          t.Wisdom,
+		TreeID:          t.TreeID,
 	})
 	return TapeEntry{Type: "meta", Data: data}
 }
@@ -177,6 +319,74 @@ func MessageEntry(msg Message) TapeEntry {
 	return TapeEntry{Type: "message", Data: data}
 }
 
+// UsageEntry returns a TapeEntry of type "usage" recording the tokens
+// consumed by one LLM call. Written after each assistant message so token
+// totals survive a crash (the outcome entry is only written on exit).
+func UsageEntry(tokensIn, tokensOut, cacheWrite, cacheRead int) TapeEntry {
+	data, _ := json.Marshal(struct {
+		TokensIn   int `json:"tokens_in"`
+		TokensOut  int `json:"tokens_out"`
+		CacheWrite int `json:"cache_write_tokens,omitempty"`
+		CacheRead  int `json:"cache_read_tokens,omitempty"`
+	}{tokensIn, tokensOut, cacheWrite, cacheRead})
+	return TapeEntry{Type: "usage", Data: data}
+}
+
+// PolicyEntry returns a TapeEntry of type "policy" recording a
+// text-only reply policy event ("violation" or "terminate") together with
+// the consecutive text-only count and the number of strikes so far.
+func PolicyEntry(event string, consecutive, strikes int) TapeEntry {
+	data, _ := json.Marshal(struct {
+		Event       string `json:"event"`
+		Consecutive int    `json:"consecutive"`
+		Strikes     int    `json:"strikes"`
+		Timestamp   int64  `json:"timestamp"`
+	}{event, consecutive, strikes, time.Now().UnixMilli()})
+	return TapeEntry{Type: "policy", Data: data}
+}
+
+// HookEntry returns a TapeEntry of type "hook" recording a tool-call hook
+// decision: phase ("pre"/"post"), the hook's name, the tool call it applied
+// to, the action ("deny", "rewrite", "error") and a detail (reason, new
+// arguments, or error text).
+func HookEntry(phase, hook, toolID, action, detail string) TapeEntry {
+	data, _ := json.Marshal(struct {
+		Phase     string `json:"phase"`
+		Hook      string `json:"hook"`
+		ToolID    string `json:"tool_id"`
+		Action    string `json:"action"`
+		Detail    string `json:"detail,omitempty"`
+		Timestamp int64  `json:"timestamp"`
+	}{phase, hook, toolID, action, detail, time.Now().UnixMilli()})
+	return TapeEntry{Type: "hook", Data: data}
+}
+
+// DivergenceEntry returns a TapeEntry of type "divergence" recording where
+// a replayed session (QUINE_API_TYPE=replay) departed from its recording:
+// the reply about to be replayed, the kind ("tool_call", "tool_result"),
+// the tool call concerned, a description, and both results when known.
+func DivergenceEntry(reply int, kind, toolID, detail, recorded, replayed string) TapeEntry {
+	data, _ := json.Marshal(struct {
+		Reply     int    `json:"reply"`
+		Kind      string `json:"kind"`
+		ToolID    string `json:"tool_id,omitempty"`
+		Detail    string `json:"detail"`
+		Recorded  string `json:"recorded,omitempty"`
+		Replayed  string `json:"replayed,omitempty"`
+		Timestamp int64  `json:"timestamp"`
+	}{reply, kind, toolID, detail, recorded, replayed, time.Now().UnixMilli()})
+	return TapeEntry{Type: "divergence", Data: data}
+}
+
+// ResumeEntry returns a TapeEntry of type "resume" marking the point where
+// an interrupted session was picked up again.
+func ResumeEntry() TapeEntry {
+	data, _ := json.Marshal(struct {
+		Timestamp int64 `json:"timestamp"`
+	}{time.Now().UnixMilli()})
+	return TapeEntry{Type: "resume", Data: data}
+}
+
 // ToolResultEntry returns a TapeEntry of type "tool_result" wrapping tr.
 func ToolResultEntry(tr ToolResult) TapeEntry {
 	data, _ := json.Marshal(tr)
@@ -89,14 +89,14 @@ func TestMessagesCopy(t *testing.T) {
 func TestAddUsage(t *testing.T) {
 	tp := NewTape("s", "", 0, "m")
 
-	tp.AddUsage(100, 50)
+	tp.AddUsage(100, 50, 0, 0)
 	// AddUsage only tracks tokens, NOT turns (turns are tracked separately via IncrementTurn)
 	if tp.TokensIn != 100 || tp.TokensOut != 50 {
 		t.Errorf("after first AddUsage: in=%d out=%d, want 100/50",
 			tp.TokensIn, tp.TokensOut)
 	}
 
-	tp.AddUsage(200, 75)
+	tp.AddUsage(200, 75, 0, 0)
 	if tp.TokensIn != 300 || tp.TokensOut != 125 {
 		t.Errorf("after second AddUsage: in=%d out=%d, want 300/125",
 			tp.TokensIn, tp.TokensOut)
@@ -123,8 +123,8 @@ func TestIncrementTurn(t *testing.T) {
 
 func TestSetOutcome(t *testing.T) {
 	tp := NewTape("s", "", 0, "m")
-	tp.AddUsage(500, 200)
-	tp.AddUsage(300, 100)
+	tp.AddUsage(500, 200, 400, 0)
+	tp.AddUsage(300, 100, 0, 250)
 	tp.IncrementTurn() // Turns are now tracked separately
 	tp.IncrementTurn()
 
@@ -145,6 +145,9 @@ func TestSetOutcome(t *testing.T) {
 	if tp.Outcome.TokensOut != 300 {
 		t.Errorf("Outcome.TokensOut = %d, want 300", tp.Outcome.TokensOut)
 	}
+	if tp.Outcome.CacheWriteTokens != 400 || tp.Outcome.CacheReadTokens != 250 {
+		t.Errorf("Outcome cache tokens = %d/%d, want 400/250", tp.Outcome.CacheWriteTokens, tp.Outcome.CacheReadTokens)
+	}
 	if tp.Outcome.TurnCount != 2 {
 		t.Errorf("Outcome.TurnCount = %d, want 2", tp.Outcome.TurnCount)
 	}
@@ -273,7 +276,7 @@ func TestToolResultEntryJSON(t *testing.T) {
 
 func TestOutcomeEntryJSON(t *testing.T) {
 	tp := NewTape("s", "", 0, "m")
-	tp.AddUsage(1000, 500)
+	tp.AddUsage(1000, 500, 0, 0)
 	tp.IncrementTurn() // Turns tracked separately
 	tp.SetOutcome(SessionOutcome{
 		ExitCode:        1,
@@ -397,3 +400,58 @@ func TestMessageOmitemptyJSON(t *testing.T) {
 		t.Error("tool_id should be omitted for empty string")
 	}
 }
+
+func TestCloseDanglingToolCalls(t *testing.T) {
+	msgs := []Message{
+		{Role: RoleUser, Content: "Begin."},
+		{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "a", Name: "sh"}, {ID: "b", Name: "fork"}, {ID: "c", Name: "sh"}}},
+		{Role: RoleToolResult, ToolID: "a", Content: "ok"},
+	}
+
+	out := CloseDanglingToolCalls(msgs, func(tc ToolCall) string { return "closed " + tc.Name })
+
+	if len(out) != 5 {
+		t.Fatalf("expected 5 messages, got %d", len(out))
+	}
+	if out[2].ToolID != "a" || out[2].Content != "ok" {
+		t.Errorf("existing result should be kept in place, got %+v", out[2])
+	}
+	if out[3].ToolID != "b" || out[3].Content != "closed fork" || out[3].Role != RoleToolResult {
+		t.Errorf("unexpected synthetic result for b: %+v", out[3])
+	}
+	if out[4].ToolID != "c" || out[4].Content != "closed sh" {
+		t.Errorf("unexpected synthetic result for c: %+v", out[4])
+	}
+}
+
+func TestCloseDanglingToolCalls_NothingMissing(t *testing.T) {
+	msgs := []Message{
+		{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "a", Name: "sh"}}},
+		{Role: RoleToolResult, ToolID: "a", Content: "ok"},
+		{Role: RoleAssistant, Content: "done"},
+	}
+
+	out := CloseDanglingToolCalls(msgs, func(tc ToolCall) string {
+		t.Errorf("resultFor called for answered call %q", tc.ID)
+		return ""
+	})
+	if len(out) != len(msgs) {
+		t.Errorf("expected %d messages, got %d", len(msgs), len(out))
+	}
+}
+
+func TestStripStatus(t *testing.T) {
+	recorded := "[EXIT CODE] 0\n[STDOUT]\nhi\n\n[STDERR]\n"
+	live := recorded +
+		"\n" + StatusTurnsLeft + "0" +
+		"\n" + StatusEnergyLeft + "50 tokens (tree-wide)" +
+		"\n" + StatusContext + "1K / 200K" +
+		"\n" + StatusCost + "$0.0100 (this process)" +
+		"\n" + StatusNearDeath + "Process will be terminated after this response."
+	if got := StripStatus(live); got != recorded {
+		t.Errorf("StripStatus = %q, want %q", got, recorded)
+	}
+	if got := StripStatus(recorded); got != recorded {
+		t.Errorf("StripStatus changed a result without status lines: %q", got)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"syscall"
 
 	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/persona"
 	"github.com/kehao95/quine/internal/tape"
 )
 
@@ -73,6 +74,19 @@ func NewExecExecutor(cfg *config.Config, originalIntent string) *ExecExecutor {
 	}
 }
 
+// Validate checks an exec request before any irreversible step is taken.
+// A named persona must resolve on the configured QUINE_PERSONA_DIR search
+// path; otherwise the successor would boot with a persona it cannot load.
+func (e *ExecExecutor) Validate(req ExecRequest) error {
+	if req.Persona == "" {
+		return nil
+	}
+	if _, err := persona.Resolve(e.Cfg.PersonaDirs, req.Persona); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Execute performs the exec syscall, replacing the current process with a
 // fresh quine instance. This function does not return on success.
 //
@@ -81,11 +95,20 @@ func NewExecExecutor(cfg *config.Config, originalIntent string) *ExecExecutor {
 //   - Same mission (passed via argv, preserved from original startup)
 //   - All QUINE_WISDOM_* vars preserved (learned insights survive)
 //   - New wisdom from the exec call merged in (overwrites existing keys)
+//   - QUINE_PERSONA set to the requested persona (current one if omitted)
 //   - QUINE_PARENT_SESSION set for lineage tracking
 //   - QUINE_DEPTH reset to 0 (fresh brain, not deeper recursion)
 //
 // Returns a ToolResult only on failure (exec syscall failed).
 func (e *ExecExecutor) Execute(toolID string, req ExecRequest) tape.ToolResult {
+	if err := e.Validate(req); err != nil {
+		return tape.ToolResult{
+			ToolID:  toolID,
+			Content: fmt.Sprintf("[EXEC ERROR] %v", err),
+			IsError: true,
+		}
+	}
+
 	// Build environment for the new process
 	execEnv, err := e.Cfg.ExecEnv(e.OriginalIntent)
 	if err != nil {
@@ -101,6 +124,11 @@ func (e *ExecExecutor) Execute(toolID string, req ExecRequest) tape.ToolResult {
 		execEnv = append(execEnv, "QUINE_WISDOM_"+key+"="+value)
 	}
 
+	// Switch persona if requested (overrides the inherited QUINE_PERSONA)
+	if req.Persona != "" {
+		execEnv = append(execEnv, "QUINE_PERSONA="+req.Persona)
+	}
+
 	// Merge with filtered OS environment (need PATH, HOME, etc.)
 	fullEnv := MergeEnv(filterSessionID(os.Environ()), execEnv)
 
@@ -9,10 +9,13 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/kehao95/quine/internal/broker"
 	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/sandbox"
 	"github.com/kehao95/quine/internal/tape"
 )
 
@@ -41,6 +44,20 @@ type ForkExecutor struct {
 	// MaxOutput limits the captured output size.
 	MaxOutput int
 
+	// Models is the allowlist a ForkRequest.Model must come from
+	// (QUINE_FORK_MODELS). Empty means the child's model cannot be chosen.
+	Models []config.Route
+
+	// Sandbox, when set, confines child processes to the policy's
+	// filesystem rules. Children always keep the network: they need the
+	// LLM API (their own shells still apply the policy's network rule).
+	Sandbox *sandbox.Policy
+
+	// BrokerShare, when set, returns a share of the credential broker's
+	// lock for a child (broker.Broker.Share), so the tree's broker keeps
+	// serving the child if this process exits first.
+	BrokerShare func() (*os.File, error)
+
 	// ProcessStarted is called when a child process starts.
 	ProcessStarted func(*os.Process)
 
@@ -68,14 +85,18 @@ func NewForkExecutor(cfg *config.Config, childEnv []string) *ForkExecutor {
 		TapePath:       tapePath,
 		DefaultTimeout: time.Duration(cfg.ShTimeout) * time.Second,
 		MaxOutput:      cfg.OutputTruncate,
+		Models:         cfg.ForkModels,
+		Sandbox:        sandbox.DefaultPolicy(cfg.Sandbox, cfg.DataDir),
 	}
 }
 
 // filterSessionID removes QUINE_SESSION_ID from an environment slice.
+// QUINE_CONTEXT_TAPE is dropped as well: it points at the tape copy this
+// process was forked with and must not leak into its own descendants.
 func filterSessionID(env []string) []string {
 	result := make([]string, 0, len(env))
 	for _, e := range env {
-		if len(e) > 17 && e[:17] == "QUINE_SESSION_ID=" {
+		if strings.HasPrefix(e, "QUINE_SESSION_ID=") || strings.HasPrefix(e, "QUINE_CONTEXT_TAPE=") {
 			continue
 		}
 		result = append(result, e)
@@ -87,6 +108,7 @@ func filterSessionID(env []string) []string {
 type ForkRequest struct {
 	Intent string // The task for the child agent (required)
 	Wait   bool   // If true, block until child completes (optional, default false)
+	Model  string // The child's model, from ForkExecutor.Models (optional, default as routed by depth)
 }
 
 // ParseForkArgs extracts ForkRequest from a ToolCall's Arguments map.
@@ -115,6 +137,14 @@ func ParseForkArgs(args map[string]any) (ForkRequest, error) {
 		req.Wait = b
 	}
 
+	if v, ok := args["model"]; ok {
+		m, ok := v.(string)
+		if !ok {
+			return ForkRequest{}, fmt.Errorf("model must be a string, got %T", v)
+		}
+		req.Model = m
+	}
+
 	return req, nil
 }
 
@@ -123,6 +153,19 @@ func ParseForkArgs(args map[string]any) (ForkRequest, error) {
 //   - If wait=false: the child's SESSION_ID (fire-and-forget)
 //   - If wait=true: the child's stdout/stderr and exit status
 func (f *ForkExecutor) Execute(toolID string, req ForkRequest) tape.ToolResult {
+	env := f.Env
+	if req.Model != "" {
+		route, ok := f.route(req.Model)
+		if !ok {
+			return tape.ToolResult{
+				ToolID:  toolID,
+				Content: fmt.Sprintf("[FORK ERROR] model %q is not allowed; choose one of: %s", req.Model, f.modelList()),
+				IsError: true,
+			}
+		}
+		env = MergeEnv(env, route.Env())
+	}
+
 	// Step 1: Copy the current tape to a temp file for the child
 	childTapePath, err := f.copyTapeForChild()
 	if err != nil {
@@ -148,12 +191,33 @@ func (f *ForkExecutor) Execute(toolID string, req ForkRequest) tape.ToolResult {
 	}
 
 	cmd := exec.CommandContext(ctx, f.QuinePath, req.Intent)
-	cmd.Env = append(f.Env, "QUINE_CONTEXT_TAPE="+childTapePath)
+	cmd.Env = append(env, "QUINE_CONTEXT_TAPE="+childTapePath)
 	// Do NOT set cmd.Stdin - child inherits parent's stdin (data stream)
 
 	// Set process group for cleanup
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
+	// The child is one of the tree's quine processes: hand it a share of
+	// the broker's lock. Our copy is closed once the child has started.
+	if f.BrokerShare != nil {
+		if share, err := f.BrokerShare(); err == nil && share != nil {
+			defer share.Close()
+			cmd.ExtraFiles = append(cmd.ExtraFiles, share)
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", broker.HoldEnv, 2+len(cmd.ExtraFiles)))
+		}
+	}
+
+	if f.Sandbox != nil {
+		if err := f.Sandbox.Wrap(cmd, true); err != nil {
+			os.Remove(childTapePath)
+			return tape.ToolResult{
+				ToolID:  toolID,
+				Content: fmt.Sprintf("[FORK ERROR] sandbox: %v", err),
+				IsError: true,
+			}
+		}
+	}
+
 	if req.Wait {
 		// Synchronous: capture output and wait
 		return f.executeSync(toolID, cmd, childTapePath)
@@ -163,6 +227,28 @@ func (f *ForkExecutor) Execute(toolID string, req ForkRequest) tape.ToolResult {
 	return f.executeAsync(toolID, cmd, childTapePath)
 }
 
+// route returns the allowlisted route for model.
+func (f *ForkExecutor) route(model string) (config.Route, bool) {
+	for _, r := range f.Models {
+		if r.ModelID == model {
+			return r, true
+		}
+	}
+	return config.Route{}, false
+}
+
+// modelList names the allowlisted models for an error message.
+func (f *ForkExecutor) modelList() string {
+	if len(f.Models) == 0 {
+		return "(none: QUINE_FORK_MODELS is not set)"
+	}
+	ids := make([]string, len(f.Models))
+	for i, r := range f.Models {
+		ids[i] = r.ModelID
+	}
+	return strings.Join(ids, ", ")
+}
+
 // executeSync runs the child and waits for completion.
 func (f *ForkExecutor) executeSync(toolID string, cmd *exec.Cmd, childTapePath string) tape.ToolResult {
 	var stdoutBuf, stderrBuf bytes.Buffer
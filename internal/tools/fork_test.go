@@ -6,6 +6,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/kehao95/quine/internal/config"
 )
 
 func TestParseForkArgs_ValidIntent(t *testing.T) {
@@ -48,6 +50,7 @@ func TestParseForkArgs_InvalidInput(t *testing.T) {
 		{"EmptyIntent", map[string]any{"intent": ""}, "empty"},
 		{"WrongIntentType", map[string]any{"intent": 123}, "string"},
 		{"WrongWaitType", map[string]any{"intent": "Do something", "wait": "yes"}, "boolean"},
+		{"WrongModelType", map[string]any{"intent": "Do something", "model": 4}, "model"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -228,3 +231,32 @@ func TestForkExecutor_Execute_AsyncMode(t *testing.T) {
 		}
 	}
 }
+
+func TestForkExecutor_Execute_Model(t *testing.T) {
+	tmpDir := t.TempDir()
+	f := &ForkExecutor{
+		QuinePath:      "/usr/bin/printenv", // prints the variable named by the intent
+		DataDir:        tmpDir,
+		SessionID:      "test-session",
+		TapePath:       filepath.Join(tmpDir, "test-session.jsonl"),
+		DefaultTimeout: 5 * time.Second,
+		MaxOutput:      10000,
+		Env:            []string{"QUINE_MODEL_ID=claude-opus-4-1", "QUINE_API_TYPE=anthropic"},
+		Models:         []config.Route{{ModelID: "claude-haiku-4-5", Provider: "anthropic", ContextWindow: 200000}},
+	}
+
+	result := f.Execute("tool-1", ForkRequest{Intent: "QUINE_MODEL_ID", Wait: true, Model: "claude-haiku-4-5"})
+	if result.IsError || !strings.Contains(result.Content, "claude-haiku-4-5") {
+		t.Errorf("child with an allowlisted model: %s", result.Content)
+	}
+
+	result = f.Execute("tool-2", ForkRequest{Intent: "QUINE_MODEL_ID", Wait: true})
+	if result.IsError || !strings.Contains(result.Content, "claude-opus-4-1") {
+		t.Errorf("child without a model should keep the routed default: %s", result.Content)
+	}
+
+	result = f.Execute("tool-3", ForkRequest{Intent: "QUINE_MODEL_ID", Wait: true, Model: "gpt-5"})
+	if !result.IsError || !strings.Contains(result.Content, "claude-haiku-4-5") {
+		t.Errorf("child with a model off the allowlist should be refused, listing the allowed ones: %s", result.Content)
+	}
+}
@@ -0,0 +1,178 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kehao95/quine/internal/config"
+)
+
+// Limits bounds the resources of the commands the persistent shell runs
+// (QUINE_SH_RLIMIT_*, QUINE_SH_CGROUP). Zero fields are unlimited.
+//
+// The rlimits are set as soft limits on the shell before every command and
+// are inherited by every process the command starts, so each process gets
+// its own CPU, memory and file-size allowance. They are guard rails, not a
+// sandbox: a command can raise them again with `ulimit -S`, though not past
+// the next command. RLIMIT_NPROC counts every process of the user, quine
+// and other agents included. A quine started by a command releases the
+// limits it inherits (Release) and applies them to its own shell instead.
+//
+// The cgroup, when configured, caps the shell's whole process tree on top
+// of that and lets the kernel OOM-kill a runaway command.
+type Limits struct {
+	CPU    int    // seconds of CPU time per process (RLIMIT_CPU)
+	Mem    int    // MB of address space per process (RLIMIT_AS); also memory.max of the cgroup
+	Fsize  int    // MB per file written (RLIMIT_FSIZE)
+	Nproc  int    // processes of the user (RLIMIT_NPROC); also pids.max of the cgroup
+	Cgroup string // delegated cgroup v2 directory to create the shell's cgroup in
+}
+
+// LimitsFor returns the limits cfg sets on the shell's commands.
+func LimitsFor(cfg *config.Config) Limits {
+	return Limits{
+		CPU:    cfg.ShRlimitCPU,
+		Mem:    cfg.ShRlimitMem,
+		Fsize:  cfg.ShRlimitFsize,
+		Nproc:  cfg.ShRlimitNproc,
+		Cgroup: cfg.ShCgroup,
+	}
+}
+
+// Exit statuses the shell reports for commands killed by rlimit signals
+// (128 + SIGXCPU, 128 + SIGXFSZ).
+const (
+	exitSIGXCPU = 128 + 24
+	exitSIGXFSZ = 128 + 25
+)
+
+// memoryHints and forkHints are stderr fragments of allocation and fork
+// failures, which is how RLIMIT_AS and RLIMIT_NPROC surface.
+var (
+	memoryHints = []string{"Cannot allocate memory", "out of memory", "Out of memory", "MemoryError", "bad_alloc", "memory exhausted"}
+	forkHints   = []string{"Cannot fork", "can't fork", "fork: Resource temporarily unavailable", "fork: retry", "Resource temporarily unavailable"}
+)
+
+// diagnose names the limit a finished command most likely hit, as a
+// "[LIMIT] ..." line, or returns "" if none applies. before and after are
+// the shell cgroup's counters around the command.
+func (l Limits) diagnose(exitCode int, stderr string, before, after cgroupEvents) string {
+	switch {
+	case after.oomKill > before.oomKill:
+		return fmt.Sprintf("[LIMIT] memory exceeded: killed by the kernel at the shell's memory limit (QUINE_SH_RLIMIT_MEM=%d MB)", l.Mem)
+	case after.pidsMax > before.pidsMax:
+		return fmt.Sprintf("[LIMIT] processes exceeded: the shell's process limit was reached (QUINE_SH_RLIMIT_NPROC=%d)", l.Nproc)
+	case l.CPU > 0 && exitCode == exitSIGXCPU:
+		return fmt.Sprintf("[LIMIT] cpu exceeded: a process used more than %d s of CPU time (QUINE_SH_RLIMIT_CPU=%d)", l.CPU, l.CPU)
+	case l.Fsize > 0 && (exitCode == exitSIGXFSZ || strings.Contains(stderr, "File too large")):
+		return fmt.Sprintf("[LIMIT] file size exceeded: files are capped at %d MB (QUINE_SH_RLIMIT_FSIZE=%d)", l.Fsize, l.Fsize)
+	case l.Mem > 0 && containsAny(stderr, memoryHints):
+		return fmt.Sprintf("[LIMIT] memory exceeded: allocation failed at %d MB per process (QUINE_SH_RLIMIT_MEM=%d)", l.Mem, l.Mem)
+	case l.Nproc > 0 && containsAny(stderr, forkHints):
+		return fmt.Sprintf("[LIMIT] processes exceeded: fork failed at %d processes (QUINE_SH_RLIMIT_NPROC=%d)", l.Nproc, l.Nproc)
+	}
+	return ""
+}
+
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------
+// cgroup v2
+// ---------------------------------------------------------------------------
+
+// shellCgroup is the cgroup a persistent shell runs in, created under a
+// delegated parent (QUINE_SH_CGROUP) whose subtree_control enables the
+// memory and pids controllers.
+type shellCgroup struct {
+	path string
+}
+
+// cgroupEvents are the counters used to attribute a failure to the cgroup.
+type cgroupEvents struct {
+	oomKill int // memory.events oom_kill
+	pidsMax int // pids.events max
+}
+
+// newShellCgroup creates parent/name, sets its limits and moves pid into it.
+func newShellCgroup(parent, name string, l Limits, pid int) (*shellCgroup, error) {
+	cg := &shellCgroup{path: filepath.Join(parent, name)}
+	if err := os.Mkdir(cg.path, 0o755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("creating cgroup: %w", err)
+	}
+	if l.Mem > 0 {
+		if err := cg.write("memory.max", strconv.Itoa(l.Mem*1024*1024)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+		// A cgroup with swap would page instead of hitting the limit.
+		_ = cg.write("memory.swap.max", "0")
+	}
+	if l.Nproc > 0 {
+		if err := cg.write("pids.max", strconv.Itoa(l.Nproc)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	if err := cg.write("cgroup.procs", strconv.Itoa(pid)); err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (cg *shellCgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("cgroup %s: %w", file, err)
+	}
+	return nil
+}
+
+// events reads the cgroup's counters. A nil cgroup or unreadable file
+// reports zeros.
+func (cg *shellCgroup) events() cgroupEvents {
+	if cg == nil {
+		return cgroupEvents{}
+	}
+	return cgroupEvents{
+		oomKill: readKeyedCounter(filepath.Join(cg.path, "memory.events"), "oom_kill"),
+		pidsMax: readKeyedCounter(filepath.Join(cg.path, "pids.events"), "max"),
+	}
+}
+
+// remove deletes the cgroup. It fails (harmlessly) while processes the
+// shell left behind still live in it.
+func (cg *shellCgroup) remove() {
+	if cg != nil {
+		os.Remove(cg.path)
+	}
+}
+
+// readKeyedCounter reads "key value" lines (the cgroup *.events format)
+// and returns the value for key.
+func readKeyedCounter(path, key string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), " ")
+		if ok && k == key {
+			n, _ := strconv.Atoi(strings.TrimSpace(v))
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const rlimitNproc = 6 // RLIMIT_NPROC, not exported by syscall
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat.
+const clockTicks = 100
+
+// rlimit is one resource Limits bounds, with its soft limit.
+type rlimit struct {
+	name     string
+	resource int
+	soft     uint64
+}
+
+// rlimits lists the resources l bounds; cpuUsed is added to the CPU
+// allowance.
+func (l Limits) rlimits(cpuUsed uint64) []rlimit {
+	var limits []rlimit
+	if l.CPU > 0 {
+		limits = append(limits, rlimit{"cpu", syscall.RLIMIT_CPU, cpuUsed + uint64(l.CPU)})
+	}
+	if l.Mem > 0 {
+		limits = append(limits, rlimit{"memory", syscall.RLIMIT_AS, uint64(l.Mem) << 20})
+	}
+	if l.Fsize > 0 {
+		limits = append(limits, rlimit{"file size", syscall.RLIMIT_FSIZE, uint64(l.Fsize) << 20})
+	}
+	if l.Nproc > 0 {
+		limits = append(limits, rlimit{"processes", rlimitNproc, uint64(l.Nproc)})
+	}
+	return limits
+}
+
+// setRlimits sets the limits as soft limits of the process pid
+// (prlimit(2)) and leaves its hard limits alone, so they can be set again
+// before every command. RLIMIT_CPU counts the CPU time of the process
+// itself, so the allowance starts from what pid has already used: each
+// command gets a fresh one instead of the shell's builtins using it up.
+func (l Limits) setRlimits(pid int) error {
+	var used uint64
+	if l.CPU > 0 {
+		var err error
+		if used, err = cpuSeconds(pid); err != nil {
+			return fmt.Errorf("reading cpu time: %w", err)
+		}
+	}
+	for _, lim := range l.rlimits(used) {
+		var rl syscall.Rlimit
+		if err := prlimit(pid, lim.resource, nil, &rl); err != nil {
+			return fmt.Errorf("reading %s limit: %w", lim.name, err)
+		}
+		rl.Cur = min(lim.soft, rl.Max)
+		if err := prlimit(pid, lim.resource, &rl, nil); err != nil {
+			return fmt.Errorf("setting %s limit: %w", lim.name, err)
+		}
+	}
+	return nil
+}
+
+// Release raises this process's soft limits for the resources l bounds
+// back to the hard ones. A quine started by a limited shell inherits the
+// limits of that shell's commands; they are not meant for the agent.
+func (l Limits) Release() error {
+	for _, lim := range l.rlimits(0) {
+		var rl syscall.Rlimit
+		if err := prlimit(0, lim.resource, nil, &rl); err != nil {
+			return fmt.Errorf("reading %s limit: %w", lim.name, err)
+		}
+		rl.Cur = rl.Max
+		if err := prlimit(0, lim.resource, &rl, nil); err != nil {
+			return fmt.Errorf("releasing %s limit: %w", lim.name, err)
+		}
+	}
+	return nil
+}
+
+func prlimit(pid, resource int, newLimit, old *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(newLimit)), uintptr(unsafe.Pointer(old)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cpuSeconds returns the CPU time pid has used, user and system, rounded
+// up to whole seconds.
+func cpuSeconds(pid int) (uint64, error) {
+	ticks, err := cpuTicks(pid)
+	if err != nil {
+		return 0, err
+	}
+	return (ticks + clockTicks - 1) / clockTicks, nil
+}
+
+// cpuTicks reads utime + stime from /proc/<pid>/stat.
+func cpuTicks(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces; the fields after it do not.
+	i := strings.LastIndexByte(string(data), ')')
+	fields := strings.Fields(string(data[i+1:]))
+	if i < 0 || len(fields) < 13 {
+		return 0, fmt.Errorf("/proc/%d/stat: unexpected format", pid)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return utime + stime, nil
+}
@@ -0,0 +1,29 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLimitCPUPerCommand(t *testing.T) {
+	b := testExecutor()
+	b.Limits = Limits{CPU: 1}
+	defer b.Close()
+
+	// Builtin loops run in the shell itself. Together they use more than
+	// the allowance, but each command starts a fresh one.
+	loop := "i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done; echo looped"
+	for n := 0; n < 40; n++ {
+		result := b.Execute(fmt.Sprintf("lim-cpu-%d", n), loop)
+		if result.IsError || !strings.Contains(result.Content, "looped") {
+			t.Fatalf("command %d failed:\n%s", n, result.Content)
+		}
+		if ticks, err := cpuTicks(b.cmd.Process.Pid); err != nil {
+			t.Fatal(err)
+		} else if ticks > 2*clockTicks {
+			return
+		}
+	}
+	t.Skip("the shell did not use 2 s of CPU")
+}
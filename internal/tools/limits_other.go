@@ -0,0 +1,22 @@
+//go:build !linux
+
+package tools
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// setRlimits fails when any limit is set: without prlimit(2) the shell
+// would otherwise run unbounded.
+func (l Limits) setRlimits(pid int) error {
+	if l.CPU > 0 || l.Mem > 0 || l.Fsize > 0 || l.Nproc > 0 {
+		return fmt.Errorf("QUINE_SH_RLIMIT_* is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+// Release is a no-op: no limits were set for a child to inherit.
+func (l Limits) Release() error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package tools
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processTable returns a pid → ppid map of every visible process.
+// It reads /proc on Linux and falls back to `ps` elsewhere.
+func processTable() map[int]int {
+	if table := procfsTable(); len(table) > 0 {
+		return table
+	}
+	return psTable()
+}
+
+// procfsTable parses /proc/[pid]/stat. The second field (comm) may contain
+// spaces and parentheses, so the ppid is located after the LAST ')'.
+func procfsTable() map[int]int {
+	matches, _ := filepath.Glob("/proc/[0-9]*/stat")
+	table := make(map[int]int, len(matches))
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // process exited while we were scanning
+		}
+		s := string(data)
+		end := strings.LastIndexByte(s, ')')
+		if end < 0 {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(s[:strings.IndexByte(s, ' ')]))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(s[end+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		table[pid] = ppid
+	}
+	return table
+}
+
+// psTable builds the process table from `ps -A -o pid= -o ppid=`.
+func psTable() map[int]int {
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=").Output()
+	if err != nil {
+		return nil
+	}
+	table := make(map[int]int)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(fields[0])
+		ppid, err2 := strconv.Atoi(fields[1])
+		if err1 == nil && err2 == nil {
+			table[pid] = ppid
+		}
+	}
+	return table
+}
+
+// childPIDs returns the direct children of pid.
+func childPIDs(pid int) map[int]bool {
+	children := make(map[int]bool)
+	for p, pp := range processTable() {
+		if pp == pid {
+			children[p] = true
+		}
+	}
+	return children
+}
+
+// killDescendants sends SIGKILL to every descendant of pid whose top-level
+// ancestor (a direct child of pid) is not listed in keep. pid itself is never
+// signalled. Returns the number of processes signalled.
+//
+// This is how the persistent shell's foreground job is terminated without
+// killing the shell: children that already existed before the command
+// started (background jobs from earlier calls) are passed in keep.
+func killDescendants(pid int, keep map[int]bool) int {
+	table := processTable()
+
+	byParent := make(map[int][]int)
+	for p, pp := range table {
+		byParent[pp] = append(byParent[pp], p)
+	}
+
+	var victims []int
+	var walk func(int)
+	walk = func(p int) {
+		victims = append(victims, p)
+		for _, c := range byParent[p] {
+			walk(c)
+		}
+	}
+	for _, c := range byParent[pid] {
+		if !keep[c] {
+			walk(c)
+		}
+	}
+
+	for _, p := range victims {
+		_ = syscall.Kill(p, syscall.SIGKILL)
+	}
+	return len(victims)
+}
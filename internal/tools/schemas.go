@@ -20,9 +20,10 @@ func ShToolSchema() llm.ToolSchema {
 	}
 }
 
-// ForkToolSchema returns the JSON Schema for the fork tool.
-func ForkToolSchema() llm.ToolSchema {
-	return llm.ToolSchema{
+// ForkToolSchema returns the JSON Schema for the fork tool. With models
+// (QUINE_FORK_MODELS), it offers a model argument restricted to them.
+func ForkToolSchema(models ...string) llm.ToolSchema {
+	schema := llm.ToolSchema{
 		Name: "fork",
 		Description: "Spawn a child agent with cloned context (horizontal scaling). " +
 			"The child inherits your conversation history and starts with the given intent. " +
@@ -42,6 +43,14 @@ func ForkToolSchema() llm.ToolSchema {
 			"required": []string{"intent"},
 		},
 	}
+	if len(models) > 0 {
+		schema.Parameters["properties"].(map[string]any)["model"] = map[string]any{
+			"type":        "string",
+			"enum":        models,
+			"description": "Optional model for the child. Pick a cheaper one for mechanical subtasks. Omit to use the default for the child's depth.",
+		}
+	}
+	return schema
 }
 
 // ExecToolSchema returns the JSON Schema for the exec tool.
@@ -64,7 +73,7 @@ func ExecToolSchema() llm.ToolSchema {
 				},
 				"persona": map[string]any{
 					"type":        "string",
-					"description": "Optional persona/system-prompt name to load (e.g. 'analyst', 'coder'). Looks for personas/{name}.md",
+					"description": "Optional persona/system-prompt name to load (e.g. 'analyst', 'coder'). Looks for {name}.md in QUINE_PERSONA_DIR (default personas/). Omit to keep your current persona.",
 				},
 			},
 			"required": []string{},
@@ -97,11 +106,12 @@ func ExitToolSchema() llm.ToolSchema {
 	}
 }
 
-// AllToolSchemas returns all tool schemas.
-func AllToolSchemas() []llm.ToolSchema {
+// AllToolSchemas returns all tool schemas. forkModels are the models the
+// fork tool may choose from (see ForkToolSchema).
+func AllToolSchemas(forkModels ...string) []llm.ToolSchema {
 	return []llm.ToolSchema{
 		ShToolSchema(),
-		ForkToolSchema(),
+		ForkToolSchema(forkModels...),
 		ExecToolSchema(),
 		ExitToolSchema(),
 	}
@@ -10,3 +10,19 @@ func TestAllToolSchemas_Count(t *testing.T) {
 		t.Fatalf("AllToolSchemas() returned %d schemas, want 4", len(schemas))
 	}
 }
+
+func TestForkToolSchema_Models(t *testing.T) {
+	props := ForkToolSchema().Parameters["properties"].(map[string]any)
+	if _, ok := props["model"]; ok {
+		t.Error("fork schema without an allowlist should not offer a model argument")
+	}
+
+	props = ForkToolSchema("claude-haiku-4-5", "gpt-4o-mini").Parameters["properties"].(map[string]any)
+	model, ok := props["model"].(map[string]any)
+	if !ok {
+		t.Fatal("fork schema with an allowlist should offer a model argument")
+	}
+	if enum := model["enum"].([]string); len(enum) != 2 || enum[0] != "claude-haiku-4-5" {
+		t.Errorf("model enum = %v", enum)
+	}
+}
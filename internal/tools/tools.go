@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/sandbox"
 	"github.com/kehao95/quine/internal/tape"
 )
 
@@ -42,6 +43,11 @@ type ShExecutor struct {
 	ShellInit string   // Shell initialization script (helper functions)
 	Env       []string // Base environment variables (without QUINE_SESSION_ID)
 
+	// Timeout bounds each Execute call (QUINE_SH_TIMEOUT). When exceeded,
+	// the rest of the command is abandoned, its processes are killed and a
+	// [TIMEOUT] result returned. Zero means no limit.
+	Timeout time.Duration
+
 	// Stdin is the material stdin file descriptor. With the persistent shell,
 	// this is passed as fd 4 (ExtraFiles[1]) so the agent can read it via
 	// /dev/fd/4 or cat <&4.
@@ -51,6 +57,14 @@ type ShExecutor struct {
 	// (ExtraFiles[0]) so commands can write to >&3.
 	Stdout *os.File
 
+	// Sandbox, when set, confines the shell (and everything it starts) to
+	// the policy (QUINE_SANDBOX). Nil runs the shell unconfined.
+	Sandbox *sandbox.Policy
+
+	// Limits bounds the resources of every command (QUINE_SH_RLIMIT_*,
+	// QUINE_SH_CGROUP). The zero value is unlimited.
+	Limits Limits
+
 	// ProcessStarted is called when the persistent shell starts.
 	ProcessStarted func(*os.Process)
 	// ProcessEnded is called when the persistent shell exits.
@@ -62,6 +76,7 @@ type ShExecutor struct {
 	stdoutPipe io.ReadCloser  // Go reads output+sentinel here
 	mu         sync.Mutex     // Serializes Execute() calls
 	started    bool
+	cgroup     *shellCgroup // the shell's cgroup, if Limits.Cgroup is set
 }
 
 // NewShExecutor creates a ShExecutor from config with the given child
@@ -84,19 +99,18 @@ func NewShExecutor(cfg *config.Config, childEnv []string) *ShExecutor {
 	}
 
 	// Filter out QUINE_SESSION_ID from os.Environ() too — the parent's
-	// session ID must not leak into children.
-	filteredOsEnv := make([]string, 0, len(os.Environ()))
-	for _, entry := range os.Environ() {
-		if !strings.HasPrefix(entry, "QUINE_SESSION_ID=") {
-			filteredOsEnv = append(filteredOsEnv, entry)
-		}
-	}
+	// session ID must not leak into children. The same goes for
+	// QUINE_CONTEXT_TAPE, which only applies to this forked process.
+	filteredOsEnv := filterSessionID(os.Environ())
 
 	return &ShExecutor{
 		Shell:     cfg.Shell,
 		MaxOutput: cfg.OutputTruncate,
 		ShellInit: shellInit,
 		Env:       MergeEnv(filteredOsEnv, filteredChildEnv),
+		Timeout:   time.Duration(cfg.ShTimeout) * time.Second,
+		Sandbox:   sandbox.DefaultPolicy(cfg.Sandbox, cfg.DataDir),
+		Limits:    LimitsFor(cfg),
 	}
 }
 
@@ -183,8 +197,16 @@ func (b *ShExecutor) startLocked() error {
 		b.cmd.ExtraFiles = extraFiles
 	}
 
-	// Shell stderr → discard (per-command stderr goes to temp files)
+	// Shell stderr → discard (per-command stderr goes to temp files).
+	// A sandboxed shell keeps it so a helper failure can be reported.
+	var startErr strings.Builder
 	b.cmd.Stderr = io.Discard
+	if b.Sandbox != nil {
+		if err := b.Sandbox.Wrap(b.cmd, b.Sandbox.AllowsNetwork()); err != nil {
+			return err
+		}
+		b.cmd.Stderr = &limitedWriter{w: &startErr, n: 4096}
+	}
 
 	// Set up pipes for command I/O
 	var err error
@@ -227,9 +249,11 @@ func (b *ShExecutor) startLocked() error {
 
 		// Consume init output until sentinel
 		scanner := bufio.NewScanner(b.stdoutPipe)
+		found := false
 		for scanner.Scan() {
 			line := scanner.Text()
 			if strings.HasPrefix(line, sentinel+"_") && strings.HasSuffix(line, "___") {
+				found = true
 				break
 			}
 		}
@@ -237,11 +261,40 @@ func (b *ShExecutor) startLocked() error {
 			b.closeLocked()
 			return fmt.Errorf("reading shell init output: %w", err)
 		}
+		if !found {
+			// The shell exited before finishing init — for a sandboxed
+			// shell, typically the helper refusing to run it unconfined.
+			b.closeLocked()
+			return fmt.Errorf("shell exited during startup: %s", strings.TrimSpace(startErr.String()))
+		}
+	}
+
+	// Limits go on once the shell is idle (a sandboxed shell has replaced
+	// the helper by now), so they bound the commands, not quine's helper.
+	if err := b.applyLimitsLocked(); err != nil {
+		b.closeLocked()
+		return fmt.Errorf("applying resource limits: %w", err)
 	}
 
 	return nil
 }
 
+// applyLimitsLocked sets b.Limits on the running shell. Caller must hold b.mu.
+func (b *ShExecutor) applyLimitsLocked() error {
+	pid := b.cmd.Process.Pid
+	if err := b.Limits.setRlimits(pid); err != nil {
+		return err
+	}
+	if b.Limits.Cgroup != "" {
+		cg, err := newShellCgroup(b.Limits.Cgroup, fmt.Sprintf("quine-sh-%d", pid), b.Limits, pid)
+		if err != nil {
+			return err
+		}
+		b.cgroup = cg
+	}
+	return nil
+}
+
 // Close shuts down the persistent shell process gracefully.
 func (b *ShExecutor) Close() error {
 	b.mu.Lock()
@@ -284,6 +337,9 @@ func (b *ShExecutor) closeLocked() error {
 		b.stdoutPipe.Close()
 	}
 
+	b.cgroup.remove()
+	b.cgroup = nil
+
 	// Notify caller that the persistent shell has exited
 	if b.ProcessEnded != nil {
 		b.ProcessEnded()
@@ -308,6 +364,9 @@ func (b *ShExecutor) handleCrash() {
 		b.cmd.Wait()
 	}
 
+	b.cgroup.remove()
+	b.cgroup = nil
+
 	// Notify caller that the shell died
 	if b.ProcessEnded != nil {
 		b.ProcessEnded()
@@ -340,24 +399,51 @@ func (b *ShExecutor) Execute(toolID string, command string) tape.ToolResult {
 	nonce := generateNonce()
 
 	// Build wrapped command:
-	// - Run the user's command in a brace group { ...; } so it executes in
-	//   the current shell context (cd, export, variables all persist)
+	// - Define the user's command as a function and call it, so it executes
+	//   in the current shell context (cd, export, variables all persist)
 	// - Redirect stderr to a nonce-named temp file for clean capture
 	// - Echo a sentinel line with the exit code
 	// - An explicit `echo` before the sentinel ensures a leading newline,
 	//   so the sentinel always starts on a fresh line even if the command's
 	//   output does not end with a newline (e.g. `head -c 200 binaryfile`).
 	//
+	// While the command runs, SIGUSR1 aborts it (see handleTimeout). The
+	// function is called with the nonce as $1 so the trap can tell whether
+	// it fired in the command's own frame, where `return` ends the whole
+	// command, or inside a function the command called, where `return`
+	// would only end that function and the caller would carry on. In the
+	// latter case the trap exits the shell instead.
+	//
 	// Risk: if the user command calls `exit N`, it kills the persistent shell.
 	// This is handled by crash recovery (handleCrash → auto-restart on next call).
 	// The system prompt instructs the agent not to use bare `exit` in sh commands.
 	stderrFile := fmt.Sprintf("/tmp/__quine_stderr_%s", nonce)
 	sentinel := fmt.Sprintf("___QUINE_DONE_%s", nonce)
 	wrappedCmd := fmt.Sprintf(
-		"{ %s\n} 2>\"%s\"; __quine_ec=$?; echo; echo \"%s_${__quine_ec}___\"\n",
-		command, stderrFile, sentinel,
+		"__quine_cmd() { %s\n}\n"+
+			"trap 'if [ \"$1\" = %s ]; then return 124; elif [ -n \"$__quine_in\" ]; then exit 124; fi' USR1\n"+
+			"__quine_in=1 __quine_cmd %s 2>\"%s\"; __quine_ec=$?; __quine_in=; trap - USR1; echo; echo \"%s_${__quine_ec}___\"\n",
+		command, nonce, nonce, stderrFile, sentinel,
 	)
 
+	// Snapshot the shell's children so a timeout only kills processes this
+	// command starts, not background jobs left by earlier calls.
+	var preexisting map[int]bool
+	if b.Timeout > 0 {
+		preexisting = childPIDs(b.cmd.Process.Pid)
+	}
+	eventsBefore := b.cgroup.events()
+
+	// The rlimits are set afresh for each command, so the CPU allowance does
+	// not carry over and neither does a limit an earlier command raised.
+	if err := b.Limits.setRlimits(b.cmd.Process.Pid); err != nil {
+		return tape.ToolResult{
+			ToolID:  toolID,
+			Content: fmt.Sprintf("[SHELL ERROR] applying resource limits: %v", err),
+			IsError: true,
+		}
+	}
+
 	// Write command to shell stdin
 	if _, err := io.WriteString(b.stdinPipe, wrappedCmd); err != nil {
 		// Shell probably died
@@ -369,34 +455,63 @@ func (b *ShExecutor) Execute(toolID string, command string) tape.ToolResult {
 		}
 	}
 
-	// Read stdout until sentinel
+	// Read stdout until sentinel. Scanning runs in its own goroutine so the
+	// per-command deadline can interrupt a command that never finishes.
+	var outMu sync.Mutex
 	var stdout strings.Builder
-	scanner := bufio.NewScanner(b.stdoutPipe)
-	// Increase scanner buffer for large outputs (1MB max per line)
-	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
-	exitCode := 0
-	foundSentinel := false
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Check if this line IS the sentinel: ___QUINE_DONE_{nonce}_{exitcode}___
-		if strings.HasPrefix(line, sentinel+"_") && strings.HasSuffix(line, "___") {
-			// Parse exit code
-			codeStr := line[len(sentinel)+1 : len(line)-3]
-			fmt.Sscanf(codeStr, "%d", &exitCode)
-			foundSentinel = true
-			break
+	done := make(chan sentinelResult, 1)
+	go func() {
+		scanner := bufio.NewScanner(b.stdoutPipe)
+		// Increase scanner buffer for large outputs (1MB max per line)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// Check if this line IS the sentinel: ___QUINE_DONE_{nonce}_{exitcode}___
+			if strings.HasPrefix(line, sentinel+"_") && strings.HasSuffix(line, "___") {
+				// Parse exit code
+				var exitCode int
+				codeStr := line[len(sentinel)+1 : len(line)-3]
+				fmt.Sscanf(codeStr, "%d", &exitCode)
+				done <- sentinelResult{exitCode: exitCode, found: true}
+				return
+			}
+			outMu.Lock()
+			stdout.WriteString(line)
+			stdout.WriteString("\n")
+			outMu.Unlock()
 		}
-		stdout.WriteString(line)
-		stdout.WriteString("\n")
+		done <- sentinelResult{}
+	}()
+
+	var timeout <-chan time.Time
+	if b.Timeout > 0 {
+		timer := time.NewTimer(b.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	if !foundSentinel {
-		// EOF without sentinel — shell crashed
+	var res sentinelResult
+	select {
+	case res = <-done:
+	case <-timeout:
+		return b.handleTimeout(toolID, done, preexisting, stderrFile, func() string {
+			outMu.Lock()
+			defer outMu.Unlock()
+			return stdout.String()
+		})
+	}
+	exitCode := res.exitCode
+
+	if !res.found {
+		// EOF without sentinel — shell crashed (possibly OOM-killed)
+		content := "[SHELL ERROR] Shell process terminated unexpectedly. State lost."
+		if note := b.Limits.diagnose(-1, "", eventsBefore, b.cgroup.events()); note != "" {
+			content += "\n" + note
+		}
 		b.handleCrash()
 		return tape.ToolResult{
 			ToolID:  toolID,
-			Content: "[SHELL ERROR] Shell process terminated unexpectedly. State lost.",
+			Content: content,
 			IsError: true,
 		}
 	}
@@ -416,6 +531,15 @@ func (b *ShExecutor) Execute(toolID string, command string) tape.ToolResult {
 	stdoutStr := b.truncate([]byte(stdoutRaw))
 	stderrStr := b.truncate(stderrBytes)
 	content := fmt.Sprintf("[EXIT CODE] %d\n[STDOUT]\n%s\n[STDERR]\n%s", exitCode, stdoutStr, stderrStr)
+	if exitCode != 0 {
+		if note := b.Limits.diagnose(exitCode, string(stderrBytes), eventsBefore, b.cgroup.events()); note != "" {
+			content += "\n" + note
+		} else if b.Sandbox != nil {
+			if note := b.Sandbox.Explain(string(stderrBytes)); note != "" {
+				content += "\n" + note
+			}
+		}
+	}
 
 	return tape.ToolResult{
 		ToolID:  toolID,
@@ -424,6 +548,80 @@ func (b *ShExecutor) Execute(toolID string, command string) tape.ToolResult {
 	}
 }
 
+// limitedWriter keeps the first n bytes written to it and discards the
+// rest, so a chatty process cannot grow the buffer without bound.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		keep := p
+		if len(keep) > l.n {
+			keep = keep[:l.n]
+		}
+		l.n -= len(keep)
+		l.w.Write(keep)
+	}
+	return len(p), nil
+}
+
+// sentinelResult is what the stdout reader reports once a command finishes:
+// the parsed exit code, or found=false if the shell hit EOF first.
+type sentinelResult struct {
+	exitCode int
+	found    bool
+}
+
+// timeoutGrace is how long the shell gets to print its sentinel after the
+// foreground job has been killed before it is considered unsalvageable.
+const timeoutGrace = 2 * time.Second
+
+// handleTimeout deals with a command that outlived b.Timeout. Caller must
+// hold b.mu.
+//
+// The shell is sent SIGUSR1, whose trap abandons the rest of the command,
+// and the foreground job (every process the command started) is killed so
+// the shell gets to run the trap. If the shell then reaches the sentinel
+// within timeoutGrace its state (cwd, variables) survives. Otherwise — the
+// trap exited the shell because it fired inside a nested function, or the
+// command replaced the trap — the shell is torn down via handleCrash and
+// restarts on the next call. Nothing after the timed-out step runs either way.
+//
+// Either way the result carries a [TIMEOUT] marker and the partial output.
+func (b *ShExecutor) handleTimeout(toolID string, done <-chan sentinelResult, preexisting map[int]bool, stderrFile string, partial func() string) tape.ToolResult {
+	_ = b.cmd.Process.Signal(syscall.SIGUSR1)
+	killDescendants(b.cmd.Process.Pid, preexisting)
+
+	salvaged := false
+	select {
+	case res := <-done:
+		salvaged = res.found
+	case <-time.After(timeoutGrace):
+	}
+
+	status := "command aborted, shell state preserved"
+	if !salvaged {
+		b.handleCrash()
+		status = "command aborted, shell was restarted, state lost"
+	}
+
+	stderrBytes, _ := os.ReadFile(stderrFile)
+	os.Remove(stderrFile)
+
+	stdoutStr := b.truncate([]byte(strings.TrimSuffix(partial(), "\n")))
+	stderrStr := b.truncate(stderrBytes)
+	content := fmt.Sprintf("[TIMEOUT] command exceeded %s (%s)\n[STDOUT]\n%s\n[STDERR]\n%s",
+		b.Timeout, status, stdoutStr, stderrStr)
+
+	return tape.ToolResult{
+		ToolID:  toolID,
+		Content: content,
+		IsError: true,
+	}
+}
+
 // truncate returns the string representation of data, truncating it if it
 // exceeds MaxOutput bytes with a trailing notice.
 func (b *ShExecutor) truncate(data []byte) string {
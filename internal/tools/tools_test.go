@@ -3,11 +3,14 @@ package tools
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kehao95/quine/internal/config"
+	"github.com/kehao95/quine/internal/sandbox"
 )
 
 // testExecutor returns a ShExecutor with test-friendly defaults.
@@ -326,6 +329,253 @@ func TestExitCrashRecovery(t *testing.T) {
 	}
 }
 
+// --- Sandbox tests (QUINE_SANDBOX) ---
+
+func TestSandboxedShell(t *testing.T) {
+	if err := sandbox.Check(); err != nil {
+		t.Skipf("sandbox unavailable: %v", err)
+	}
+	work := t.TempDir()
+	// /tmp is writable in the sandbox, so the forbidden dir lives elsewhere.
+	outside, err := os.MkdirTemp(".", "sandbox-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	outside, _ = filepath.Abs(outside)
+	b := testExecutor()
+	b.Sandbox = &sandbox.Policy{Mode: sandbox.ModeFS, Writable: []string{work, "/tmp"}}
+	defer b.Close()
+
+	// The persistent shell still works: state carries across calls.
+	b.Execute("sb-1", "cd "+work)
+	result := b.Execute("sb-2", "echo hi > f && cat f")
+	if result.IsError || !strings.Contains(result.Content, "hi") {
+		t.Fatalf("write inside sandbox failed:\n%s", result.Content)
+	}
+
+	// A write outside the policy fails and is reported as a sandbox error.
+	result = b.Execute("sb-3", "echo no > "+outside+"/f")
+	if !result.IsError || !strings.Contains(result.Content, "[SANDBOX]") {
+		t.Errorf("expected sandbox error, got:\n%s", result.Content)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "f")); err == nil {
+		t.Error("file outside the sandbox was created")
+	}
+}
+
+func TestSandboxedShellFailsClosed(t *testing.T) {
+	if err := sandbox.Check(); err != nil {
+		t.Skipf("sandbox unavailable: %v", err)
+	}
+	b := testExecutor()
+	// The helper cannot confine writes to a directory it cannot create.
+	b.Sandbox = &sandbox.Policy{Mode: sandbox.ModeFS, Writable: []string{"/proc/quine-sandbox-test"}}
+	defer b.Close()
+
+	result := b.Execute("sb-closed", "echo unconfined")
+	if !result.IsError || !strings.Contains(result.Content, "[SHELL ERROR]") || strings.Contains(result.Content, "[EXIT CODE]") {
+		t.Errorf("expected shell start failure, got:\n%s", result.Content)
+	}
+}
+
+// --- Resource limit tests (QUINE_SH_RLIMIT_*, QUINE_SH_CGROUP) ---
+
+func TestLimitFileSize(t *testing.T) {
+	dir := t.TempDir()
+	b := testExecutor()
+	b.Limits = Limits{Fsize: 1}
+	defer b.Close()
+
+	result := b.Execute("lim-fsize", "head -c 2000000 /dev/zero > "+dir+"/big")
+	if !result.IsError || !strings.Contains(result.Content, "[LIMIT] file size exceeded") {
+		t.Errorf("expected file size limit, got:\n%s", result.Content)
+	}
+
+	// Small files are unaffected, and the shell survived.
+	result = b.Execute("lim-small", "echo ok > "+dir+"/small && cat "+dir+"/small")
+	if result.IsError || !strings.Contains(result.Content, "ok") {
+		t.Errorf("small write failed:\n%s", result.Content)
+	}
+}
+
+func TestLimitCPU(t *testing.T) {
+	b := testExecutor()
+	b.Limits = Limits{CPU: 1}
+	defer b.Close()
+
+	start := time.Now()
+	result := b.Execute("lim-cpu", "sh -c 'while :; do :; done'")
+	if !result.IsError || !strings.Contains(result.Content, "[LIMIT] cpu exceeded") {
+		t.Errorf("expected cpu limit, got:\n%s", result.Content)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("cpu-bound command ran for %v", elapsed)
+	}
+}
+
+func TestLimitMemory(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	b := testExecutor()
+	b.Limits = Limits{Mem: 256}
+	defer b.Close()
+
+	result := b.Execute("lim-mem", "python3 -c 'x = bytearray(512 << 20)'")
+	if !result.IsError || !strings.Contains(result.Content, "[LIMIT] memory exceeded") {
+		t.Errorf("expected memory limit, got:\n%s", result.Content)
+	}
+}
+
+func TestLimitsDiagnose(t *testing.T) {
+	l := Limits{Mem: 64, Nproc: 10}
+	cases := []struct {
+		exit          int
+		stderr        string
+		before, after cgroupEvents
+		want          string
+	}{
+		{1, "python: MemoryError", cgroupEvents{}, cgroupEvents{}, "[LIMIT] memory exceeded"},
+		{137, "", cgroupEvents{oomKill: 2}, cgroupEvents{oomKill: 3}, "[LIMIT] memory exceeded"},
+		{2, "sh: 1: Cannot fork", cgroupEvents{}, cgroupEvents{}, "[LIMIT] processes exceeded"},
+		{1, "ls: cannot access 'x'", cgroupEvents{}, cgroupEvents{}, ""},
+		{152, "", cgroupEvents{}, cgroupEvents{}, ""}, // no CPU limit configured
+	}
+	for _, c := range cases {
+		got := l.diagnose(c.exit, c.stderr, c.before, c.after)
+		if (c.want == "" && got != "") || !strings.HasPrefix(got, c.want) {
+			t.Errorf("diagnose(%d, %q) = %q, want prefix %q", c.exit, c.stderr, got, c.want)
+		}
+	}
+}
+
+func TestShellCgroup(t *testing.T) {
+	// A cgroup's interface is plain files, so a directory stands in for a
+	// delegated cgroup (the kernel's enforcement is not exercised here).
+	parent := t.TempDir()
+	cg, err := newShellCgroup(parent, "quine-sh-1", Limits{Mem: 64, Nproc: 10}, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{"memory.max": "67108864", "pids.max": "10", "cgroup.procs": "1234"} {
+		if data, _ := os.ReadFile(filepath.Join(cg.path, file)); string(data) != want {
+			t.Errorf("%s = %q, want %q", file, data, want)
+		}
+	}
+
+	os.WriteFile(filepath.Join(cg.path, "memory.events"), []byte("low 0\nhigh 0\nmax 4\noom 1\noom_kill 1\n"), 0o644)
+	os.WriteFile(filepath.Join(cg.path, "pids.events"), []byte("max 3\n"), 0o644)
+	if ev := cg.events(); ev != (cgroupEvents{oomKill: 1, pidsMax: 3}) {
+		t.Errorf("events = %+v", ev)
+	}
+}
+
+// --- Per-command timeout tests (QUINE_SH_TIMEOUT) ---
+
+func TestTimeoutKillsForegroundJob(t *testing.T) {
+	b := testExecutor()
+	b.Timeout = 500 * time.Millisecond
+	defer b.Close()
+
+	b.Execute("tool-t0", "cd /tmp && MY_STATE=kept")
+
+	start := time.Now()
+	result := b.Execute("tool-t1", "echo partial; sleep 30")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("timeout not enforced, took %v", elapsed)
+	}
+	if !result.IsError {
+		t.Error("expected IsError for timed-out command")
+	}
+	if !strings.HasPrefix(result.Content, "[TIMEOUT]") {
+		t.Errorf("expected [TIMEOUT] marker, got:\n%s", result.Content)
+	}
+	if !strings.Contains(result.Content, "partial") {
+		t.Errorf("expected partial output, got:\n%s", result.Content)
+	}
+	if !strings.Contains(result.Content, "state preserved") {
+		t.Errorf("expected shell to be salvaged, got:\n%s", result.Content)
+	}
+
+	// Shell state survives the kill.
+	result = b.Execute("tool-t2", "pwd; echo $MY_STATE")
+	if !strings.Contains(result.Content, "/tmp") || !strings.Contains(result.Content, "kept") {
+		t.Errorf("expected shell state to persist after timeout, got:\n%s", result.Content)
+	}
+}
+
+func TestTimeoutRestartsStuckShell(t *testing.T) {
+	b := testExecutor()
+	b.Timeout = 300 * time.Millisecond
+	defer b.Close()
+
+	// The command ignores the abort signal, so nothing short of killing the
+	// shell stops its builtin loop.
+	result := b.Execute("tool-t3", "trap '' USR1; while :; do :; done")
+	if !strings.HasPrefix(result.Content, "[TIMEOUT]") {
+		t.Fatalf("expected [TIMEOUT] marker, got:\n%s", result.Content)
+	}
+	if !strings.Contains(result.Content, "restarted") {
+		t.Errorf("expected restart notice, got:\n%s", result.Content)
+	}
+
+	result = b.Execute("tool-t4", "echo recovered")
+	if result.IsError || !strings.Contains(result.Content, "recovered") {
+		t.Errorf("expected shell to restart, got:\n%s", result.Content)
+	}
+}
+
+func TestTimeoutAbortsRestOfCommand(t *testing.T) {
+	b := testExecutor()
+	b.Timeout = 500 * time.Millisecond
+	defer b.Close()
+
+	dir := t.TempDir()
+	cases := []struct {
+		name    string
+		command string
+	}{
+		{"sequence", "sleep 30; touch %s"},
+		{"builtin loop", "while :; do :; done; touch %s"},
+		{"nested function", "f() { sleep 30; touch %[1]s.f; }; f; touch %[1]s"},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			marker := filepath.Join(dir, fmt.Sprintf("after-%d", i))
+			result := b.Execute("tool-t8", fmt.Sprintf(tc.command, marker))
+			if !strings.HasPrefix(result.Content, "[TIMEOUT]") {
+				t.Fatalf("expected [TIMEOUT] marker, got:\n%s", result.Content)
+			}
+			time.Sleep(200 * time.Millisecond)
+			for _, path := range []string{marker, marker + ".f"} {
+				if _, err := os.Stat(path); err == nil {
+					t.Errorf("%s was created after the timeout", filepath.Base(path))
+				}
+			}
+
+			result = b.Execute("tool-t9", "echo alive")
+			if result.IsError || !strings.Contains(result.Content, "alive") {
+				t.Errorf("expected a working shell after the timeout, got:\n%s", result.Content)
+			}
+		})
+	}
+}
+
+func TestTimeoutSparesEarlierBackgroundJobs(t *testing.T) {
+	b := testExecutor()
+	b.Timeout = 500 * time.Millisecond
+	defer b.Close()
+
+	b.Execute("tool-t5", "sleep 30 >/dev/null 2>&1 & BG=$!")
+	b.Execute("tool-t6", "sleep 30")
+
+	result := b.Execute("tool-t7", "kill -0 $BG && echo bg-alive; kill $BG")
+	if !strings.Contains(result.Content, "bg-alive") {
+		t.Errorf("background job from an earlier call should survive, got:\n%s", result.Content)
+	}
+}
+
 // --- Recursion / Environment propagation tests ---
 
 func TestMergeEnvOverlaysChildVars(t *testing.T) {
@@ -610,3 +860,34 @@ func TestExecEnv(t *testing.T) {
 		t.Errorf("QUINE_MAX_DEPTH = %q, want 5", envMap["QUINE_MAX_DEPTH"])
 	}
 }
+
+func TestExecUnknownPersona(t *testing.T) {
+	cfg := &config.Config{
+		SessionID:   "persona-session",
+		PersonaDirs: []string{t.TempDir()},
+	}
+	e := NewExecExecutor(cfg, "mission")
+
+	result := e.Execute("call_1", ExecRequest{Persona: "ghost"})
+	if !result.IsError {
+		t.Fatal("expected error result for unknown persona")
+	}
+	if !strings.HasPrefix(result.Content, "[EXEC ERROR]") || !strings.Contains(result.Content, "ghost") {
+		t.Errorf("unexpected content: %q", result.Content)
+	}
+}
+
+func TestExecValidateKnownPersona(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "analyst.md"), []byte("Analyse."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewExecExecutor(&config.Config{PersonaDirs: []string{dir}}, "mission")
+
+	if err := e.Validate(ExecRequest{Persona: "analyst"}); err != nil {
+		t.Errorf("Validate(analyst) = %v, want nil", err)
+	}
+	if err := e.Validate(ExecRequest{}); err != nil {
+		t.Errorf("Validate(no persona) = %v, want nil", err)
+	}
+}